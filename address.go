@@ -43,7 +43,7 @@ func fromString(address string) (*Addr, error) {
 	}
 
 	// if port is given
-	if len(addrParts) <= 2 {
+	if len(addrParts) == 2 {
 		a.Host = addrParts[0] // host might be empty, which is okay
 		if addrParts[1] == "" {
 			a.Port = uint16(0)
@@ -80,6 +80,10 @@ const (
 	// by the rdtp service failing to attach a created socket to the socket mgr
 	ServiceErrorTypeFailedToAttachSocket = ServiceErrorType("ATTACH_SOCKET_FAIL")
 
+	// ServiceErrorTypeAddressInUse is the error type for errors caused by
+	// the rdtp client asking to bind a local port which is already in use
+	ServiceErrorTypeAddressInUse = ServiceErrorType("ADDRESS_IN_USE")
+
 	// ServiceErrorTypeFailedToAttachListener is the error type for errors caused
 	// by the rdtp service failing to attach a created listener to the socket mgr
 	ServiceErrorTypeFailedToAttachListener = ServiceErrorType("ATTACH_LISTENER_FAIL")
@@ -0,0 +1,937 @@
+package atc
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adrianosela/rdtp/clock"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAckWaitTime = time.Second * 1
+	maxAckWaitTime     = time.Second * 30
+
+	// consecutive timeouts of full-size packets after which
+	// the path is assumed to be an MTU black hole
+	blackHoleRTOs = 3
+
+	// the payload size is never shrunk below this (as TCP's default MSS)
+	minPayloadBytes = 536
+
+	// time to wait before re-trying a forward which would have blocked
+	wouldBlockRetryTime = time.Millisecond * 10
+)
+
+// ErrWouldBlock is the error a forward function returns when the network
+// layer cannot take a packet right now (e.g. its buffer is full) but may
+// shortly. Packets which would block are re-forwarded after a short wait,
+// rather than after the ACK wait time, and are not counted as lost
+var ErrWouldBlock = errors.New("forwarding would block")
+
+// IsPermanent returns true if a forward error is permanent, i.e. the
+// error (or any error it wraps) reports itself as not temporary, like
+// the network being unreachable (syscall.ENETUNREACH): re-trying the
+// forward is pointless. Any other error is presumed transient
+func IsPermanent(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && !t.Temporary()
+}
+
+// closedChan is an already closed channel
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// AirTrafficCtrl keeps track of packets in flight (sent but not
+// yet acknowledged by the remote host) and re-forwards any packet
+// which is not acknowledged in time
+type AirTrafficCtrl struct {
+	sync.RWMutex
+
+	// inFlight is a map of sequence number to packet
+	inFlight map[uint32]*inFlightPacket
+
+	// closed whenever nothing is in flight (see Idle)
+	idle chan struct{}
+
+	// time to wait for an ACK before re-forwarding a packet,
+	// doubled every time the same packet is re-forwarded
+	ackWait time.Duration
+
+	fwFunc func(*packet.Packet) error
+	closed bool
+
+	// source of time for retransmission timers and deadlines
+	clock clock.Clock
+
+	// source of retransmission timers: the clock, or a timer wheel on
+	// it when coarse-grained (see SetTimerGranularity)
+	timers      clock.Clock
+	granularity time.Duration
+
+	// bytes of data in flight, limited to the send window (if set)
+	// with senders waiting for space in the window on windowSpace
+	bytesInFlight int
+	window        int
+	windowSpace   *sync.Cond
+
+	// closed once there is room in the send window (see WindowReady),
+	// nil while it is not waited on
+	windowReady chan struct{}
+
+	// highest cumulative ack number processed (if any ack was processed)
+	highestAck uint32
+	acked      bool
+
+	// sequence numbers sent, from the first one (if any packet was sent)
+	// up to the next one: acks beyond them acknowledge data never sent
+	firstSeqNo, nextSeqNo uint32
+	sent                  bool
+
+	// MTU black hole detection, disabled when payloadSize is zero
+	payloadSize  int            // current (full) payload size
+	fullSizeRTOs int            // consecutive timeouts of full-size packets
+	onShrink     func(size int) // notified of the new payload size
+
+	// high loss warnings, disabled when no warning function is set
+	loss lossMeter
+
+	// bounds retransmissions connection-wide, disabled when not set
+	budget retransmitBudget
+
+	// spaces first transmissions, disabled when not set
+	pacer pacer
+
+	// estimates the ack wait time from the RTTs sampled (see SampleRTT)
+	rtt rttEstimator
+
+	// set while no new packets are forwarded (see Pause)
+	paused bool
+
+	// re-forwards after timing out (diagnostics)
+	retransmits uint64
+
+	// duplicate acks after which the oldest packet in flight is re-forwarded
+	// (fast retransmit), disabled when not set (see SetDupAckThreshold), and
+	// the duplicates of the highest ack counted so far
+	dupAckThreshold int
+	dupAcks         int
+	fastRetransmits uint64 // diagnostics
+
+	// notified of every retransmission (if set)
+	onRetransmit func(p *packet.Packet)
+
+	// notified of the first permanent forward error, after which nothing
+	// is re-forwarded (fail fast), disabled when not set
+	onPermanentError func(err error)
+	failed           bool
+}
+
+// Info is a snapshot of an air traffic controller's state, for diagnostics
+type Info struct {
+	AckWait time.Duration // initial retransmission timeout
+
+	// longest retransmission timeout (after backoff) of the packets
+	// in flight, or the initial timeout when nothing is in flight
+	RTO time.Duration
+
+	// smoothed round trip time and its mean variation,
+	// zero until any RTT is sampled (see SampleRTT)
+	SRTT   time.Duration
+	RTTVar time.Duration
+
+	PacketsInFlight int
+	BytesInFlight   int
+	Window          int    // send window in bytes, zero when not limited
+	PayloadSize     int    // full payload size, zero without black hole detection
+	Retransmits     uint64 // re-forwards after timing out, in total
+	FastRetransmits uint64 // re-forwards after duplicate acks, in total
+}
+
+type inFlightPacket struct {
+	pck     *packet.Packet
+	timer   clock.Timer
+	ackWait time.Duration
+
+	// number of sequence numbers covered by the packet
+	length uint32
+
+	// time after which the packet's data is abandoned (if set)
+	deadline time.Time
+
+	// set when the last forward of the packet would have blocked
+	blocked bool
+
+	// set while a retransmission of the packet is yet to be forwarded
+	resending bool
+
+	// set when the last forward of the packet failed: its timing out is
+	// then no sign of an MTU black hole (see retransmit)
+	failed bool
+
+	// time of the last retransmission of the packet (see retransmit)
+	retransmittedAt time.Time
+
+	// diagnostics (see InFlightSnapshot)
+	sentAt, lastSentAt time.Time
+	retransmits        int
+}
+
+// InFlightInfo describes a packet in flight, for diagnostics
+type InFlightInfo struct {
+	SeqNo       uint32
+	Bytes       int       // sequence numbers covered by the packet
+	SentAt      time.Time // first sent (incl. as part of a larger packet)
+	LastSentAt  time.Time // last (re-)forwarded
+	Retransmits int       // re-forwards after timing out
+	Abandoned   bool      // past its deadline, replaced by a FWD packet
+}
+
+// NewAirTrafficCtrl returns an air traffic controller which forwards (and
+// re-forwards) packets with the given function. A forward is all or nothing:
+// the function either forwards the whole packet, or returns an error (incl.
+// when the network layer only took part of it, e.g. a short write), after
+// which the whole packet is forwarded again
+func NewAirTrafficCtrl(fw func(*packet.Packet) error) *AirTrafficCtrl {
+	return NewAirTrafficCtrlWithAckWait(fw, defaultAckWaitTime)
+}
+
+// NewAirTrafficCtrlWithAckWait returns an air traffic controller which
+// waits for the given time for an ACK before first re-forwarding a packet.
+// The default wait time is used when the given wait time is not positive
+func NewAirTrafficCtrlWithAckWait(fw func(*packet.Packet) error, ackWait time.Duration) *AirTrafficCtrl {
+	if ackWait <= 0 {
+		ackWait = defaultAckWaitTime
+	}
+	if ackWait > maxAckWaitTime {
+		ackWait = maxAckWaitTime
+	}
+	atc := &AirTrafficCtrl{
+		inFlight: make(map[uint32]*inFlightPacket),
+		idle:     make(chan struct{}),
+		ackWait:  ackWait,
+		fwFunc:   fw,
+		clock:    clock.Real{},
+		timers:   clock.Real{},
+	}
+	atc.windowSpace = sync.NewCond(&atc.RWMutex)
+	close(atc.idle) // nothing in flight yet
+	return atc
+}
+
+// Send forwards a packet and keeps track of it until it is acknowledged
+func (atc *AirTrafficCtrl) Send(p *packet.Packet) error {
+	return atc.SendWithDeadline(p, time.Time{})
+}
+
+// SendWithDeadline forwards a packet and keeps track of it until it is
+// acknowledged or until the deadline passes, whichever happens first.
+// Once past its deadline, a packet's data is no longer re-forwarded:
+// the remote host is instead sent (until acknowledged) a FWD packet
+// telling it to skip over the abandoned data. A zero deadline means
+// the packet is re-forwarded until acknowledged. When a send window is
+// set, sending blocks until the packet fits in the window (see SetWindow),
+// and when a pacing rate is set, until the packet's turn to be forwarded
+// (see SetPacingRate). A packet which fails to be forwarded is tracked all
+// the same, and re-forwarded once its ACK wait time passes as if lost on
+// the way (its sequence numbers are taken, later packets must not leave a
+// hole behind them), unless the error is permanent (see IsPermanent) and
+// the air traffic controller fails fast (see FailFast), in which case the
+// error is returned without tracking the packet, for the connection to be
+// torn down
+func (atc *AirTrafficCtrl) SendWithDeadline(p *packet.Packet, deadline time.Time) error {
+	atc.Lock()
+	defer atc.Unlock()
+
+	if err := atc.waitForWindow(len(p.Payload)); err != nil {
+		return err
+	}
+	if wait := atc.pacer.reserve(atc.clock.Now(), packet.HeaderByteSize+len(p.Payload)); wait > 0 {
+		atc.Unlock()
+		atc.sleep(wait)
+		atc.Lock()
+		if err := atc.waitForWindow(len(p.Payload)); err != nil {
+			return err
+		}
+	}
+
+	err := atc.fwFunc(p)
+	if IsPermanent(err) && atc.onPermanentError != nil {
+		return errors.Wrap(err, "could not forward packet")
+	}
+
+	f := atc.track(p, atc.ackWait, deadline)
+	if errors.Cause(err) == ErrWouldBlock {
+		f.block()
+	} else if err != nil {
+		f.failed = true
+		log.Println(errors.Wrap(err, "could not forward packet, re-forwarding once timed out"))
+	}
+	return nil
+}
+
+// SetClock sets the source of time for retransmission timers and deadlines,
+// the real clock by default. Must be called before any packets are sent
+func (atc *AirTrafficCtrl) SetClock(c clock.Clock) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.clock = c
+	atc.timers = atc.newTimers()
+}
+
+// SetTimerGranularity fires the retransmission timers of all packets in
+// flight on the ticks (of the given granularity, e.g. 10ms) of a single
+// timer wheel, rather than each on its own timer, which scales better to
+// many (e.g. thousands of) packets in flight. Retransmission timeouts are
+// then rounded up to the next tick. Timers are fine-grained (one per
+// packet) when the granularity is not positive, the default. Must be
+// called before any packets are sent
+func (atc *AirTrafficCtrl) SetTimerGranularity(tick time.Duration) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.granularity = tick
+	atc.timers = atc.newTimers()
+}
+
+// newTimers returns the source of retransmission timers
+// for the current clock and timer granularity
+func (atc *AirTrafficCtrl) newTimers() clock.Clock {
+	if atc.granularity <= 0 {
+		return atc.clock
+	}
+	return clock.NewWheel(atc.clock, atc.granularity)
+}
+
+// SetWindow limits the data in flight to the given number of bytes, so
+// that sending data blocks until enough of it is acknowledged (or until
+// the air traffic controller is closed). A packet is always let through
+// when nothing is in flight, however large. The window is not limited
+// when the given number of bytes is not positive
+func (atc *AirTrafficCtrl) SetWindow(bytes int) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.window = bytes
+	atc.windowSpace.Broadcast()
+	atc.signalWindowReady()
+}
+
+// SetPacingRate spaces the forwards of packets sent at the given rate
+// (in bytes per second, incl. headers) instead of forwarding them as soon
+// as they fit in the window, to smooth out bursts. Retransmissions are
+// not paced, they are spaced by their timers already. Pacing is disabled
+// when the rate is not positive
+func (atc *AirTrafficCtrl) SetPacingRate(rate float64) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.pacer = pacer{rate: rate}
+}
+
+// SampleRTT feeds a round trip time measured by the owner (e.g. of a
+// probe) to the RTT estimator, and sets the time to wait for an ACK
+// before first re-forwarding the packets sent thereafter to the estimated
+// retransmission timeout, refining the initial one. The packets in flight
+// keep their timers
+func (atc *AirTrafficCtrl) SampleRTT(rtt time.Duration) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.ackWait = atc.rtt.sample(rtt)
+}
+
+// Pause stops forwarding new packets, e.g. to throttle a sender on behalf
+// of an external rate limit: sends block (and there is no room in the
+// send window) until resumed, or until the air traffic controller is
+// closed. Packets in flight are still re-forwarded until acknowledged,
+// and acks processed, so pausing does not stall data already sent
+func (atc *AirTrafficCtrl) Pause() {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.paused = true
+}
+
+// Resume resumes forwarding new packets after a Pause
+func (atc *AirTrafficCtrl) Resume() {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.paused = false
+	atc.windowSpace.Broadcast()
+	atc.signalWindowReady()
+}
+
+// DetectBlackHoles enables MTU black hole detection for packets
+// with payloads of the given size: when full-size packets time out
+// repeatedly without any data being acknowledged, the payload size
+// is halved, unacknowledged data is split onto smaller packets
+// and re-forwarded, and onShrink is notified of the new size so
+// that data sent thereafter is packetized accordingly
+func (atc *AirTrafficCtrl) DetectBlackHoles(payloadSize int, onShrink func(size int)) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.payloadSize = payloadSize
+	atc.fullSizeRTOs = 0
+	atc.onShrink = onShrink
+}
+
+// WarnOnLoss enables high loss warnings: warn is called with the current
+// retransmission rate (retransmissions per second, measured over a sliding
+// window) whenever the rate exceeds the given threshold, at most once per
+// window so that a degraded path does not flood the logs
+func (atc *AirTrafficCtrl) WarnOnLoss(threshold float64, warn func(rate float64)) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.loss.threshold = threshold
+	atc.loss.warn = warn
+}
+
+// Ack processes a cumulative acknowledgement: every packet in flight
+// whose data is fully covered by the ack number (i.e. every byte in the
+// packet has a sequence number lower than the ack number) is cleared.
+// Acks older than the highest ack already processed (e.g. reordered by
+// the network) carry no news and are ignored, as are acks outside of the
+// range of sequence numbers sent (e.g. spoofed by an off-path host, or
+// replayed from an earlier connection), which would otherwise clear
+// packets never delivered. Duplicates of the highest ack are counted
+// towards a fast retransmission (see SetDupAckThreshold)
+func (atc *AirTrafficCtrl) Ack(ackNo uint32) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	if !atc.sent || !covers(ackNo, atc.firstSeqNo) || !covers(atc.nextSeqNo, ackNo) {
+		return // out of range
+	}
+	if atc.acked && !covers(ackNo, atc.highestAck) {
+		return // stale
+	}
+	una := atc.firstSeqNo // oldest data not acknowledged
+	if atc.acked {
+		una = atc.highestAck
+	}
+	if ackNo == una {
+		atc.duplicateAck(ackNo)
+		return // nothing new acknowledged
+	}
+	atc.highestAck, atc.acked = ackNo, true
+	atc.dupAcks = 0
+
+	for seqNo, f := range atc.inFlight {
+		if covers(ackNo, seqNo+f.length) {
+			atc.untrack(seqNo, f)
+			atc.fullSizeRTOs = 0 // the path is delivering data
+		}
+	}
+	atc.windowSpace.Broadcast()
+	atc.signalWindowReady()
+}
+
+// OnRetransmit sets a function to be notified of every packet re-forwarded,
+// after timing out or split onto smaller packets (see DetectBlackHoles),
+// right after it is forwarded, so that retransmissions can be told apart
+// from first transmissions. It is called with the air traffic controller
+// locked and must not call back into it
+func (atc *AirTrafficCtrl) OnRetransmit(notify func(p *packet.Packet)) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.onRetransmit = notify
+}
+
+// FailFast stops re-forwarding packets (all of them) on the first permanent
+// error re-forwarding one (see IsPermanent), rather than re-trying until
+// acknowledged, and notifies onFailure of the error so that the connection
+// can be torn down. It is called with the air traffic controller locked
+// and must not call back into it
+func (atc *AirTrafficCtrl) FailFast(onFailure func(err error)) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.onPermanentError = onFailure
+}
+
+// SetDupAckThreshold sets the number of duplicate acks (acks which
+// acknowledge nothing new while data is in flight, e.g. sent by the remote
+// host for data received out of order) after which the oldest packet in
+// flight is presumed lost, rather than reordered, and re-forwarded right
+// away instead of once it times out (fast retransmit). A lower threshold
+// recovers from loss faster, a higher one tolerates more reordering without
+// spurious retransmissions. Fast retransmit is disabled when not positive
+func (atc *AirTrafficCtrl) SetDupAckThreshold(n int) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.dupAckThreshold = n
+	atc.dupAcks = 0
+}
+
+// SetRetransmitBudget bounds the retransmissions of all packets in flight to
+// a steady rate (per second) with bursts of up to the given size, as a token
+// bucket. Once the budget is exhausted packets are no longer re-forwarded
+// and onExhausted is notified (only once), so that the connection can be
+// declared failed. The budget is disabled when the rate is not positive
+func (atc *AirTrafficCtrl) SetRetransmitBudget(rate float64, burst int, onExhausted func()) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	atc.budget = retransmitBudget{
+		rate:        rate,
+		burst:       float64(burst),
+		onExhausted: onExhausted,
+		tokens:      float64(burst),
+		last:        atc.clock.Now(),
+	}
+}
+
+// InFlightSnapshot returns a copy of the state of every packet in flight,
+// ordered by sequence number, e.g. to inspect a stalled transfer. It takes
+// no more than the read lock for as long as it takes to copy the state
+func (atc *AirTrafficCtrl) InFlightSnapshot() []InFlightInfo {
+	atc.RLock()
+	defer atc.RUnlock()
+
+	return atc.snapshot()
+}
+
+// snapshot describes the packets in flight, from the oldest sequence
+// number. It must be called with the air traffic controller locked
+func (atc *AirTrafficCtrl) snapshot() []InFlightInfo {
+	snapshot := make([]InFlightInfo, 0, len(atc.inFlight))
+	for seqNo, f := range atc.inFlight {
+		snapshot = append(snapshot, InFlightInfo{
+			SeqNo:       seqNo,
+			Bytes:       int(f.length),
+			SentAt:      f.sentAt,
+			LastSentAt:  f.lastSentAt,
+			Retransmits: f.retransmits,
+			Abandoned:   f.pck.IsFWD(),
+		})
+	}
+
+	// from the oldest sequence number, in serial number arithmetic
+	sort.Slice(snapshot, func(i, j int) bool {
+		return int32(snapshot[i].SeqNo-snapshot[j].SeqNo) < 0
+	})
+	return snapshot
+}
+
+// Info returns a snapshot of the air traffic controller's state,
+// consistent as of a single point in time
+func (atc *AirTrafficCtrl) Info() Info {
+	atc.RLock()
+	defer atc.RUnlock()
+
+	info := Info{
+		AckWait:         atc.ackWait,
+		RTO:             atc.ackWait,
+		SRTT:            atc.rtt.srtt,
+		RTTVar:          atc.rtt.rttvar,
+		PacketsInFlight: len(atc.inFlight),
+		BytesInFlight:   atc.bytesInFlight,
+		PayloadSize:     atc.payloadSize,
+		Retransmits:     atc.retransmits,
+		FastRetransmits: atc.fastRetransmits,
+	}
+	if atc.window > 0 {
+		info.Window = atc.window
+	}
+	for _, f := range atc.inFlight {
+		if f.ackWait > info.RTO {
+			info.RTO = f.ackWait
+		}
+	}
+	return info
+}
+
+// Idle returns a channel which is closed once nothing is in flight, i.e.
+// once all data sent is acknowledged (or discarded by Close). The channel
+// returned while nothing is in flight is already closed. Packets in flight
+// are briefly untracked when split, so an idle channel may be closed while
+// data is still in flight: callers should check InFlight once it is closed
+func (atc *AirTrafficCtrl) Idle() <-chan struct{} {
+	atc.RLock()
+	defer atc.RUnlock()
+
+	return atc.idle
+}
+
+// InFlight returns the number of packets sent but not yet acknowledged
+func (atc *AirTrafficCtrl) InFlight() int {
+	atc.RLock()
+	defer atc.RUnlock()
+
+	return len(atc.inFlight)
+}
+
+// UnackedSince returns the time the oldest data in flight was first sent,
+// i.e. since when data is waiting to be acknowledged, or the zero time
+// if nothing is in flight
+func (atc *AirTrafficCtrl) UnackedSince() time.Time {
+	atc.RLock()
+	defer atc.RUnlock()
+
+	var since time.Time
+	for _, f := range atc.inFlight {
+		if since.IsZero() || f.sentAt.Before(since) {
+			since = f.sentAt
+		}
+	}
+	return since
+}
+
+// Close stops all retransmissions and discards all packets in flight
+func (atc *AirTrafficCtrl) Close() {
+	atc.Lock()
+	defer atc.Unlock()
+
+	for seqNo, f := range atc.inFlight {
+		atc.untrack(seqNo, f)
+	}
+	atc.closed = true
+	atc.windowSpace.Broadcast()
+	atc.signalWindowReady()
+}
+
+// Reset abandons the packets in flight (stopping their retransmission
+// timers) and clears the state kept about the sequence numbers sent and
+// acknowledged, along with the counters of duplicate acks, retransmissions
+// and timeouts, leaving the air traffic controller ready to track new
+// packets as if none had been sent, e.g. to restart a connection's
+// reliability after a migration. Its settings (and the RTT estimated) are
+// kept, and a closed one stays closed. It returns the packets abandoned
+// (see InFlightSnapshot), for the data they carried to be skipped (or
+// re-sent) by the caller
+func (atc *AirTrafficCtrl) Reset() []InFlightInfo {
+	atc.Lock()
+	defer atc.Unlock()
+
+	abandoned := atc.snapshot()
+	for seqNo, f := range atc.inFlight {
+		atc.untrack(seqNo, f)
+	}
+	atc.highestAck, atc.acked = 0, false
+	atc.firstSeqNo, atc.nextSeqNo, atc.sent = 0, 0, false
+	atc.fullSizeRTOs = 0
+	atc.dupAcks = 0
+	atc.retransmits, atc.fastRetransmits = 0, 0
+	atc.loss = lossMeter{threshold: atc.loss.threshold, warn: atc.loss.warn}
+	atc.windowSpace.Broadcast()
+	atc.signalWindowReady()
+	return abandoned
+}
+
+func (atc *AirTrafficCtrl) retransmit(seqNo uint32) {
+	atc.Lock()
+	defer atc.Unlock()
+
+	f, ok := atc.inFlight[seqNo]
+	if !ok {
+		return // acknowledged in the meantime
+	}
+	if atc.failed {
+		return // failed fast, see FailFast
+	}
+
+	if !f.deadline.IsZero() && atc.clock.Now().After(f.deadline) {
+		f.pck = abandon(f.pck)
+		f.deadline = time.Time{} // the FWD itself is reliable
+	}
+
+	if f.blocked {
+		atc.forward(f) // not a timeout, the previous forward would have blocked
+		return
+	}
+
+	// a packet is re-sent at most once within half of its current ack wait
+	// (the retransmission timeout estimated from round trip time samples
+	// when it was sent, see SampleRTT, backed off since), however many
+	// triggers fire for it (e.g. a stale timer)
+	now := atc.clock.Now()
+	if f.retransmits > 0 && now.Sub(f.retransmittedAt) < f.ackWait/2 {
+		return
+	}
+
+	if !atc.budget.take(now) {
+		return // the connection is failing, stop re-forwarding
+	}
+
+	if atc.payloadSize > minPayloadBytes && len(f.pck.Payload) >= atc.payloadSize && !f.failed {
+		if atc.fullSizeRTOs++; atc.fullSizeRTOs >= blackHoleRTOs {
+			atc.shrink()
+			return
+		}
+	}
+
+	atc.loss.retransmitted(now)
+	atc.retransmits++
+	f.retransmits++
+	f.retransmittedAt = now
+
+	if f.ackWait *= 2; f.ackWait > maxAckWaitTime {
+		f.ackWait = maxAckWaitTime
+	}
+	f.resending = true
+	atc.forward(f)
+}
+
+// duplicateAck counts an ack of the oldest data in flight, re-forwarding
+// the packet it waits on (only once) when the duplicates reach the
+// threshold (see SetDupAckThreshold). Unlike a timeout, a fast
+// retransmission does not back the packet's retransmission timeout off.
+// It must be called with the air traffic controller locked
+func (atc *AirTrafficCtrl) duplicateAck(ackNo uint32) {
+	f, ok := atc.inFlight[ackNo]
+	if atc.dupAckThreshold <= 0 || !ok {
+		return // disabled, or nothing in flight waits on the ack
+	}
+	if atc.dupAcks++; atc.dupAcks != atc.dupAckThreshold {
+		return
+	}
+	if atc.failed || f.blocked {
+		return // failed fast, or about to be re-forwarded anyway
+	}
+
+	now := atc.clock.Now()
+	if !atc.budget.take(now) {
+		return // the connection is failing, stop re-forwarding
+	}
+	atc.loss.retransmitted(now)
+	atc.fastRetransmits++
+	f.retransmits++
+	f.retransmittedAt = now
+	f.resending = true
+	atc.forward(f)
+}
+
+// forward re-forwards a packet in flight and waits for its ACK, or
+// re-tries shortly if the network layer would block
+func (atc *AirTrafficCtrl) forward(f *inFlightPacket) {
+	err := atc.fwFunc(f.pck)
+	if errors.Cause(err) == ErrWouldBlock {
+		f.block()
+		return
+	}
+	if err != nil && atc.onPermanentError != nil && IsPermanent(err) {
+		atc.failed = true
+		atc.onPermanentError(err)
+		return
+	}
+	if err != nil {
+		log.Println(errors.Wrap(err, "could not re-forward packet"))
+	}
+	f.failed = err != nil
+	f.lastSentAt = atc.clock.Now()
+	f.blocked = false
+	f.timer.Reset(f.ackWait)
+	if f.resending && atc.onRetransmit != nil {
+		atc.onRetransmit(f.pck)
+	}
+	f.resending = false
+}
+
+// shrink halves the payload size, then splits and
+// re-forwards every packet in flight which is too large
+func (atc *AirTrafficCtrl) shrink() {
+	if atc.payloadSize /= 2; atc.payloadSize < minPayloadBytes {
+		atc.payloadSize = minPayloadBytes
+	}
+	atc.fullSizeRTOs = 0
+
+	if atc.onShrink != nil {
+		atc.onShrink(atc.payloadSize)
+	}
+
+	var large []*inFlightPacket
+	for seqNo, f := range atc.inFlight {
+		if len(f.pck.Payload) > atc.payloadSize {
+			atc.untrack(seqNo, f)
+			large = append(large, f)
+		}
+	}
+
+	for _, f := range large {
+		for _, p := range split(f.pck, atc.payloadSize) {
+			sf := atc.track(p, f.ackWait, f.deadline)
+			sf.sentAt, sf.retransmits = f.sentAt, f.retransmits
+			sf.resending = true
+			atc.forward(sf)
+		}
+	}
+}
+
+// track keeps track of a forwarded packet until it is acknowledged
+func (atc *AirTrafficCtrl) track(p *packet.Packet, ackWait time.Duration, deadline time.Time) *inFlightPacket {
+	f := &inFlightPacket{
+		pck:      p,
+		ackWait:  ackWait,
+		length:   uint32(len(p.Payload)),
+		deadline: deadline,
+	}
+	if p.IsFWD() {
+		f.length = p.ForwardBytes() // covers the data skipped
+	}
+	f.sentAt = atc.clock.Now()
+	f.lastSentAt = f.sentAt
+	f.timer = atc.timers.AfterFunc(f.ackWait, func() { atc.retransmit(p.SeqNo) })
+	if len(atc.inFlight) == 0 {
+		atc.idle = make(chan struct{})
+	}
+	atc.inFlight[p.SeqNo] = f
+	atc.bytesInFlight += int(f.length)
+
+	if end := p.SeqNo + f.length; !atc.sent {
+		atc.firstSeqNo, atc.nextSeqNo, atc.sent = p.SeqNo, end, true
+	} else if !covers(atc.nextSeqNo, end) {
+		atc.nextSeqNo = end
+	}
+	return f
+}
+
+// untrack stops keeping track of a packet in flight
+func (atc *AirTrafficCtrl) untrack(seqNo uint32, f *inFlightPacket) {
+	f.timer.Stop()
+	delete(atc.inFlight, seqNo)
+	atc.bytesInFlight -= int(f.length)
+	if len(atc.inFlight) == 0 {
+		close(atc.idle)
+	}
+}
+
+// Room returns the number of bytes of data which can be sent right away,
+// without waiting for space in the send window (none while paused, see
+// Pause), or -1 if the send window is not limited (see SetWindow)
+func (atc *AirTrafficCtrl) Room() int {
+	atc.RLock()
+	defer atc.RUnlock()
+
+	return atc.room()
+}
+
+func (atc *AirTrafficCtrl) room() int {
+	if atc.paused {
+		return 0
+	}
+	if atc.window <= 0 {
+		return -1
+	}
+	if atc.bytesInFlight >= atc.window {
+		return 0
+	}
+	return atc.window - atc.bytesInFlight
+}
+
+// WindowReady returns a channel which is closed once there is room in the
+// send window (see Room) or the air traffic controller is closed, e.g. for
+// senders which do not block on a full window. A channel returned while
+// there is room is already closed
+func (atc *AirTrafficCtrl) WindowReady() <-chan struct{} {
+	atc.Lock()
+	defer atc.Unlock()
+
+	if atc.closed || atc.room() != 0 {
+		return closedChan
+	}
+	if atc.windowReady == nil {
+		atc.windowReady = make(chan struct{})
+	}
+	return atc.windowReady
+}
+
+// signalWindowReady closes the window ready channel (if waited
+// on) once there is room in the send window
+func (atc *AirTrafficCtrl) signalWindowReady() {
+	if atc.windowReady != nil && (atc.closed || atc.room() != 0) {
+		close(atc.windowReady)
+		atc.windowReady = nil
+	}
+}
+
+// fitsWindow returns true if the given number of bytes of data
+// can be sent without exceeding the send window (if set)
+func (atc *AirTrafficCtrl) fitsWindow(bytes int) bool {
+	return atc.window <= 0 || atc.bytesInFlight == 0 || atc.bytesInFlight+bytes <= atc.window
+}
+
+// waitForWindow waits (with the air traffic controller locked)
+// until the given number of bytes fits in the window (and it is
+// not paused), or returns
+// an error if the air traffic controller is closed
+func (atc *AirTrafficCtrl) waitForWindow(bytes int) error {
+	for !atc.closed && (atc.paused || !atc.fitsWindow(bytes)) {
+		atc.windowSpace.Wait()
+	}
+	if atc.closed {
+		return errors.New("air traffic controller is closed")
+	}
+	return nil
+}
+
+// sleep waits (with the air traffic controller unlocked) for the given time
+func (atc *AirTrafficCtrl) sleep(d time.Duration) {
+	done := make(chan struct{})
+	atc.clock.AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+// block schedules a packet whose forward would have blocked to be re-tried
+func (f *inFlightPacket) block() {
+	f.blocked = true
+	f.timer.Reset(wouldBlockRetryTime)
+}
+
+// split splits a data packet onto packets carrying at most size bytes
+// of its payload each, with sequence numbers adjusted accordingly
+func split(p *packet.Packet, size int) []*packet.Packet {
+	var pcks []*packet.Packet
+	for off := 0; off < len(p.Payload); off += size {
+		end := off + size
+		if end > len(p.Payload) {
+			end = len(p.Payload)
+		}
+		pck, _ := packet.NewPacket(p.SrcPort, p.DstPort, p.Payload[off:end]) // smaller than p
+		pck.SetSeqNo(p.SeqNo + uint32(off))
+		pck.Flags = p.Flags
+		pcks = append(pcks, inherit(pck, p))
+	}
+	return pcks
+}
+
+// abandon returns the FWD packet which replaces a data packet
+// whose data is no longer worth delivering to the remote host
+func abandon(p *packet.Packet) *packet.Packet {
+	fwd := packet.NewForwardPacket(p.SrcPort, p.DstPort, p.SeqNo, uint16(len(p.Payload)))
+	return inherit(fwd, p)
+}
+
+// inherit sets the acknowledgement number, addresses, trace tag and
+// application header of the original packet on a packet derived from it
+func inherit(p, original *packet.Packet) *packet.Packet {
+	p.SetAckNo(original.AckNo)
+	p.TraceTag = original.TraceTag
+	p.AppHeader = original.AppHeader
+	if ip, err := original.GetSourceIPv4(); err == nil {
+		p.SetSourceIPv4(ip)
+	}
+	if ip, err := original.GetDestinationIPv4(); err == nil {
+		p.SetDestinationIPv4(ip)
+	}
+	p.SetSum()
+	return p
+}
+
+// covers returns true if the ack number acknowledges all sequence
+// numbers up to (not including) end, using serial number arithmetic
+func covers(ackNo, end uint32) bool {
+	return int32(ackNo-end) >= 0
+}
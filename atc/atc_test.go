@@ -0,0 +1,971 @@
+package atc
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/clock"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockPacket(seqNo uint32, payload []byte) *packet.Packet {
+	p, _ := packet.NewPacket(1234, 5678, payload)
+	p.SetSeqNo(seqNo)
+	return p
+}
+
+// countingForwarder counts the number of times each sequence number is forwarded
+type countingForwarder struct {
+	sync.Mutex
+	forwarded map[uint32]int
+}
+
+func (c *countingForwarder) fw(p *packet.Packet) error {
+	c.Lock()
+	defer c.Unlock()
+	c.forwarded[p.SeqNo]++
+	return nil
+}
+
+func (c *countingForwarder) count(seqNo uint32) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.forwarded[seqNo]
+}
+
+func TestSendError(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		return errors.Wrap(syscall.ENETUNREACH, "mock error")
+	})
+	defer atc.Close()
+	atc.FailFast(func(err error) {})
+	assert.NotNil(t, atc.Send(mockPacket(0, []byte("data"))))
+	assert.Equal(t, 0, atc.InFlight())
+}
+
+func TestSendPermanentErrorNotFailingFast(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	attempts := 0
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		c.fw(p)
+		if attempts++; attempts == 1 {
+			return errors.Wrap(syscall.ENETUNREACH, "mock error")
+		}
+		return nil
+	})
+	atc.SetClock(clk)
+	defer atc.Close()
+
+	// the packet's sequence numbers are taken: it is tracked (and
+	// re-forwarded) as when failing transiently
+	assert.Nil(t, atc.Send(mockPacket(0, []byte("data"))))
+	assert.Equal(t, 1, atc.InFlight())
+	clk.Advance(defaultAckWaitTime)
+	assert.Equal(t, 2, c.count(0))
+}
+
+func TestSendTransientError(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	attempts := 0
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		c.fw(p)
+		if attempts++; attempts <= 2 {
+			return errors.New("mock error") // e.g. a short write
+		}
+		return nil
+	})
+	atc.SetClock(clk)
+	defer atc.Close()
+
+	// a packet which fails to be forwarded is tracked as lost on the
+	// way, and forwarded again (whole) once its ACK wait time passes
+	assert.Nil(t, atc.Send(mockPacket(0, []byte("data"))))
+	assert.Equal(t, 1, atc.InFlight())
+	clk.Advance(defaultAckWaitTime)
+	assert.Equal(t, 2, c.count(0))
+	clk.Advance(defaultAckWaitTime * 2)
+	assert.Equal(t, 3, c.count(0))
+	assert.Equal(t, uint64(2), atc.Info().Retransmits)
+
+	atc.Ack(4)
+	assert.Equal(t, 0, atc.InFlight())
+	clk.Advance(defaultAckWaitTime * 4)
+	assert.Equal(t, 3, c.count(0))
+}
+
+func TestSendWouldBlock(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	delivered := make(chan time.Time, 1)
+
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts <= 2 {
+			return errors.Wrap(ErrWouldBlock, "mock buffer full")
+		}
+		delivered <- time.Now()
+		return nil
+	})
+	defer atc.Close()
+
+	sent := time.Now()
+	assert.Nil(t, atc.Send(mockPacket(0, []byte("data"))), "would block is not a failure")
+	assert.Equal(t, 1, atc.InFlight())
+
+	select {
+	case at := <-delivered:
+		// re-tried shortly, not after the ACK wait time
+		assert.True(t, at.Sub(sent) < defaultAckWaitTime/2)
+	case <-time.After(defaultAckWaitTime / 2):
+		t.Fatal("packet which would block was not re-forwarded shortly")
+	}
+
+	mu.Lock()
+	assert.Equal(t, 3, attempts)
+	mu.Unlock()
+
+	// once forwarded the packet waits for its ACK as usual
+	atc.RLock()
+	assert.False(t, atc.inFlight[0].blocked)
+	assert.Equal(t, defaultAckWaitTime, atc.inFlight[0].ackWait)
+	atc.RUnlock()
+}
+
+func TestCumulativeAck(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+
+	// five packets of 10 bytes each: [100, 110), [110, 120), ..., [140, 150)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(100+i*10), make([]byte, 10))))
+	}
+	assert.Equal(t, 5, atc.InFlight())
+
+	// acknowledging the third packet clears the first three
+	atc.Ack(130)
+	assert.Equal(t, 2, atc.InFlight())
+	for _, seqNo := range []uint32{100, 110, 120} {
+		_, ok := atc.inFlight[seqNo]
+		assert.False(t, ok)
+	}
+
+	// an ack in the middle of a packet does not clear it
+	atc.Ack(135)
+	assert.Equal(t, 2, atc.InFlight())
+
+	atc.Ack(150)
+	assert.Equal(t, 0, atc.InFlight())
+}
+
+func TestReorderedAcks(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+
+	// five packets of 10 bytes each: [100, 110), [110, 120), ..., [140, 150)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(100+i*10), make([]byte, 10))))
+	}
+
+	// acks delivered in reversed order: only the first one counts
+	for _, ackNo := range []uint32{130, 120, 110} {
+		atc.Ack(ackNo)
+		assert.Equal(t, 2, atc.InFlight())
+		assert.Equal(t, uint32(130), atc.highestAck)
+	}
+
+	// a stale ack does not count as the path delivering data
+	atc.fullSizeRTOs = 2
+	atc.Ack(120)
+	assert.Equal(t, 2, atc.fullSizeRTOs)
+
+	atc.Ack(150)
+	assert.Equal(t, 0, atc.InFlight())
+	assert.Equal(t, uint32(150), atc.highestAck)
+}
+
+func TestCumulativeAckWrapAround(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+
+	assert.Nil(t, atc.Send(mockPacket(^uint32(0)-9, make([]byte, 10)))) // [2^32-10, 0)
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))            // [0, 10)
+
+	atc.Ack(0)
+	assert.Equal(t, 1, atc.InFlight())
+	atc.Ack(10)
+	assert.Equal(t, 0, atc.InFlight())
+}
+
+func TestOutOfRangeAcks(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+
+	// an ack before anything was sent does not make later acks stale
+	atc.Ack(1 << 31)
+	assert.False(t, atc.acked)
+
+	// three packets of 10 bytes each: [100, 110), [110, 120), [120, 130)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(100+i*10), make([]byte, 10))))
+	}
+
+	// acks of data never sent (spoofed, or replayed from an earlier
+	// connection) are ignored, within or beyond half the sequence space
+	for _, ackNo := range []uint32{131, 1000, 100 + 1<<31, 99, 0} {
+		atc.Ack(ackNo)
+		assert.Equal(t, 3, atc.InFlight(), "ack %d cleared packets in flight", ackNo)
+		assert.False(t, atc.acked)
+	}
+
+	atc.Ack(110)
+	assert.Equal(t, 2, atc.InFlight())
+	atc.Ack(131)
+	assert.Equal(t, 2, atc.InFlight())
+	assert.Equal(t, uint32(110), atc.highestAck)
+
+	// packets sent later extend the range
+	assert.Nil(t, atc.Send(mockPacket(130, make([]byte, 10))))
+	atc.Ack(140)
+	assert.Equal(t, 0, atc.InFlight())
+}
+
+func TestRetransmit(t *testing.T) {
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.ackWait = time.Millisecond * 10
+	defer atc.Close()
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+	atc.Ack(10)
+
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Equal(t, 1, c.count(0), "acknowledged packet must not be re-forwarded")
+	assert.True(t, c.count(10) > 1, "unacknowledged packet must be re-forwarded")
+}
+
+func TestRetransmitDeduplicated(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.SetClock(clk)
+	defer atc.Close()
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+
+	// the timer and another trigger fire close together
+	clk.Advance(defaultAckWaitTime)
+	assert.Equal(t, 2, c.count(0))
+	clk.Advance(time.Millisecond)
+	atc.retransmit(0)
+	assert.Equal(t, 2, c.count(0), "re-sent twice within the minimum interval")
+	assert.Equal(t, uint64(1), atc.Info().Retransmits)
+
+	// the timer (backed off) still fires
+	clk.Advance(defaultAckWaitTime*2 - time.Millisecond)
+	assert.Equal(t, 3, c.count(0))
+
+	// and other triggers do once enough time passed since
+	clk.Advance(defaultAckWaitTime * 2)
+	atc.retransmit(0)
+	assert.Equal(t, 4, c.count(0))
+}
+
+func TestClose(t *testing.T) {
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.ackWait = time.Millisecond * 10
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	atc.Close()
+	assert.Equal(t, 0, atc.InFlight())
+
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, 1, c.count(0))
+
+	assert.NotNil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+}
+
+func TestReset(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.SetClock(clk)
+	atc.SetDupAckThreshold(3)
+	defer atc.Close()
+
+	for seqNo := uint32(0); seqNo < 30; seqNo += 10 {
+		assert.Nil(t, atc.Send(mockPacket(seqNo, make([]byte, 10))))
+	}
+	atc.Ack(10)
+	atc.Ack(10)
+	clk.Advance(defaultAckWaitTime)
+	assert.Equal(t, uint64(2), atc.Info().Retransmits)
+
+	// the packets in flight are abandoned, and returned
+	abandoned := atc.Reset()
+	assert.Equal(t, []uint32{10, 20}, []uint32{abandoned[0].SeqNo, abandoned[1].SeqNo})
+	assert.Equal(t, 10, abandoned[1].Bytes)
+	assert.Equal(t, 0, atc.InFlight())
+	assert.Equal(t, 0, atc.Info().BytesInFlight)
+	assert.Equal(t, uint64(0), atc.Info().Retransmits)
+	select {
+	case <-atc.Idle():
+	default:
+		t.Fatal("not idle once reset")
+	}
+
+	// and no longer re-forwarded
+	clk.Advance(defaultAckWaitTime * 4)
+	assert.Equal(t, 2, c.count(10))
+	assert.Equal(t, 2, c.count(20))
+
+	// new packets are tracked afresh, from any sequence number
+	assert.Nil(t, atc.Send(mockPacket(500, make([]byte, 10))))
+	assert.Equal(t, 1, atc.InFlight())
+	atc.Ack(20)
+	assert.Equal(t, 1, atc.InFlight(), "acks of the data abandoned are out of range")
+	atc.Ack(500)
+	atc.Ack(500)
+	assert.Equal(t, 1, c.count(500), "duplicates counted afresh")
+	atc.Ack(510)
+	assert.Equal(t, 0, atc.InFlight())
+
+	// FWD packets (e.g. skipping data abandoned) cover the data skipped
+	assert.Nil(t, atc.Send(packet.NewForwardPacket(1234, 5678, 510, 100)))
+	assert.Equal(t, 100, atc.Info().BytesInFlight)
+	atc.Ack(610)
+	assert.Equal(t, 0, atc.InFlight())
+}
+
+func TestResetConcurrent(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for seqNo := uint32(i * 10000); seqNo < uint32(i*10000+1000); seqNo += 10 {
+				assert.Nil(t, atc.Send(mockPacket(seqNo, make([]byte, 10))))
+				atc.Ack(seqNo)
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		atc.Reset()
+	}
+	wg.Wait()
+	atc.Reset()
+	assert.Equal(t, 0, atc.InFlight())
+}
+
+func TestBlackHoleShrinksPackets(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		rx       = make(map[uint32][]byte)
+		rxNext   = uint32(100)
+		shrunkTo []int
+		tags     = make(map[string]bool)
+	)
+
+	var atc *AirTrafficCtrl
+	atc = NewAirTrafficCtrl(func(p *packet.Packet) error {
+		if len(p.Payload) > 600 {
+			return nil // black hole: large packets silently dropped
+		}
+		// cumulatively acknowledge data received in order
+		lock.Lock()
+		defer lock.Unlock()
+		if p.SeqNo == rxNext {
+			rx[p.SeqNo] = p.Payload
+			rxNext += uint32(len(p.Payload))
+		}
+		tags[string(p.TraceTag)+"/"+string(p.AppHeader)] = true
+		go atc.Ack(rxNext)
+		return nil
+	})
+	defer atc.Close()
+	atc.ackWait = time.Millisecond
+	atc.DetectBlackHoles(packet.MaxPayloadBytes, func(size int) {
+		lock.Lock()
+		defer lock.Unlock()
+		shrunkTo = append(shrunkTo, size)
+	})
+
+	payload := make([]byte, packet.MaxPayloadBytes)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	p := mockPacket(100, payload)
+	p.TraceTag = []byte("trace")
+	p.AppHeader = []byte("header")
+	assert.Nil(t, atc.Send(p))
+
+	deadline := time.Now().Add(time.Second * 3)
+	for atc.InFlight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 0, atc.InFlight())
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// 1483 -> 741 (still dropped) -> 536 (minimum)
+	assert.Equal(t, []int{packet.MaxPayloadBytes / 2, minPayloadBytes}, shrunkTo)
+
+	var reassembled []byte
+	for seqNo := uint32(100); len(reassembled) < len(payload); {
+		chunk, ok := rx[seqNo]
+		if !assert.True(t, ok, "missing data at sequence number %d", seqNo) {
+			return
+		}
+		reassembled = append(reassembled, chunk...)
+		seqNo += uint32(len(chunk))
+	}
+	assert.Equal(t, payload, reassembled)
+	assert.Equal(t, map[string]bool{"trace/header": true}, tags, "carried over when split")
+}
+
+func TestBlackHoleDetectionDisabled(t *testing.T) {
+	fw := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrl(fw.fw)
+	defer atc.Close()
+	atc.ackWait = time.Millisecond
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, packet.MaxPayloadBytes))))
+	time.Sleep(time.Millisecond * 50)
+
+	// the packet is only ever re-forwarded whole
+	atc.RLock()
+	defer atc.RUnlock()
+	assert.Equal(t, 1, len(atc.inFlight))
+	assert.Equal(t, packet.MaxPayloadBytes, len(atc.inFlight[0].pck.Payload))
+	assert.True(t, fw.count(0) > blackHoleRTOs)
+}
+
+func TestBlackHoleDetectionSendError(t *testing.T) {
+	fw := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		fw.fw(p)
+		return errors.New("mock error")
+	})
+	defer atc.Close()
+	atc.ackWait = time.Millisecond
+	shrunk := make(chan int, 1)
+	atc.DetectBlackHoles(packet.MaxPayloadBytes, func(size int) { shrunk <- size })
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, packet.MaxPayloadBytes))))
+	time.Sleep(time.Millisecond * 50)
+
+	// packets which could not be sent were not lost on the path
+	assert.True(t, fw.count(0) > blackHoleRTOs)
+	assert.Equal(t, 0, len(shrunk))
+}
+
+func TestNewAirTrafficCtrlWithAckWait(t *testing.T) {
+	fw := func(p *packet.Packet) error { return nil }
+
+	assert.Equal(t, defaultAckWaitTime, NewAirTrafficCtrl(fw).ackWait)
+	assert.Equal(t, defaultAckWaitTime, NewAirTrafficCtrlWithAckWait(fw, 0).ackWait)
+	assert.Equal(t, time.Millisecond*50, NewAirTrafficCtrlWithAckWait(fw, time.Millisecond*50).ackWait)
+	assert.Equal(t, maxAckWaitTime, NewAirTrafficCtrlWithAckWait(fw, time.Hour).ackWait)
+}
+
+func TestSendWithDeadline(t *testing.T) {
+	forwarded := make(chan *packet.Packet, 100)
+
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		forwarded <- p
+		return nil
+	})
+	defer atc.Close()
+	atc.ackWait = time.Millisecond * 5
+
+	assert.Nil(t, atc.SendWithDeadline(mockPacket(100, []byte("stale soon")), time.Now().Add(time.Millisecond*20)))
+	assert.Nil(t, atc.Send(mockPacket(110, []byte("reliable"))))
+
+	// expired data is replaced by a FWD over the same sequence numbers
+	var fwd *packet.Packet
+	for fwd == nil {
+		select {
+		case p := <-forwarded:
+			if p.IsFWD() {
+				fwd = p
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expired packet was not abandoned")
+		}
+	}
+	assert.Equal(t, uint32(100), fwd.SeqNo)
+	assert.Equal(t, uint32(len("stale soon")), fwd.ForwardBytes())
+	assert.True(t, fwd.CheckSum())
+	assert.Equal(t, 2, atc.InFlight())
+
+	// the FWD is acknowledged as the data it replaces would have been
+	atc.Ack(110)
+	assert.Equal(t, 1, atc.InFlight())
+
+	// data without a deadline is never abandoned
+	atc.RLock()
+	defer atc.RUnlock()
+	assert.False(t, atc.inFlight[110].pck.IsFWD())
+}
+
+func TestSendWindow(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+	atc.SetWindow(30)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(i*10), make([]byte, 10))))
+	}
+
+	sent := make(chan error)
+	go func() { sent <- atc.Send(mockPacket(30, make([]byte, 10))) }()
+
+	select {
+	case <-sent:
+		t.Fatal("packet sent beyond the send window")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	atc.Ack(10)
+	select {
+	case err := <-sent:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("packet not sent after space was acknowledged")
+	}
+	assert.Equal(t, 3, atc.InFlight())
+
+	// closing unblocks senders waiting for space
+	go func() { sent <- atc.Send(mockPacket(40, make([]byte, 10))) }()
+	time.Sleep(time.Millisecond * 20)
+	atc.Close()
+	select {
+	case err := <-sent:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("sender not unblocked by close")
+	}
+
+	// a packet larger than the window is sent when nothing is in flight
+	atc = NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+	atc.SetWindow(5)
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+}
+
+func TestWindowReady(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+	assert.Equal(t, -1, atc.Room(), "not limited")
+	atc.SetWindow(30)
+	assert.Equal(t, 30, atc.Room())
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	assert.Equal(t, 20, atc.Room())
+	select {
+	case <-atc.WindowReady():
+	default:
+		t.Fatal("window not ready with room in it")
+	}
+
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 20))))
+	assert.Equal(t, 0, atc.Room())
+	ready := atc.WindowReady()
+	select {
+	case <-ready:
+		t.Fatal("window ready while full")
+	default:
+	}
+
+	atc.Ack(10)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("window not ready after space was acknowledged")
+	}
+	assert.Equal(t, 10, atc.Room())
+
+	// closing readies the window, senders then get an error
+	assert.Nil(t, atc.Send(mockPacket(30, make([]byte, 10))))
+	ready = atc.WindowReady()
+	atc.Close()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("window not ready after close")
+	}
+}
+
+func TestPause(t *testing.T) {
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.ackWait = time.Millisecond * 10
+	defer atc.Close()
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+	atc.Pause()
+	assert.Equal(t, 0, atc.Room())
+	ready := atc.WindowReady()
+
+	sent := make(chan error, 1)
+	go func() { sent <- atc.Send(mockPacket(20, make([]byte, 10))) }()
+
+	// packets in flight are still acknowledged and re-forwarded
+	atc.Ack(10)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 0, c.count(20), "new packet forwarded while paused")
+	assert.True(t, c.count(10) > 1, "unacknowledged packet must be re-forwarded while paused")
+	select {
+	case <-sent:
+		t.Fatal("send returned while paused")
+	case <-ready:
+		t.Fatal("window ready while paused")
+	default:
+	}
+
+	atc.Resume()
+	select {
+	case err := <-sent:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("send blocked after resuming")
+	}
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("window not ready after resuming")
+	}
+	assert.True(t, c.count(20) > 0)
+}
+
+func TestUnackedSince(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+	assert.True(t, atc.UnackedSince().IsZero(), "nothing in flight")
+
+	before := time.Now()
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	time.Sleep(time.Millisecond * 10)
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+	first := atc.UnackedSince()
+	assert.False(t, first.Before(before))
+	assert.True(t, first.Before(before.Add(time.Millisecond*10)))
+
+	// the oldest data in flight
+	atc.Ack(10)
+	assert.True(t, atc.UnackedSince().After(first))
+	atc.Ack(20)
+	assert.True(t, atc.UnackedSince().IsZero())
+}
+
+func TestInFlightSnapshot(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	atc.ackWait = time.Millisecond * 20
+	defer atc.Close()
+
+	start := time.Now()
+	assert.Nil(t, atc.Send(mockPacket(110, make([]byte, 20))))
+	assert.Nil(t, atc.Send(mockPacket(100, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(130, make([]byte, 30))))
+
+	snapshot := atc.InFlightSnapshot()
+	assert.Equal(t, 3, len(snapshot))
+	for i, seqNo := range []uint32{100, 110, 130} {
+		assert.Equal(t, seqNo, snapshot[i].SeqNo)
+		assert.False(t, snapshot[i].SentAt.Before(start))
+		assert.Equal(t, 0, snapshot[i].Retransmits)
+	}
+	assert.Equal(t, 20, snapshot[1].Bytes)
+
+	// acknowledged packets are gone, unacknowledged ones are re-sent
+	atc.Ack(130)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond * 5) {
+		snapshot = atc.InFlightSnapshot()
+		if len(snapshot) == 1 && snapshot[0].Retransmits > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected snapshot %+v", snapshot)
+		}
+	}
+	assert.Equal(t, uint32(130), snapshot[0].SeqNo)
+	assert.True(t, snapshot[0].LastSentAt.After(snapshot[0].SentAt))
+}
+
+func TestInfo(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	atc.ackWait = time.Millisecond * 10
+	defer atc.Close()
+	atc.SetWindow(100)
+
+	info := atc.Info()
+	assert.Equal(t, atc.ackWait, info.RTO)
+	assert.Equal(t, 100, info.Window)
+
+	assert.Nil(t, atc.Send(mockPacket(100, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(110, make([]byte, 20))))
+	atc.Ack(110)
+
+	// the packet left in flight times out and backs off
+	for deadline := time.Now().Add(time.Second); atc.Info().Retransmits < 2; time.Sleep(time.Millisecond * 5) {
+		if time.Now().After(deadline) {
+			t.Fatal("packet not re-sent")
+		}
+	}
+	info = atc.Info()
+	assert.Equal(t, 1, info.PacketsInFlight)
+	assert.Equal(t, 20, info.BytesInFlight)
+	assert.True(t, info.RTO >= 4*info.AckWait, "RTO %s not backed off", info.RTO)
+}
+
+func TestSetClock(t *testing.T) {
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	clk := clock.NewFake(time.Unix(1000, 0))
+
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.SetClock(clk)
+	defer atc.Close()
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+
+	// nothing happens until the clock is advanced past the ack wait
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, 1, c.count(0))
+	clk.Advance(defaultAckWaitTime)
+	assert.Equal(t, 2, c.count(0))
+	clk.Advance(defaultAckWaitTime * 2)
+	assert.Equal(t, 3, c.count(0))
+}
+
+func TestOnRetransmit(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	forwards := make(map[uint32]int)
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		if forwards[p.SeqNo]++; p.SeqNo == 10 && forwards[p.SeqNo] == 2 {
+			return ErrWouldBlock // the first retransmission of the second packet
+		}
+		return nil
+	})
+	atc.SetClock(clk)
+	defer atc.Close()
+
+	var retransmitted []uint32
+	atc.OnRetransmit(func(p *packet.Packet) { retransmitted = append(retransmitted, p.SeqNo) })
+
+	// first transmissions are not retransmissions
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+	assert.Empty(t, retransmitted)
+
+	// a retransmission is only notified once actually forwarded
+	clk.Advance(defaultAckWaitTime)
+	assert.Equal(t, []uint32{0}, retransmitted)
+	clk.Advance(wouldBlockRetryTime)
+	assert.Equal(t, []uint32{0, 10}, retransmitted)
+
+	atc.Ack(20)
+	clk.Advance(maxAckWaitTime)
+	assert.Equal(t, []uint32{0, 10}, retransmitted)
+}
+
+func TestIsPermanent(t *testing.T) {
+	assert.True(t, IsPermanent(syscall.ENETUNREACH))
+	assert.True(t, IsPermanent(errors.Wrap(syscall.ENETUNREACH, "could not send")))
+	assert.False(t, IsPermanent(syscall.EAGAIN))
+	assert.False(t, IsPermanent(ErrWouldBlock))
+	assert.False(t, IsPermanent(errors.New("mock error")))
+	assert.False(t, IsPermanent(nil))
+}
+
+func TestFailFast(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	var fwErr error
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		c.fw(p)
+		return fwErr
+	})
+	atc.SetClock(clk)
+	defer atc.Close()
+
+	var failures []error
+	atc.FailFast(func(err error) { failures = append(failures, err) })
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+
+	// transient errors are re-tried
+	fwErr = syscall.EAGAIN
+	clk.Advance(defaultAckWaitTime)
+	assert.Empty(t, failures)
+
+	// the first permanent error stops all retransmissions
+	fwErr = errors.Wrap(syscall.ENETUNREACH, "could not send")
+	clk.Advance(defaultAckWaitTime * 2)
+	assert.Len(t, failures, 1)
+	assert.Equal(t, syscall.ENETUNREACH, errors.Cause(failures[0]))
+	forwards := c.count(0) + c.count(10)
+	assert.Equal(t, 5, forwards, "two sends, two retransmissions, one failure")
+
+	clk.Advance(maxAckWaitTime * 4)
+	assert.Len(t, failures, 1, "only notified once")
+	assert.Equal(t, forwards, c.count(0)+c.count(10))
+}
+
+func TestIdle(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+
+	idle := atc.Idle()
+	select {
+	case <-idle:
+	default:
+		t.Fatal("idle channel not closed with nothing in flight")
+	}
+
+	assert.Nil(t, atc.Send(mockPacket(100, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(110, make([]byte, 10))))
+	idle = atc.Idle()
+
+	atc.Ack(110)
+	select {
+	case <-idle:
+		t.Fatal("idle channel closed with data in flight")
+	default:
+	}
+
+	atc.Ack(120)
+	select {
+	case <-idle:
+	default:
+		t.Fatal("idle channel not closed once all data was acknowledged")
+	}
+}
+
+func TestSetTimerGranularity(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrlWithAckWait(c.fw, time.Millisecond*15)
+	atc.SetTimerGranularity(time.Millisecond * 10)
+	atc.SetClock(clk) // in either order
+	defer atc.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(i*10), make([]byte, 10))))
+	}
+
+	// timeouts are rounded up to the next tick: 15ms to 20ms, then 30ms to 50ms
+	clk.Advance(time.Millisecond * 15)
+	assert.Equal(t, 1, c.count(0))
+	clk.Advance(time.Millisecond * 5)
+	assert.Equal(t, 2, c.count(0))
+	assert.Equal(t, 2, c.count(990))
+	clk.Advance(time.Millisecond * 29)
+	assert.Equal(t, 2, c.count(0))
+	clk.Advance(time.Millisecond * 1)
+	assert.Equal(t, 3, c.count(0))
+
+	atc.Ack(1000)
+	clk.Advance(time.Second)
+	assert.Equal(t, 3, c.count(0))
+}
+
+func benchmarkInFlightTimers(b *testing.B, granularity time.Duration) {
+	pcks := make([]*packet.Packet, 10000)
+	for i := range pcks {
+		pcks[i] = mockPacket(uint32(i*10), make([]byte, 10))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 10k packets in flight, all acknowledged before timing out
+		atc := NewAirTrafficCtrlWithAckWait(func(p *packet.Packet) error { return nil }, time.Second)
+		atc.SetTimerGranularity(granularity)
+		for _, p := range pcks {
+			if err := atc.Send(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+		atc.Ack(uint32(len(pcks) * 10))
+		atc.Close()
+	}
+}
+
+func BenchmarkInFlightTimersPerPacket(b *testing.B) {
+	benchmarkInFlightTimers(b, 0)
+}
+
+func BenchmarkInFlightTimersWheel(b *testing.B) {
+	benchmarkInFlightTimers(b, time.Millisecond*10)
+}
+
+func TestFastRetransmit(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.SetClock(clk)
+	atc.SetDupAckThreshold(2)
+	defer atc.Close()
+
+	for seqNo := uint32(0); seqNo < 40; seqNo += 10 {
+		assert.Nil(t, atc.Send(mockPacket(seqNo, make([]byte, 10))))
+	}
+
+	// the packet at 10 is lost: the remote host acknowledges
+	// the one before it, then again for each one after it
+	atc.Ack(10)
+	atc.Ack(10)
+	assert.Equal(t, 1, c.count(10), "re-forwarded after a single duplicate ack")
+	atc.Ack(10)
+	assert.Equal(t, 2, c.count(10), "not re-forwarded after two duplicate acks")
+	atc.Ack(10)
+	assert.Equal(t, 2, c.count(10), "re-forwarded more than once")
+	assert.Equal(t, uint64(1), atc.Info().FastRetransmits)
+	assert.Equal(t, uint64(0), atc.Info().Retransmits)
+
+	// the timeout is not backed off, and duplicates are counted afresh
+	// once the next packet lost is waited on
+	assert.Equal(t, defaultAckWaitTime, atc.Info().RTO)
+	atc.Ack(30)
+	atc.Ack(30)
+	atc.Ack(30)
+	assert.Equal(t, 2, c.count(30))
+	assert.Equal(t, uint64(2), atc.Info().FastRetransmits)
+}
+
+func TestFastRetransmitDisabled(t *testing.T) {
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+	atc := NewAirTrafficCtrlWithAckWait(c.fw, time.Minute)
+	defer atc.Close()
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	assert.Nil(t, atc.Send(mockPacket(10, make([]byte, 10))))
+
+	// duplicates of an ack acknowledging nothing yet count too, when enabled
+	for i := 0; i < 10; i++ {
+		atc.Ack(0)
+	}
+	assert.Equal(t, 1, c.count(0))
+	atc.SetDupAckThreshold(3)
+	for i := 0; i < 3; i++ {
+		atc.Ack(0)
+	}
+	assert.Equal(t, 2, c.count(0))
+}
@@ -0,0 +1,45 @@
+package atc
+
+import "time"
+
+// retransmitBudget is a token bucket bounding the retransmissions of a
+// connection: each retransmission takes a token, and tokens are added at
+// a steady rate up to the burst size. Once no token is left the connection
+// is presumed to be failing (e.g. the path drops everything) and no further
+// packets are re-forwarded
+type retransmitBudget struct {
+	rate        float64 // tokens added per second
+	burst       float64 // maximum number of tokens
+	onExhausted func()
+
+	tokens    float64
+	last      time.Time // last time tokens were added
+	exhausted bool
+}
+
+// take takes a token for a retransmission, returning false (and notifying
+// onExhausted, only the first time) if the budget is exhausted. Always
+// returns true when no budget is set
+func (b *retransmitBudget) take(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	if b.exhausted {
+		return false
+	}
+
+	if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		b.exhausted = true
+		if b.onExhausted != nil {
+			b.onExhausted()
+		}
+		return false
+	}
+	b.tokens--
+	return true
+}
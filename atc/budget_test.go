@@ -0,0 +1,61 @@
+package atc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetransmitBudget(t *testing.T) {
+	start := time.Unix(1000, 0)
+	exhausted := 0
+	b := &retransmitBudget{
+		rate:        10,
+		burst:       5,
+		onExhausted: func() { exhausted++ },
+		tokens:      5,
+		last:        start,
+	}
+
+	// the burst, then the steady rate
+	for i := 0; i < 5; i++ {
+		assert.True(t, b.take(start))
+	}
+	assert.True(t, b.take(start.Add(time.Millisecond*100)))
+	assert.True(t, b.take(start.Add(time.Millisecond*200)))
+	assert.Equal(t, 0, exhausted)
+
+	// faster than the steady rate
+	assert.False(t, b.take(start.Add(time.Millisecond*250)))
+	assert.Equal(t, 1, exhausted)
+
+	// exhaustion is final, and only notified once
+	assert.False(t, b.take(start.Add(time.Hour)))
+	assert.Equal(t, 1, exhausted)
+
+	// disabled
+	assert.True(t, (&retransmitBudget{}).take(start))
+}
+
+func TestRetransmitBudgetStopsRetransmissions(t *testing.T) {
+	c := &countingForwarder{forwarded: make(map[uint32]int)}
+
+	atc := NewAirTrafficCtrl(c.fw)
+	atc.ackWait = time.Millisecond
+	defer atc.Close()
+
+	exhausted := make(chan struct{})
+	atc.SetRetransmitBudget(1, 3, func() { close(exhausted) })
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+
+	select {
+	case <-exhausted:
+	case <-time.After(time.Second):
+		t.Fatal("retransmission budget not exhausted")
+	}
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 1+3, c.count(0), "first forward plus a burst of retransmissions")
+	assert.Equal(t, 1, atc.InFlight())
+}
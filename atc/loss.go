@@ -0,0 +1,55 @@
+package atc
+
+import "time"
+
+const (
+	// the retransmission rate is measured over a sliding window
+	// of lossWindowBuckets buckets of one second each
+	lossWindowBuckets = 10
+
+	// minimum time between two high loss warnings
+	lossWarnInterval = time.Second * lossWindowBuckets
+)
+
+// lossMeter measures the rate of retransmissions over a sliding window
+type lossMeter struct {
+	threshold float64 // retransmissions per second
+	warn      func(rate float64)
+	lastWarn  time.Time
+
+	counts [lossWindowBuckets]int
+	secs   [lossWindowBuckets]int64 // second each bucket counts for
+}
+
+// record records a retransmission and returns the retransmission
+// rate (per second) over the sliding window ending now
+func (m *lossMeter) record(now time.Time) float64 {
+	sec := now.Unix()
+
+	i := sec % lossWindowBuckets
+	if m.secs[i] != sec {
+		m.secs[i] = sec
+		m.counts[i] = 0
+	}
+	m.counts[i]++
+
+	total := 0
+	for j := range m.counts {
+		if sec-m.secs[j] < lossWindowBuckets {
+			total += m.counts[j]
+		}
+	}
+	return float64(total) / lossWindowBuckets
+}
+
+// retransmitted records a retransmission and warns (at most once
+// per lossWarnInterval) if the rate exceeds the threshold
+func (m *lossMeter) retransmitted(now time.Time) {
+	if m.warn == nil {
+		return
+	}
+	if rate := m.record(now); rate > m.threshold && now.Sub(m.lastWarn) >= lossWarnInterval {
+		m.lastWarn = now
+		m.warn(rate)
+	}
+}
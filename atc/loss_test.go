@@ -0,0 +1,91 @@
+package atc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLossMeterSlidingWindow(t *testing.T) {
+	m := &lossMeter{}
+	start := time.Unix(1000, 0)
+
+	// 20 retransmissions within the first second
+	var rate float64
+	for i := 0; i < 20; i++ {
+		rate = m.record(start)
+	}
+	assert.Equal(t, float64(20)/lossWindowBuckets, rate)
+
+	// still counted until they slide out of the window
+	rate = m.record(start.Add(time.Second * (lossWindowBuckets - 1)))
+	assert.Equal(t, float64(21)/lossWindowBuckets, rate)
+
+	rate = m.record(start.Add(time.Second * lossWindowBuckets))
+	assert.Equal(t, float64(2)/lossWindowBuckets, rate)
+
+	// buckets are reused
+	rate = m.record(start.Add(time.Second * lossWindowBuckets * 5))
+	assert.Equal(t, float64(1)/lossWindowBuckets, rate)
+}
+
+func TestLossMeterWarningThrottled(t *testing.T) {
+	var warnings []float64
+	m := &lossMeter{
+		threshold: 1,
+		warn:      func(rate float64) { warnings = append(warnings, rate) },
+	}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < lossWindowBuckets; i++ {
+		m.retransmitted(now)
+	}
+	assert.Equal(t, 0, len(warnings), "rate not above threshold")
+
+	m.retransmitted(now)
+	assert.Equal(t, 1, len(warnings))
+
+	for i := 0; i < 100; i++ {
+		m.retransmitted(now.Add(time.Millisecond * time.Duration(i)))
+	}
+	assert.Equal(t, 1, len(warnings), "warnings are throttled")
+
+	for i := 0; i < 20; i++ {
+		m.retransmitted(now.Add(lossWarnInterval))
+	}
+	assert.Equal(t, 2, len(warnings))
+}
+
+func TestLossMeterDoesNotAllocate(t *testing.T) {
+	m := &lossMeter{threshold: 1, warn: func(rate float64) {}}
+	now := time.Now()
+
+	allocs := testing.AllocsPerRun(100, func() { m.retransmitted(now) })
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestWarnOnLoss(t *testing.T) {
+	warned := make(chan float64, 10)
+
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+	atc.ackWait = time.Millisecond
+	atc.WarnOnLoss(0.5, func(rate float64) { warned <- rate })
+
+	// nothing is ever acknowledged
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(i*10), make([]byte, 10))))
+	}
+
+	select {
+	case rate := <-warned:
+		assert.True(t, rate > 0.5)
+	case <-time.After(time.Second):
+		t.Fatal("no warning despite high loss")
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 0, len(warned), "warnings are throttled")
+}
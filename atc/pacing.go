@@ -0,0 +1,27 @@
+package atc
+
+import "time"
+
+// pacer spaces forwards at a steady rate (in bytes per second) rather than
+// letting a whole window of data go out back-to-back, which would overflow
+// the small buffers of shallow-buffered paths: each forward reserves the
+// time its bytes take at the pacing rate, after the previous reservation
+type pacer struct {
+	rate float64   // bytes per second
+	next time.Time // earliest time of the next forward
+}
+
+// reserve reserves the time to forward the given number of bytes and
+// returns how long to wait before forwarding them. Always returns zero
+// when no rate is set
+func (pc *pacer) reserve(now time.Time, bytes int) time.Duration {
+	if pc.rate <= 0 {
+		return 0
+	}
+	if pc.next.Before(now) {
+		pc.next = now // idle: no credit is accumulated for a burst
+	}
+	wait := pc.next.Sub(now)
+	pc.next = pc.next.Add(time.Duration(float64(bytes) / pc.rate * float64(time.Second)))
+	return wait
+}
@@ -0,0 +1,62 @@
+package atc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	pc := &pacer{rate: 1000}
+
+	// back-to-back forwards are spaced by the time their bytes take
+	assert.Equal(t, time.Duration(0), pc.reserve(start, 100))
+	assert.Equal(t, time.Millisecond*100, pc.reserve(start, 100))
+	assert.Equal(t, time.Millisecond*150, pc.reserve(start.Add(time.Millisecond*50), 500))
+
+	// no credit is accumulated while idle
+	later := start.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), pc.reserve(later, 100))
+	assert.Equal(t, time.Millisecond*100, pc.reserve(later, 100))
+
+	// disabled
+	assert.Equal(t, time.Duration(0), (&pacer{}).reserve(start, 100))
+}
+
+func TestSetPacingRate(t *testing.T) {
+	var mu sync.Mutex
+	var sentAt []time.Time
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sentAt = append(sentAt, time.Now())
+		return nil
+	})
+	defer atc.Close()
+
+	// a packet every 20ms
+	payload := 100
+	atc.SetPacingRate(float64(packet.HeaderByteSize+payload) * 50)
+
+	const packets = 10
+	start := time.Now()
+	for i := 0; i < packets; i++ {
+		assert.Nil(t, atc.Send(mockPacket(uint32(i*payload), make([]byte, payload))))
+	}
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, sentAt, packets)
+	assert.True(t, sentAt[0].Sub(start) < time.Millisecond*10, "first packet not sent right away")
+	assert.True(t, elapsed >= time.Millisecond*20*(packets-1), "%d packets sent in %s", packets, elapsed)
+	assert.True(t, elapsed < time.Millisecond*20*(packets-1)*2, "%d packets sent in %s", packets, elapsed)
+	for i := 1; i < packets; i++ {
+		assert.InDelta(t, float64(time.Millisecond*20*time.Duration(i)), float64(sentAt[i].Sub(sentAt[0])), float64(time.Millisecond*15),
+			"packet %d sent off pace", i)
+	}
+}
@@ -0,0 +1,40 @@
+package atc
+
+import "time"
+
+// the retransmission timeout estimated from round trip times is never
+// shorter than this (as Linux's TCP), so that delayed ACKs or scheduling
+// hiccups are not mistaken for losses on paths with very short RTTs
+const minAckWaitTime = time.Millisecond * 200
+
+// rttEstimator smooths round trip time samples onto a retransmission
+// timeout as TCP does (RFC 6298): the smoothed RTT plus four times its
+// mean variation, within [minAckWaitTime, maxAckWaitTime]
+type rttEstimator struct {
+	srtt, rttvar time.Duration
+	sampled      bool
+}
+
+// sample takes a round trip time sample and returns the resulting
+// retransmission timeout
+func (e *rttEstimator) sample(rtt time.Duration) time.Duration {
+	if !e.sampled {
+		e.srtt, e.rttvar, e.sampled = rtt, rtt/2, true
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	rto := e.srtt + 4*e.rttvar
+	if rto < minAckWaitTime {
+		rto = minAckWaitTime
+	}
+	if rto > maxAckWaitTime {
+		rto = maxAckWaitTime
+	}
+	return rto
+}
@@ -0,0 +1,46 @@
+package atc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	e := &rttEstimator{}
+
+	// the first sample sets the variation to half of it
+	assert.Equal(t, time.Second*3, e.sample(time.Second))
+	assert.Equal(t, time.Second, e.srtt)
+	assert.Equal(t, time.Millisecond*500, e.rttvar)
+
+	// then samples are smoothed
+	assert.Equal(t, time.Millisecond*2500, e.sample(time.Second))
+	assert.Equal(t, time.Second, e.srtt)
+	assert.Equal(t, time.Millisecond*375, e.rttvar)
+
+	// within bounds
+	assert.Equal(t, minAckWaitTime, (&rttEstimator{}).sample(time.Millisecond))
+	assert.Equal(t, maxAckWaitTime, (&rttEstimator{}).sample(time.Minute))
+}
+
+func TestSampleRTT(t *testing.T) {
+	atc := NewAirTrafficCtrl(func(p *packet.Packet) error { return nil })
+	defer atc.Close()
+	assert.Equal(t, defaultAckWaitTime, atc.Info().AckWait)
+	assert.Equal(t, time.Duration(0), atc.Info().SRTT)
+
+	assert.Nil(t, atc.Send(mockPacket(0, make([]byte, 10))))
+	for i := 0; i < 5; i++ {
+		atc.SampleRTT(time.Millisecond * 100)
+	}
+	info := atc.Info()
+	assert.Equal(t, time.Millisecond*100, info.SRTT)
+	assert.True(t, info.AckWait < defaultAckWaitTime, "ack wait %s not refined", info.AckWait)
+	assert.True(t, info.AckWait >= minAckWaitTime)
+
+	// packets in flight keep their timers
+	assert.Equal(t, defaultAckWaitTime, info.RTO)
+}
@@ -0,0 +1,147 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of time and timers, so that time-dependent
+// behaviour (e.g. retransmission timeouts and deadlines) can be
+// tested deterministically with a Fake clock
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock, as time.Timer
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the real clock, backed by the time package
+type Real struct{}
+
+var _ Clock = Real{}
+
+// Now returns the current time
+func (Real) Now() time.Time { return time.Now() }
+
+// AfterFunc calls f in its own goroutine after d, see time.AfterFunc
+func (Real) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Fake is a clock whose time only moves when advanced, firing
+// the timers which expire along the way (e.g. for tests)
+type Fake struct {
+	sync.Mutex
+
+	now    time.Time
+	timers []*fakeTimer // armed timers
+}
+
+var _ Clock = (*Fake)(nil)
+
+type fakeTimer struct {
+	clock *Fake
+	at    time.Time
+	f     func()
+	armed bool
+}
+
+// NewFake returns a fake clock set to the given time
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake clock's current time
+func (c *Fake) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+// AfterFunc calls f once the fake clock is advanced by at least d
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f, armed: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the fake clock forward, calling the function of every
+// timer which expires (in the calling goroutine, in order of expiry and
+// with the clock set to the time of expiry). Timers set or reset by those
+// functions also fire if they expire before the new time
+func (c *Fake) Advance(d time.Duration) {
+	c.Lock()
+	end := c.now.Add(d)
+	c.Unlock()
+
+	for {
+		c.Lock()
+		t := c.next(end)
+		if t == nil {
+			c.now = end
+			c.Unlock()
+			return
+		}
+		c.now = t.at
+		c.disarm(t)
+		c.Unlock()
+
+		t.f()
+	}
+}
+
+// next returns the armed timer expiring first, no later than end (if any)
+func (c *Fake) next(end time.Time) *fakeTimer {
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+	if len(c.timers) == 0 || c.timers[0].at.After(end) {
+		return nil
+	}
+	return c.timers[0]
+}
+
+// Stop prevents the timer from firing, returning false
+// if the timer already fired or was already stopped
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	wasArmed := t.armed
+	t.clock.disarm(t)
+	return wasArmed
+}
+
+// disarm removes a timer from the armed timers (if armed)
+func (c *Fake) disarm(t *fakeTimer) {
+	if !t.armed {
+		return
+	}
+	t.armed = false
+	for i, armed := range c.timers {
+		if armed == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reset re-arms the timer to fire after d, returning
+// true if the timer was armed before being reset
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	wasArmed := t.armed
+	t.at = t.clock.now.Add(d)
+	if !wasArmed {
+		t.armed = true
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	return wasArmed
+}
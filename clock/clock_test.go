@@ -0,0 +1,81 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	assert.Equal(t, start, c.Now())
+
+	var fired []time.Duration
+	record := func() { fired = append(fired, c.Now().Sub(start)) }
+
+	c.AfterFunc(time.Second*2, record)
+	c.AfterFunc(time.Second, record)
+	stopped := c.AfterFunc(time.Second, record)
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	c.Advance(time.Millisecond * 1500)
+	assert.Equal(t, []time.Duration{time.Second}, fired)
+	assert.Equal(t, start.Add(time.Millisecond*1500), c.Now())
+
+	c.Advance(time.Second)
+	assert.Equal(t, []time.Duration{time.Second, time.Second * 2}, fired)
+}
+
+func TestFakeReset(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+
+	// a timer re-armed by its own function (as a backoff)
+	fired := 0
+	var timer Timer
+	backoff := time.Second
+	timer = c.AfterFunc(backoff, func() {
+		fired++
+		backoff *= 2
+		timer.Reset(backoff)
+	})
+
+	c.Advance(time.Second * 7) // fires at 1s, 3s and 7s
+	assert.Equal(t, 3, fired)
+
+	assert.True(t, timer.Stop())
+	c.Advance(time.Hour)
+	assert.Equal(t, 3, fired)
+
+	assert.False(t, timer.Reset(time.Second))
+	c.Advance(time.Second)
+	assert.Equal(t, 4, fired)
+}
+
+func TestReal(t *testing.T) {
+	var c Clock = Real{}
+	assert.WithinDuration(t, time.Now(), c.Now(), time.Second)
+
+	fired := make(chan struct{})
+	c.AfterFunc(time.Millisecond, func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
+
+func TestFakeTimersReleased(t *testing.T) {
+	c := NewFake(time.Unix(1000, 0))
+
+	var timer Timer
+	timer = c.AfterFunc(time.Second, func() { timer.Reset(time.Second) })
+	c.Advance(time.Second * 100)
+	assert.Equal(t, 1, len(c.timers))
+
+	timer.Stop()
+	assert.Equal(t, 0, len(c.timers))
+}
@@ -0,0 +1,174 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// number of slots of a timer wheel, timers due further than this many
+// ticks ahead stay in their slot for more than one turn of the wheel
+const wheelSlots = 256
+
+// Wheel is a clock whose timers fire on the ticks of a timer wheel, all
+// driven by a single timer of an underlying clock rather than each by its
+// own. Timers are rounded up to the next tick, which suits many (e.g.
+// thousands of) coarse timers mostly stopped or reset before they fire,
+// such as retransmission timers
+type Wheel struct {
+	sync.Mutex
+
+	clock Clock
+	tick  time.Duration
+	start time.Time // time of the wheel's first tick
+	ticks uint64    // ticks elapsed, by which all timers due fired
+
+	slots   [wheelSlots]wheelTimer // sentinels of lists of armed timers
+	pending int                    // armed timers
+
+	// fires on the next tick, armed only while timers are pending
+	ticker  Timer
+	ticking bool
+}
+
+var _ Clock = (*Wheel)(nil)
+
+type wheelTimer struct {
+	wheel *Wheel
+	due   uint64 // tick on which the timer fires
+	f     func()
+	armed bool
+
+	// neighbours in the list of its slot while armed
+	prev, next *wheelTimer
+}
+
+// NewWheel returns a timer wheel ticking (while any of its timers are
+// armed) at the given positive granularity on the given clock
+func NewWheel(c Clock, tick time.Duration) *Wheel {
+	w := &Wheel{clock: c, tick: tick, start: c.Now()}
+	for i := range w.slots {
+		w.slots[i].prev, w.slots[i].next = &w.slots[i], &w.slots[i]
+	}
+	return w
+}
+
+// Now returns the underlying clock's current time
+func (w *Wheel) Now() time.Time {
+	return w.clock.Now()
+}
+
+// AfterFunc calls f on the first tick at least d from now, in the
+// goroutine of the wheel's ticker (after the timers due before it)
+func (w *Wheel) AfterFunc(d time.Duration, f func()) Timer {
+	w.Lock()
+	defer w.Unlock()
+
+	t := &wheelTimer{wheel: w, f: f}
+	w.arm(t, d)
+	return t
+}
+
+// arm schedules a timer to fire on the first tick at least d from now
+func (w *Wheel) arm(t *wheelTimer, d time.Duration) {
+	due := w.ticks + 1
+	if at := w.clock.Now().Sub(w.start) + d; at > 0 {
+		if n := uint64((at + w.tick - 1) / w.tick); n > due {
+			due = n
+		}
+	}
+	t.due, t.armed = due, true
+
+	slot := &w.slots[due%wheelSlots]
+	t.prev, t.next = slot.prev, slot
+	slot.prev.next, slot.prev = t, t
+
+	if w.pending++; !w.ticking {
+		w.schedule()
+	}
+}
+
+// disarm removes a timer from its slot (if armed), and stops
+// the ticker once no timers are pending
+func (w *Wheel) disarm(t *wheelTimer) {
+	if !t.armed {
+		return
+	}
+	t.armed = false
+	t.prev.next, t.next.prev = t.next, t.prev
+	t.prev, t.next = nil, nil
+
+	if w.pending--; w.pending == 0 && w.ticking {
+		w.ticker.Stop()
+		w.ticking = false
+	}
+}
+
+// schedule arms the ticker to fire on the next tick
+func (w *Wheel) schedule() {
+	elapsed := w.clock.Now().Sub(w.start)
+	next := time.Duration(elapsed/w.tick+1) * w.tick
+	if w.ticker == nil {
+		w.ticker = w.clock.AfterFunc(next-elapsed, w.advance)
+	} else {
+		w.ticker.Reset(next - elapsed)
+	}
+	w.ticking = true
+}
+
+// advance fires the timers due by the current tick (in order of their
+// ticks), visiting the slots of the ticks elapsed since the last advance
+// (at most one turn of the wheel, covering every slot once)
+func (w *Wheel) advance() {
+	w.Lock()
+	now := uint64(w.clock.Now().Sub(w.start) / w.tick)
+
+	var due []*wheelTimer
+	for n, tick := 0, w.ticks+1; tick <= now && n < wheelSlots; tick, n = tick+1, n+1 {
+		slot := &w.slots[tick%wheelSlots]
+		for t := slot.next; t != slot; t = t.next {
+			if t.due <= now {
+				due = append(due, t)
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].due < due[j].due })
+	for _, t := range due {
+		w.disarm(t)
+	}
+	if now > w.ticks {
+		w.ticks = now
+	}
+	w.ticking = false
+	if w.pending > 0 {
+		w.schedule()
+	}
+	w.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// Stop prevents the timer from firing, returning false
+// if the timer already fired or was already stopped
+func (t *wheelTimer) Stop() bool {
+	t.wheel.Lock()
+	defer t.wheel.Unlock()
+
+	wasArmed := t.armed
+	t.wheel.disarm(t)
+	return wasArmed
+}
+
+// Reset re-arms the timer to fire on the first tick at least
+// d from now, returning true if the timer was armed before
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	t.wheel.Lock()
+	defer t.wheel.Unlock()
+
+	wasArmed := t.armed
+	t.wheel.disarm(t)
+	t.wheel.arm(t, d)
+	return wasArmed
+}
@@ -0,0 +1,83 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWheel(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	w := NewWheel(c, time.Millisecond*10)
+	assert.Equal(t, start, w.Now())
+
+	var fired []time.Duration
+	record := func() { fired = append(fired, c.Now().Sub(start)) }
+
+	// timers fire on the next tick at least their duration away
+	w.AfterFunc(time.Millisecond*15, record)
+	w.AfterFunc(time.Millisecond*20, record)
+	w.AfterFunc(time.Millisecond*1, record)
+	stopped := w.AfterFunc(time.Millisecond*5, record)
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	c.Advance(time.Millisecond * 15)
+	assert.Equal(t, []time.Duration{time.Millisecond * 10}, fired)
+	c.Advance(time.Millisecond * 5)
+	assert.Equal(t, []time.Duration{time.Millisecond * 10, time.Millisecond * 20, time.Millisecond * 20}, fired)
+
+	// a single ticker drives all timers, and only while any are armed
+	assert.Equal(t, 0, len(c.timers))
+	for i := 0; i < 1000; i++ {
+		w.AfterFunc(time.Millisecond*time.Duration(i), func() {})
+	}
+	assert.Equal(t, 1, len(c.timers))
+	c.Advance(time.Second)
+	assert.Equal(t, 0, w.pending)
+	assert.Equal(t, 0, len(c.timers))
+}
+
+func TestWheelReset(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	w := NewWheel(c, time.Millisecond*10)
+
+	// a timer re-armed by its own function (as a backoff)
+	var at []time.Duration
+	var timer Timer
+	backoff := time.Millisecond * 10
+	timer = w.AfterFunc(backoff, func() {
+		at = append(at, c.Now().Sub(start))
+		backoff *= 2
+		timer.Reset(backoff)
+	})
+
+	c.Advance(time.Millisecond * 70) // fires at 10ms, 30ms and 70ms
+	assert.Equal(t, []time.Duration{time.Millisecond * 10, time.Millisecond * 30, time.Millisecond * 70}, at)
+
+	assert.True(t, timer.Stop())
+	c.Advance(time.Hour)
+	assert.Equal(t, 3, len(at))
+
+	// timers due more than a turn of the wheel ahead, after an idle hour
+	assert.False(t, timer.Reset(time.Millisecond*10*wheelSlots*2))
+	c.Advance(time.Millisecond * 10 * wheelSlots)
+	assert.Equal(t, 3, len(at))
+	c.Advance(time.Millisecond * 10 * wheelSlots)
+	assert.Equal(t, 4, len(at))
+}
+
+func TestWheelReal(t *testing.T) {
+	w := NewWheel(Real{}, time.Millisecond)
+
+	fired := make(chan struct{})
+	w.AfterFunc(time.Millisecond*5, func() { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
@@ -1,6 +1,7 @@
 package rdtp
 
 import (
+	"bufio"
 	"fmt"
 	"net"
 	"time"
@@ -10,26 +11,66 @@ import (
 
 // Conn is a logical communication channel between the local and remote hosts.
 // Implements the net.Conn interface (https://golang.org/pkg/net/#Conn)
+//
+// Reads and writes touch disjoint state so a Read and a Write may be called
+// concurrently (see Reader and Writer). Concurrent calls in the same direction
+// are not supported: data from concurrent Reads (or Writes) may interleave
 type Conn struct {
 	laddr *Addr
 	raddr *Addr
 	svc   net.Conn
+
+	// buffers data read from the service, so that it can be peeked at
+	rx *bufio.Reader
 }
 
+// MaxPeekBytes is the largest number of bytes which can be peeked at
+const MaxPeekBytes = 4096
+
+func newConn(svc net.Conn, laddr, raddr *Addr) *Conn {
+	return &Conn{
+		laddr: laddr,
+		raddr: raddr,
+		svc:   svc,
+		rx:    bufio.NewReaderSize(svc, MaxPeekBytes),
+	}
+}
+
+var _ net.Conn = (*Conn)(nil)
+
 // Dial returns a connection to a remote address
 // where the remote address has a format: ${host}:${port}
 func Dial(address string) (*Conn, error) {
-	svc, err := net.Dial("unix", DefaultRDTPServiceAddr)
+	raddr, err := fromString(address)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not connect to rdtp service")
+		return nil, errors.Wrap(err, "invalid remote rdtp address")
 	}
+	return dial(nil, raddr)
+}
 
-	raddr, err := fromString(address)
+// DialFrom returns a connection to a remote address from the given local
+// address, where both addresses have a format: ${host}:${port}. An empty
+// host or port is chosen by the rdtp service. An error is returned if the
+// local port is already in use
+func DialFrom(localAddress, remoteAddress string) (*Conn, error) {
+	laddr, err := fromString(localAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid local rdtp address")
+	}
+	raddr, err := fromString(remoteAddress)
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid remote rdtp address")
 	}
+	return dial(laddr, raddr)
+}
 
-	req, err := NewClientMessage(ClientMessageTypeDial, nil, raddr)
+func dial(laddr, raddr *Addr) (*Conn, error) {
+	svc, err := net.Dial("unix", serviceAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to rdtp service")
+	}
+
+	req, err := NewClientMessage(ClientMessageTypeDial, laddr, raddr)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create rdtp dial request")
 	}
@@ -44,22 +85,27 @@ func Dial(address string) (*Conn, error) {
 		return nil, errors.Wrap(err, "RDTP Dial error")
 	}
 
-	return &Conn{
-		svc:   svc,
-		laddr: verifiedLocalAddr,
-		raddr: raddr,
-	}, nil
+	return newConn(svc, verifiedLocalAddr, raddr), nil
 }
 
 // Read reads data from the connection.
 func (c Conn) Read(b []byte) (n int, err error) {
-	return c.svc.Read(b)
+	return c.rx.Read(b)
+}
+
+// Peek returns the next n bytes of data without consuming them: they are
+// returned again by the next Read. Peek blocks until n bytes are received,
+// returning fewer bytes only along with an error (e.g. if the connection is
+// closed, or n is larger than MaxPeekBytes). The bytes returned are only
+// valid until the next Read. Peek and Read must not be called concurrently
+func (c Conn) Peek(n int) ([]byte, error) {
+	return c.rx.Peek(n)
 }
 
 // Write writes data to the connection.
 func (c Conn) Write(b []byte) (n int, err error) {
 	n, err = c.svc.Write(b)
-	if err != nil && err.Error() == fmt.Sprintf("write unix ->%s: write: broken pipe", DefaultRDTPServiceAddr) {
+	if err != nil && err.Error() == fmt.Sprintf("write unix ->%s: write: broken pipe", serviceAddr) {
 		err = errors.New("connection closed by rdtp service")
 	}
 	return
@@ -96,3 +142,45 @@ func (c Conn) SetReadDeadline(t time.Time) error {
 func (c Conn) SetWriteDeadline(t time.Time) error {
 	return c.svc.SetWriteDeadline(t)
 }
+
+// ReadHalf is the receiving direction of a connection
+type ReadHalf struct {
+	c Conn
+}
+
+// WriteHalf is the sending direction of a connection
+type WriteHalf struct {
+	c Conn
+}
+
+// Reader returns a view of the connection which can only be read from,
+// meant to be handed to a read pump running in its own goroutine
+func (c Conn) Reader() *ReadHalf {
+	return &ReadHalf{c: c}
+}
+
+// Writer returns a view of the connection which can only be written to,
+// meant to be handed to a write pump running in its own goroutine
+func (c Conn) Writer() *WriteHalf {
+	return &WriteHalf{c: c}
+}
+
+// Read reads data from the connection.
+func (r *ReadHalf) Read(b []byte) (int, error) {
+	return r.c.Read(b)
+}
+
+// SetDeadline sets the read deadline on the connection
+func (r *ReadHalf) SetDeadline(t time.Time) error {
+	return r.c.SetReadDeadline(t)
+}
+
+// Write writes data to the connection.
+func (w *WriteHalf) Write(b []byte) (int, error) {
+	return w.c.Write(b)
+}
+
+// SetDeadline sets the write deadline on the connection
+func (w *WriteHalf) SetDeadline(t time.Time) error {
+	return w.c.SetWriteDeadline(t)
+}
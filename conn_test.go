@@ -0,0 +1,96 @@
+package rdtp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnReaderWriterPumps(t *testing.T) {
+	local, remote := net.Pipe()
+	c := newConn(local, nil, nil)
+
+	// mock service echoing everything back
+	go io.Copy(remote, remote)
+
+	msg := bytes.Repeat([]byte("pumping data "), 1000)
+
+	r, w := c.Reader(), c.Writer()
+	assert.Nil(t, r.SetDeadline(time.Now().Add(time.Second*5)))
+	assert.Nil(t, w.SetDeadline(time.Now().Add(time.Second*5)))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < len(msg); i += 100 {
+			_, err := w.Write(msg[i : i+100])
+			assert.Nil(t, err)
+		}
+	}()
+
+	var rx []byte
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 512)
+		for len(rx) < len(msg) {
+			n, err := r.Read(buf)
+			assert.Nil(t, err)
+			if err != nil {
+				return
+			}
+			rx = append(rx, buf[:n]...)
+		}
+	}()
+
+	wg.Wait()
+	assert.Equal(t, msg, rx)
+}
+
+func TestConnReaderDeadline(t *testing.T) {
+	local, _ := net.Pipe()
+	c := newConn(local, nil, nil)
+
+	r := c.Reader()
+	assert.Nil(t, r.SetDeadline(time.Now().Add(time.Millisecond)))
+
+	_, err := r.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestConnPeek(t *testing.T) {
+	local, remote := net.Pipe()
+	c := newConn(local, nil, nil)
+
+	go func() {
+		remote.Write([]byte("RDTP/1"))
+		remote.Write([]byte(" hello"))
+		remote.Close()
+	}()
+
+	// peeking blocks until enough data is received, however many reads it takes
+	header, err := c.Peek(len("RDTP/1 "))
+	assert.Nil(t, err)
+	assert.Equal(t, "RDTP/1 ", string(header))
+
+	// peeked data is not consumed
+	data, err := ioutil.ReadAll(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "RDTP/1 hello", string(data))
+
+	_, err = c.Peek(1)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = c.Peek(MaxPeekBytes + 1)
+	assert.NotNil(t, err)
+}
@@ -14,51 +14,132 @@ const (
 	flagFmt = "{SYN[%t] ACK[%t] FIN[%t] ERR[%t]}"
 )
 
+var (
+	// ErrTimeout is returned when an expected packet is not received in time
+	ErrTimeout = errors.New("operation timed out")
+
+	// ErrConnectionRefused is returned when the remote host answers a SYN with an ERR
+	ErrConnectionRefused = errors.New("connection refused")
+
+	// errChannelClosed is returned when the channel packets are received on is closed
+	errChannelClosed = errors.New("receive channel closed")
+)
+
 type ctrlPacketSender func(syn, ack, fin, err bool) error
 
-// InitiateConnection sends a SYN, waits for a SYN ACK, and sends an ACK
-func InitiateConnection(recv chan *packet.Packet, recvTimeout time.Duration, sendCtrl ctrlPacketSender) error {
-	// send SYN
-	if err := sendCtrl(true, false, false, false); err != nil {
-		conditionallyLog(debug, "DIAL: Send SYN [FAIL]: %s", err)
-		return errors.Wrap(err, "connect handshake failed when sending SYN")
-	}
-	conditionallyLog(debug, "DIAL: Send SYN [OK]")
+// InitiateConnection sends a SYN, waits for a SYN ACK, and sends an ACK.
+// Returns the SYN ACK received from the remote host
+func InitiateConnection(recv chan *packet.Packet, recvTimeout time.Duration, sendCtrl ctrlPacketSender) (*packet.Packet, error) {
+	return InitiateConnectionWithRetries(recv, recvTimeout, 0, sendCtrl)
+}
 
-	// wait for SYN ACK
-	if err := receiveControlPacket(recv, true, true, false, false, recvTimeout); err != nil {
-		conditionallyLog(debug, "DIAL: Receive SYN ACK [FAIL]: %s", err)
-		return errors.Wrap(err, "connect handshake failed when waiting for SYN ACK")
+// InitiateConnectionWithRetries sends a SYN, waits for a SYN ACK, and sends
+// an ACK. If no SYN ACK is received, the SYN is re-sent up to maxSynRetries
+// times, doubling the time to wait for a response after every attempt.
+// If the remote host answers with a SYN of its own (both hosts dialed
+// each other at once), the handshake completes as a simultaneous open.
+// Returns the SYN ACK received from the remote host
+func InitiateConnectionWithRetries(recv chan *packet.Packet, recvTimeout time.Duration, maxSynRetries int, sendCtrl ctrlPacketSender) (*packet.Packet, error) {
+	var synack *packet.Packet
+
+	timeout := recvTimeout
+	for attempt := 0; ; attempt++ {
+		// send SYN
+		if err := sendCtrl(true, false, false, false); err != nil {
+			conditionallyLog(debug, "DIAL: Send SYN [FAIL]: %s", err)
+			return nil, errors.Wrap(err, "connect handshake failed when sending SYN")
+		}
+		conditionallyLog(debug, "DIAL: Send SYN [OK]")
+
+		// wait for SYN ACK
+		p, err := WaitForControlPacket(recv, time.Now().Add(timeout))
+		if err == ErrTimeout && attempt < maxSynRetries {
+			conditionallyLog(debug, "DIAL: Receive SYN ACK [TIMEOUT]: retrying (%d/%d)", attempt+1, maxSynRetries)
+			timeout *= 2
+			continue
+		}
+		if err == nil && p.IsERR() {
+			err = ErrConnectionRefused
+		}
+		if err == nil && p.IsSYN() && !p.IsACK() && !p.IsFIN() {
+			conditionallyLog(debug, "DIAL: Receive SYN [OK]: simultaneous open")
+			return simultaneousOpen(recv, timeout, sendCtrl)
+		}
+		if err == nil {
+			err = checkFlags(p, true, true, false, false)
+		}
+		if err != nil {
+			conditionallyLog(debug, "DIAL: Receive SYN ACK [FAIL]: %s", err)
+			return nil, errors.Wrap(err, "connect handshake failed when waiting for SYN ACK")
+		}
+		conditionallyLog(debug, "DIAL: Receive SYN ACK [OK]")
+		synack = p
+		break
 	}
-	conditionallyLog(debug, "DIAL: Receive SYN ACK [OK]")
 
 	// send ACK
 	if err := sendCtrl(false, true, false, false); err != nil {
 		conditionallyLog(debug, "DIAL: Send ACK [FAIL]: %s", err)
-		return errors.Wrap(err, "connect handshake failed when sending ACK")
+		return nil, errors.Wrap(err, "connect handshake failed when sending ACK")
 	}
 	conditionallyLog(debug, "DIAL: Send ACK [OK]")
 
-	return nil
+	return synack, nil
 }
 
-// AcceptConnection sends a SYN ACK and waits for an ACK
-func AcceptConnection(recv chan *packet.Packet, recvTimeout time.Duration, sendCtrl ctrlPacketSender) error {
+// simultaneousOpen completes the handshake after a SYN was received in
+// response to ours: as in TCP, a SYN ACK is sent and the handshake completes
+// once the remote host's own SYN ACK is received, with no further ACK.
+// Duplicates of the remote host's SYN are ignored
+func simultaneousOpen(recv chan *packet.Packet, recvTimeout time.Duration, sendCtrl ctrlPacketSender) (*packet.Packet, error) {
+	// send SYN ACK
+	if err := sendCtrl(true, true, false, false); err != nil {
+		conditionallyLog(debug, "DIAL: Send SYN ACK [FAIL]: %s", err)
+		return nil, errors.Wrap(err, "simultaneous open failed when sending SYN ACK")
+	}
+	conditionallyLog(debug, "DIAL: Send SYN ACK [OK]")
+
+	// wait for SYN ACK
+	deadline := time.Now().Add(recvTimeout)
+	for {
+		p, err := WaitForControlPacket(recv, deadline)
+		if err == nil && p.IsSYN() && !p.IsACK() && !p.IsFIN() && !p.IsERR() {
+			continue // the remote host re-sent its SYN
+		}
+		if err == nil {
+			err = checkFlags(p, true, true, false, false)
+		}
+		if err != nil {
+			conditionallyLog(debug, "DIAL: Receive SYN ACK [FAIL]: %s", err)
+			return nil, errors.Wrap(err, "simultaneous open failed when waiting for SYN ACK")
+		}
+		conditionallyLog(debug, "DIAL: Receive SYN ACK [OK]")
+		return p, nil
+	}
+}
+
+// AcceptConnection sends a SYN ACK and waits for an ACK.
+// Returns the ACK received from the remote host
+func AcceptConnection(recv chan *packet.Packet, recvTimeout time.Duration, sendCtrl ctrlPacketSender) (*packet.Packet, error) {
 	// send SYN ACK
 	if err := sendCtrl(true, true, false, false); err != nil {
 		conditionallyLog(debug, "ACCEPT: Send SYN ACK [FAIL]: %s", err)
-		return errors.Wrap(err, "connect handshake failed when sending SYN ACK")
+		return nil, errors.Wrap(err, "connect handshake failed when sending SYN ACK")
 	}
 	conditionallyLog(debug, "ACCEPT: Send SYN ACK [OK]")
 
 	// wait for ACK
-	if err := receiveControlPacket(recv, false, true, false, false, recvTimeout); err != nil {
+	p, err := WaitForControlPacket(recv, time.Now().Add(recvTimeout))
+	if err == nil {
+		err = checkFlags(p, false, true, false, false)
+	}
+	if err != nil {
 		conditionallyLog(debug, "ACCEPT: Receive ACK [FAIL]: %s", err)
-		return errors.Wrap(err, "connect handshake failed when waiting for ACK")
+		return nil, errors.Wrap(err, "connect handshake failed when waiting for ACK")
 	}
 	conditionallyLog(debug, "ACCEPT: Receive ACK [OK]")
 
-	return nil
+	return p, nil
 }
 
 // InitiateDisconnection sends a FIN, waits for a FIN ACK, and sends an ACK
@@ -106,24 +187,74 @@ func AcceptDisconnection(recv chan *packet.Packet, recvTimeout time.Duration, se
 	return nil
 }
 
-// receiveControlPacket blocks until the a packet is received (or timeout)
+// receiveControlPacket blocks until a control packet is received (or timeout)
+// and returns an error if it does not have the expected flags
 func receiveControlPacket(in chan *packet.Packet, syn, ack, fin, err bool, recvTimeout time.Duration) error {
+	p, recvErr := WaitForControlPacket(in, time.Now().Add(recvTimeout))
+	if recvErr != nil {
+		return recvErr
+	}
+	return checkFlags(p, syn, ack, fin, err)
+}
+
+// WaitForControlPacket blocks until a control packet is received, or
+// returns ErrTimeout once the deadline passes. Data packets received in the
+// meantime (e.g. data the remote host sent as the handshake completed, and
+// which overtook its control packet) are neither matched nor dropped: they
+// are put back on the channel when WaitForControlPacket returns, in the
+// order received, for normal processing once the handshake is over (unless
+// the channel is full by then, as if they were received on a full channel)
+func WaitForControlPacket(in chan *packet.Packet, deadline time.Time) (*packet.Packet, error) {
+	var data []*packet.Packet
+	defer func() { requeue(in, data) }()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
 	for {
 		select {
-		case p := <-in:
-			if syn != p.IsSYN() || ack != p.IsACK() || fin != p.IsFIN() || err != p.IsERR() {
-				return fmt.Errorf(
-					"expected packet with flags %s but got %s",
-					fmt.Sprintf(flagFmt, syn, ack, fin, err),
-					fmt.Sprintf(flagFmt, p.IsSYN(), p.IsACK(), p.IsFIN(), p.IsERR()))
+		case p, ok := <-in:
+			if !ok {
+				data = nil // nowhere to put them back
+				return nil, errChannelClosed
+			}
+			if !isDataPacket(p) {
+				return p, nil
 			}
-			return nil
-		case <-time.After(recvTimeout):
-			return errors.New("operation timed out")
+			data = append(data, p)
+		case <-timer.C:
+			return nil, ErrTimeout
 		}
 	}
 }
 
+// isDataPacket returns true if a packet carries a payload (e.g. data, or a
+// ping) but none of the flags of the handshakes. Data acknowledging the
+// handshake (see the socket's DialWithInitialData) is a control packet
+func isDataPacket(p *packet.Packet) bool {
+	return len(p.Payload) > 0 && !p.IsSYN() && !p.IsACK() && !p.IsFIN() && !p.IsERR()
+}
+
+// requeue puts packets back on a channel, dropping them if it is full
+func requeue(in chan *packet.Packet, ps []*packet.Packet) {
+	for _, p := range ps {
+		select {
+		case in <- p:
+		default:
+		}
+	}
+}
+
+// checkFlags returns an error if the flags on a packet are not the expected
+func checkFlags(p *packet.Packet, syn, ack, fin, err bool) error {
+	if syn != p.IsSYN() || ack != p.IsACK() || fin != p.IsFIN() || err != p.IsERR() {
+		return fmt.Errorf(
+			"expected packet with flags %s but got %s",
+			fmt.Sprintf(flagFmt, syn, ack, fin, err),
+			fmt.Sprintf(flagFmt, p.IsSYN(), p.IsACK(), p.IsFIN(), p.IsERR()))
+	}
+	return nil
+}
+
 func conditionallyLog(cond bool, fmtString string, indirects ...interface{}) {
 	if cond {
 		log.Printf(fmtString, indirects...)
@@ -1,13 +1,13 @@
 package handshake
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"testing"
 	"time"
 
 	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -68,7 +68,7 @@ func TestInitiateConnectionOK(t *testing.T) {
 		assert.False(t, p.IsERR())
 	}()
 
-	err := InitiateConnection(local, time.Millisecond*1, func(syn, ack, fin, err bool) error {
+	_, err := InitiateConnection(local, time.Millisecond*1, func(syn, ack, fin, err bool) error {
 		remote <- mockControlPacket(syn, ack, fin, err)
 		return nil
 	})
@@ -79,7 +79,7 @@ func TestInitiateConnectionOK(t *testing.T) {
 }
 
 func TestInitiateConnectionSendSynError(t *testing.T) {
-	err := InitiateConnection(make(chan *packet.Packet), recvTimeout, func(syn, ack, fin, err bool) error {
+	_, err := InitiateConnection(make(chan *packet.Packet), recvTimeout, func(syn, ack, fin, err bool) error {
 		return errMock
 	})
 	assert.NotNil(t, err)
@@ -102,7 +102,7 @@ func TestInitiateConnectionWaitForSynAckError(t *testing.T) {
 		// don't send SYN ACK (let it time out)
 	}()
 
-	err := InitiateConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
+	_, err := InitiateConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
 		remote <- mockControlPacket(syn, ack, fin, err)
 		return nil
 	})
@@ -131,7 +131,7 @@ func TestInitiateConnectionSendAckError(t *testing.T) {
 
 	sendInvocations := 0
 
-	err := InitiateConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
+	_, err := InitiateConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
 		if sendInvocations > 0 {
 			return errMock
 		}
@@ -145,6 +145,89 @@ func TestInitiateConnectionSendAckError(t *testing.T) {
 	assert.Equal(t, err.Error(), fmt.Sprintf("connect handshake failed when sending ACK: %s", errMock))
 }
 
+func TestInitiateConnectionWithRetriesSilentPeer(t *testing.T) {
+	syns := 0
+
+	_, err := InitiateConnectionWithRetries(make(chan *packet.Packet), recvTimeout, 2, func(syn, ack, fin, err bool) error {
+		assert.True(t, syn)
+		syns++
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrTimeout, errors.Cause(err))
+	assert.Equal(t, 3, syns)
+}
+
+func TestInitiateConnectionWithRetriesRespondsOnThirdSyn(t *testing.T) {
+	local := make(chan *packet.Packet, 1)
+	syns := 0
+
+	_, err := InitiateConnectionWithRetries(local, recvTimeout, 5, func(syn, ack, fin, err bool) error {
+		if syn {
+			syns++
+			// the remote only answers the third SYN
+			if syns == 3 {
+				local <- mockControlPacket(true, true, false, false)
+			}
+			return nil
+		}
+		// final ACK
+		assert.True(t, ack)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, syns)
+}
+
+func TestInitiateConnectionWithRetriesRefused(t *testing.T) {
+	local := make(chan *packet.Packet, 1)
+
+	_, err := InitiateConnectionWithRetries(local, recvTimeout, 5, func(syn, ack, fin, err bool) error {
+		local <- mockControlPacket(false, false, false, true)
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrConnectionRefused, errors.Cause(err))
+}
+
+func TestInitiateConnectionSimultaneousOpen(t *testing.T) {
+	local := make(chan *packet.Packet, 3)
+	var sent []*packet.Packet
+
+	synack, err := InitiateConnection(local, time.Millisecond*10, func(syn, ack, fin, err bool) error {
+		sent = append(sent, mockControlPacket(syn, ack, fin, err))
+		if len(sent) == 1 {
+			// the remote host's SYN crosses ours, and is re-sent
+			// before its SYN ACK is received
+			local <- mockControlPacket(true, false, false, false)
+			local <- mockControlPacket(true, false, false, false)
+			local <- mockControlPacket(true, true, false, false)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, synack.IsSYN())
+	assert.True(t, synack.IsACK())
+
+	// SYN, then SYN ACK, and no final ACK
+	assert.Len(t, sent, 2)
+	assert.Nil(t, checkFlags(sent[0], true, false, false, false))
+	assert.Nil(t, checkFlags(sent[1], true, true, false, false))
+}
+
+func TestInitiateConnectionSimultaneousOpenNoSynAck(t *testing.T) {
+	local := make(chan *packet.Packet, 1)
+
+	_, err := InitiateConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
+		if syn && !ack {
+			local <- mockControlPacket(true, false, false, false)
+		}
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrTimeout, errors.Cause(err))
+}
+
 func TestAcceptConnectionOK(t *testing.T) {
 	local := make(chan *packet.Packet)
 	remote := make(chan *packet.Packet)
@@ -165,7 +248,7 @@ func TestAcceptConnectionOK(t *testing.T) {
 		local <- mockControlPacket(false, true, false, false)
 	}()
 
-	err := AcceptConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
+	_, err := AcceptConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
 		remote <- mockControlPacket(syn, ack, fin, err)
 		return nil
 	})
@@ -173,7 +256,7 @@ func TestAcceptConnectionOK(t *testing.T) {
 }
 
 func TestAcceptConnectionSendSynAckError(t *testing.T) {
-	err := AcceptConnection(make(chan *packet.Packet), recvTimeout, func(syn, ack, fin, err bool) error {
+	_, err := AcceptConnection(make(chan *packet.Packet), recvTimeout, func(syn, ack, fin, err bool) error {
 		return errMock
 	})
 	assert.NotNil(t, err)
@@ -195,7 +278,7 @@ func TestAcceptConnectionWaitForAckError(t *testing.T) {
 		// don't send ACK (let it time out)
 	}()
 
-	err := AcceptConnection(make(chan *packet.Packet), recvTimeout, func(syn, ack, fin, err bool) error {
+	_, err := AcceptConnection(make(chan *packet.Packet), recvTimeout, func(syn, ack, fin, err bool) error {
 		remote <- mockControlPacket(syn, ack, fin, err)
 		return nil
 	})
@@ -412,6 +495,47 @@ func TestReceiveControlPacketErrorUnexpectedPacket(t *testing.T) {
 	}
 }
 
+func TestWaitForControlPacketKeepsData(t *testing.T) {
+	recvChan := make(chan *packet.Packet, 10)
+	data := mockDataPacket("first")
+	recvChan <- data
+	recvChan <- mockDataPacket("second")
+	recvChan <- mockControlPacket(true, true, false, false)
+
+	p, err := WaitForControlPacket(recvChan, time.Now().Add(recvTimeout))
+	assert.Nil(t, err)
+	assert.True(t, p.IsSYN() && p.IsACK())
+
+	// the data packets are put back, in order
+	assert.Equal(t, 2, len(recvChan))
+	assert.Equal(t, data, <-recvChan)
+	assert.Equal(t, "second", string((<-recvChan).Payload))
+
+	// also when the deadline passes
+	recvChan <- data
+	_, err = WaitForControlPacket(recvChan, time.Now().Add(recvTimeout))
+	assert.Equal(t, ErrTimeout, err)
+	assert.Equal(t, 1, len(recvChan))
+}
+
+func TestInitiateConnectionDataBeforeSynAck(t *testing.T) {
+	local := make(chan *packet.Packet, 10)
+
+	// the remote host's data overtakes its SYN ACK
+	_, err := InitiateConnection(local, recvTimeout, func(syn, ack, fin, err bool) error {
+		if syn {
+			local <- mockDataPacket("early data")
+			local <- mockControlPacket(true, true, false, false)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+
+	// and is left for normal processing
+	assert.Equal(t, 1, len(local))
+	assert.Equal(t, "early data", string((<-local).Payload))
+}
+
 type assertingWriter struct {
 	t       *testing.T
 	onWrite func()
@@ -459,3 +583,8 @@ func mockControlPacket(syn, ack, fin, err bool) *packet.Packet {
 	}
 	return p
 }
+
+func mockDataPacket(payload string) *packet.Packet {
+	p, _ := packet.NewPacket(0, 0, []byte(payload))
+	return p
+}
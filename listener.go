@@ -1,10 +1,12 @@
 package rdtp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -13,18 +15,31 @@ const (
 	messageBufferBytes = 1024
 )
 
+// ErrListenerClosed is the error returned by Accept
+// once the listener is closed (or shut down)
+var ErrListenerClosed = errors.New("use of closed listener")
+
 // Listener listens for new inbound rdtp
 // connections on a local rdtp port
 // Implements the net.Listener interface
 // https://golang.org/pkg/net/#Listener
 type Listener struct {
+	sync.Mutex
+
 	laddr *Addr
 	svc   net.Conn
+
+	// connections to the service of accepts whose handshake is in progress
+	closed     bool
+	handshakes map[net.Conn]struct{}
+	pending    sync.WaitGroup
 }
 
+var _ net.Listener = (*Listener)(nil)
+
 // Listen announces on the local network address
 func Listen(address string) (net.Listener, error) {
-	svc, err := net.Dial("unix", DefaultRDTPServiceAddr)
+	svc, err := net.Dial("unix", serviceAddr)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not connect to rdtp service")
 	}
@@ -52,27 +67,37 @@ func Listen(address string) (net.Listener, error) {
 	}
 
 	l := &Listener{
-		laddr: verifiedLocalAddr,
-		svc:   svc,
+		laddr:      verifiedLocalAddr,
+		svc:        svc,
+		handshakes: make(map[net.Conn]struct{}),
 	}
 
 	return l, nil
 }
 
 // Accept waits for and returns the next connection to the listener.
+// Once the listener is closed (or shut down) Accept returns ErrListenerClosed
 func (l *Listener) Accept() (net.Conn, error) {
 	verifiedRemoteAddr, err := waitForServiceMessageNotify(l.svc)
 	if err != nil {
+		if l.isClosed() {
+			return nil, ErrListenerClosed
+		}
 		if err == io.EOF {
 			return nil, errors.New("Listener terminated by rdtp service")
 		}
 		return nil, errors.Wrap(err, "remote address is not valid")
 	}
 
-	svc, err := net.Dial("unix", DefaultRDTPServiceAddr)
+	svc, err := net.Dial("unix", serviceAddr)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not connect to rdtp service")
 	}
+	if !l.startHandshake(svc) {
+		svc.Close()
+		return nil, ErrListenerClosed
+	}
+	defer l.endHandshake(svc)
 
 	req, err := NewClientMessage(ClientMessageTypeAccept, l.laddr, verifiedRemoteAddr)
 	if err != nil {
@@ -85,24 +110,99 @@ func (l *Listener) Accept() (net.Conn, error) {
 
 	verifiedLocalAddr, err := waitForServiceMessageOK(svc)
 	if err != nil {
+		svc.Close()
+		if l.isClosed() {
+			return nil, ErrListenerClosed // aborted by Close
+		}
 		if err == io.EOF {
 			return nil, errors.New("Listener terminated by rdtp service")
 		}
 		return nil, errors.Wrap(err, "RDTP Accept error")
 	}
 
-	return &Conn{
-		laddr: verifiedLocalAddr,
-		raddr: verifiedRemoteAddr,
-		svc:   svc,
-	}, nil
+	return newConn(svc, verifiedLocalAddr, verifiedRemoteAddr), nil
 }
 
-// Close closes the listener.
+// startHandshake keeps track of an accept whose handshake is in progress,
+// returning false if the listener is closed
+func (l *Listener) startHandshake(svc net.Conn) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return false
+	}
+	l.handshakes[svc] = struct{}{}
+	l.pending.Add(1)
+	return true
+}
+
+func (l *Listener) endHandshake(svc net.Conn) {
+	l.Lock()
+	delete(l.handshakes, svc)
+	l.Unlock()
+	l.pending.Done()
+}
+
+func (l *Listener) isClosed() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.closed
+}
+
+// Close closes the listener: no more connections are accepted, accepts
+// whose handshake is in progress are aborted, and any blocked Accept
+// returns ErrListenerClosed
 func (l *Listener) Close() error {
+	err := l.stopAccepting()
+	l.abortHandshakes()
+	return err
+}
+
+// Shutdown closes the listener gracefully: no more connections are
+// accepted and any Accept still waiting for one returns ErrListenerClosed,
+// but accepts whose handshake is in progress are completed. If the context
+// is done first, the remaining handshakes are aborted (as by Close) and the
+// context's error is returned
+func (l *Listener) Shutdown(ctx context.Context) error {
+	err := l.stopAccepting()
+
+	done := make(chan struct{})
+	go func() {
+		l.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		l.abortHandshakes()
+		return ctx.Err()
+	}
+}
+
+// stopAccepting marks the listener closed and closes its connection to the
+// service, which stops the service from notifying it of new connections
+func (l *Listener) stopAccepting() error {
+	l.Lock()
+	l.closed = true
+	l.Unlock()
+
 	return l.svc.Close()
 }
 
+// abortHandshakes closes the connections to the service of
+// the accepts whose handshake is in progress
+func (l *Listener) abortHandshakes() {
+	l.Lock()
+	defer l.Unlock()
+
+	for svc := range l.handshakes {
+		svc.Close()
+	}
+}
+
 // Addr returns the listener's network address.
 func (l *Listener) Addr() net.Addr {
 	return l.laddr
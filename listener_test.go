@@ -0,0 +1,182 @@
+package rdtp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockService is a minimal in-process rdtp service: dialers are connected
+// directly to listeners on the local host, bypassing the network entirely
+type mockService struct {
+	sync.Mutex
+
+	listeners map[uint16]net.Conn // by local port
+	dialers   map[string]net.Conn // by dialer address, until accepted
+	nextPort  uint16
+}
+
+// runMockService serves the client API on a temporary unix socket
+// which clients in this package connect to instead of the real service
+func runMockService(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "rdtp")
+	assert.Nil(t, err)
+
+	sock, err := net.Listen("unix", filepath.Join(dir, "rdtp.sock"))
+	assert.Nil(t, err)
+
+	svc := &mockService{
+		listeners: make(map[uint16]net.Conn),
+		dialers:   make(map[string]net.Conn),
+		nextPort:  49152,
+	}
+
+	go func() {
+		for {
+			c, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			go svc.serve(c)
+		}
+	}()
+
+	serviceAddr = sock.Addr().String()
+	return func() {
+		serviceAddr = DefaultRDTPServiceAddr
+		sock.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (svc *mockService) serve(c net.Conn) {
+	buf := make([]byte, messageBufferBytes)
+	n, err := c.Read(buf)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	var msg ClientMessage
+	if err := json.Unmarshal(buf[:n], &msg); err != nil {
+		c.Close()
+		return
+	}
+
+	local := &Addr{Host: "127.0.0.1"}
+
+	switch msg.Type {
+	case ClientMessageTypeListen:
+		local.Port = msg.LocalAddr.Port
+		svc.Lock()
+		svc.listeners[local.Port] = c
+		svc.Unlock()
+		reply(c, ServiceMessageTypeOK, local, nil)
+	case ClientMessageTypeDial:
+		svc.Lock()
+		l, ok := svc.listeners[msg.RemoteAddr.Port]
+		local.Port = svc.nextPort
+		svc.nextPort++
+		svc.dialers[local.String()] = c
+		svc.Unlock()
+		if !ok {
+			c.Close()
+			return
+		}
+		reply(l, ServiceMessageTypeNotify, nil, local)
+	case ClientMessageTypeAccept:
+		svc.Lock()
+		d, ok := svc.dialers[msg.RemoteAddr.String()]
+		delete(svc.dialers, msg.RemoteAddr.String())
+		svc.Unlock()
+		if !ok {
+			c.Close()
+			return
+		}
+		local.Port = msg.LocalAddr.Port
+		reply(c, ServiceMessageTypeOK, local, &msg.RemoteAddr)
+		reply(d, ServiceMessageTypeOK, &msg.RemoteAddr, local)
+		go func() { io.Copy(c, d); c.Close() }()
+		go func() { io.Copy(d, c); d.Close() }()
+	}
+}
+
+func reply(c net.Conn, typ ServiceMessageType, laddr, raddr *Addr) {
+	msg, _ := NewServiceMessage(typ, laddr, raddr, nil)
+	c.Write(msg)
+}
+
+func TestListenerServesHTTP(t *testing.T) {
+	defer runMockService(t)()
+
+	l, err := Listen(":8080")
+	assert.Nil(t, err)
+	defer l.Close()
+	assert.Equal(t, "127.0.0.1:8080", l.Addr().String())
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s over rdtp", r.URL.Query().Get("name"))
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return Dial(addr)
+			},
+		},
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		resp, err := client.Get("http://127.0.0.1:8080/?name=" + name)
+		if !assert.Nil(t, err) {
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("hello %s over rdtp", name), string(body))
+	}
+}
+
+func TestListenerCloseUnblocksAccept(t *testing.T) {
+	defer runMockService(t)()
+
+	for name, closeListener := range map[string]func(*Listener) error{
+		"close":    (*Listener).Close,
+		"shutdown": func(l *Listener) error { return l.Shutdown(context.Background()) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, err := Listen(":8081")
+			assert.Nil(t, err)
+
+			accepted := make(chan error, 1)
+			go func() {
+				_, err := l.Accept()
+				accepted <- err
+			}()
+
+			assert.Nil(t, closeListener(l.(*Listener)))
+			select {
+			case err := <-accepted:
+				assert.Equal(t, ErrListenerClosed, err)
+			case <-time.After(time.Second * 5):
+				t.Fatal("Accept did not return after the listener was closed")
+			}
+
+			_, err = l.Accept()
+			assert.Equal(t, ErrListenerClosed, err)
+		})
+	}
+}
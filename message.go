@@ -0,0 +1,91 @@
+package rdtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxMessageBytes is the largest message a MessageConn
+	// sends or receives when no maximum message size is given
+	DefaultMaxMessageBytes = 1 << 20
+
+	// size of the message length prefix
+	messageLengthBytes = 4
+)
+
+// ErrMessageTooLarge is the error returned when a message to be sent or
+// received is larger than the MessageConn's maximum message size
+var ErrMessageTooLarge = errors.New("message too large")
+
+// MessageConn frames messages over a connection's byte stream, so that
+// they are received with the same boundaries they were sent with. Each
+// message is sent with its length as a 4 byte (big endian) prefix.
+//
+// A ReadMessage and a WriteMessage may be called concurrently, but the
+// underlying connection must not be read from or written to directly
+// once wrapped, as that would corrupt the message framing
+type MessageConn struct {
+	net.Conn
+
+	maxMessageBytes int
+	header          [messageLengthBytes]byte
+}
+
+// NewMessageConn returns a MessageConn which frames messages of up to
+// maxMessageBytes bytes over the given connection. The default maximum
+// message size is used when the given maximum is not positive
+func NewMessageConn(c net.Conn, maxMessageBytes int) *MessageConn {
+	if maxMessageBytes <= 0 {
+		maxMessageBytes = DefaultMaxMessageBytes
+	}
+	return &MessageConn{
+		Conn:            c,
+		maxMessageBytes: maxMessageBytes,
+	}
+}
+
+// WriteMessage sends a message, prefixed with its length
+func (mc *MessageConn) WriteMessage(msg []byte) error {
+	if len(msg) > mc.maxMessageBytes {
+		return errors.Wrap(ErrMessageTooLarge, fmt.Sprintf("%d bytes, maximum is %d", len(msg), mc.maxMessageBytes))
+	}
+
+	// a single write so that short messages are not split onto two packets
+	buf := make([]byte, messageLengthBytes+len(msg))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[messageLengthBytes:], msg)
+
+	if _, err := mc.Conn.Write(buf); err != nil {
+		return errors.Wrap(err, "could not write message")
+	}
+	return nil
+}
+
+// ReadMessage blocks until a whole message is received, however many
+// reads it takes, and returns it. A message larger than the maximum
+// message size is not read: ErrMessageTooLarge is returned and the
+// connection can no longer be used for messages
+func (mc *MessageConn) ReadMessage() ([]byte, error) {
+	if _, err := io.ReadFull(mc.Conn, mc.header[:]); err != nil {
+		if err == io.EOF {
+			return nil, err // no more messages
+		}
+		return nil, errors.Wrap(err, "could not read message length")
+	}
+
+	size := binary.BigEndian.Uint32(mc.header[:])
+	if uint64(size) > uint64(mc.maxMessageBytes) {
+		return nil, errors.Wrap(ErrMessageTooLarge, fmt.Sprintf("%d bytes, maximum is %d", size, mc.maxMessageBytes))
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(mc.Conn, msg); err != nil {
+		return nil, errors.Wrap(err, "could not read message")
+	}
+	return msg, nil
+}
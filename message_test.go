@@ -0,0 +1,68 @@
+package rdtp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// oneByteConn reads at most one byte at a time, as a
+// byte stream split across many packets would be read
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c oneByteConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func TestMessageConn(t *testing.T) {
+	local, remote := net.Pipe()
+	sender := NewMessageConn(local, 0)
+	receiver := NewMessageConn(oneByteConn{remote}, 0)
+
+	msgs := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte("a longer message "), 500),
+	}
+
+	go func() {
+		for _, msg := range msgs {
+			assert.Nil(t, sender.WriteMessage(msg))
+		}
+		sender.Close()
+	}()
+
+	for _, msg := range msgs {
+		got, err := receiver.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, msg, got)
+	}
+
+	_, err := receiver.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMessageConnMaxMessageBytes(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	sender := NewMessageConn(local, 10)
+	err := sender.WriteMessage(make([]byte, 11))
+	assert.Equal(t, ErrMessageTooLarge, errors.Cause(err))
+
+	// the receiver's maximum is enforced on the length prefix,
+	// regardless of what the sender is willing to send
+	go NewMessageConn(local, 100).WriteMessage(make([]byte, 11))
+
+	_, err = NewMessageConn(remote, 10).ReadMessage()
+	assert.Equal(t, ErrMessageTooLarge, errors.Cause(err))
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// coalescer packs the serialized rdtp packets sent to the same destination
+// while a datagram is being sent onto (as few as possible) datagrams of at
+// most maxBytes, so that bursts of small packets take fewer datagrams. The
+// packets coalesced are simply concatenated, as their headers carry their
+// length (see packet.DeserializeAll). Packets are never held back waiting
+// for others to coalesce with: a packet sent while no datagram is being
+// sent goes out right away, on its own
+type coalescer struct {
+	sync.Mutex
+
+	maxBytes int
+	send     func(dst net.IP, datagram []byte) error
+
+	sending bool                 // set while a datagram is being sent
+	pending []*coalescedDatagram // queued while sending, in order
+}
+
+type coalescedDatagram struct {
+	dst net.IP
+	buf []byte
+}
+
+func newCoalescer(maxBytes int, send func(dst net.IP, datagram []byte) error) *coalescer {
+	return &coalescer{maxBytes: maxBytes, send: send}
+}
+
+// Send sends a serialized packet to the destination IP address, or
+// queues it to be coalesced with others while a datagram is being sent.
+// The errors sending queued packets are logged rather than returned
+func (c *coalescer) Send(dst net.IP, pck []byte) error {
+	c.Lock()
+	if c.sending {
+		c.queue(dst, pck)
+		c.Unlock()
+		return nil
+	}
+	c.sending = true
+	c.Unlock()
+
+	err := c.send(dst, pck)
+	c.flush()
+	return err
+}
+
+// queue appends a packet to the last datagram queued for its destination
+// if it fits, or onto a new datagram otherwise, which keeps the packets
+// to each destination in order. It must be called with the coalescer locked
+func (c *coalescer) queue(dst net.IP, pck []byte) {
+	for i := len(c.pending) - 1; i >= 0; i-- {
+		if d := c.pending[i]; d.dst.Equal(dst) {
+			if len(d.buf)+len(pck) <= c.maxBytes {
+				d.buf = append(d.buf, pck...)
+				return
+			}
+			break
+		}
+	}
+	c.pending = append(c.pending, &coalescedDatagram{
+		dst: dst,
+		buf: append(make([]byte, 0, c.maxBytes), pck...),
+	})
+}
+
+// flush sends the datagrams queued until none are left
+func (c *coalescer) flush() {
+	for {
+		c.Lock()
+		pending := c.pending
+		c.pending = nil
+		if len(pending) == 0 {
+			c.sending = false
+			c.Unlock()
+			return
+		}
+		c.Unlock()
+
+		for _, d := range pending {
+			if err := c.send(d.dst, d.buf); err != nil {
+				log.Println(errors.Wrap(err, "could not send coalesced datagram"))
+			}
+		}
+	}
+}
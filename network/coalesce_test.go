@@ -0,0 +1,76 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+type sentDatagram struct {
+	dst string
+	buf []byte
+}
+
+func TestCoalescer(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		sent    []sentDatagram
+		release = make(chan struct{})
+	)
+	c := newCoalescer(100, func(dst net.IP, datagram []byte) error {
+		lock.Lock()
+		first := len(sent) == 0
+		sent = append(sent, sentDatagram{dst.String(), datagram})
+		lock.Unlock()
+		if first {
+			<-release // packets sent meanwhile are coalesced
+		}
+		return nil
+	})
+
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	first := make(chan error, 1)
+	go func() { first <- c.Send(a, mockPacket("10.0.0.0", "10.0.0.1", []byte("first")).Serialize()) }()
+	for sending := false; !sending; {
+		c.Lock()
+		sending = c.sending
+		c.Unlock()
+	}
+
+	var payloads [][]byte
+	for _, payload := range []string{"one", "two", "three", "four"} {
+		payloads = append(payloads, []byte(payload))
+		assert.Nil(t, c.Send(a, mockPacket("10.0.0.0", "10.0.0.1", []byte(payload)).Serialize()))
+	}
+	assert.Nil(t, c.Send(b, mockPacket("10.0.0.0", "10.0.0.2", []byte("other")).Serialize()))
+	// does not fit in the datagram of the packets queued for the host
+	big := make([]byte, 50)
+	assert.Nil(t, c.Send(a, mockPacket("10.0.0.0", "10.0.0.1", big).Serialize()))
+
+	close(release)
+	assert.Nil(t, <-first)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 4, len(sent))
+
+	// the packets queued for a host round trip through a single datagram
+	assert.Equal(t, "10.0.0.1", sent[1].dst)
+	assert.True(t, len(sent[1].buf) <= 100)
+	pcks, err := packet.DeserializeAll(sent[1].buf)
+	assert.Nil(t, err)
+	assert.Equal(t, len(payloads), len(pcks))
+	for i, p := range pcks {
+		assert.Equal(t, payloads[i], p.Payload)
+	}
+
+	assert.Equal(t, "10.0.0.2", sent[2].dst)
+	assert.Equal(t, "10.0.0.1", sent[3].dst)
+	pcks, err = packet.DeserializeAll(sent[3].buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pcks))
+	assert.Equal(t, big, pcks[0].Payload)
+}
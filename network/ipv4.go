@@ -3,7 +3,9 @@ package network
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/adrianosela/rdtp"
@@ -18,17 +20,116 @@ import (
 // interface
 type IPv4 struct {
 	sckfd int
+
+	// the raw socket, non-blocking so that closing it unblocks reads
+	file *os.File
+	conn syscall.RawConn
+
+	closed    int32 // atomic, set by Close
+	receiving int32 // atomic, the number of receiver goroutines running
+	readers   int32 // atomic, receiver goroutines to run (see SetReaders)
+
+	coalescer atomic.Value // *coalescer, nil unless coalescing packets
 }
 
+const (
+	// size of an IPv4 header (without options)
+	ipv4HeaderBytes = 20
+
+	// minimum MTU every IPv4 host must accept (RFC 791)
+	minIPv4MTU = 68
+)
+
 // NewIPv4 returns a new ipv4 network interface
 func NewIPv4() (*IPv4, error) {
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, rdtp.IPProtoRDTP)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get raw network socket")
 	}
-	return &IPv4{
-		sckfd: fd,
-	}, nil
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "could not set raw network socket non-blocking")
+	}
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "could not get raw network socket's connection")
+	}
+	ip := &IPv4{
+		sckfd:   fd,
+		file:    file,
+		conn:    conn,
+		readers: 1,
+	}
+	ip.coalescer.Store((*coalescer)(nil))
+	return ip, nil
+}
+
+// Healthy returns true while the network socket is open and packets
+// received are being forwarded (see StartReceiver). It never blocks
+func (ip *IPv4) Healthy() bool {
+	return atomic.LoadInt32(&ip.closed) == 0 && atomic.LoadInt32(&ip.receiving) > 0
+}
+
+// Close closes the network socket, which stops the receiver
+func (ip *IPv4) Close() error {
+	if !atomic.CompareAndSwapInt32(&ip.closed, 0, 1) {
+		return nil
+	}
+	if err := ip.file.Close(); err != nil {
+		return errors.Wrap(err, "could not close network socket")
+	}
+	return nil
+}
+
+// SetTrafficClass sets the IP DSCP/ToS byte on all outgoing packets.
+// Packets are sent best-effort (traffic class 0) unless this is set.
+// This is a no-op on platforms which do not support the IP_TOS option
+func (ip *IPv4) SetTrafficClass(tc int) error {
+	if tc < 0 || tc > 0xff {
+		return fmt.Errorf("invalid traffic class %d, must be in range [0, 255]", tc)
+	}
+	err := syscall.SetsockoptInt(ip.sckfd, syscall.IPPROTO_IP, syscall.IP_TOS, tc)
+	if err != nil && err != syscall.ENOPROTOOPT {
+		return errors.Wrap(err, "could not set traffic class on network socket")
+	}
+	return nil
+}
+
+// SetCoalescing sets whether packets sent to the same destination while
+// a datagram is being sent are coalesced onto a single datagram, of at
+// most the given path MTU (incl. the IP header). This saves datagrams
+// (and their overhead) for bursts of small packets, e.g. of chatty or
+// many connections. Packets are sent on their own datagrams, as they
+// are by default, when the MTU is 0. The receiving hosts must
+// decode coalesced packets, as this network always does
+func (ip *IPv4) SetCoalescing(mtu int) error {
+	if mtu == 0 {
+		ip.coalescer.Store((*coalescer)(nil))
+		return nil
+	}
+	if mtu < minIPv4MTU || mtu > 65535 {
+		return fmt.Errorf("invalid MTU %d, must be in range [%d, 65535]", mtu, minIPv4MTU)
+	}
+	ip.coalescer.Store(newCoalescer(mtu-ipv4HeaderBytes, ip.sendDatagram))
+	return nil
+}
+
+// SetReaders sets the number of goroutines the receiver (see StartReceiver)
+// reads, decodes and forwards packets with, one by default. Reads off the
+// network socket are serialized, but decoding and forwarding are not,
+// which scales receiving at high packet rates on multicore hosts. The
+// function packets are forwarded to is then called concurrently, and the
+// packets of a connection may be forwarded out of order, which its socket
+// handles as it does any reordering by the network. It takes effect once
+// the receiver is started
+func (ip *IPv4) SetReaders(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid number of readers %d, must be at least 1", n)
+	}
+	atomic.StoreInt32(&ip.readers, int32(n))
+	return nil
 }
 
 // Send sends a packet to the destination IP address
@@ -37,11 +138,28 @@ func (ip *IPv4) Send(pck *packet.Packet) error {
 	if err != nil {
 		return errors.Wrap(err, "could not determine destination IP addresss")
 	}
+	if c := ip.coalescer.Load().(*coalescer); c != nil {
+		return c.Send(dstIP, pck.Serialize())
+	}
+	return ip.sendDatagram(dstIP, pck.Serialize())
+}
 
+// sendDatagram sends the (serialized, possibly coalesced) rdtp
+// packets in an IP datagram to the destination IP address
+func (ip *IPv4) sendDatagram(dstIP net.IP, buf []byte) error {
 	var remote syscall.SockaddrInet4
 	copy(remote.Addr[:], dstIP.To4())
 
-	if err := syscall.Sendto(ip.sckfd, pck.Serialize(), 0, &remote); err != nil {
+	// blocks (as on a blocking socket) while the send buffer is full
+	var sendErr error
+	err := ip.conn.Write(func(fd uintptr) bool {
+		sendErr = syscall.Sendto(int(fd), buf, 0, &remote)
+		return sendErr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err != nil {
 		return errors.Wrap(err, "could not send data to network socket")
 	}
 	return nil
@@ -49,48 +167,62 @@ func (ip *IPv4) Send(pck *packet.Packet) error {
 
 // StartReceiver forwards all ipv4 packets received which carry rdtp
 // These ipv4 packets are processed until an rdtp packet.Packet
-// is extracted, then the next() function is called with the packet
+// is extracted, then the next() function is called with the packet,
+// until the network socket is closed
 func (ip *IPv4) StartReceiver(forward func(*packet.Packet) error) {
-	buf := make([]byte, 65535) // maximum IP packet
+	readers := atomic.LoadInt32(&ip.readers)
+
+	atomic.AddInt32(&ip.receiving, readers)
+	for i := int32(0); i < readers; i++ {
+		go func() {
+			defer atomic.AddInt32(&ip.receiving, -1)
+			ip.receive(forward)
+		}()
+	}
+}
 
-	go func() {
-		rdtpFile := os.NewFile(uintptr(ip.sckfd), fmt.Sprintf("fd %d", ip.sckfd))
-		defer rdtpFile.Close()
+// receive reads datagrams off the network socket and forwards the rdtp
+// packets they carry, until the network socket is closed
+func (ip *IPv4) receive(forward func(*packet.Packet) error) {
+	buf := make([]byte, 65535) // maximum IP packet
 
-		for {
-			ipDatagramSize, err := rdtpFile.Read(buf)
-			if err != nil {
-				log.Println(errors.Wrap(err, "could not read data from network socket"))
-				continue
+	for {
+		ipDatagramSize, err := ip.file.Read(buf)
+		if err != nil {
+			if atomic.LoadInt32(&ip.closed) == 1 {
+				return
 			}
+			log.Println(errors.Wrap(err, "could not read data from network socket"))
+			continue
+		}
 
-			// decode ipv4
-			networkPck := gopacket.NewPacket(
-				buf[:ipDatagramSize],
-				layers.LayerTypeIPv4,
-				gopacket.Default)
-			ipv4NetworkData := networkPck.Layer(layers.LayerTypeIPv4)
+		// decode ipv4
+		networkPck := gopacket.NewPacket(
+			buf[:ipDatagramSize],
+			layers.LayerTypeIPv4,
+			gopacket.Default)
+		ipv4NetworkData := networkPck.Layer(layers.LayerTypeIPv4)
 
-			if ipv4NetworkData == nil {
-				log.Println("not an ipv4 packet")
-				continue
-			}
+		if ipv4NetworkData == nil {
+			log.Println("not an ipv4 packet")
+			continue
+		}
 
-			ipv4 := ipv4NetworkData.(*layers.IPv4)
+		ipv4 := ipv4NetworkData.(*layers.IPv4)
 
-			rdtpPacket, err := packet.Deserialize(ipv4.Payload)
-			if err != nil {
-				log.Println(errors.Wrap(err, "could not deserialize rdtp packet"))
-				continue
-			}
+		// the datagram may carry several (coalesced) packets
+		rdtpPackets, err := packet.DeserializeAll(ipv4.Payload)
+		if err != nil {
+			log.Println(errors.Wrap(err, "could not deserialize rdtp packet"))
+		}
 
+		for _, rdtpPacket := range rdtpPackets {
 			rdtpPacket.SetDestinationIPv4(ipv4.DstIP)
 			rdtpPacket.SetSourceIPv4(ipv4.SrcIP)
 
 			if err = forward(rdtpPacket); err != nil {
 				log.Println(errors.Wrap(err, "could not forward received rdtp packet"))
-				continue
 			}
 		}
-	}()
+	}
 }
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPv4Healthy(t *testing.T) {
+	ip, err := NewIPv4()
+	if err != nil {
+		t.Skipf("raw sockets not permitted: %s", err)
+	}
+
+	assert.False(t, ip.Healthy(), "no receiver running")
+	ip.StartReceiver(func(p *packet.Packet) error { return nil })
+	assert.True(t, ip.Healthy())
+	assert.Nil(t, ip.Send(mockPacket("127.0.0.1", "127.0.0.1", []byte("hello"))))
+
+	// closing the socket stops the receiver
+	assert.Nil(t, ip.Close())
+	assert.False(t, ip.Healthy())
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&ip.receiving) != 0; time.Sleep(time.Millisecond * 5) {
+		if time.Now().After(deadline) {
+			t.Fatal("receiver still running after the socket was closed")
+		}
+	}
+	assert.Nil(t, ip.Close())
+
+	assert.NotNil(t, ip.Send(mockPacket("127.0.0.1", "127.0.0.1", []byte("hello"))))
+}
+
+func TestIPv4SetCoalescing(t *testing.T) {
+	ip, err := NewIPv4()
+	if err != nil {
+		t.Skipf("raw sockets not permitted: %s", err)
+	}
+	defer ip.Close()
+
+	assert.NotNil(t, ip.SetCoalescing(minIPv4MTU-1))
+	assert.NotNil(t, ip.SetCoalescing(65536))
+	assert.Nil(t, ip.SetCoalescing(1500))
+	assert.NotNil(t, ip.coalescer.Load().(*coalescer))
+	assert.Nil(t, ip.Send(mockPacket("127.0.0.1", "127.0.0.1", []byte("hello"))))
+	assert.Nil(t, ip.SetCoalescing(0))
+	assert.Nil(t, ip.coalescer.Load().(*coalescer))
+}
+
+// mockPortPacket returns a packet over loopback from a port
+// no other test uses, to the given destination port
+func mockPortPacket(dstPort uint16, payload []byte) *packet.Packet {
+	p := mockPacket("127.0.0.1", "127.0.0.1", payload)
+	p.SrcPort, p.DstPort = 4242, dstPort
+	return p
+}
+
+func TestIPv4SetTrafficClass(t *testing.T) {
+	ip, err := NewIPv4()
+	if err != nil {
+		t.Skipf("raw sockets not permitted: %s", err)
+	}
+	defer ip.Close()
+
+	assert.NotNil(t, ip.SetTrafficClass(-1))
+	assert.NotNil(t, ip.SetTrafficClass(0x100))
+
+	// set on the socket, for every packet sent from then on
+	assert.Nil(t, ip.SetTrafficClass(0xb8)) // DSCP EF
+	tos, err := syscall.GetsockoptInt(ip.sckfd, syscall.IPPROTO_IP, syscall.IP_TOS)
+	assert.Nil(t, err)
+	assert.Equal(t, 0xb8, tos)
+}
+
+func TestIPv4SetReaders(t *testing.T) {
+	ip, err := NewIPv4()
+	if err != nil {
+		t.Skipf("raw sockets not permitted: %s", err)
+	}
+	defer ip.Close()
+
+	assert.NotNil(t, ip.SetReaders(0))
+	assert.Nil(t, ip.SetReaders(4))
+
+	// packets are demultiplexed by destination port, concurrently
+	var mu sync.Mutex
+	received, n := make(map[uint16]map[string]bool), 0
+	all := make(chan struct{})
+	ports, perPort := []uint16{1001, 1002, 1003, 1004}, 50
+	ip.StartReceiver(func(p *packet.Packet) error {
+		if p.SrcPort != 4242 {
+			return nil // not sent by this test
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if received[p.DstPort] == nil {
+			received[p.DstPort] = make(map[string]bool)
+		}
+		if !received[p.DstPort][string(p.Payload)] {
+			received[p.DstPort][string(p.Payload)] = true
+			if n++; n == len(ports)*perPort {
+				close(all)
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, int32(4), atomic.LoadInt32(&ip.receiving))
+
+	for i := 0; i < perPort; i++ {
+		for _, port := range ports {
+			assert.Nil(t, ip.Send(mockPortPacket(port, []byte(fmt.Sprintf("%d to %d", i, port)))))
+		}
+	}
+	select {
+	case <-all:
+	case <-time.After(time.Second * 5):
+		t.Fatal("packets not received")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, port := range ports {
+		assert.Equal(t, perPort, len(received[port]))
+		for i := 0; i < perPort; i++ {
+			assert.True(t, received[port][fmt.Sprintf("%d to %d", i, port)], "packet %d to port %d missing", i, port)
+		}
+	}
+}
+
+func BenchmarkIPv4Receive(b *testing.B) {
+	for _, readers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			ip, err := NewIPv4()
+			if err != nil {
+				b.Skipf("raw sockets not permitted: %s", err)
+			}
+			defer ip.Close()
+			assert.Nil(b, ip.SetReaders(readers))
+
+			// at most a window of packets is in flight, so that the
+			// socket's receive buffer does not overflow
+			window := make(chan struct{}, 256)
+			ip.StartReceiver(func(p *packet.Packet) error {
+				if p.SrcPort == 4242 {
+					<-window
+				}
+				return nil
+			})
+
+			pck := mockPortPacket(1001, make([]byte, 64))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				select {
+				case window <- struct{}{}:
+				case <-time.After(time.Second):
+					<-window // presumed lost
+					window <- struct{}{}
+				}
+				if err := ip.Send(pck); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for deadline := time.Now().Add(time.Second); len(window) > 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+// packets queued for a loopback host before further packets are dropped
+const loopbackQueueSize = 1024
+
+// Loopback is an in-memory network which routes packets between the hosts
+// attached to it by their destination IP address, after an (optional)
+// latency and dropping an (optional) fraction of them. It is meant for
+// testing sockets end to end and for local IPC, without a real network
+type Loopback struct {
+	sync.RWMutex
+
+	latency  time.Duration
+	lossRate float64
+	rand     *rand.Rand
+
+	hosts map[string]*LoopbackHost // by IP address
+	done  chan struct{}
+	once  sync.Once
+}
+
+// LoopbackHost is a host's interface to a Loopback network
+type LoopbackHost struct {
+	lo    *Loopback
+	ip    string
+	queue chan *packet.Packet
+
+	receiving int32 // atomic, set while the receiver is running
+}
+
+var _ Network = (*LoopbackHost)(nil)
+
+// NewLoopback returns a loopback network which delivers packets after the
+// given latency and drops the given fraction of them (between 0 and 1).
+// Packets are dropped pseudo-randomly, but always in the same pattern for
+// the same sequence of packets sent
+func NewLoopback(latency time.Duration, lossRate float64) (*Loopback, error) {
+	lo := &Loopback{
+		rand:  rand.New(rand.NewSource(1)),
+		hosts: make(map[string]*LoopbackHost),
+		done:  make(chan struct{}),
+	}
+	lo.SetLatency(latency)
+	if err := lo.SetLossRate(lossRate); err != nil {
+		return nil, err
+	}
+	return lo, nil
+}
+
+// SetLatency sets the time packets take to be delivered
+func (lo *Loopback) SetLatency(latency time.Duration) {
+	lo.Lock()
+	defer lo.Unlock()
+
+	lo.latency = latency
+}
+
+// SetLossRate sets the fraction of packets (between 0 and 1) dropped
+func (lo *Loopback) SetLossRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("invalid loss rate %f, must be in range [0, 1]", rate)
+	}
+
+	lo.Lock()
+	defer lo.Unlock()
+
+	lo.lossRate = rate
+	return nil
+}
+
+// Host attaches a host with the given IP address to the network (if
+// not already attached) and returns its interface to the network
+func (lo *Loopback) Host(ip string) *LoopbackHost {
+	lo.Lock()
+	defer lo.Unlock()
+
+	if h, ok := lo.hosts[ip]; ok {
+		return h
+	}
+	h := &LoopbackHost{
+		lo:    lo,
+		ip:    ip,
+		queue: make(chan *packet.Packet, loopbackQueueSize),
+	}
+	lo.hosts[ip] = h
+	return h
+}
+
+// Close stops delivering packets to all hosts
+func (lo *Loopback) Close() {
+	lo.once.Do(func() { close(lo.done) })
+}
+
+// Send sends a packet to the host with the packet's destination IP address.
+// As on a real network, packets to unknown hosts are silently dropped
+func (h *LoopbackHost) Send(p *packet.Packet) error {
+	dstIP, err := p.GetDestinationIPv4()
+	if err != nil {
+		return errors.Wrap(err, "could not determine destination IP addresss")
+	}
+
+	h.lo.Lock()
+	dst, ok := h.lo.hosts[dstIP.String()]
+	lost := h.lo.lossRate > 0 && h.lo.rand.Float64() < h.lo.lossRate
+	latency := h.lo.latency
+	h.lo.Unlock()
+
+	if !ok || lost {
+		return nil
+	}
+
+	// the receiver gets its own copy, as it would off the wire
+	cp, err := packet.Unmarshal(p.Serialize())
+	if err != nil {
+		return errors.Wrap(err, "could not copy packet")
+	}
+	if srcIP, err := p.GetSourceIPv4(); err == nil {
+		cp.SetSourceIPv4(srcIP)
+	}
+	cp.SetDestinationIPv4(dstIP)
+
+	if latency <= 0 {
+		dst.enqueue(cp)
+	} else {
+		time.AfterFunc(latency, func() { dst.enqueue(cp) })
+	}
+	return nil
+}
+
+// StartReceiver forwards all packets sent to the host, in the order
+// they arrive, until the loopback network is closed
+func (h *LoopbackHost) StartReceiver(forward func(*packet.Packet) error) {
+	atomic.StoreInt32(&h.receiving, 1)
+	go func() {
+		defer atomic.StoreInt32(&h.receiving, 0)
+
+		for {
+			select {
+			case p := <-h.queue:
+				if err := forward(p); err != nil {
+					log.Println(errors.Wrap(err, "could not forward received rdtp packet"))
+				}
+			case <-h.lo.done:
+				return
+			}
+		}
+	}()
+}
+
+// Healthy returns true while the loopback network is open and packets
+// sent to the host are being forwarded (see StartReceiver). It never blocks
+func (h *LoopbackHost) Healthy() bool {
+	select {
+	case <-h.lo.done:
+		return false
+	default:
+		return atomic.LoadInt32(&h.receiving) == 1
+	}
+}
+
+// enqueue queues a packet for the receiver, dropping it if the queue is full
+func (h *LoopbackHost) enqueue(p *packet.Packet) {
+	select {
+	case <-h.lo.done:
+	case h.queue <- p:
+	default:
+	}
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockPacket(src, dst string, payload []byte) *packet.Packet {
+	p, _ := packet.NewPacket(1234, 5678, payload)
+	p.SetSourceIPv4(net.ParseIP(src))
+	p.SetDestinationIPv4(net.ParseIP(dst))
+	return p
+}
+
+func TestLoopback(t *testing.T) {
+	latency := time.Millisecond * 20
+
+	lo, err := NewLoopback(latency, 0)
+	assert.Nil(t, err)
+	defer lo.Close()
+
+	received := make(chan *packet.Packet, 1)
+	lo.Host("10.0.0.2").StartReceiver(func(p *packet.Packet) error {
+		received <- p
+		return nil
+	})
+
+	sent := mockPacket("10.0.0.1", "10.0.0.2", []byte("hello"))
+	start := time.Now()
+	assert.Nil(t, lo.Host("10.0.0.1").Send(sent))
+
+	select {
+	case p := <-received:
+		assert.True(t, time.Since(start) >= latency)
+		assert.Equal(t, []byte("hello"), p.Payload)
+		src, _ := p.GetSourceIPv4()
+		assert.Equal(t, "10.0.0.1", src.String())
+
+		// the receiver gets a copy of the packet sent
+		sent.Payload[0] = 'j'
+		assert.Equal(t, []byte("hello"), p.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("packet not delivered")
+	}
+
+	// packets to unknown hosts are dropped
+	assert.Nil(t, lo.Host("10.0.0.1").Send(mockPacket("10.0.0.1", "10.0.0.3", nil)))
+}
+
+func TestLoopbackLossRate(t *testing.T) {
+	_, err := NewLoopback(0, 1.5)
+	assert.NotNil(t, err)
+
+	lo, err := NewLoopback(0, 0.25)
+	assert.Nil(t, err)
+	defer lo.Close()
+
+	host := lo.Host("10.0.0.2")
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, lo.Host("10.0.0.1").Send(mockPacket("10.0.0.1", "10.0.0.2", nil)))
+	}
+
+	// not yet received, all delivered packets are still queued
+	delivered := len(host.queue)
+	assert.True(t, delivered > 650 && delivered < 850, "%d of 1000 packets delivered", delivered)
+}
+
+func TestLoopbackHealthy(t *testing.T) {
+	lo, err := NewLoopback(0, 0)
+	assert.Nil(t, err)
+
+	h := lo.Host("10.0.0.1")
+	assert.False(t, h.Healthy(), "no receiver running")
+	h.StartReceiver(func(p *packet.Packet) error { return nil })
+	assert.True(t, h.Healthy())
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() { h.Healthy() }))
+
+	lo.Close()
+	assert.False(t, h.Healthy())
+}
@@ -4,8 +4,39 @@ import (
 	"github.com/adrianosela/rdtp/packet"
 )
 
-// Network represents an unreliable channel for sending and receiving rdtp packets
+// Network represents an unreliable channel for sending and receiving rdtp packets.
+// Sockets only depend on this interface, so that any network layer (or a fake
+// one, in tests) can be injected. Packets carry their destination IP address,
+// so Send needs nothing other than the packet. Send either sends the whole
+// packet or returns an error (e.g. on a short write): the packet is then
+// sent again whole once found lost, unless the error is permanent (see
+// atc.IsPermanent)
 type Network interface {
 	Send(p *packet.Packet) error
 	StartReceiver(fn func(p *packet.Packet) error)
 }
+
+// HealthChecker is implemented by networks which can tell whether they
+// still send and receive packets, e.g. for health checks by load balancers
+// or orchestration to detect a wedged transport. Unlike a ping, this says
+// nothing about any connection
+type HealthChecker interface {
+	Healthy() bool
+}
+
+// TrafficClassSetter is implemented by networks which can mark the packets
+// they send with an IP traffic class (the DSCP/ToS byte), e.g. to have
+// them prioritized by routers which honour it
+type TrafficClassSetter interface {
+	SetTrafficClass(tc int) error
+}
+
+var _ Network = (*IPv4)(nil)
+
+var _ TrafficClassSetter = (*IPv4)(nil)
+
+var (
+	_ HealthChecker = (*IPv4)(nil)
+	_ HealthChecker = (*LoopbackHost)(nil)
+	_ HealthChecker = (*Scheduler)(nil)
+)
@@ -0,0 +1,231 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+// packets queued per flow by a scheduler before further packets are dropped
+const schedulerQueueSize = 256
+
+// Flow identifies the packets of a connection sent through a Scheduler
+type Flow struct {
+	LocalPort  uint16
+	RemoteIP   string
+	RemotePort uint16
+}
+
+// flowQueue is the queue of packets of a flow waiting to be sent
+type flowQueue struct {
+	flow    Flow
+	packets []*packet.Packet
+	deficit int // bytes the flow may still send on its turn
+}
+
+// Scheduler is a network which sends the packets of the connections sharing
+// another network at a limited rate (e.g. that of a constrained link), and
+// shares that rate fairly between them rather than in the order packets are
+// sent. Packets are queued per connection (see Flow) and sent in (deficit)
+// round robin, so that each connection with packets queued gets a share of
+// the rate in proportion to its weight (see SetWeight). Packets are dropped
+// while a connection's queue is full, as by a router's, and re-sent by the
+// connection once found lost
+type Scheduler struct {
+	sync.Mutex
+
+	network Network
+	rate    float64 // bytes per second
+
+	weights map[Flow]int
+	queues  map[Flow]*flowQueue
+	active  []*flowQueue // flows with packets queued, in round robin order
+	visited bool         // set once the first active flow's turn started
+
+	dropped uint64 // atomic, packets dropped due to a full queue
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+var _ Network = (*Scheduler)(nil)
+
+// NewScheduler returns a scheduler sending packets through the given network
+// at the given rate (in bytes per second, incl. headers)
+func NewScheduler(nw Network, rate float64) (*Scheduler, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid rate %f, must be positive", rate)
+	}
+	s := &Scheduler{
+		network: nw,
+		rate:    rate,
+		weights: make(map[Flow]int),
+		queues:  make(map[Flow]*flowQueue),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// SetWeight sets the weight of a connection's share of the rate, relative to
+// that of other connections, e.g. 2 for twice the rate of a connection of
+// weight 1 (the default, which a weight of zero restores)
+func (s *Scheduler) SetWeight(f Flow, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d, must not be negative", weight)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if weight == 0 {
+		delete(s.weights, f)
+	} else {
+		s.weights[f] = weight
+	}
+	return nil
+}
+
+// Send queues a packet to be sent on its connection's turn. It never blocks
+func (s *Scheduler) Send(p *packet.Packet) error {
+	dstIP, err := p.GetDestinationIPv4()
+	if err != nil {
+		return errors.Wrap(err, "could not determine destination IP addresss")
+	}
+	f := Flow{LocalPort: p.SrcPort, RemoteIP: dstIP.String(), RemotePort: p.DstPort}
+
+	s.Lock()
+	q, ok := s.queues[f]
+	if !ok {
+		q = &flowQueue{flow: f}
+		s.queues[f] = q
+		s.active = append(s.active, q)
+	}
+	if len(q.packets) >= schedulerQueueSize {
+		s.Unlock()
+		atomic.AddUint64(&s.dropped, 1)
+		return nil
+	}
+	q.packets = append(q.packets, p)
+	s.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// StartReceiver starts the receiver of the network packets are sent through
+func (s *Scheduler) StartReceiver(forward func(*packet.Packet) error) {
+	s.network.StartReceiver(forward)
+}
+
+// Healthy returns true until the scheduler is closed, while
+// the network packets are sent through is (if it can tell)
+func (s *Scheduler) Healthy() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	if hc, ok := s.network.(HealthChecker); ok {
+		return hc.Healthy()
+	}
+	return true
+}
+
+// Dropped returns the number of packets dropped due to a full queue
+func (s *Scheduler) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops sending packets, discarding those queued. It does
+// not close the network packets are sent through
+func (s *Scheduler) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// run sends the packets queued at the scheduler's rate until closed. Each
+// packet reserves the time its bytes take at the rate, after the previous
+// reservation, and no credit is accumulated while idle
+func (s *Scheduler) run() {
+	var next time.Time
+	for {
+		p, ok := s.next()
+		if !ok {
+			return
+		}
+		if now := time.Now(); next.Before(now) {
+			next = now
+		} else if wait := next.Sub(now); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-s.done:
+				return
+			}
+		}
+		next = next.Add(time.Duration(float64(packet.HeaderByteSize+len(p.Payload)) / s.rate * float64(time.Second)))
+
+		if err := s.network.Send(p); err != nil {
+			log.Println(errors.Wrap(err, "could not send scheduled packet"))
+		}
+	}
+}
+
+// next waits for a packet to be queued and returns the next one to send,
+// in deficit round robin: on its turn, each flow may send up to its weight
+// in full-size packets worth of bytes (plus what it did not use of its
+// previous turn, while it has packets queued). Returns false once closed
+func (s *Scheduler) next() (*packet.Packet, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for len(s.active) == 0 {
+		s.Unlock()
+		select {
+		case <-s.wake:
+		case <-s.done:
+			s.Lock()
+			return nil, false
+		}
+		s.Lock()
+	}
+
+	for {
+		q := s.active[0]
+		if !s.visited {
+			q.deficit += s.weight(q.flow) * packet.MaxPacketBytes
+			s.visited = true
+		}
+		p := q.packets[0]
+		if size := packet.HeaderByteSize + len(p.Payload); size <= q.deficit {
+			q.deficit -= size
+			q.packets = q.packets[1:]
+			if len(q.packets) == 0 {
+				s.active = s.active[1:]
+				s.visited = false
+				delete(s.queues, q.flow)
+			}
+			return p, true
+		}
+		// the flow's turn is over
+		s.active = append(s.active[1:], q)
+		s.visited = false
+	}
+}
+
+// weight returns the weight of a flow. It must be called with the scheduler locked
+func (s *Scheduler) weight(f Flow) int {
+	if weight, ok := s.weights[f]; ok {
+		return weight
+	}
+	return 1
+}
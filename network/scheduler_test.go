@@ -0,0 +1,121 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingNetwork records the source ports of the packets sent through it
+type recordingNetwork struct {
+	sync.Mutex
+	ports []uint16
+}
+
+func (n *recordingNetwork) Send(p *packet.Packet) error {
+	n.Lock()
+	defer n.Unlock()
+	n.ports = append(n.ports, p.SrcPort)
+	return nil
+}
+
+func (n *recordingNetwork) StartReceiver(fn func(p *packet.Packet) error) {}
+
+func (n *recordingNetwork) sent() []uint16 {
+	n.Lock()
+	defer n.Unlock()
+	return append([]uint16(nil), n.ports...)
+}
+
+func mockScheduledPacket(t *testing.T, port uint16, size int) *packet.Packet {
+	p, err := packet.NewPacket(port, 2000, make([]byte, size-packet.HeaderByteSize))
+	assert.Nil(t, err)
+	p.SetDestinationIPv4(net.ParseIP("10.0.0.2"))
+	return p
+}
+
+func TestScheduler(t *testing.T) {
+	nw := &recordingNetwork{}
+	s, err := NewScheduler(nw, 1000*1000) // a full packet every 1.5ms
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// a connection of weight 3 gets thrice the rate of one of weight
+	// 1 while both have packets queued, regardless of the order (nor
+	// the number) of packets sent by each
+	heavy := Flow{LocalPort: 1001, RemoteIP: "10.0.0.2", RemotePort: 2000}
+	assert.Nil(t, s.SetWeight(heavy, 3))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, s.Send(mockScheduledPacket(t, 1000, packet.MaxPacketBytes)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, s.Send(mockScheduledPacket(t, 1001, packet.MaxPacketBytes)))
+	}
+
+	assert.Eventually(t, func() bool { return len(nw.sent()) >= 81 }, time.Second*2, time.Millisecond)
+	counts := make(map[uint16]int)
+	for _, port := range nw.sent()[:81] {
+		counts[port]++
+	}
+	// the first packet could be sent before the other flow's was queued
+	assert.InDelta(t, 20, counts[1000], 1)
+	assert.InDelta(t, 60, counts[1001], 1)
+	assert.Equal(t, uint64(0), s.Dropped())
+}
+
+func TestSchedulerSmallPackets(t *testing.T) {
+	nw := &recordingNetwork{}
+	s, err := NewScheduler(nw, 1000*1000)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// shares are of bytes rather than packets: a connection sending
+	// packets half the size sends twice as many of them
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, s.Send(mockScheduledPacket(t, 1000, packet.MaxPacketBytes)))
+		assert.Nil(t, s.Send(mockScheduledPacket(t, 1001, packet.MaxPacketBytes/2)))
+	}
+	assert.Eventually(t, func() bool { return len(nw.sent()) >= 60 }, time.Second*2, time.Millisecond)
+	counts := make(map[uint16]int)
+	for _, port := range nw.sent()[:60] {
+		counts[port]++
+	}
+	assert.InDelta(t, 20, counts[1000], 1)
+	assert.InDelta(t, 40, counts[1001], 1)
+}
+
+func TestSchedulerQueueFull(t *testing.T) {
+	nw := &recordingNetwork{}
+	s, err := NewScheduler(nw, 1) // nothing is sent past the first packet
+	assert.Nil(t, err)
+	defer s.Close()
+
+	for i := 0; i < schedulerQueueSize+10; i++ {
+		assert.Nil(t, s.Send(mockScheduledPacket(t, 1000, packet.HeaderByteSize)))
+	}
+	// other connections queue packets of their own
+	assert.Nil(t, s.Send(mockScheduledPacket(t, 1001, packet.HeaderByteSize)))
+	assert.InDelta(t, 10, s.Dropped(), 1, "the first packet may be sent before the queue fills")
+
+	p, _ := packet.NewPacket(1000, 2000, nil)
+	assert.NotNil(t, s.Send(p), "no destination address")
+}
+
+func TestSchedulerValidation(t *testing.T) {
+	_, err := NewScheduler(&recordingNetwork{}, 0)
+	assert.NotNil(t, err)
+
+	s, err := NewScheduler(&recordingNetwork{}, 1000)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.SetWeight(Flow{}, -1))
+	assert.Nil(t, s.SetWeight(Flow{}, 0))
+
+	assert.True(t, s.Healthy())
+	s.Close()
+	s.Close()
+	assert.False(t, s.Healthy())
+}
@@ -0,0 +1,194 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+)
+
+// Direction is whether a captured packet was sent or received
+type Direction uint8
+
+// packet directions, from the point of view of the capturing host
+const (
+	Sent Direction = iota
+	Received
+)
+
+const (
+	// byte size of a record's length prefix
+	lengthBytes = 4
+
+	// byte size of the fields of a record before its packet: the
+	// timestamp, the record flags and the source and destination IPv4
+	recordHeaderBytes = 8 + 1 + net.IPv4len*2
+
+	// record flags
+	receivedMask  = 0x01 // the packet was received (sent otherwise)
+	truncatedMask = 0x02 // the packet's payload was left out
+)
+
+// ErrTruncated is the error returned when replaying a packet
+// captured without its payload (see NewWriter)
+var ErrTruncated = errors.New("packet captured without its payload (see NewWriter)")
+
+// Record is a captured packet
+type Record struct {
+	Time      time.Time
+	Direction Direction
+	Packet    *packet.Packet
+
+	// set when the packet's payload was left out of the capture, in
+	// which case the packet's Length still is that of the payload
+	Truncated bool
+}
+
+// Writer writes packets to a capture, safe for concurrent use
+type Writer struct {
+	sync.Mutex
+
+	w        io.Writer
+	payloads bool
+}
+
+// NewWriter returns a writer of packets to a capture on the given writer,
+// which leaves their payloads out unless payloads is set (the capture is
+// then lighter but cannot be replayed, see Replay)
+func NewWriter(w io.Writer, payloads bool) *Writer {
+	return &Writer{w: w, payloads: payloads}
+}
+
+// Write writes a single record (incl. its length prefix) to the capture.
+// The packet's source and destination IPv4 addresses (if set) are captured
+// along with it, so that it can be replayed through a network
+func (w *Writer) Write(r Record) error {
+	p := r.Packet
+
+	var flags byte
+	if r.Direction == Received {
+		flags |= receivedMask
+	}
+	pck := p.Serialize()
+	if !w.payloads && len(p.Payload) > 0 {
+		flags |= truncatedMask
+		pck = pck[:packet.HeaderByteSize]
+	}
+
+	b := make([]byte, lengthBytes+recordHeaderBytes, lengthBytes+recordHeaderBytes+len(pck))
+	binary.BigEndian.PutUint32(b[0:4], uint32(recordHeaderBytes+len(pck)))
+	binary.BigEndian.PutUint64(b[4:12], uint64(r.Time.UnixNano()))
+	b[12] = flags
+	if ip, err := p.GetSourceIPv4(); err == nil {
+		copy(b[13:17], ip.To4())
+	}
+	if ip, err := p.GetDestinationIPv4(); err == nil {
+		copy(b[17:21], ip.To4())
+	}
+	b = append(b, pck...)
+
+	w.Lock()
+	defer w.Unlock()
+
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Reader reads the packets of a capture, in the order they were written
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader returns a reader of the packets of a capture
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next returns the next record of the capture, or io.EOF at its end
+// (io.ErrUnexpectedEOF if it ends in the middle of a record)
+func (r *Reader) Next() (*Record, error) {
+	prefix := make([]byte, lengthBytes)
+	if _, err := io.ReadFull(r.r, prefix); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix)
+	if length < recordHeaderBytes+packet.HeaderByteSize || length > recordHeaderBytes+packet.MaxPacketBytes {
+		return nil, fmt.Errorf("invalid capture record length %d", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	rec := &Record{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(b[0:8]))),
+		Direction: Sent,
+		Truncated: b[8]&truncatedMask != 0,
+	}
+	if b[8]&receivedMask != 0 {
+		rec.Direction = Received
+	}
+
+	pck := b[recordHeaderBytes:]
+	var length16 uint16
+	if rec.Truncated {
+		// decoded as carrying no payload, then given its length back
+		length16 = binary.BigEndian.Uint16(pck[4:6])
+		binary.BigEndian.PutUint16(pck[4:6], 0)
+	}
+	p, err := packet.Deserialize(pck)
+	if err != nil {
+		return nil, fmt.Errorf("invalid captured packet: %s", err)
+	}
+	if rec.Truncated {
+		p.Length = length16
+	}
+	if ip := net.IP(b[9:13]); !ip.Equal(net.IPv4zero) {
+		p.SetSourceIPv4(ip)
+	}
+	if ip := net.IP(b[13:17]); !ip.Equal(net.IPv4zero) {
+		p.SetDestinationIPv4(ip)
+	}
+	rec.Packet = p
+	return rec, nil
+}
+
+// Replay sends the packets of a capture in the given direction with the
+// given function (e.g. a network's or the delivery to a socket), as spaced
+// out in time as when they were captured, to reproduce what happened to a
+// connection. It returns the first error sending a packet (or reading the
+// capture), and ErrTruncated on a packet captured without its payload
+func Replay(r io.Reader, dir Direction, send func(*packet.Packet) error) error {
+	rd := NewReader(r)
+	var last time.Time
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Direction != dir {
+			continue
+		}
+		if rec.Truncated {
+			return ErrTruncated
+		}
+		if !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+		if err := send(rec.Packet); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockPacket(t *testing.T, seq uint32, payload string) *packet.Packet {
+	p, err := packet.NewPacket(1234, 4321, []byte(payload))
+	assert.Nil(t, err)
+	p.SetSeqNo(seq)
+	p.SetFlagACK()
+	p.SetSourceIPv4(net.ParseIP("10.0.0.1"))
+	p.SetDestinationIPv4(net.ParseIP("10.0.0.2"))
+	p.SetSum()
+	return p
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, payloads := range []bool{true, false} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, payloads)
+
+		at := time.Unix(0, 1600000000123456789)
+		sent, ack := mockPacket(t, 100, "hello"), mockPacket(t, 200, "")
+		assert.Nil(t, w.Write(Record{Time: at, Direction: Sent, Packet: sent}))
+		assert.Nil(t, w.Write(Record{Time: at.Add(time.Millisecond), Direction: Received, Packet: ack}))
+
+		r := NewReader(&buf)
+		rec, err := r.Next()
+		assert.Nil(t, err)
+		assert.True(t, at.Equal(rec.Time))
+		assert.Equal(t, Sent, rec.Direction)
+		assert.Equal(t, !payloads, rec.Truncated)
+		assert.Equal(t, uint32(100), rec.Packet.SeqNo)
+		assert.Equal(t, uint16(5), rec.Packet.Length)
+		if payloads {
+			assert.Equal(t, []byte("hello"), rec.Packet.Payload)
+			assert.True(t, rec.Packet.CheckSum())
+		} else {
+			assert.Equal(t, 0, len(rec.Packet.Payload))
+		}
+		src, err := rec.Packet.GetSourceIPv4()
+		assert.Nil(t, err)
+		assert.True(t, src.Equal(net.ParseIP("10.0.0.1")))
+		dst, err := rec.Packet.GetDestinationIPv4()
+		assert.Nil(t, err)
+		assert.True(t, dst.Equal(net.ParseIP("10.0.0.2")))
+
+		// packets without payload are never truncated
+		rec, err = r.Next()
+		assert.Nil(t, err)
+		assert.True(t, at.Add(time.Millisecond).Equal(rec.Time))
+		assert.Equal(t, Received, rec.Direction)
+		assert.False(t, rec.Truncated)
+		assert.True(t, rec.Packet.IsACK())
+		assert.True(t, rec.Packet.CheckSum())
+
+		_, err = r.Next()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, NewWriter(&buf, true).Write(Record{Time: time.Now(), Packet: mockPacket(t, 1, "hello")}))
+	capture := buf.Bytes()
+
+	_, err := NewReader(bytes.NewReader(capture[:len(capture)-1])).Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewReader(bytes.NewReader([]byte{0, 0, 0, 1, 0})).Next()
+	assert.NotNil(t, err, "record too short for a packet")
+
+	// a packet shorter than its header's length
+	corrupt := append([]byte(nil), capture...)
+	corrupt[lengthBytes+recordHeaderBytes+5]++
+	_, err = NewReader(bytes.NewReader(corrupt)).Next()
+	assert.NotNil(t, err)
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, true)
+	at := time.Now()
+	for i, dir := range []Direction{Received, Sent, Received, Received} {
+		p := mockPacket(t, uint32(i), "data")
+		assert.Nil(t, w.Write(Record{Time: at.Add(time.Duration(i) * time.Millisecond * 20), Direction: dir, Packet: p}))
+	}
+
+	// only the packets in the direction replayed are sent,
+	// as spaced out as when they were captured
+	var seqs []uint32
+	start := time.Now()
+	assert.Nil(t, Replay(bytes.NewReader(buf.Bytes()), Received, func(p *packet.Packet) error {
+		assert.True(t, p.CheckSum())
+		seqs = append(seqs, p.SeqNo)
+		return nil
+	}))
+	assert.Equal(t, []uint32{0, 2, 3}, seqs)
+	assert.True(t, time.Since(start) >= time.Millisecond*60)
+
+	// packets captured without their payload cannot be replayed
+	buf.Reset()
+	assert.Nil(t, NewWriter(&buf, false).Write(Record{Time: at, Packet: mockPacket(t, 1, "data")}))
+	assert.Equal(t, ErrTruncated, Replay(&buf, Sent, func(p *packet.Packet) error { return nil }))
+}
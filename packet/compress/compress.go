@@ -0,0 +1,141 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+// FlateID identifies the DEFLATE format (see Flate) at handshake
+const FlateID = 1
+
+// Compressor compresses and decompresses packet payloads
+type Compressor interface {
+	// ID identifies the compression format at handshake: payloads are
+	// only compressed when both hosts offer compressors of the same ID
+	ID() uint8
+
+	Compress(payload []byte) ([]byte, error)
+	Decompress(payload []byte) ([]byte, error)
+}
+
+// Primer is a Compressor which may be primed with a preset dictionary
+type Primer interface {
+	Compressor
+
+	// Prime returns a compressor of the same format primed with a dictionary
+	Prime(dict []byte) (Compressor, error)
+}
+
+// Payload compresses a payload with the given compressor. The compressed
+// payload starts with the length of the original (2 bytes, see Restore),
+// and is only returned (along with true) if it is smaller than the
+// original, otherwise the original payload should be sent as is
+func Payload(c Compressor, payload []byte) ([]byte, bool) {
+	compressed, err := c.Compress(payload)
+	if err != nil || 2+len(compressed) >= len(payload) {
+		return payload, false
+	}
+	framed := make([]byte, 2, 2+len(compressed))
+	binary.BigEndian.PutUint16(framed, uint16(len(payload)))
+	return append(framed, compressed...), true
+}
+
+// Restore decompresses a payload compressed by Payload, and returns
+// an error unless it decompresses to the length it starts with
+func Restore(c Compressor, payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("compressed payload too short")
+	}
+	data, err := c.Decompress(payload[2:])
+	if err != nil {
+		return nil, err
+	}
+	if size := int(binary.BigEndian.Uint16(payload)); len(data) != size {
+		return nil, fmt.Errorf("payload decompressed to %d bytes, expected %d", len(data), size)
+	}
+	return data, nil
+}
+
+// Flate is a Compressor using the DEFLATE format
+type Flate struct {
+	level   int
+	dict    []byte // preset dictionary (if any)
+	writers sync.Pool
+}
+
+// NewFlate returns a DEFLATE Compressor with the given compression
+// level, as defined in the compress/flate package
+func NewFlate(level int) (*Flate, error) {
+	return NewFlateWithDict(level, nil)
+}
+
+// NewFlateWithDict returns a DEFLATE Compressor primed with a preset
+// dictionary: data which is typical of the payloads (e.g. the field names
+// and values common to a protocol's messages). Every payload is compressed
+// on its own, so priming dramatically improves the compression of small
+// payloads, which otherwise have little to refer back to. Payloads can
+// only be decompressed with the same dictionary, so it must be pre-shared
+// by (or negotiated between) both peers
+func NewFlateWithDict(level int, dict []byte) (*Flate, error) {
+	if _, err := flate.NewWriterDict(ioutil.Discard, level, dict); err != nil {
+		return nil, errors.Wrap(err, "invalid compression level")
+	}
+	return &Flate{level: level, dict: dict}, nil
+}
+
+// ID returns FlateID
+func (f *Flate) ID() uint8 {
+	return FlateID
+}
+
+// Prime returns a DEFLATE Compressor of the same compression level
+// primed with a preset dictionary (see NewFlateWithDict)
+func (f *Flate) Prime(dict []byte) (Compressor, error) {
+	return NewFlateWithDict(f.level, dict)
+}
+
+// Compress compresses a payload
+func (f *Flate) Compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, ok := f.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w, _ = flate.NewWriterDict(&buf, f.level, f.dict) // level checked in NewFlateWithDict
+	}
+	defer f.writers.Put(w)
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, errors.Wrap(err, "could not compress payload")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "could not compress payload")
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses a payload. Payloads which decompress to more
+// than the maximum payload size of a packet are rejected, so that a
+// small malicious payload cannot exhaust the receiver's memory
+func (f *Flate) Decompress(payload []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(payload), f.dict)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, packet.MaxPayloadBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decompress payload")
+	}
+	if len(data) > packet.MaxPayloadBytes {
+		return nil, fmt.Errorf("decompressed payload more than %d bytes", packet.MaxPayloadBytes)
+	}
+	return data, nil
+}
@@ -0,0 +1,162 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"testing"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+var textPayload = bytes.Repeat([]byte(`{"method":"GET","path":"/api/v1/items"}`), 40)[:packet.MaxPayloadBytes]
+
+func randomPayload() []byte {
+	b := make([]byte, packet.MaxPayloadBytes)
+	rand.Read(b)
+	return b
+}
+
+func TestNewFlate(t *testing.T) {
+	_, err := NewFlate(flate.BestSpeed)
+	assert.Nil(t, err)
+
+	_, err = NewFlate(42)
+	assert.NotNil(t, err)
+}
+
+func TestFlateRoundTrip(t *testing.T) {
+	f, err := NewFlate(flate.DefaultCompression)
+	assert.Nil(t, err)
+
+	for _, payload := range [][]byte{textPayload, randomPayload(), {}, []byte("x")} {
+		compressed, err := f.Compress(payload)
+		assert.Nil(t, err)
+
+		decompressed, err := f.Decompress(compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, len(payload), len(decompressed))
+		assert.True(t, bytes.Equal(payload, decompressed))
+	}
+}
+
+func TestFlateDecompressBomb(t *testing.T) {
+	f, err := NewFlate(flate.BestCompression)
+	assert.Nil(t, err)
+
+	bomb, err := f.Compress(make([]byte, packet.MaxPayloadBytes*100))
+	assert.Nil(t, err)
+	assert.True(t, len(bomb) < packet.MaxPayloadBytes)
+
+	_, err = f.Decompress(bomb)
+	assert.NotNil(t, err)
+
+	_, err = f.Decompress([]byte("not deflate data"))
+	assert.NotNil(t, err)
+}
+
+func TestFlateWithDict(t *testing.T) {
+	_, err := NewFlateWithDict(42, nil)
+	assert.NotNil(t, err)
+
+	dict := []byte(`{"method":"GET","path":"/api/v1/items","status":200}{"method":"POST","path":"/api/v1/items","status":201}`)
+	primed, err := NewFlateWithDict(flate.BestCompression, dict)
+	assert.Nil(t, err)
+	plain, err := NewFlate(flate.BestCompression)
+	assert.Nil(t, err)
+
+	// small, similar messages
+	for _, msg := range []string{
+		`{"method":"GET","path":"/api/v1/items/42","status":200}`,
+		`{"method":"POST","path":"/api/v1/items","status":201}`,
+		`{"method":"GET","path":"/api/v1/items?page=2","status":200}`,
+	} {
+		withDict, err := primed.Compress([]byte(msg))
+		assert.Nil(t, err)
+		withoutDict, err := plain.Compress([]byte(msg))
+		assert.Nil(t, err)
+		assert.True(t, len(withDict)*2 < len(withoutDict),
+			"%d bytes compressed with the dictionary, %d without", len(withDict), len(withoutDict))
+
+		decompressed, err := primed.Decompress(withDict)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, string(decompressed))
+
+		// without the dictionary, the payload cannot be recovered
+		decompressed, err = plain.Decompress(withDict)
+		assert.True(t, err != nil || string(decompressed) != msg)
+	}
+
+	// compressors may be primed once created
+	var _ Primer = plain
+	reprimed, err := plain.Prime(dict)
+	assert.Nil(t, err)
+	withDict, err := primed.Compress(textPayload)
+	assert.Nil(t, err)
+	again, err := reprimed.Compress(textPayload)
+	assert.Nil(t, err)
+	assert.Equal(t, withDict, again)
+}
+
+func TestPayload(t *testing.T) {
+	f, err := NewFlate(flate.BestSpeed)
+	assert.Nil(t, err)
+
+	// text compresses well
+	compressed, ok := Payload(f, textPayload)
+	assert.True(t, ok)
+	assert.True(t, len(compressed) < len(textPayload))
+	restored, err := Restore(f, compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, textPayload, restored)
+
+	// payloads must decompress to the length they start with
+	compressed[1]++
+	_, err = Restore(f, compressed)
+	assert.NotNil(t, err)
+	_, err = Restore(f, compressed[:1])
+	assert.NotNil(t, err)
+
+	// random data does not benefit, so is sent raw
+	random := randomPayload()
+	raw, ok := Payload(f, random)
+	assert.False(t, ok)
+	assert.Equal(t, random, raw)
+}
+
+func BenchmarkFlateCompressText(b *testing.B) {
+	benchmarkCompress(b, textPayload)
+}
+
+func BenchmarkFlateCompressRandom(b *testing.B) {
+	benchmarkCompress(b, randomPayload())
+}
+
+func BenchmarkFlateDecompressText(b *testing.B) {
+	f, _ := NewFlate(flate.BestSpeed)
+	compressed, _ := f.Compress(textPayload)
+
+	b.SetBytes(int64(len(textPayload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Decompress(compressed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkCompress(b *testing.B, payload []byte) {
+	f, _ := NewFlate(flate.BestSpeed)
+
+	compressed, _ := f.Compress(payload)
+	b.ReportMetric(float64(len(compressed))/float64(len(payload)), "ratio")
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Compress(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
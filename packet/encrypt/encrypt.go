@@ -0,0 +1,326 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+// ErrNoKeyShare is returned when the remote host sent no key share
+// at handshake, i.e. it does not encrypt the connection
+var ErrNoKeyShare = errors.New("no key share received")
+
+// ErrKeyExhausted is returned by Session.Seal once a session sealed as
+// many bytes as there are sequence numbers: sealing more would reuse
+// nonces. The error is permanent (see atc.IsPermanent)
+var ErrKeyExhausted error = exhaustedError{}
+
+type exhaustedError struct{}
+
+func (exhaustedError) Error() string   { return "encryption key exhausted, sequence numbers wrapped" }
+func (exhaustedError) Temporary() bool { return false }
+
+// KeyExchange agrees on a secret with the remote host, from the (ephemeral)
+// public keys both hosts exchange at handshake
+type KeyExchange interface {
+	// GenerateKey returns a new key pair, whose public key is sent to the remote host
+	GenerateKey(rand io.Reader) (private, public []byte, err error)
+
+	// SharedSecret returns the secret shared with the owner of a public key
+	SharedSecret(private, peerPublic []byte) ([]byte, error)
+}
+
+// Suite is an encryption suite: how hosts agree on a secret at handshake,
+// and the AEAD cipher payloads are sealed with, keyed from that secret
+type Suite struct {
+	// identifies the suite in key shares, so that hosts configured
+	// with different suites fail to connect rather than to decrypt
+	ID byte
+
+	KeyExchange KeyExchange
+
+	// size of the keys of the cipher, and its constructor. The cipher's
+	// nonces must be at least 6 bytes long (see Session)
+	KeySize int
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// P256AES128GCM returns the default suite: ECDH over the P-256 curve,
+// and AES-128 in Galois/Counter Mode
+func P256AES128GCM() *Suite {
+	return &Suite{ID: 1, KeyExchange: P256{}, KeySize: 16, NewAEAD: newAESGCM}
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Overhead returns the bytes sealing adds to a payload (i.e. the cipher's
+// tag), or an error if the suite is incomplete or its cipher unsuitable
+func (s *Suite) Overhead() (int, error) {
+	if s.KeyExchange == nil || s.NewAEAD == nil {
+		return 0, errors.New("invalid encryption suite, missing key exchange or cipher")
+	}
+	if s.KeySize <= 0 {
+		return 0, fmt.Errorf("invalid encryption suite key size %d, must be positive", s.KeySize)
+	}
+	aead, err := s.NewAEAD(make([]byte, s.KeySize))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid encryption suite cipher")
+	}
+	if aead.NonceSize() < nonceBytes {
+		return 0, fmt.Errorf("invalid encryption suite cipher nonce size %d, must be at least %d", aead.NonceSize(), nonceBytes)
+	}
+	return aead.Overhead(), nil
+}
+
+// KeyShare returns the key share sent to the remote host at handshake:
+// the suite's ID followed by the public key
+func (s *Suite) KeyShare(public []byte) []byte {
+	return append([]byte{s.ID}, public...)
+}
+
+// PeerKey returns the public key of a key share received from the remote
+// host, or an error if there is none (ErrNoKeyShare) or it is of another suite
+func (s *Suite) PeerKey(share []byte) ([]byte, error) {
+	if len(share) == 0 {
+		return nil, ErrNoKeyShare
+	}
+	if share[0] != s.ID {
+		return nil, fmt.Errorf("key share of encryption suite %d, expected %d", share[0], s.ID)
+	}
+	return share[1:], nil
+}
+
+// P256 is a KeyExchange by (ephemeral) elliptic curve Diffie-Hellman over
+// the P-256 curve, whose public keys are uncompressed points (65 bytes)
+type P256 struct{}
+
+// GenerateKey returns a new key pair
+func (P256) GenerateKey(rand io.Reader) (private, public []byte, err error) {
+	curve := elliptic.P256()
+	private, x, y, err := elliptic.GenerateKey(curve, rand)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate key")
+	}
+	return private, elliptic.Marshal(curve, x, y), nil
+}
+
+// SharedSecret returns the x coordinate of the point shared with the owner
+// of a public key, which must be a point of the curve
+func (P256) SharedSecret(private, peerPublic []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, peerPublic)
+	if x == nil {
+		return nil, errors.New("invalid public key, not a point of the P-256 curve")
+	}
+	sx, _ := curve.ScalarMult(x, y, private)
+	if sx.Sign() == 0 {
+		return nil, errors.New("invalid shared secret")
+	}
+	return sx.FillBytes(make([]byte, (curve.Params().BitSize+7)/8)), nil
+}
+
+var _ KeyExchange = P256{}
+
+// a nonce is made of the sequence number and the length of the payload
+// sealed, its top bit set if the payload is compressed and the next one if
+// it is the skip count of a FWD (zero padded to the cipher's nonce size)
+const nonceBytes = 6
+
+// Session seals the payloads of the packets sent on a connection, and opens
+// those of the packets received, with a key for each direction derived from
+// the secret shared at handshake (see NewSession). The nonce of a payload
+// is derived from its packet's sequence number and length, so that a packet
+// re-sent is sealed the same way and a packet split (e.g. when shrinking
+// packets) is not sealed with a nonce used before. The header is sent in
+// the clear (for demultiplexing) and the fields of it which never change
+// for a given payload (ports, sequence number and the FIN, REL and CMP flags)
+// are authenticated along with the payload. Other fields (e.g. ACKs) and
+// control packets are not: an attacker on the path can neither read nor
+// alter the data, but can still disrupt the connection (e.g. reset it).
+// The payload of a compressed packet (CMP flag set) starts with the length
+// of the data it decompresses to (see compress.Payload), which is sent in
+// the clear and authenticated: it takes the place of the payload's length
+// in the nonce, so that data compressed again after being split is not
+// sealed with a nonce used before. The payload of a FWD (the number of
+// bytes it skips) is sent in the clear and authenticated the same way, in
+// the place of the length of the data, so that data abandoned can only be
+// skipped by the remote host
+type Session struct {
+	sync.Mutex
+
+	seal cipher.AEAD
+	open cipher.AEAD
+
+	// end of the highest sequence numbers sealed, and bytes sealed in all
+	started bool
+	end     uint32
+	sealed  uint64
+}
+
+// NewSession returns the session of a connection, keyed from the secret
+// shared by the local private key and the remote host's public key
+func NewSession(suite *Suite, private, public, peerPublic []byte) (*Session, error) {
+	if _, err := suite.Overhead(); err != nil {
+		return nil, err
+	}
+	order := bytes.Compare(public, peerPublic)
+	if order == 0 {
+		return nil, errors.New("remote host's public key is the local host's")
+	}
+	secret, err := suite.KeyExchange.SharedSecret(private, peerPublic)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not agree on a secret")
+	}
+
+	// a key for the packets sent by each host, in the order of their public keys
+	low, high := public, peerPublic
+	if order > 0 {
+		low, high = peerPublic, public
+	}
+	info := append(append([]byte("rdtp session keys "), low...), high...)
+	keys := hkdf(secret, info, 2*suite.KeySize)
+	sealKey, openKey := keys[:suite.KeySize], keys[suite.KeySize:]
+	if order > 0 {
+		sealKey, openKey = openKey, sealKey
+	}
+
+	s := &Session{}
+	if s.seal, err = suite.NewAEAD(sealKey); err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	if s.open, err = suite.NewAEAD(openKey); err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	return s, nil
+}
+
+// Seal returns a copy of a packet with its payload sealed (and its length
+// and checksum set accordingly). The packet given is left untouched. Once
+// the sequence numbers sealed wrap around, it returns ErrKeyExhausted
+func (s *Session) Seal(p *packet.Packet) (*packet.Packet, error) {
+	size, prefix, payload, err := split(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	end := p.SeqNo + uint32(size)
+	if !s.started {
+		s.started, s.end = true, p.SeqNo
+	}
+	if ahead := int32(end - s.end); ahead > 0 {
+		s.sealed += uint64(ahead)
+		s.end = end
+	}
+	exhausted := s.sealed > 1<<32
+	s.Unlock()
+	if exhausted {
+		return nil, ErrKeyExhausted
+	}
+
+	sealed := *p
+	sealed.Payload = s.seal.Seal(append([]byte(nil), prefix...), nonce(s.seal, p, size), payload, additionalData(p, prefix))
+	sealed.Length = uint16(len(sealed.Payload))
+	sealed.SetSum()
+	return &sealed, nil
+}
+
+// Open opens the sealed payload of a packet received, in place (and sets
+// its length and checksum accordingly). It returns an error, leaving the
+// packet untouched, if the payload or header was tampered with, or if the
+// packet was not sealed by the remote host's session
+func (s *Session) Open(p *packet.Packet) error {
+	size, prefix, sealed, err := split(p)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < s.open.Overhead() {
+		return errors.New("payload too short to be sealed")
+	}
+	if len(prefix) == 0 {
+		size -= s.open.Overhead()
+	}
+	payload, err := s.open.Open(append([]byte(nil), prefix...), nonce(s.open, p, size), sealed, additionalData(p, prefix))
+	if err != nil {
+		return errors.Wrap(err, "could not open payload")
+	}
+	p.Payload = payload
+	p.Length = uint16(len(payload))
+	p.SetSum()
+	return nil
+}
+
+// split returns the length of the data a packet's payload carries, i.e.
+// that of the payload unless compressed (or the bytes skipped by a FWD),
+// along with the part of the payload sent in the clear (the length prefix
+// of a compressed payload or the skip count of a FWD, if any) and the
+// part sealed
+func split(p *packet.Packet) (int, []byte, []byte, error) {
+	if !p.IsCMP() && !p.IsFWD() {
+		return len(p.Payload), nil, p.Payload, nil
+	}
+	if len(p.Payload) < 2 {
+		return 0, nil, nil, errors.New("compressed or forward payload too short")
+	}
+	return int(binary.BigEndian.Uint16(p.Payload)), p.Payload[:2], p.Payload[2:], nil
+}
+
+// nonce returns the nonce of a packet's payload carrying data of the given size
+func nonce(aead cipher.AEAD, p *packet.Packet, size int) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(n, p.SeqNo)
+	binary.BigEndian.PutUint16(n[4:], uint16(size))
+	if p.IsCMP() {
+		n[4] |= 0x80 // sizes never reach it (see packet.MaxPayloadBytes)
+	}
+	if p.IsFWD() {
+		n[4] |= 0x40 // nor this one
+	}
+	return n
+}
+
+// additionalData returns the header fields authenticated with a payload,
+// along with the part of it sent in the clear
+func additionalData(p *packet.Packet, clear []byte) []byte {
+	ad := make([]byte, 9, 9+len(clear))
+	binary.BigEndian.PutUint16(ad, p.SrcPort)
+	binary.BigEndian.PutUint16(ad[2:], p.DstPort)
+	binary.BigEndian.PutUint32(ad[4:], p.SeqNo)
+	ad[8] = p.Flags & uint8(packet.FlagFIN|packet.FlagREL|packet.FlagCMP|packet.FlagFWD)
+	return append(ad, clear...)
+}
+
+// hkdf derives keys of the given total size from a secret, as by the HMAC
+// (SHA-256) based key derivation function of RFC 5869 (with no salt)
+func hkdf(secret, info []byte, size int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var keys, block []byte
+	for i := byte(1); len(keys) < size; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		keys = append(keys, block...)
+	}
+	return keys[:size]
+}
@@ -0,0 +1,294 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"testing"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockSessions returns the sessions of both hosts of a connection
+func mockSessions(t *testing.T) (*Session, *Session) {
+	suite := P256AES128GCM()
+	privA, pubA, err := suite.KeyExchange.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	privB, pubB, err := suite.KeyExchange.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	a, err := NewSession(suite, privA, pubA, pubB)
+	assert.Nil(t, err)
+	b, err := NewSession(suite, privB, pubB, pubA)
+	assert.Nil(t, err)
+	return a, b
+}
+
+func mockDataPacket(t *testing.T, seqNo uint32, payload []byte) *packet.Packet {
+	p, err := packet.NewPacket(1000, 2000, payload)
+	assert.Nil(t, err)
+	p.SetSeqNo(seqNo)
+	p.SetSum()
+	return p
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	a, b := mockSessions(t)
+	overhead, err := P256AES128GCM().Overhead()
+	assert.Nil(t, err)
+	assert.Equal(t, 16, overhead)
+
+	for _, size := range []int{1, 100, packet.MaxPayloadBytes - overhead} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+		p := mockDataPacket(t, 42, payload)
+
+		sealed, err := a.Seal(p)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(payload, p.Payload), "the packet given is left untouched")
+		assert.Equal(t, size+overhead, len(sealed.Payload))
+		assert.Equal(t, uint16(size+overhead), sealed.Length)
+		assert.NotEqual(t, payload, sealed.Payload[:size], "payload is encrypted")
+		assert.True(t, sealed.CheckSum())
+		assert.Equal(t, p.SeqNo, sealed.SeqNo, "header in the clear")
+		assert.Equal(t, p.SrcPort, sealed.SrcPort)
+
+		// wire format round trip
+		received, err := packet.Deserialize(sealed.Serialize())
+		assert.Nil(t, err)
+
+		assert.Nil(t, b.Open(received))
+		assert.True(t, bytes.Equal(payload, received.Payload))
+		assert.Equal(t, uint16(size), received.Length)
+		assert.True(t, received.CheckSum())
+	}
+
+	// each direction has its own key
+	sealed, err := b.Seal(mockDataPacket(t, 7, []byte("reply")))
+	assert.Nil(t, err)
+	assert.NotNil(t, b.Open(sealed), "a host cannot open what it sealed")
+	assert.Nil(t, a.Open(sealed))
+	assert.Equal(t, []byte("reply"), sealed.Payload)
+}
+
+func TestSessionDeterministic(t *testing.T) {
+	a, _ := mockSessions(t)
+
+	// a packet re-sent is sealed the same way
+	first, err := a.Seal(mockDataPacket(t, 100, []byte("hello world")))
+	assert.Nil(t, err)
+	again, err := a.Seal(mockDataPacket(t, 100, []byte("hello world")))
+	assert.Nil(t, err)
+	assert.Equal(t, first.Payload, again.Payload)
+
+	// packets split from it are not sealed with the same nonce
+	split, err := a.Seal(mockDataPacket(t, 100, []byte("hello")))
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Payload[:5], split.Payload[:5])
+}
+
+func TestSessionCompressed(t *testing.T) {
+	a, b := mockSessions(t)
+
+	// the length prefix of a compressed payload is sent in the clear
+	p := mockDataPacket(t, 100, []byte{0x01, 0x00, 0xca, 0xfe})
+	p.SetFlagCMP()
+	sealed, err := a.Seal(p)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x01, 0x00}, sealed.Payload[:2])
+	assert.Nil(t, b.Open(sealed))
+	assert.Equal(t, p.Payload, sealed.Payload)
+	assert.Equal(t, uint16(4), sealed.Length)
+
+	// and authenticated, as is the CMP flag
+	for name, tamper := range map[string]func(p *packet.Packet){
+		"length prefix": func(p *packet.Packet) { p.Payload[1]++ },
+		"CMP flag":      func(p *packet.Packet) { p.Flags &^= uint8(packet.FlagCMP) },
+	} {
+		sealed, err := a.Seal(p)
+		assert.Nil(t, err)
+		tamper(sealed)
+		assert.NotNil(t, b.Open(sealed), name)
+	}
+
+	// data compressed is not sealed with the nonce of data sent as is
+	raw, err := a.Seal(mockDataPacket(t, 100, []byte{0x01, 0x00, 0xca, 0xfe}))
+	assert.Nil(t, err)
+	sealed, err = a.Seal(p)
+	assert.Nil(t, err)
+	assert.NotEqual(t, raw.Payload[2:4], sealed.Payload[2:4])
+
+	// nor is data split then compressed again to as many bytes
+	split := mockDataPacket(t, 100, []byte{0x00, 0x80, 0xca, 0xfe})
+	split.SetFlagCMP()
+	again, err := a.Seal(split)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealed.Payload[2:4], again.Payload[2:4])
+
+	_, err = a.Seal(&packet.Packet{Flags: uint8(packet.FlagCMP), Payload: []byte{0x01}})
+	assert.NotNil(t, err)
+}
+
+func TestSessionForward(t *testing.T) {
+	a, b := mockSessions(t)
+
+	// the skip count of a FWD is sent in the clear
+	fwd := packet.NewForwardPacket(1234, 5678, 100, 1000)
+	sealed, err := a.Seal(fwd)
+	assert.Nil(t, err)
+	assert.Equal(t, fwd.Payload, sealed.Payload[:2])
+	assert.Nil(t, b.Open(sealed))
+	assert.Equal(t, uint32(1000), sealed.ForwardBytes())
+
+	// and authenticated, as is the FWD flag
+	for name, tamper := range map[string]func(p *packet.Packet){
+		"skip count":    func(p *packet.Packet) { p.Payload[1]++ },
+		"FWD flag":      func(p *packet.Packet) { p.Flags &^= uint8(packet.FlagFWD) },
+		"forged as is":  func(p *packet.Packet) { p.Payload = p.Payload[:2] },
+		"another FWD":   func(p *packet.Packet) { p.SeqNo++ },
+		"without a tag": func(p *packet.Packet) { p.Payload = p.Payload[:1] },
+	} {
+		sealed, err := a.Seal(fwd)
+		assert.Nil(t, err)
+		tamper(sealed)
+		assert.NotNil(t, b.Open(sealed), name)
+	}
+
+	// nor is it sealed with the nonce of data of the same length
+	skip := packet.NewForwardPacket(1234, 5678, 100, 2)
+	data := mockDataPacket(t, 100, skip.Payload)
+	sealedSkip, err := a.Seal(skip)
+	assert.Nil(t, err)
+	sealedData, err := a.Seal(data)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealedData.Payload[2:], sealedSkip.Payload[2:])
+}
+
+func TestSessionTamper(t *testing.T) {
+	a, b := mockSessions(t)
+
+	for name, tamper := range map[string]func(p *packet.Packet){
+		"payload":          func(p *packet.Packet) { p.Payload[0] ^= 0x01 },
+		"tag":              func(p *packet.Packet) { p.Payload[len(p.Payload)-1] ^= 0x80 },
+		"truncated":        func(p *packet.Packet) { p.Payload = p.Payload[:len(p.Payload)-1] },
+		"too short":        func(p *packet.Packet) { p.Payload = p.Payload[:4] },
+		"sequence number":  func(p *packet.Packet) { p.SeqNo++ },
+		"source port":      func(p *packet.Packet) { p.SrcPort++ },
+		"destination port": func(p *packet.Packet) { p.DstPort++ },
+		"FIN flag":         func(p *packet.Packet) { p.SetFlagFIN() },
+	} {
+		sealed, err := a.Seal(mockDataPacket(t, 100, []byte("sensitive data")))
+		assert.Nil(t, err)
+		tamper(sealed)
+		before := append([]byte(nil), sealed.Payload...)
+		assert.NotNil(t, b.Open(sealed), name)
+		assert.Equal(t, before, sealed.Payload, "%s: the packet is left untouched", name)
+	}
+
+	// fields which may change when re-sent are not authenticated
+	sealed, err := a.Seal(mockDataPacket(t, 100, []byte("sensitive data")))
+	assert.Nil(t, err)
+	sealed.SetAckNo(12345)
+	sealed.SetFlagACK()
+	assert.Nil(t, b.Open(sealed))
+
+	// nor is a payload sent in the clear, nor one sealed by another session
+	assert.NotNil(t, b.Open(mockDataPacket(t, 100, bytes.Repeat([]byte("x"), 32))))
+	c, _ := mockSessions(t)
+	sealed, err = c.Seal(mockDataPacket(t, 100, []byte("sensitive data")))
+	assert.Nil(t, err)
+	assert.NotNil(t, b.Open(sealed))
+}
+
+func TestSessionKeyExhausted(t *testing.T) {
+	a, _ := mockSessions(t)
+
+	// up to as many bytes as there are sequence numbers, re-sending
+	// (or splitting) packets sealed before included
+	for _, seqNo := range []uint32{0, 1 << 30, 0, 2 << 30, 3 << 30, 1 << 30} {
+		_, err := a.Seal(mockDataPacket(t, seqNo, make([]byte, 1000)))
+		assert.Nil(t, err)
+	}
+
+	// sequence numbers wrapped around
+	_, err := a.Seal(mockDataPacket(t, 0, make([]byte, 1000)))
+	assert.Equal(t, ErrKeyExhausted, err)
+	var temporary interface{ Temporary() bool }
+	assert.True(t, errors.As(err, &temporary))
+	assert.False(t, temporary.Temporary())
+}
+
+func TestNewSession(t *testing.T) {
+	suite := P256AES128GCM()
+	priv, pub, err := suite.KeyExchange.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	_, err = NewSession(suite, priv, pub, pub)
+	assert.NotNil(t, err, "reflected public key")
+
+	_, err = NewSession(suite, priv, pub, []byte("not a point"))
+	assert.NotNil(t, err)
+
+	_, err = NewSession(&Suite{}, priv, pub, pub)
+	assert.NotNil(t, err)
+}
+
+func TestSuite(t *testing.T) {
+	suite := P256AES128GCM()
+
+	_, pub, err := suite.KeyExchange.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 65, len(pub))
+	share := suite.KeyShare(pub)
+	peer, err := suite.PeerKey(share)
+	assert.Nil(t, err)
+	assert.Equal(t, pub, peer)
+
+	_, err = suite.PeerKey(nil)
+	assert.Equal(t, ErrNoKeyShare, err)
+	_, err = suite.PeerKey(append([]byte{suite.ID + 1}, pub...))
+	assert.NotNil(t, err, "another suite's key share")
+
+	for _, s := range []*Suite{
+		{KeyExchange: P256{}, KeySize: 16},
+		{NewAEAD: newAESGCM, KeySize: 16},
+		{KeyExchange: P256{}, NewAEAD: newAESGCM},
+		{KeyExchange: P256{}, NewAEAD: newAESGCM, KeySize: 15},
+		{KeyExchange: P256{}, NewAEAD: func(key []byte) (cipher.AEAD, error) {
+			aead, _ := newAESGCM(key)
+			return shortNonceAEAD{aead}, nil
+		}, KeySize: 16},
+	} {
+		_, err := s.Overhead()
+		assert.NotNil(t, err, "%+v", s)
+	}
+}
+
+// shortNonceAEAD is a cipher whose nonces are too short to be derived
+// from sequence numbers and lengths
+type shortNonceAEAD struct{ cipher.AEAD }
+
+func (shortNonceAEAD) NonceSize() int { return 4 }
+
+func TestP256SharedSecret(t *testing.T) {
+	kx := P256{}
+	privA, pubA, err := kx.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	privB, pubB, err := kx.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	secretA, err := kx.SharedSecret(privA, pubB)
+	assert.Nil(t, err)
+	secretB, err := kx.SharedSecret(privB, pubA)
+	assert.Nil(t, err)
+	assert.Equal(t, secretA, secretB)
+	assert.Equal(t, 32, len(secretA))
+
+	// points off the curve are rejected
+	offCurve := append([]byte(nil), pubB...)
+	offCurve[len(offCurve)-1] ^= 0x01
+	_, err = kx.SharedSecret(privA, offCurve)
+	assert.NotNil(t, err)
+}
@@ -1,8 +1,13 @@
 package factory
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/adrianosela/rdtp/packet"
 	"github.com/pkg/errors"
@@ -12,32 +17,45 @@ import (
 // chunks of a given max size, builds an rdtp packet
 // with the data, and forwards it
 type PacketFactory struct {
+	sync.Mutex
+
 	lhost  net.IP
 	rhost  net.IP
 	lport  uint16
 	rport  uint16
 	fwFunc func(*packet.Packet) error
 	size   int
+	mss    uint16 // proposed on SYNs, if set
+
+	isn   uint32 // initial sequence number
+	seqNo uint32 // sequence number of the next byte to send
+	ackNo uint32 // acknowledgement number carried by all packets
 }
 
-// New returns a new packet factory
+// New returns a new packet factory which builds packets
+// carrying at most size bytes of payload each
 func New(lhost, rhost net.IP, lport, rport uint16, size int, fw func(*packet.Packet) error) (*PacketFactory, error) {
 	if size > packet.MaxPayloadBytes {
 		return nil, fmt.Errorf("max size is %d", packet.MaxPayloadBytes)
 	}
-	return &PacketFactory{
+	if size <= 0 {
+		return nil, errors.New("size must be positive")
+	}
+	pf := &PacketFactory{
 		lhost:  lhost,
 		rhost:  rhost,
 		lport:  lport,
 		rport:  rport,
 		fwFunc: fw,
 		size:   size,
-	}, nil
+	}
+	pf.SetISN(RandomISN())
+	return pf, nil
 }
 
 // DefaultPacketFactory returns a new packet factory with the maximum chunk size
 func DefaultPacketFactory(lhost, rhost net.IP, lport, rport uint16, fw func(*packet.Packet) error) *PacketFactory {
-	return &PacketFactory{
+	pf := &PacketFactory{
 		lhost:  lhost,
 		rhost:  rhost,
 		lport:  lport,
@@ -45,6 +63,102 @@ func DefaultPacketFactory(lhost, rhost net.IP, lport, rport uint16, fw func(*pac
 		fwFunc: fw,
 		size:   packet.MaxPayloadBytes,
 	}
+	pf.SetISN(RandomISN())
+	return pf
+}
+
+// RandomISN returns a cryptographically random initial sequence number
+func RandomISN() uint32 {
+	return ISNFrom(rand.Reader)
+}
+
+// ISNFrom returns an initial sequence number read from the given source
+// of randomness, e.g. a deterministic one for reproducible tests
+func ISNFrom(r io.Reader) uint32 {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// SetISN sets the initial sequence number of the factory. Must
+// be called before any packets are sent to take effect cleanly
+func (pf *PacketFactory) SetISN(isn uint32) {
+	pf.Lock()
+	defer pf.Unlock()
+
+	pf.isn = isn
+	pf.seqNo = isn
+}
+
+// ISN returns the initial sequence number of the factory
+func (pf *PacketFactory) ISN() uint32 {
+	pf.Lock()
+	defer pf.Unlock()
+
+	return pf.isn
+}
+
+// SeqNo returns the sequence number of the next byte to be sent
+func (pf *PacketFactory) SeqNo() uint32 {
+	pf.Lock()
+	defer pf.Unlock()
+
+	return pf.seqNo
+}
+
+// SetAckNo sets the acknowledgement number carried by all packets
+// sent thereafter (i.e. the next sequence number expected from the peer)
+func (pf *PacketFactory) SetAckNo(ack uint32) {
+	pf.Lock()
+	defer pf.Unlock()
+
+	pf.ackNo = ack
+}
+
+// AckNo returns the acknowledgement number carried by packets sent
+func (pf *PacketFactory) AckNo() uint32 {
+	pf.Lock()
+	defer pf.Unlock()
+
+	return pf.ackNo
+}
+
+// SetSize sets the maximum payload size of packets built thereafter
+// (e.g. when the path to the remote host cannot carry larger packets)
+func (pf *PacketFactory) SetSize(size int) error {
+	if size <= 0 || size > packet.MaxPayloadBytes {
+		return fmt.Errorf("size must be between 1 and %d", packet.MaxPayloadBytes)
+	}
+
+	pf.Lock()
+	defer pf.Unlock()
+
+	pf.size = size
+	return nil
+}
+
+// SetMSS sets the maximum segment size (packet size incl. header)
+// proposed on the SYNs built thereafter (see packet.SetMSS)
+func (pf *PacketFactory) SetMSS(mss int) error {
+	if mss < packet.MinMSS || mss > packet.MaxPacketBytes {
+		return fmt.Errorf("MSS must be between %d and %d", packet.MinMSS, packet.MaxPacketBytes)
+	}
+
+	pf.Lock()
+	defer pf.Unlock()
+
+	pf.mss = uint16(mss)
+	return nil
+}
+
+// Size returns the maximum payload size of packets built by the factory
+func (pf *PacketFactory) Size() int {
+	pf.Lock()
+	defer pf.Unlock()
+
+	return pf.size
 }
 
 // SendControlPacket crafts and sends a control packet to the network
@@ -63,6 +177,24 @@ func (pf *PacketFactory) SendControlPacket(syn, ack, fin, err bool) error {
 	if err {
 		p.SetFlagERR()
 	}
+
+	// SYN and FIN each consume a sequence number.
+	// A (re-sent) SYN always carries the initial sequence number
+	pf.Lock()
+	p.SetSeqNo(pf.seqNo)
+	p.SetAckNo(pf.ackNo)
+	if syn {
+		p.SetSeqNo(pf.isn)
+		pf.seqNo = pf.isn + 1
+		if pf.mss > 0 {
+			p.SetMSS(pf.mss)
+		}
+	}
+	if fin {
+		pf.seqNo++
+	}
+	pf.Unlock()
+
 	p.SetSourceIPv4(pf.lhost)
 	p.SetDestinationIPv4(pf.rhost)
 	p.SetSum()
@@ -74,37 +206,107 @@ func (pf *PacketFactory) SendControlPacket(syn, ack, fin, err bool) error {
 	return nil
 }
 
+// SendFIN crafts and sends a FIN carrying a final payload (of at most
+// the maximum payload size), which consumes a sequence number for each
+// payload byte and one for the FIN itself
+func (pf *PacketFactory) SendFIN(payload []byte) error {
+	if size := pf.Size(); len(payload) > size {
+		return fmt.Errorf("final payload of %d bytes exceeds the maximum payload size of %d bytes", len(payload), size)
+	}
+	p, err := packet.NewPacket(pf.lport, pf.rport, payload)
+	if err != nil {
+		return errors.Wrap(err, "error packetizing final payload")
+	}
+	p.SetFlagFIN()
+
+	pf.Lock()
+	p.SetSeqNo(pf.seqNo)
+	p.SetAckNo(pf.ackNo)
+	pf.seqNo += uint32(len(payload)) + 1
+	pf.Unlock()
+
+	p.SetSourceIPv4(pf.lhost)
+	p.SetDestinationIPv4(pf.rhost)
+	p.SetSum()
+
+	if err = pf.fwFunc(p); err != nil {
+		return errors.Wrap(err, "could not send FIN")
+	}
+	return nil
+}
+
 // PackAndForwardMessage chops a stream of bytes onto chunks of maximum size,
-// wraps them in rdtp Packets and forwards them to the fwFunc
+// wraps them in rdtp Packets and forwards them to the fwFunc. The number of
+// bytes returned is the number of bytes of msg forwarded, excluding headers.
+// Data is never truncated: a message larger than the maximum size is split
+// onto as many packets as needed, with consecutive sequence numbers, and
+// only a forwarding error stops the remaining chunks from being sent. On
+// such an error the count is of the chunks forwarded before it, i.e. the
+// application bytes sent, and never includes the chunk which failed
 func (pf *PacketFactory) PackAndForwardMessage(msg []byte) (int, error) {
-	var chunk []byte
+	return pf.PackAndForwardMessageWith(msg, pf.fwFunc)
+}
+
+// PackAndForwardMessageWith chops a stream of bytes as PackAndForwardMessage
+// does but forwards the resulting packets to the given function instead
+func (pf *PacketFactory) PackAndForwardMessageWith(msg []byte, fw func(*packet.Packet) error) (int, error) {
+	return pf.PackAndForwardBuffersWith([][]byte{msg}, fw)
+}
 
-	rem := msg
+// PackAndForwardBuffersWith chops the stream of bytes made of the given
+// buffers (one after the other) as PackAndForwardMessageWith does, filling
+// packets across buffer boundaries, so that data assembled from several
+// buffers is sent without concatenating it first (as writev does)
+func (pf *PacketFactory) PackAndForwardBuffersWith(bufs [][]byte, fw func(*packet.Packet) error) (int, error) {
+	rem := 0
+	for _, buf := range bufs {
+		rem += len(buf)
+	}
 	txBytes := 0
+	size := pf.Size()
 
-	for len(rem) > 0 {
-		if len(rem) >= pf.size {
-			chunk, rem = rem[:pf.size], rem[pf.size:]
-		} else {
-			chunk, rem = rem, []byte{}
+	// the next byte to be sent is bufs[i][off]
+	i, off := 0, 0
+	for rem > 0 {
+		n := rem
+		if n > size {
+			n = size
 		}
-		if err := pf.packetizeAndForwardChunk(chunk); err != nil {
+		// packets may outlive the caller's buffers (e.g. when retransmitted)
+		payload := make([]byte, n)
+		for filled := 0; filled < n; {
+			copied := copy(payload[filled:], bufs[i][off:])
+			filled += copied
+			if off += copied; off == len(bufs[i]) {
+				i, off = i+1, 0
+			}
+		}
+		if err := pf.forwardPayloadWith(payload, fw); err != nil {
 			return txBytes, errors.Wrap(err, "could not packatize and forward chunk")
 		}
-		txBytes += len(chunk)
+		txBytes += n
+		rem -= n
 	}
 	return txBytes, nil
 }
 
-func (pf *PacketFactory) packetizeAndForwardChunk(chunk []byte) error {
-	pck, err := packet.NewPacket(pf.lport, pf.rport, chunk)
+// forwardPayloadWith wraps a payload (owned by the packet from then on)
+// in the next packet of the stream and forwards it to the given function
+func (pf *PacketFactory) forwardPayloadWith(payload []byte, fw func(*packet.Packet) error) error {
+	pck, err := packet.NewPacket(pf.lport, pf.rport, payload)
 	if err != nil {
 		return errors.Wrap(err, "error packetizing message")
 	}
+	pf.Lock()
+	pck.SetSeqNo(pf.seqNo)
+	pck.SetAckNo(pf.ackNo)
+	pf.seqNo += uint32(len(payload))
+	pf.Unlock()
+
 	pck.SetSourceIPv4(pf.lhost)
 	pck.SetDestinationIPv4(pf.rhost)
 	pck.SetSum() // set checksum here
-	if err = pf.fwFunc(pck); err != nil {
+	if err = fw(pck); err != nil {
 		return errors.Wrap(err, "error forwarding packet")
 	}
 	return nil
@@ -1,6 +1,7 @@
 package factory
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"testing"
@@ -44,6 +45,14 @@ func TestNewPacketFactoryError(t *testing.T) {
 	assert.Nil(t, p)
 	assert.NotNil(t, err)
 	assert.Equal(t, fmt.Errorf("max size is %d", packet.MaxPayloadBytes), err)
+
+	p, err = New(testSrcIP, testDstIP, 1234, 5678, 0,
+		func(x *packet.Packet) error {
+			return nil
+		})
+
+	assert.Nil(t, p)
+	assert.NotNil(t, err)
 }
 
 func TestDefaultPacketFactoryOK(t *testing.T) {
@@ -169,43 +178,47 @@ func TestSendControlPacketError(t *testing.T) {
 	}
 }
 
-func TestPacketizeAndForwardChunkOK(t *testing.T) {
-	var rx []byte
+func TestPackAndForwardMessageSinglePacket(t *testing.T) {
+	var forwarded []*packet.Packet
 
-	// subset of message
+	// subset of message, the size of a packet
 	size := len(testMsg) / 10
 	chunk := testMsg[:size]
 
 	p, err := New(testSrcIP, testDstIP, 1234, 5678, size,
 		func(x *packet.Packet) error {
-			rx = append(rx, x.Payload...)
+			forwarded = append(forwarded, x)
 			return nil
 		})
 	assert.Nil(t, err)
 
-	err = p.packetizeAndForwardChunk(chunk)
+	n, err := p.PackAndForwardMessage(chunk)
 	assert.Nil(t, err)
+	assert.Equal(t, size, n)
 
 	// check chunk sent and received match
-	assert.Equal(t, chunk, rx)
+	assert.Equal(t, 1, len(forwarded))
+	assert.Equal(t, chunk, forwarded[0].Payload)
 }
 
-func TestPacketizeAndForwardChunkError(t *testing.T) {
-	badChunkLength := packet.MaxPayloadBytes + 1
+func TestPackAndForwardMessageCopies(t *testing.T) {
+	var forwarded []*packet.Packet
 
-	chunk := make([]byte, badChunkLength)
-
-	p, err := New(testSrcIP, testDstIP, 1234, 5678, 10, func(x *packet.Packet) error { return nil })
+	p, err := New(testSrcIP, testDstIP, 1234, 5678, 10,
+		func(x *packet.Packet) error {
+			forwarded = append(forwarded, x)
+			return nil
+		})
 	assert.Nil(t, err)
 
-	err = p.packetizeAndForwardChunk(chunk)
-	assert.NotNil(t, err)
-	assert.Equal(t,
-		fmt.Errorf(
-			"error packetizing message: invalid rdtp payload - payload length %d more than %d bytes",
-			badChunkLength,
-			packet.MaxPayloadBytes).Error(),
-		err.Error())
+	// packets outlive the caller's buffer (e.g. when retransmitted)
+	msg := []byte("hello world")
+	_, err = p.PackAndForwardMessage(msg)
+	assert.Nil(t, err)
+	copy(msg, "HELLO WORLD")
+	assert.Equal(t, 2, len(forwarded))
+	assert.Equal(t, []byte("hello worl"), forwarded[0].Payload)
+	assert.Equal(t, []byte("d"), forwarded[1].Payload)
 }
 
 func TestPackAndForwardMessageOK(t *testing.T) {
@@ -229,6 +242,63 @@ func TestPackAndForwardMessageOK(t *testing.T) {
 	assert.Equal(t, testMsg, rx)
 }
 
+func TestPackAndForwardMessageSplits(t *testing.T) {
+	var forwarded []*packet.Packet
+
+	p := DefaultPacketFactory(testSrcIP, testDstIP, 1234, 5678,
+		func(x *packet.Packet) error {
+			forwarded = append(forwarded, x)
+			return nil
+		})
+	p.SetISN(1000)
+
+	msg := make([]byte, 2*packet.MaxPayloadBytes)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	n, err := p.PackAndForwardMessage(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, len(msg), n)
+
+	// two full packets with consecutive sequence numbers, nothing truncated
+	assert.Equal(t, 2, len(forwarded))
+	assert.Equal(t, uint32(1000), forwarded[0].SeqNo)
+	assert.Equal(t, uint32(1000+packet.MaxPayloadBytes), forwarded[1].SeqNo)
+	for i, pck := range forwarded {
+		assert.Equal(t, msg[i*packet.MaxPayloadBytes:(i+1)*packet.MaxPayloadBytes], pck.Payload)
+	}
+	assert.Equal(t, uint32(1000+len(msg)), p.SeqNo())
+}
+
+func TestPackAndForwardBuffers(t *testing.T) {
+	var forwarded []*packet.Packet
+
+	p, err := New(testSrcIP, testDstIP, 1234, 5678, 4,
+		func(x *packet.Packet) error {
+			forwarded = append(forwarded, x)
+			return nil
+		})
+	assert.Nil(t, err)
+	p.SetISN(1000)
+
+	bufs := [][]byte{[]byte("hello"), {}, []byte(" "), []byte("world!")}
+	n, err := p.PackAndForwardBuffersWith(bufs, p.fwFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, n)
+
+	// packets are filled across buffer boundaries
+	var payloads []string
+	for i, pck := range forwarded {
+		assert.Equal(t, uint32(1000+i*4), pck.SeqNo)
+		payloads = append(payloads, string(pck.Payload))
+	}
+	assert.Equal(t, []string{"hell", "o wo", "rld!"}, payloads)
+
+	// the buffers are left untouched
+	assert.Equal(t, [][]byte{[]byte("hello"), {}, []byte(" "), []byte("world!")}, bufs)
+}
+
 func TestPackAndForwardMessageError(t *testing.T) {
 	mockError := errors.New("mock error")
 
@@ -243,3 +313,145 @@ func TestPackAndForwardMessageError(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, errors.Wrap(mockError, "could not packatize and forward chunk: error forwarding packet").Error(), err.Error())
 }
+
+func TestPackAndForwardMessagePartialError(t *testing.T) {
+	mockError := errors.New("mock error")
+	forwarded := 0
+
+	p, err := New(testSrcIP, testDstIP, 1234, 5678, 3,
+		func(x *packet.Packet) error {
+			if forwarded == 2 {
+				return mockError
+			}
+			forwarded++
+			return nil
+		})
+	assert.Nil(t, err)
+
+	// the count is of the bytes forwarded before the third packet failed
+	n, err := p.PackAndForwardMessage([]byte("hello world"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 6, n)
+}
+
+func TestRandomISN(t *testing.T) {
+	// chances of a collision are 1 in 2^32
+	assert.NotEqual(t, RandomISN(), RandomISN())
+}
+
+func TestISNFrom(t *testing.T) {
+	assert.Equal(t, uint32(0x01020304), ISNFrom(bytes.NewReader([]byte{1, 2, 3, 4})))
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	var forwarded []*packet.Packet
+
+	pf, err := New(testSrcIP, testDstIP, 1234, 5678, 10,
+		func(p *packet.Packet) error {
+			forwarded = append(forwarded, p)
+			return nil
+		})
+	assert.Nil(t, err)
+
+	pf.SetISN(1000)
+	assert.Equal(t, uint32(1000), pf.ISN())
+	pf.SetAckNo(42)
+	assert.Equal(t, uint32(42), pf.AckNo())
+
+	// SYN carries the ISN and consumes one sequence number,
+	// a re-sent SYN carries the exact same sequence number
+	assert.Nil(t, pf.SendControlPacket(true, false, false, false))
+	assert.Nil(t, pf.SendControlPacket(true, false, false, false))
+
+	// data advances the sequence number by the payload length
+	_, err = pf.PackAndForwardMessage(make([]byte, 15))
+	assert.Nil(t, err)
+
+	// a pure ACK does not consume a sequence number, a FIN does
+	assert.Nil(t, pf.SendControlPacket(false, true, false, false))
+	assert.Nil(t, pf.SendControlPacket(false, false, true, false))
+	assert.Nil(t, pf.SendControlPacket(false, true, false, false))
+
+	expected := []uint32{1000, 1000, 1001, 1011, 1016, 1016, 1017}
+	assert.Equal(t, len(expected), len(forwarded))
+	for i, seq := range expected {
+		assert.Equal(t, seq, forwarded[i].SeqNo)
+	}
+}
+
+func TestSendFIN(t *testing.T) {
+	var forwarded []*packet.Packet
+	pf, err := New(testSrcIP, testDstIP, 1234, 5678, 10,
+		func(p *packet.Packet) error {
+			forwarded = append(forwarded, p)
+			return nil
+		})
+	assert.Nil(t, err)
+	pf.SetISN(1000)
+	pf.SetAckNo(2000)
+
+	assert.NotNil(t, pf.SendFIN(make([]byte, 11)), "larger than a packet")
+
+	// the final payload and the FIN each consume sequence numbers
+	assert.Nil(t, pf.SendFIN([]byte("goodbye")))
+	assert.Nil(t, pf.SendControlPacket(false, true, false, false))
+
+	assert.Equal(t, 2, len(forwarded))
+	fin := forwarded[0]
+	assert.True(t, fin.IsFIN())
+	assert.False(t, fin.IsACK())
+	assert.Equal(t, []byte("goodbye"), fin.Payload)
+	assert.Equal(t, uint32(1000), fin.SeqNo)
+	assert.Equal(t, uint32(2000), fin.AckNo)
+	assert.True(t, fin.CheckSum())
+	assert.Equal(t, uint32(1000+7+1), forwarded[1].SeqNo)
+}
+
+func TestSetSize(t *testing.T) {
+	var sizes []int
+	p := DefaultPacketFactory(testSrcIP, testDstIP, 1234, 5678,
+		func(x *packet.Packet) error {
+			sizes = append(sizes, len(x.Payload))
+			return nil
+		})
+
+	assert.NotNil(t, p.SetSize(0))
+	assert.NotNil(t, p.SetSize(packet.MaxPayloadBytes+1))
+	assert.Equal(t, packet.MaxPayloadBytes, p.Size())
+
+	assert.Nil(t, p.SetSize(600))
+	assert.Equal(t, 600, p.Size())
+
+	n, err := p.PackAndForwardMessage(make([]byte, 1500))
+	assert.Nil(t, err)
+	assert.Equal(t, 1500, n)
+	assert.Equal(t, []int{600, 600, 300}, sizes)
+}
+
+func TestSetMSS(t *testing.T) {
+	var forwarded []*packet.Packet
+	p := DefaultPacketFactory(testSrcIP, testDstIP, 1234, 5678,
+		func(x *packet.Packet) error {
+			forwarded = append(forwarded, x)
+			return nil
+		})
+
+	assert.NotNil(t, p.SetMSS(packet.HeaderByteSize), "no room for any payload")
+	assert.NotNil(t, p.SetMSS(packet.MaxPacketBytes+1))
+
+	// no MSS proposed until set
+	assert.Nil(t, p.SendControlPacket(true, false, false, false))
+	assert.Nil(t, p.SetMSS(1200))
+	assert.Nil(t, p.SendControlPacket(true, false, false, false))
+	assert.Nil(t, p.SendControlPacket(true, true, false, false))
+
+	// only SYNs carry it
+	assert.Nil(t, p.SendControlPacket(false, true, false, false))
+
+	assert.Equal(t, 4, len(forwarded))
+	assert.Equal(t, 0, forwarded[0].MSS())
+	assert.Equal(t, 1200, forwarded[1].MSS())
+	assert.Equal(t, 1200, forwarded[2].MSS())
+	assert.Empty(t, forwarded[3].Payload)
+	assert.Equal(t, uint32(forwarded[0].SeqNo+1), forwarded[3].SeqNo, "the MSS consumes no sequence numbers")
+}
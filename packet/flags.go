@@ -1,12 +1,77 @@
 package packet
 
+import "strings"
+
 const (
 	synMask = 0x80
 	ackMask = 0x40
 	finMask = 0x20
 	errMask = 0x10
+	fwdMask = 0x08
+	pngMask = 0x04
+	cmpMask = 0x02
+	relMask = 0x01
+)
+
+// Flags is a bitmask of packet flags
+type Flags uint8
+
+// packet flags, which may be combined (e.g. FlagSYN | FlagACK)
+const (
+	FlagSYN Flags = synMask
+	FlagACK Flags = ackMask
+	FlagFIN Flags = finMask
+	FlagERR Flags = errMask
+	FlagFWD Flags = fwdMask
+	FlagPNG Flags = pngMask
+	FlagCMP Flags = cmpMask
+	FlagREL Flags = relMask
 )
 
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagSYN, "SYN"},
+	{FlagACK, "ACK"},
+	{FlagFIN, "FIN"},
+	{FlagERR, "ERR"},
+	{FlagFWD, "FWD"},
+	{FlagPNG, "PNG"},
+	{FlagCMP, "CMP"},
+	{FlagREL, "REL"},
+}
+
+// String returns the names of the flags set, e.g. "SYN|ACK"
+func (f Flags) String() string {
+	var names []string
+	for _, fn := range flagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// GetFlags returns the flags set on a packet
+func (p *Packet) GetFlags() Flags {
+	return Flags(p.Flags)
+}
+
+// SetFlags replaces the flags set on a packet
+func (p *Packet) SetFlags(f Flags) {
+	p.Flags = uint8(f)
+}
+
+// SetFlag sets (or clears, when on is false) the given flags on a packet
+func (p *Packet) SetFlag(f Flags, on bool) {
+	if on {
+		p.Flags = p.Flags | uint8(f)
+	} else {
+		p.Flags = p.Flags &^ uint8(f)
+	}
+}
+
 // SetFlagSYN sets the SYN flag on a packet
 func (p *Packet) SetFlagSYN() {
 	p.Flags = p.Flags | synMask
@@ -27,6 +92,26 @@ func (p *Packet) SetFlagERR() {
 	p.Flags = p.Flags | errMask
 }
 
+// SetFlagFWD sets the FWD flag on a packet
+func (p *Packet) SetFlagFWD() {
+	p.Flags = p.Flags | fwdMask
+}
+
+// SetFlagPNG sets the PNG flag on a packet
+func (p *Packet) SetFlagPNG() {
+	p.Flags = p.Flags | pngMask
+}
+
+// SetFlagCMP sets the CMP flag on a packet
+func (p *Packet) SetFlagCMP() {
+	p.Flags = p.Flags | cmpMask
+}
+
+// SetFlagREL sets the REL flag on a packet
+func (p *Packet) SetFlagREL() {
+	p.Flags = p.Flags | relMask
+}
+
 // IsSYN returns true if the SYN flag is set
 func (p *Packet) IsSYN() bool {
 	return p.Flags&synMask != 0
@@ -46,3 +131,23 @@ func (p *Packet) IsFIN() bool {
 func (p *Packet) IsERR() bool {
 	return p.Flags&errMask != 0
 }
+
+// IsFWD returns true if the FWD flag is set
+func (p *Packet) IsFWD() bool {
+	return p.Flags&fwdMask != 0
+}
+
+// IsPNG returns true if the PNG flag is set
+func (p *Packet) IsPNG() bool {
+	return p.Flags&pngMask != 0
+}
+
+// IsCMP returns true if the CMP flag is set
+func (p *Packet) IsCMP() bool {
+	return p.Flags&cmpMask != 0
+}
+
+// IsREL returns true if the REL flag is set
+func (p *Packet) IsREL() bool {
+	return p.Flags&relMask != 0
+}
@@ -35,6 +35,26 @@ func TestFlags(t *testing.T) {
 			SetFunc:   func() { p.SetFlagERR() },
 			CheckFunc: func() bool { return p.IsERR() },
 		},
+		{
+			FlagName:  "FWD",
+			SetFunc:   func() { p.SetFlagFWD() },
+			CheckFunc: func() bool { return p.IsFWD() },
+		},
+		{
+			FlagName:  "PNG",
+			SetFunc:   func() { p.SetFlagPNG() },
+			CheckFunc: func() bool { return p.IsPNG() },
+		},
+		{
+			FlagName:  "CMP",
+			SetFunc:   func() { p.SetFlagCMP() },
+			CheckFunc: func() bool { return p.IsCMP() },
+		},
+		{
+			FlagName:  "REL",
+			SetFunc:   func() { p.SetFlagREL() },
+			CheckFunc: func() bool { return p.IsREL() },
+		},
 	}
 
 	for _, test := range tests {
@@ -43,3 +63,31 @@ func TestFlags(t *testing.T) {
 		assert.True(t, test.CheckFunc())
 	}
 }
+
+func TestSetFlags(t *testing.T) {
+	p, err := NewPacket(uint16(14), uint16(15), nil)
+	assert.Nil(t, err)
+
+	for _, f := range []Flags{0, FlagSYN, FlagSYN | FlagACK, FlagFIN | FlagACK, FlagERR, FlagFWD | FlagACK, FlagPNG, FlagCMP | FlagSYN, FlagREL} {
+		p.SetFlags(f)
+		assert.Equal(t, f, p.GetFlags())
+
+		// round trip through the wire format
+		cp, err := Unmarshal(p.Serialize())
+		assert.Nil(t, err)
+		assert.Equal(t, f, cp.GetFlags())
+	}
+
+	p.SetFlags(FlagSYN | FlagACK)
+	assert.True(t, p.IsSYN() && p.IsACK())
+	assert.Equal(t, "SYN|ACK", p.GetFlags().String())
+
+	p.SetFlag(FlagSYN, false)
+	assert.False(t, p.IsSYN())
+	assert.True(t, p.IsACK())
+
+	p.SetFlag(FlagFIN|FlagERR, true)
+	assert.Equal(t, FlagACK|FlagFIN|FlagERR, p.GetFlags())
+	p.SetFlag(FlagFIN, true) // already set
+	assert.Equal(t, FlagACK|FlagFIN|FlagERR, p.GetFlags())
+}
@@ -0,0 +1,25 @@
+package packet
+
+import "encoding/binary"
+
+// NewForwardPacket returns a FWD packet, which tells the receiver to move
+// its next expected sequence number forward past n bytes of data (starting
+// at the given sequence number) which the sender abandoned. The number of
+// bytes to skip is carried in the payload
+func NewForwardPacket(src, dst uint16, seqNo uint32, n uint16) *Packet {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, n)
+
+	p, _ := NewPacket(src, dst, payload) // err checks for payload size
+	p.SetFlagFWD()
+	p.SetSeqNo(seqNo)
+	return p
+}
+
+// ForwardBytes returns the number of bytes a FWD packet skips
+func (p *Packet) ForwardBytes() uint32 {
+	if !p.IsFWD() || len(p.Payload) < 2 {
+		return 0
+	}
+	return uint32(binary.BigEndian.Uint16(p.Payload))
+}
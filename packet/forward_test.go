@@ -0,0 +1,25 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardPacket(t *testing.T) {
+	p := NewForwardPacket(14, 15, 1000, 1483)
+	assert.True(t, p.IsFWD())
+	assert.Equal(t, uint32(1000), p.SeqNo)
+	assert.Equal(t, uint32(1483), p.ForwardBytes())
+
+	// survives the wire
+	p.SetSum()
+	rx, err := Deserialize(p.Serialize())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1483), rx.ForwardBytes())
+
+	// data packets skip nothing
+	data, err := NewPacket(14, 15, []byte{0x05, 0xcb})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), data.ForwardBytes())
+}
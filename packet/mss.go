@@ -0,0 +1,25 @@
+package packet
+
+import "encoding/binary"
+
+// MinMSS is the smallest maximum segment size which leaves room for the
+// header and at least one byte of payload
+const MinMSS = HeaderByteSize + 1
+
+// SetMSS sets the maximum segment size (the largest packet, incl. header,
+// the sender can receive) proposed on a SYN (or SYN ACK). The proposal
+// is carried in the payload
+func (p *Packet) SetMSS(mss uint16) {
+	p.Payload = make([]byte, 2)
+	binary.BigEndian.PutUint16(p.Payload, mss)
+	p.Length = 2
+}
+
+// MSS returns the maximum segment size proposed on a SYN (or SYN ACK),
+// or zero if none was proposed
+func (p *Packet) MSS() int {
+	if !p.IsSYN() || len(p.Payload) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(p.Payload))
+}
@@ -0,0 +1,28 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMSS(t *testing.T) {
+	p, err := NewPacket(14, 15, nil)
+	assert.Nil(t, err)
+	p.SetFlagSYN()
+	assert.Equal(t, 0, p.MSS(), "no MSS proposed")
+
+	p.SetMSS(1200)
+	assert.Equal(t, 1200, p.MSS())
+
+	// survives the wire
+	p.SetSum()
+	rx, err := Deserialize(p.Serialize())
+	assert.Nil(t, err)
+	assert.Equal(t, 1200, rx.MSS())
+
+	// data packets propose no MSS
+	data, err := NewPacket(14, 15, []byte{0x04, 0xb0})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, data.MSS())
+}
@@ -10,7 +10,7 @@ const (
 	MaxPacketBytes = 1500 // will chunk otherwise
 
 	// HeaderByteSize is the byte size of an RDTP header
-	HeaderByteSize = 17
+	HeaderByteSize = 19
 
 	// MaxPayloadBytes is the maximum size of a payload that
 	// a single RDTP packet can carry
@@ -32,11 +32,26 @@ type Packet struct {
 	AckNo uint32
 
 	// control
-	Flags uint8 // {SYN, FIN, ACK, ERR, XXXX, XXXX, XXXX, XXXX}
+	Flags uint8 // {SYN, ACK, FIN, ERR, FWD, PNG, CMP, REL}
+
+	// incarnation of the connection, picked by the sender (see SetEpoch)
+	Epoch uint16
 
 	// data
 	Payload []byte
 
+	// application-defined trace tag of the data (if any), not part of the
+	// header: carried at the front of the payload when both hosts agreed
+	// to at handshake (see socket.Config.TraceTags), and not counted by
+	// sequence numbers
+	TraceTag []byte
+
+	// application header of the data (if any), not part of the header
+	// either: a fixed-size field carried at the front of the payload when
+	// both hosts agreed to its size at handshake (see
+	// socket.Config.AppHeaderSize), and not counted by sequence numbers
+	AppHeader []byte
+
 	// the fields below dont make up the
 	// packet that goes over the wire.
 	// they are used to communicate
@@ -0,0 +1,23 @@
+package packet
+
+import "encoding/binary"
+
+// NewPingPacket returns a PNG packet, which the receiver echoes back
+// (with the ACK flag set) so that the sender can measure the round trip
+// time. The ping identifier is carried in the payload
+func NewPingPacket(src, dst uint16, id uint32) *Packet {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, id)
+
+	p, _ := NewPacket(src, dst, payload) // err checks for payload size
+	p.SetFlagPNG()
+	return p
+}
+
+// PingID returns the identifier of a PNG packet
+func (p *Packet) PingID() uint32 {
+	if !p.IsPNG() || len(p.Payload) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(p.Payload)
+}
@@ -0,0 +1,25 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingPacket(t *testing.T) {
+	p := NewPingPacket(14, 15, 0xdeadbeef)
+	assert.True(t, p.IsPNG())
+	assert.False(t, p.IsACK())
+	assert.Equal(t, uint32(0xdeadbeef), p.PingID())
+
+	// survives the wire
+	p.SetSum()
+	rx, err := Deserialize(p.Serialize())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0xdeadbeef), rx.PingID())
+
+	// data packets carry no ping identifier
+	data, err := NewPacket(14, 15, []byte{0xde, 0xad, 0xbe, 0xef})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), data.PingID())
+}
@@ -9,3 +9,10 @@ func (p *Packet) SetSeqNo(seq uint32) {
 func (p *Packet) SetAckNo(ack uint32) {
 	p.AckNo = ack
 }
+
+// SetEpoch sets the epoch of this packet: a number each host picks for
+// every connection it opens (zero meaning none), so that packets of a
+// previous connection between the same addresses can be told apart
+func (p *Packet) SetEpoch(epoch uint16) {
+	p.Epoch = epoch
+}
@@ -16,6 +16,7 @@ func (p *Packet) Serialize() []byte {
 	binary.BigEndian.PutUint32(b[8:12], p.SeqNo)
 	binary.BigEndian.PutUint32(b[12:16], p.AckNo)
 	b[16] = byte(p.Flags)
+	binary.BigEndian.PutUint16(b[17:19], p.Epoch)
 	return append(b, p.Payload...)
 }
 
@@ -35,6 +36,7 @@ func Deserialize(data []byte) (*Packet, error) {
 		SeqNo:    binary.BigEndian.Uint32(data[8:12]),
 		AckNo:    binary.BigEndian.Uint32(data[12:16]),
 		Flags:    data[16],
+		Epoch:    binary.BigEndian.Uint16(data[17:19]),
 		Payload:  data[HeaderByteSize:],
 	}
 	// safely clean up payload length
@@ -48,3 +50,19 @@ func Deserialize(data []byte) (*Packet, error) {
 	}
 	return p, nil
 }
+
+// DeserializeAll byte decodes the RDTP packets concatenated in the data
+// (e.g. coalesced onto a single datagram), each delimited by its header's
+// 'Length' field. On error it returns the packets decoded before it
+func DeserializeAll(data []byte) ([]*Packet, error) {
+	var pcks []*Packet
+	for len(data) > 0 {
+		p, err := Deserialize(data)
+		if err != nil {
+			return pcks, err
+		}
+		pcks = append(pcks, p)
+		data = data[HeaderByteSize+len(p.Payload):]
+	}
+	return pcks, nil
+}
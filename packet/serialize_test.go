@@ -15,6 +15,7 @@ func TestSerialize(t *testing.T) {
 
 	p.SetSeqNo(uint32(1234))
 	p.SetAckNo(uint32(4567))
+	p.SetEpoch(uint16(89))
 
 	header := make([]byte, HeaderByteSize)
 	binary.BigEndian.PutUint16(header[0:2], p.SrcPort)
@@ -24,6 +25,7 @@ func TestSerialize(t *testing.T) {
 	binary.BigEndian.PutUint32(header[8:12], p.SeqNo)
 	binary.BigEndian.PutUint32(header[12:16], p.AckNo)
 	header[16] = uint8(0) // flags
+	binary.BigEndian.PutUint16(header[17:19], p.Epoch)
 
 	byt := p.Serialize()
 	assert.Equal(t, string(byt), string(append(header, payload...)))
@@ -38,7 +40,9 @@ func TestDeserialize(t *testing.T) {
 		0, byte(len(payload)), 185, 28, // length, checksum
 		0, 0, 0, 10, // seqno
 		0, 0, 0, 9, // ackno
-		0}, payload...) // flags, payload
+		0,    // flags
+		0, 7, // epoch
+	}, payload...)
 
 	p, err := Deserialize(serialized)
 	assert.Nil(t, err)
@@ -48,6 +52,7 @@ func TestDeserialize(t *testing.T) {
 	assert.Equal(t, p.Length, uint16(len(payload)))
 	assert.Equal(t, p.SeqNo, uint32(10))
 	assert.Equal(t, p.AckNo, uint32(9))
+	assert.Equal(t, p.Epoch, uint16(7))
 
 	// ensure we dont deserialize non-packet data
 	_, err = Deserialize([]byte("small"))
@@ -76,3 +81,25 @@ func TestSerializeDeserialize(t *testing.T) {
 
 	assert.EqualValues(t, pRemote, pLocal)
 }
+
+func TestDeserializeAll(t *testing.T) {
+	first, err := NewPacket(uint16(8081), uint16(8082), []byte("first"))
+	assert.Nil(t, err)
+	second, err := NewPacket(uint16(8081), uint16(8082), nil)
+	assert.Nil(t, err)
+	third, err := NewPacket(uint16(8081), uint16(8082), []byte("third"))
+	assert.Nil(t, err)
+
+	data := append(append(first.Serialize(), second.Serialize()...), third.Serialize()...)
+	pcks, err := DeserializeAll(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(pcks))
+	assert.Equal(t, []byte("first"), pcks[0].Payload)
+	assert.Empty(t, pcks[1].Payload)
+	assert.Equal(t, []byte("third"), pcks[2].Payload)
+
+	// trailing bytes too short for a header
+	pcks, err = DeserializeAll(append(first.Serialize(), []byte("short")...))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(pcks))
+}
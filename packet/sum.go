@@ -23,6 +23,7 @@ func (p *Packet) sum() uint16 {
 	csum += uint16(p.AckNo)
 
 	csum += uint16(p.Flags)
+	csum += p.Epoch
 
 	for i := 0; i < len(p.Payload); i++ {
 		csum += uint16(p.Payload[i])
@@ -0,0 +1,47 @@
+package packet
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// WireFormatVersion is the version of the rdtp wire format implemented by
+// this package (see the package README). The header has no version field:
+// any change to the layout of the header must bump this version, as
+// packets of different versions cannot be told apart on the wire
+const WireFormatVersion = 2
+
+// Marshal byte-encodes an RDTP packet in the rdtp wire format, all fields
+// in network (big endian) byte order. Unlike Serialize, Marshal verifies
+// that the packet is well formed: its payload must fit in a packet and
+// its Length field must match the length of its payload
+func (p *Packet) Marshal() ([]byte, error) {
+	if len(p.Payload) > MaxPayloadBytes {
+		return nil, fmt.Errorf("payload length %d more than %d bytes", len(p.Payload), MaxPayloadBytes)
+	}
+	if int(p.Length) != len(p.Payload) {
+		return nil, fmt.Errorf("'Length' field (%d) does not match payload length (%d)", p.Length, len(p.Payload))
+	}
+	return p.Serialize(), nil
+}
+
+// Unmarshal byte-decodes an RDTP packet in the rdtp wire format. Any bytes
+// after the payload (as given by the Length field) are ignored. The packet's
+// payload is copied, so data may be reused once Unmarshal returns
+func Unmarshal(data []byte) (*Packet, error) {
+	if len(data) > MaxPacketBytes {
+		return nil, fmt.Errorf("packet length %d more than %d bytes", len(data), MaxPacketBytes)
+	}
+
+	p, err := Deserialize(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed packet")
+	}
+
+	payload := make([]byte, len(p.Payload))
+	copy(payload, p.Payload)
+	p.Payload = payload
+
+	return p, nil
+}
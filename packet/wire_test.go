@@ -0,0 +1,126 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalFieldOffsets(t *testing.T) {
+	p, err := NewPacket(0x0102, 0x0304, []byte{0xaa, 0xbb})
+	assert.Nil(t, err)
+	p.SetSeqNo(0x05060708)
+	p.SetAckNo(0x090a0b0c)
+	p.Checksum = 0x0d0e
+	p.Flags = 0xf0
+	p.SetEpoch(0x1011)
+
+	b, err := p.Marshal()
+	assert.Nil(t, err)
+
+	// version 2 of the wire format: fields are big endian at fixed offsets
+	assert.Equal(t, []byte{
+		0x01, 0x02, // [0:2] source port
+		0x03, 0x04, // [2:4] destination port
+		0x00, 0x02, // [4:6] payload length
+		0x0d, 0x0e, // [6:8] checksum
+		0x05, 0x06, 0x07, 0x08, // [8:12] sequence number
+		0x09, 0x0a, 0x0b, 0x0c, // [12:16] acknowledgement number
+		0xf0,       // [16] flags
+		0x10, 0x11, // [17:19] epoch
+		0xaa, 0xbb, // [19:] payload
+	}, b)
+	assert.Equal(t, 2, WireFormatVersion)
+	assert.Equal(t, 19, HeaderByteSize)
+}
+
+func TestFlagBits(t *testing.T) {
+	tests := []struct {
+		set func(p *Packet)
+		bit uint8
+	}{
+		{set: (*Packet).SetFlagSYN, bit: 0x80},
+		{set: (*Packet).SetFlagACK, bit: 0x40},
+		{set: (*Packet).SetFlagFIN, bit: 0x20},
+		{set: (*Packet).SetFlagERR, bit: 0x10},
+		{set: (*Packet).SetFlagFWD, bit: 0x08},
+		{set: (*Packet).SetFlagPNG, bit: 0x04},
+		{set: (*Packet).SetFlagCMP, bit: 0x02},
+	}
+	for _, test := range tests {
+		p, _ := NewPacket(1, 2, nil)
+		test.set(p)
+		b, err := p.Marshal()
+		assert.Nil(t, err)
+		assert.Equal(t, test.bit, b[16])
+	}
+}
+
+func TestMarshalUnmarshalAllFlags(t *testing.T) {
+	for flags := 0; flags <= 0xff; flags++ {
+		p, _ := NewPacket(8081, 8082, []byte("flags"))
+		p.Flags = uint8(flags)
+		p.SetSum()
+
+		b, err := p.Marshal()
+		assert.Nil(t, err)
+
+		rx, err := Unmarshal(b)
+		assert.Nil(t, err)
+		assert.Equal(t, p, rx)
+		assert.True(t, rx.CheckSum())
+	}
+}
+
+func TestMarshalUnmarshalMaxPayload(t *testing.T) {
+	p, err := NewPacket(8081, 8082, bytes.Repeat([]byte{0x7f}, MaxPayloadBytes))
+	assert.Nil(t, err)
+	p.SetSeqNo(0xffffffff)
+	p.SetAckNo(0xffffffff)
+	p.SetSum()
+
+	b, err := p.Marshal()
+	assert.Nil(t, err)
+	assert.Equal(t, MaxPacketBytes, len(b))
+
+	rx, err := Unmarshal(b)
+	assert.Nil(t, err)
+	assert.Equal(t, p, rx)
+
+	// the payload does not alias the input
+	b[HeaderByteSize] = 0x00
+	assert.Equal(t, byte(0x7f), rx.Payload[0])
+}
+
+func TestMarshalMalformed(t *testing.T) {
+	p := &Packet{Payload: make([]byte, MaxPayloadBytes+1), Length: MaxPayloadBytes + 1}
+	_, err := p.Marshal()
+	assert.NotNil(t, err)
+
+	p, _ = NewPacket(8081, 8082, []byte("data"))
+	p.Length = 3
+	_, err = p.Marshal()
+	assert.NotNil(t, err)
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	p, _ := NewPacket(8081, 8082, []byte("data"))
+	b, err := p.Marshal()
+	assert.Nil(t, err)
+
+	// truncated anywhere
+	for i := 0; i < len(b); i++ {
+		_, err := Unmarshal(b[:i])
+		assert.NotNil(t, err, "truncated to %d bytes", i)
+	}
+
+	// longer than any packet
+	_, err = Unmarshal(make([]byte, MaxPacketBytes+1))
+	assert.NotNil(t, err)
+
+	// trailing bytes after the payload are ignored
+	rx, err := Unmarshal(append(b, 0x00, 0x00))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), rx.Payload)
+}
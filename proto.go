@@ -15,3 +15,6 @@ const (
 	// DefaultRDTPServiceAddr is the default rdtp service socket
 	DefaultRDTPServiceAddr = "/var/run/rdtp.sock"
 )
+
+// address of the rdtp service socket clients connect to (overridden in tests)
+var serviceAddr = DefaultRDTPServiceAddr
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 
 	"github.com/adrianosela/rdtp"
@@ -49,7 +48,22 @@ func (s *Service) handleClientMessage(c net.Conn) {
 }
 
 func (s *Service) handleClientMessageDial(c net.Conn, r rdtp.ClientMessage) {
-	laddr := &rdtp.Addr{Host: getOutboundIP(), Port: uint16(rand.Intn(int(rdtp.MaxPort)-1) + 1)}
+	// the local address is chosen by the service unless requested by the client
+	laddr := &r.LocalAddr
+	if laddr.Host == "" {
+		laddr.Host = getOutboundIP()
+	}
+	bind := laddr.Port != 0
+	if !bind {
+		port, err := s.ports.EphemeralPort()
+		if err != nil {
+			log.Println(errors.Wrap(err, "failed to allocate local port"))
+			sendErrorMessage(c, rdtp.ServiceErrorTypeFailedToAttachSocket)
+			return
+		}
+		laddr.Port = port
+	}
+
 	sck, err := socket.New(socket.Config{
 		LocalAddr:   laddr,
 		RemoteAddr:  &r.RemoteAddr,
@@ -63,10 +77,14 @@ func (s *Service) handleClientMessageDial(c net.Conn, r rdtp.ClientMessage) {
 		return
 	}
 
-	if err = s.ports.Put(sck); err != nil {
+	if err = s.ports.Bind(sck); err != nil {
+		log.Println(errors.Wrap(err, "failed to bind socket"))
+		if bind {
+			sendErrorMessage(c, rdtp.ServiceErrorTypeAddressInUse)
+		} else {
+			sendErrorMessage(c, rdtp.ServiceErrorTypeFailedToAttachSocket)
+		}
 		sck.Close()
-		log.Println(errors.Wrap(err, "failed to attach socket"))
-		sendErrorMessage(c, rdtp.ServiceErrorTypeFailedToAttachSocket)
 		return
 	}
 	defer s.ports.Evict(sck.ID())
@@ -83,7 +101,9 @@ func (s *Service) handleClientMessageDial(c net.Conn, r rdtp.ClientMessage) {
 		return
 	}
 
-	sck.Run()
+	if err := sck.Run(); err != nil {
+		log.Println(errors.Wrap(err, "socket terminated with error"))
+	}
 
 	return
 }
@@ -122,7 +142,9 @@ func (s *Service) handleClientMessageAccept(c net.Conn, r rdtp.ClientMessage) {
 		return
 	}
 
-	sck.Run()
+	if err := sck.Run(); err != nil {
+		log.Println(errors.Wrap(err, "socket terminated with error"))
+	}
 
 	return
 }
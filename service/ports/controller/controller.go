@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"time"
+
 	"github.com/adrianosela/rdtp/packet"
 	"github.com/adrianosela/rdtp/service/ports"
 	"github.com/adrianosela/rdtp/socket"
@@ -10,8 +12,23 @@ import (
 // It allocates and deallocates rdtp sockets and listeners.
 type Controller interface {
 	Put(sck *socket.Socket) error
+	Bind(sck *socket.Socket) error
+	EphemeralPort() (uint16, error)
 	Evict(sckID string) error
 	Deliver(p *packet.Packet) error
 	AttachListener(l *ports.Listener) error
 	DetachListener(port uint16) error
+	Connections() []ConnSummary
+	ConnectionCount() int
+	SetMaxConnections(max int)
+}
+
+// ConnSummary is a snapshot of a connection managed by a controller,
+// e.g. for an administrative listing of connections (akin to netstat)
+type ConnSummary struct {
+	ID           string       // the socket's id, "laddr:lport raddr:rport"
+	UID          uint64       // the connection's unique identifier (see socket.UID)
+	State        socket.State // the state of the connection
+	Stats        socket.Stats // the socket's statistics
+	LastActivity time.Time    // when a packet was last sent or received
 }
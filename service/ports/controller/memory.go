@@ -1,11 +1,20 @@
 package controller
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/adrianosela/rdtp"
+	"github.com/adrianosela/rdtp/network"
 	"github.com/adrianosela/rdtp/packet"
 	"github.com/adrianosela/rdtp/service/ports"
 
@@ -14,70 +23,367 @@ import (
 )
 
 // MemoryController represents an in-memory rdtp ports manager.
-// It allocates and deallocates rdtp sockets and listeners.
+// It allocates and deallocates rdtp sockets and listeners, and
+// demultiplexes inbound packets onto the socket matching their
+// (local address, remote address) 4-tuple.
 type MemoryController struct {
 	sync.RWMutex
 
 	// listeners is a map of port number to listener
 	listeners map[uint16]*ports.Listener
 
-	// sockets is a map of sockets where each socket's
-	// unique identifier is "laddr:lport raddr:rport",
+	// sockets is a map of sockets by their (local address, remote
+	// address) 4-tuple, whose string form is the socket's unique
+	// identifier "laddr:lport raddr:rport",
 	// e.g. "192.168.1.75:4444 192.168.1.88:1201"
-	sockets map[string]*socket.Socket
+	sockets map[socketKey]*socket.Socket
+
+	// syns is a map of 4-tuple to the SYN a listener was notified of,
+	// delivered to the socket accepting the connection once attached
+	// (so that the MSS proposed by the remote host is taken into account)
+	syns map[socketKey]*packet.Packet
+
+	// timeWait is a map of 4-tuple to the end of the TIME_WAIT of the
+	// connection evicted: its socket address stays reserved until then,
+	// so that delayed packets of the connection are dropped rather than
+	// delivered to a new connection between the same addresses
+	timeWait         map[socketKey]time.Time
+	timeWaitDuration time.Duration
+
+	// ephemeral ports are allocated at random from [ephemeralMin, ephemeralMax]
+	ephemeralMin, ephemeralMax uint16
+	rand                       *rand.Rand
+
+	// maximum number of sockets attached at once, unlimited when not
+	// positive, and the network connection requests refused past it are
+	// answered through (see SetMaxConnections and SetNetwork)
+	maxConnections int
+	network        network.Network
 }
 
+// ErrTooManyConnections is returned when a connection is refused
+// as the maximum number of connections is reached (see SetMaxConnections)
+var ErrTooManyConnections = errors.New("too many connections")
+
+const (
+	// the IANA dynamic (ephemeral) port range
+	ephemeralPortMin = uint16(49152)
+	ephemeralPortMax = uint16(65535)
+
+	// random ports tried before searching the range for a free port
+	ephemeralPortAttempts = 64
+
+	// SYNs kept for connections not (yet) accepted, beyond which
+	// connections are accepted without the remote host's SYN
+	maxPendingSYNs = 1024
+
+	// time a packet is presumed to possibly linger on the network
+	maxSegmentLifetime = time.Second * 30
+
+	// time a connection's socket address stays reserved once evicted
+	defaultTimeWait = 2 * maxSegmentLifetime
+)
+
 // NewMemoryController returns an initialized in-memory rdtp sockets manager
 func NewMemoryController() *MemoryController {
+	// seeded unpredictably so that port allocation can not be guessed
+	var seed [8]byte
+	crand.Read(seed[:])
+
 	return &MemoryController{
-		listeners: make(map[uint16]*ports.Listener),
-		sockets:   make(map[string]*socket.Socket),
+		listeners:    make(map[uint16]*ports.Listener),
+		sockets:      make(map[socketKey]*socket.Socket),
+		syns:         make(map[socketKey]*packet.Packet),
+		timeWait:     make(map[socketKey]time.Time),
+		ephemeralMin: ephemeralPortMin,
+		ephemeralMax: ephemeralPortMax,
+		rand:         rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+
+		timeWaitDuration: defaultTimeWait,
 	}
 }
 
-// Put attaches a socket to the controller
-func (m *MemoryController) Put(s *socket.Socket) error {
+// SetRand reseeds the random choice of ephemeral ports from the given
+// source of randomness (crypto/rand by default), e.g. a deterministic
+// one for reproducible tests
+func (m *MemoryController) SetRand(r io.Reader) error {
+	var seed [8]byte
+	if _, err := io.ReadFull(r, seed[:]); err != nil {
+		return errors.Wrap(err, "could not read seed")
+	}
+
 	m.Lock()
 	defer m.Unlock()
 
-	id := s.ID()
-	if _, ok := m.sockets[id]; ok {
+	m.rand = rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
+	return nil
+}
+
+// SetTimeWait sets the time the socket address of an established
+// connection stays reserved once evicted (its TIME_WAIT), 2*MSL (a
+// minute) by default. TIME_WAIT is disabled when not positive
+func (m *MemoryController) SetTimeWait(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.timeWaitDuration = d
+}
+
+// SetMaxConnections sets the maximum number of connections (i.e. sockets
+// attached) at once, unlimited when not positive (the default), so that
+// too many connections cannot exhaust the host's resources. Past it,
+// connection requests (SYNs) are refused, answered with an ERR when the
+// controller has a network to send it through (see SetNetwork), and no
+// socket accepting a connection is attached (see Put). Sockets dialing
+// out (see Bind) count toward the maximum but are never refused
+func (m *MemoryController) SetMaxConnections(max int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.maxConnections = max
+}
+
+// SetNetwork sets the network through which the connection requests refused
+// are answered with an ERR (see SetMaxConnections), which the remote host
+// takes as a connection refused. They are dropped when it is not set
+func (m *MemoryController) SetNetwork(nw network.Network) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.network = nw
+}
+
+// ConnectionCount returns the number of connections (i.e. sockets attached)
+func (m *MemoryController) ConnectionCount() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.sockets)
+}
+
+// atConnectionLimit returns true once the maximum number of connections
+// is reached. It must be called with the controller (at least read) locked
+func (m *MemoryController) atConnectionLimit() bool {
+	return m.maxConnections > 0 && len(m.sockets) >= m.maxConnections
+}
+
+// refuse answers a connection request with an ERR through the given
+// network (if any). It is called with the controller unlocked, so that
+// packets keep being demultiplexed meanwhile
+func refuse(nw network.Network, syn *packet.Packet) {
+	if nw == nil {
+		return
+	}
+	p, _ := packet.NewPacket(syn.DstPort, syn.SrcPort, nil) // err checks for payload size (no payload)
+	p.SetFlagERR()
+	p.SetFlagACK()
+	p.SetAckNo(syn.SeqNo + 1)
+	p.SetSum()
+	if ip, err := syn.GetDestinationIPv4(); err == nil {
+		p.SetSourceIPv4(ip)
+	}
+	if ip, err := syn.GetSourceIPv4(); err == nil {
+		p.SetDestinationIPv4(ip)
+	}
+	if err := nw.Send(p); err != nil {
+		log.Println(errors.Wrap(err, "could not refuse connection"))
+	}
+}
+
+// Put attaches a socket to the controller, unless the maximum number of
+// connections is reached (see SetMaxConnections), in which case the
+// connection request it was to accept (if any) is refused
+func (m *MemoryController) Put(s *socket.Socket) error {
+	var refused *packet.Packet
+	m.Lock()
+	defer func() {
+		nw := m.network
+		m.Unlock()
+		if refused != nil {
+			refuse(nw, refused)
+		}
+	}()
+
+	key, err := keyFromSocket(s)
+	if err != nil {
+		return errors.Wrap(err, "invalid socket address")
+	}
+	if _, ok := m.sockets[key]; ok {
 		return errors.New("socket address already in use")
 	}
-	m.sockets[id] = s
+	if m.inTimeWait(key) {
+		return errors.New("socket address in TIME_WAIT")
+	}
+	if m.atConnectionLimit() {
+		if syn, ok := m.syns[key]; ok {
+			delete(m.syns, key)
+			refused = syn
+		}
+		return ErrTooManyConnections
+	}
+	m.sockets[key] = s
+	if syn, ok := m.syns[key]; ok {
+		delete(m.syns, key)
+		s.Deliver(syn)
+	}
+
+	log.Printf("%s [attached]\n", key)
+	return nil
+}
+
+// Bind attaches a socket to the controller as Put does, but only if
+// no other socket or listener is using the socket's local port
+func (m *MemoryController) Bind(s *socket.Socket) error {
+	m.Lock()
+	defer m.Unlock()
+
+	laddr, ok := s.LocalAddr().(*rdtp.Addr)
+	if !ok {
+		return errors.New("socket local address is not an rdtp address")
+	}
+	if m.portInUse(laddr.Port) {
+		return fmt.Errorf("port %d is in use", laddr.Port)
+	}
 
-	log.Printf("%s [attached]\n", id)
+	key, err := keyFromSocket(s)
+	if err != nil {
+		return errors.Wrap(err, "invalid socket address")
+	}
+	if m.inTimeWait(key) {
+		return errors.New("socket address in TIME_WAIT")
+	}
+	m.sockets[key] = s
+
+	log.Printf("%s [bound]\n", key)
 	return nil
 }
 
+// EphemeralPort returns a random port from the ephemeral port range
+// which no socket or listener is using, to be bound by a new socket
+func (m *MemoryController) EphemeralPort() (uint16, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.allocateEphemeralPort()
+}
+
+// allocateEphemeralPort tries random ports first, which succeeds quickly
+// unless the range is nearly exhausted, then searches the whole range
+// from a random port. It must be called with the controller locked
+func (m *MemoryController) allocateEphemeralPort() (uint16, error) {
+	size := int(m.ephemeralMax) - int(m.ephemeralMin) + 1
+
+	for i := 0; i < ephemeralPortAttempts; i++ {
+		port := m.ephemeralMin + uint16(m.rand.Intn(size))
+		if !m.portInUse(port) {
+			return port, nil
+		}
+	}
+
+	start := m.rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := m.ephemeralMin + uint16((start+i)%size)
+		if !m.portInUse(port) {
+			return port, nil
+		}
+	}
+
+	return 0, errors.New("ephemeral port range exhausted")
+}
+
+// portInUse returns true if any socket or listener is using the given
+// local port. It must be called with the controller (at least read) locked
+func (m *MemoryController) portInUse(port uint16) bool {
+	if _, ok := m.listeners[port]; ok {
+		return true
+	}
+	for _, sck := range m.sockets {
+		if laddr, ok := sck.LocalAddr().(*rdtp.Addr); ok && laddr.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
 // Evict removes a socket given its id
 func (m *MemoryController) Evict(id string) error {
 	m.Lock()
 	defer m.Unlock()
 
-	sck, ok := m.sockets[id]
+	key, err := keyFromID(id)
+	if err != nil {
+		return nil // not present, as never attached
+	}
+	sck, ok := m.sockets[key]
 	if !ok {
 		return nil // already not present
 	}
 
 	sck.Close()
-	delete(m.sockets, id)
-
+	delete(m.sockets, key)
 	log.Printf("%s [evicted]\n", id)
+
+	// connections which were never established have no packets to linger
+	if _, established := sck.ConnInfo(); established && m.timeWaitDuration > 0 {
+		m.purgeTimeWait()
+		m.timeWait[key] = time.Now().Add(m.timeWaitDuration)
+		log.Printf("%s [time-wait]\n", id)
+	}
 	return nil
 }
 
-// AttachListener attaches a listener to a port
-func (m *MemoryController) AttachListener(l *ports.Listener) error {
+// Connections returns a snapshot of the sockets attached to the controller,
+// in no particular order. The controller is only locked while the sockets
+// are listed, not while each is summarized, so that packets keep being
+// demultiplexed meanwhile
+func (m *MemoryController) Connections() []ConnSummary {
 	m.RLock()
-	_, ok := m.listeners[l.Port]
+	scks := make([]*socket.Socket, 0, len(m.sockets))
+	for _, sck := range m.sockets {
+		scks = append(scks, sck)
+	}
 	m.RUnlock()
-	if ok {
-		return fmt.Errorf("port %d is in use", l.Port)
+
+	conns := make([]ConnSummary, 0, len(scks))
+	for _, sck := range scks {
+		conns = append(conns, ConnSummary{
+			ID:           sck.ID(),
+			UID:          sck.UID(),
+			State:        sck.State(),
+			Stats:        sck.Stats(),
+			LastActivity: sck.LastActivity(),
+		})
+	}
+	return conns
+}
+
+// inTimeWait returns true if the given socket address is reserved by a
+// connection in TIME_WAIT. It must be called with the controller (at least
+// read) locked
+func (m *MemoryController) inTimeWait(key socketKey) bool {
+	end, ok := m.timeWait[key]
+	return ok && time.Now().Before(end)
+}
+
+// purgeTimeWait forgets the connections whose TIME_WAIT ended.
+// It must be called with the controller locked
+func (m *MemoryController) purgeTimeWait() {
+	now := time.Now()
+	for key, end := range m.timeWait {
+		if !now.Before(end) {
+			delete(m.timeWait, key)
+		}
 	}
+}
 
+// AttachListener attaches a listener to a port
+func (m *MemoryController) AttachListener(l *ports.Listener) error {
 	m.Lock()
 	defer m.Unlock()
+
+	if _, ok := m.listeners[l.Port]; ok {
+		return fmt.Errorf("port %d is in use", l.Port)
+	}
 	m.listeners[l.Port] = l
 
 	log.Printf("listener on :%d [started]\n", l.Port)
@@ -114,6 +420,28 @@ func (m *MemoryController) notifyListener(p *packet.Packet) error {
 		return errors.Wrap(err, "could not get destination address from packet")
 	}
 
+	key, err := keyFromPacket(p)
+	if err != nil {
+		return errors.Wrap(err, "could not build socket address from packet data")
+	}
+
+	m.Lock()
+	if m.inTimeWait(key) {
+		m.Unlock() // e.g. a delayed duplicate of the evicted connection's SYN
+		return errors.New("connection request for a socket address in TIME_WAIT")
+	}
+	if _, ok := m.sockets[key]; !ok && m.atConnectionLimit() {
+		nw := m.network
+		m.Unlock()
+		refuse(nw, p)
+		return ErrTooManyConnections
+	}
+	// kept before notifying, as the connection may be accepted right away
+	if _, ok := m.syns[key]; ok || len(m.syns) < maxPendingSYNs {
+		m.syns[key] = p
+	}
+	m.Unlock()
+
 	if err = l.Notify(&rdtp.Addr{Host: remoteAddress.String(), Port: p.SrcPort}); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("could not notify listener of connection from %s", remoteAddress.String()))
 	}
@@ -130,14 +458,18 @@ func (m *MemoryController) Deliver(p *packet.Packet) error {
 		return nil
 	}
 
-	id, err := socketIDFromPacket(p)
+	key, err := keyFromPacket(p)
 	if err != nil {
 		return errors.Wrap(err, "could not build socket address from packet data")
 	}
 
 	m.RLock()
-	s, ok := m.sockets[id]
+	s, ok := m.sockets[key]
+	stale := !ok && m.inTimeWait(key)
 	m.RUnlock()
+	if stale {
+		return errors.New("stale packet for a connection in TIME_WAIT")
+	}
 	if !ok {
 		return errors.New("socket address not active")
 	}
@@ -146,16 +478,100 @@ func (m *MemoryController) Deliver(p *packet.Packet) error {
 	return nil
 }
 
-func socketIDFromPacket(p *packet.Packet) (string, error) {
+// socketKey is a connection's (local address, remote address) 4-tuple:
+// comparable and of a fixed size, so that demultiplexing inbound packets
+// onto sockets does not allocate (as formatting socket ids would)
+type socketKey struct {
+	localIP, remoteIP     [net.IPv6len]byte
+	localPort, remotePort uint16
+}
+
+// String returns the key's socket id, i.e. "laddr:lport raddr:rport"
+func (k socketKey) String() string {
+	return fmt.Sprintf("%s:%d %s:%d", net.IP(k.localIP[:]), k.localPort, net.IP(k.remoteIP[:]), k.remotePort)
+}
+
+// keyFromPacket returns the 4-tuple of an inbound packet's connection
+func keyFromPacket(p *packet.Packet) (socketKey, error) {
+	var k socketKey
 	// destination = local for inbound, remote for outbound pcks
 	dst, err := p.GetDestinationIPv4()
 	if err != nil {
-		return "", err
+		return k, err
 	}
 	// source = local for outbound, remote for inbound pcks
 	src, err := p.GetSourceIPv4()
 	if err != nil {
-		return "", err
+		return k, err
+	}
+	if !putIP(&k.localIP, dst) || !putIP(&k.remoteIP, src) {
+		return k, errors.New("invalid IP address")
+	}
+	k.localPort, k.remotePort = p.DstPort, p.SrcPort
+	return k, nil
+}
+
+// keyFromSocket returns the 4-tuple of a socket's connection
+func keyFromSocket(s *socket.Socket) (socketKey, error) {
+	laddr, ok := s.LocalAddr().(*rdtp.Addr)
+	if !ok {
+		return socketKey{}, errors.New("socket local address is not an rdtp address")
+	}
+	raddr, ok := s.RemoteAddr().(*rdtp.Addr)
+	if !ok {
+		return socketKey{}, errors.New("socket remote address is not an rdtp address")
+	}
+	return keyFromAddrs(laddr.Host, laddr.Port, raddr.Host, raddr.Port)
+}
+
+// keyFromID returns the 4-tuple of a socket id ("laddr:lport raddr:rport")
+func keyFromID(id string) (socketKey, error) {
+	addrs := strings.Fields(id)
+	if len(addrs) != 2 {
+		return socketKey{}, fmt.Errorf("invalid socket id %q", id)
+	}
+	var hosts [2]string
+	var ports [2]uint16
+	for i, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return socketKey{}, errors.Wrap(err, "invalid socket id")
+		}
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return socketKey{}, errors.Wrap(err, "invalid socket id")
+		}
+		hosts[i], ports[i] = host, uint16(n)
+	}
+	return keyFromAddrs(hosts[0], ports[0], hosts[1], ports[1])
+}
+
+func keyFromAddrs(lhost string, lport uint16, rhost string, rport uint16) (socketKey, error) {
+	k := socketKey{localPort: lport, remotePort: rport}
+	if !putIP(&k.localIP, net.ParseIP(lhost)) {
+		return k, fmt.Errorf("invalid IP address %q", lhost)
+	}
+	if !putIP(&k.remoteIP, net.ParseIP(rhost)) {
+		return k, fmt.Errorf("invalid IP address %q", rhost)
+	}
+	return k, nil
+}
+
+// prefix of IPv4 addresses in their 16-byte form
+var v4InV6Prefix = [12]byte{10: 0xff, 11: 0xff}
+
+// putIP copies an IP address (in its 16-byte form) onto a key's field,
+// returning false if it is not a valid IP address. Unlike net.IP.To16,
+// it does not allocate for 4-byte IPv4 addresses
+func putIP(dst *[net.IPv6len]byte, ip net.IP) bool {
+	switch len(ip) {
+	case net.IPv4len:
+		copy(dst[:], v4InV6Prefix[:])
+		copy(dst[len(v4InV6Prefix):], ip)
+	case net.IPv6len:
+		copy(dst[:], ip)
+	default:
+		return false
 	}
-	return fmt.Sprintf("%s:%d %s:%d", dst, p.DstPort, src, p.SrcPort), nil
+	return true
 }
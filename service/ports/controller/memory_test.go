@@ -0,0 +1,543 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp"
+	"github.com/adrianosela/rdtp/handshake"
+	"github.com/adrianosela/rdtp/network"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/service/ports"
+	"github.com/adrianosela/rdtp/socket"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockNetwork struct{}
+
+func (n *mockNetwork) Send(p *packet.Packet) error                   { return nil }
+func (n *mockNetwork) StartReceiver(fn func(p *packet.Packet) error) {}
+
+func mockSocket(t testing.TB, laddr, raddr *rdtp.Addr) (*socket.Socket, net.Conn) {
+	app, svc := net.Pipe()
+	sck, err := socket.New(socket.Config{
+		LocalAddr:   laddr,
+		RemoteAddr:  raddr,
+		Application: svc,
+		Network:     &mockNetwork{},
+	})
+	assert.Nil(t, err)
+	return sck, app
+}
+
+func mockDataPacket(src, dst *rdtp.Addr, payload []byte) *packet.Packet {
+	p, _ := packet.NewPacket(src.Port, dst.Port, payload)
+	p.SetSourceIPv4(net.ParseIP(src.Host))
+	p.SetDestinationIPv4(net.ParseIP(dst.Host))
+	p.SetSum()
+	return p
+}
+
+func TestPutEvict(t *testing.T) {
+	m := NewMemoryController()
+
+	sck, _ := mockSocket(t,
+		&rdtp.Addr{Host: "10.0.0.1", Port: 1000},
+		&rdtp.Addr{Host: "10.0.0.2", Port: 2000})
+
+	assert.Nil(t, m.Put(sck))
+	assert.NotNil(t, m.Put(sck), "socket address already in use")
+
+	assert.Nil(t, m.Evict(sck.ID()))
+	assert.Nil(t, m.Evict(sck.ID()), "evicting twice is a no-op")
+	assert.Nil(t, m.Put(sck))
+}
+
+func TestAttachDetachListener(t *testing.T) {
+	m := NewMemoryController()
+
+	_, c := net.Pipe()
+
+	assert.Nil(t, m.AttachListener(ports.NewListener(22, c)))
+	assert.NotNil(t, m.AttachListener(ports.NewListener(22, c)))
+	assert.Nil(t, m.DetachListener(22))
+	assert.Nil(t, m.AttachListener(ports.NewListener(22, c)))
+}
+
+func TestDeliverUnknownSocket(t *testing.T) {
+	m := NewMemoryController()
+
+	p := mockDataPacket(
+		&rdtp.Addr{Host: "10.0.0.2", Port: 2000},
+		&rdtp.Addr{Host: "10.0.0.1", Port: 1000},
+		[]byte("nobody home"))
+
+	assert.NotNil(t, m.Deliver(p))
+}
+
+func TestDeliverConcurrentConnections(t *testing.T) {
+	m := NewMemoryController()
+
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	remotes := []*rdtp.Addr{
+		{Host: "10.0.0.2", Port: 2000},
+		{Host: "10.0.0.3", Port: 2000},
+	}
+
+	apps := make([]net.Conn, len(remotes))
+
+	// register both connections concurrently
+	var wg sync.WaitGroup
+	for i, raddr := range remotes {
+		sck, app := mockSocket(t, local, raddr)
+		apps[i] = app
+
+		wg.Add(1)
+		go func(s *socket.Socket) {
+			defer wg.Done()
+			assert.Nil(t, m.Put(s))
+			go s.Run()
+		}(sck)
+	}
+	wg.Wait()
+
+	// deliver to both connections concurrently
+	for _, raddr := range remotes {
+		go func(src *rdtp.Addr) {
+			msg := []byte(fmt.Sprintf("hello from %s", src))
+			assert.Nil(t, m.Deliver(mockDataPacket(src, local, msg)))
+		}(raddr)
+	}
+
+	// each application must only see data from its own remote
+	for i, raddr := range remotes {
+		buf := make([]byte, 1024)
+		apps[i].SetReadDeadline(time.Now().Add(time.Second))
+		n, err := apps[i].Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("hello from %s", raddr), string(buf[:n]))
+	}
+}
+
+func TestBindPortInUse(t *testing.T) {
+	m := NewMemoryController()
+
+	first, _ := mockSocket(t,
+		&rdtp.Addr{Host: "10.0.0.1", Port: 4444},
+		&rdtp.Addr{Host: "10.0.0.2", Port: 2000})
+	second, _ := mockSocket(t,
+		&rdtp.Addr{Host: "10.0.0.1", Port: 4444},
+		&rdtp.Addr{Host: "10.0.0.3", Port: 3000})
+
+	assert.Nil(t, m.Bind(first))
+	assert.NotNil(t, m.Bind(second), "local port already in use")
+
+	assert.Nil(t, m.Evict(first.ID()))
+	assert.Nil(t, m.Bind(second), "local port no longer in use")
+
+	_, c := net.Pipe()
+	assert.Nil(t, m.AttachListener(ports.NewListener(5555, c)))
+	listening, _ := mockSocket(t,
+		&rdtp.Addr{Host: "10.0.0.1", Port: 5555},
+		&rdtp.Addr{Host: "10.0.0.2", Port: 2000})
+	assert.NotNil(t, m.Bind(listening), "local port in use by a listener")
+}
+
+func TestEphemeralPort(t *testing.T) {
+	m := NewMemoryController()
+
+	used := make(map[uint16]bool)
+	for i := 0; i < 500; i++ {
+		port, err := m.EphemeralPort()
+		assert.Nil(t, err)
+		assert.True(t, port >= ephemeralPortMin && port <= ephemeralPortMax)
+		assert.False(t, used[port], "port %d allocated twice", port)
+		used[port] = true
+
+		sck, _ := mockSocket(t,
+			&rdtp.Addr{Host: "10.0.0.1", Port: port},
+			&rdtp.Addr{Host: "10.0.0.2", Port: 2000})
+		assert.Nil(t, m.Bind(sck))
+	}
+}
+
+func TestSetRand(t *testing.T) {
+	allocate := func() []uint16 {
+		m := NewMemoryController()
+		assert.Nil(t, m.SetRand(bytes.NewReader(make([]byte, 8))))
+
+		var allocated []uint16
+		for i := 0; i < 10; i++ {
+			port, err := m.EphemeralPort()
+			assert.Nil(t, err)
+			allocated = append(allocated, port)
+
+			sck, _ := mockSocket(t,
+				&rdtp.Addr{Host: "10.0.0.1", Port: port},
+				&rdtp.Addr{Host: "10.0.0.2", Port: 2000})
+			assert.Nil(t, m.Bind(sck))
+		}
+		return allocated
+	}
+	assert.Equal(t, allocate(), allocate(), "port allocation is reproducible")
+
+	assert.NotNil(t, NewMemoryController().SetRand(bytes.NewReader(nil)))
+}
+
+func TestEphemeralPortExhausted(t *testing.T) {
+	m := NewMemoryController()
+	m.ephemeralMin, m.ephemeralMax = 50000, 50009
+
+	for i := 0; i < 10; i++ {
+		port, err := m.EphemeralPort()
+		assert.Nil(t, err)
+		sck, _ := mockSocket(t,
+			&rdtp.Addr{Host: "10.0.0.1", Port: port},
+			&rdtp.Addr{Host: "10.0.0.2", Port: 2000})
+		assert.Nil(t, m.Bind(sck))
+	}
+
+	_, err := m.EphemeralPort()
+	assert.NotNil(t, err, "ephemeral port range exhausted")
+}
+
+func TestPutDeliversListenerSYN(t *testing.T) {
+	m := NewMemoryController()
+
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	remote := &rdtp.Addr{Host: "10.0.0.2", Port: 2000}
+
+	notifier, c := net.Pipe()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := notifier.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	assert.Nil(t, m.AttachListener(ports.NewListener(local.Port, c)))
+	defer m.DetachListener(local.Port)
+
+	syn := mockDataPacket(remote, local, nil)
+	syn.SetFlagSYN()
+	syn.SetMSS(1000)
+	assert.Nil(t, m.Deliver(syn))
+
+	// the socket accepting the connection gets the SYN once attached
+	sck, _ := mockSocket(t, local, remote)
+	defer sck.Close()
+	assert.Nil(t, m.Put(sck))
+	go sck.Accept()
+
+	for deadline := time.Now().Add(time.Second); sck.MSS() != 1000; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("MSS proposed on the SYN not taken into account")
+		}
+	}
+}
+
+func TestTimeWait(t *testing.T) {
+	m := NewMemoryController()
+	m.SetTimeWait(time.Millisecond * 200)
+
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	remote := &rdtp.Addr{Host: "10.0.0.2", Port: 2000}
+
+	lo, err := network.NewLoopback(0, 0)
+	assert.Nil(t, err)
+	defer lo.Close()
+	lo.Host(local.Host).StartReceiver(m.Deliver)
+
+	notifier, c := net.Pipe()
+	notified := make(chan struct{}, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := notifier.Read(buf); err != nil {
+				return
+			}
+			notified <- struct{}{}
+		}
+	}()
+	assert.Nil(t, m.AttachListener(ports.NewListener(local.Port, c)))
+	defer m.DetachListener(local.Port)
+
+	// a connection is established...
+	_, app := net.Pipe()
+	dialer, err := socket.New(socket.Config{
+		LocalAddr:   remote,
+		RemoteAddr:  local,
+		Application: app,
+		Network:     lo.Host(remote.Host),
+	})
+	assert.Nil(t, err)
+	lo.Host(remote.Host).StartReceiver(func(p *packet.Packet) error {
+		dialer.Deliver(p)
+		return nil
+	})
+	dialed := make(chan error, 1)
+	go func() { dialed <- dialer.Dial() }()
+
+	<-notified
+	_, app = net.Pipe()
+	acceptor, err := socket.New(socket.Config{
+		LocalAddr:   local,
+		RemoteAddr:  remote,
+		Application: app,
+		Network:     lo.Host(local.Host),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, m.Put(acceptor))
+	assert.Nil(t, acceptor.Accept())
+	assert.Nil(t, <-dialed)
+
+	// ...then evicted, the socket address enters TIME_WAIT
+	assert.Nil(t, m.Evict(acceptor.ID()))
+	defer dialer.Close()
+
+	// delayed packets of the old connection are dropped...
+	assert.NotNil(t, m.Deliver(mockDataPacket(remote, local, []byte("stale"))))
+	syn := mockDataPacket(remote, local, nil)
+	syn.SetFlagSYN()
+	assert.NotNil(t, m.Deliver(syn))
+	assert.Equal(t, 0, len(notified))
+
+	// ...and no new connection can take the socket address over
+	reuse, _ := mockSocket(t, local, remote)
+	assert.NotNil(t, m.Put(reuse))
+	assert.NotNil(t, m.Bind(reuse))
+
+	// until TIME_WAIT ends
+	time.Sleep(time.Millisecond * 200)
+	assert.Nil(t, m.Put(reuse))
+	assert.Nil(t, m.Evict(reuse.ID()))
+	assert.Nil(t, m.Put(reuse), "never established, no TIME_WAIT")
+	m.Evict(reuse.ID())
+}
+
+func TestConnections(t *testing.T) {
+	m := NewMemoryController()
+	assert.Equal(t, 0, len(m.Connections()))
+
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	remote := &rdtp.Addr{Host: "10.0.0.2", Port: 2000}
+
+	lo, err := network.NewLoopback(0, 0)
+	assert.Nil(t, err)
+	defer lo.Close()
+	lo.Host(local.Host).StartReceiver(m.Deliver)
+
+	notifier, c := net.Pipe()
+	go ioutil.ReadAll(notifier)
+	assert.Nil(t, m.AttachListener(ports.NewListener(local.Port, c)))
+	defer m.DetachListener(local.Port)
+
+	// an established connection...
+	_, app := net.Pipe()
+	dialer, err := socket.New(socket.Config{
+		LocalAddr:   remote,
+		RemoteAddr:  local,
+		Application: app,
+		Network:     lo.Host(remote.Host),
+	})
+	assert.Nil(t, err)
+	defer dialer.Close()
+	lo.Host(remote.Host).StartReceiver(func(p *packet.Packet) error {
+		dialer.Deliver(p)
+		return nil
+	})
+	dialed := make(chan error, 1)
+	go func() { dialed <- dialer.Dial() }()
+
+	_, app = net.Pipe()
+	acceptor, err := socket.New(socket.Config{
+		LocalAddr:   local,
+		RemoteAddr:  remote,
+		Application: app,
+		Network:     lo.Host(local.Host),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, m.Put(acceptor))
+	assert.Nil(t, acceptor.Accept())
+	assert.Nil(t, <-dialed)
+
+	// ...next to sockets not connected, and one evicted
+	idle := make(map[string]bool)
+	for port := uint16(1001); port <= 1003; port++ {
+		sck, _ := mockSocket(t, &rdtp.Addr{Host: local.Host, Port: port}, remote)
+		assert.Nil(t, m.Put(sck))
+		idle[sck.ID()] = true
+	}
+	evicted, _ := mockSocket(t, &rdtp.Addr{Host: local.Host, Port: 1004}, remote)
+	assert.Nil(t, m.Put(evicted))
+	assert.Nil(t, m.Evict(evicted.ID()))
+
+	conns := m.Connections()
+	assert.Equal(t, 4, len(conns))
+	for _, conn := range conns {
+		if conn.ID == acceptor.ID() {
+			assert.Equal(t, socket.StateEstablished, conn.State)
+			assert.Equal(t, acceptor.UID(), conn.UID)
+		} else {
+			assert.True(t, idle[conn.ID], "unexpected connection %s", conn.ID)
+			assert.Equal(t, socket.StateClosed, conn.State)
+		}
+		assert.False(t, conn.LastActivity.IsZero())
+	}
+	m.Evict(acceptor.ID())
+}
+
+func TestMaxConnections(t *testing.T) {
+	m := NewMemoryController()
+	m.SetMaxConnections(1)
+
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	remote := &rdtp.Addr{Host: "10.0.0.2", Port: 2000}
+
+	lo, err := network.NewLoopback(0, 0)
+	assert.Nil(t, err)
+	defer lo.Close()
+	lo.Host(local.Host).StartReceiver(m.Deliver)
+	m.SetNetwork(lo.Host(local.Host))
+
+	notifier, c := net.Pipe()
+	notified := make(chan struct{}, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := notifier.Read(buf); err != nil {
+				return
+			}
+			notified <- struct{}{}
+		}
+	}()
+	assert.Nil(t, m.AttachListener(ports.NewListener(local.Port, c)))
+	defer m.DetachListener(local.Port)
+
+	var mu sync.Mutex
+	var dialer *socket.Socket
+	lo.Host(remote.Host).StartReceiver(func(p *packet.Packet) error {
+		mu.Lock()
+		defer mu.Unlock()
+		dialer.Deliver(p)
+		return nil
+	})
+	dial := func() (*socket.Socket, chan error) {
+		_, app := net.Pipe()
+		sck, err := socket.New(socket.Config{
+			LocalAddr:   remote,
+			RemoteAddr:  local,
+			Application: app,
+			Network:     lo.Host(remote.Host),
+		})
+		assert.Nil(t, err)
+		mu.Lock()
+		dialer = sck
+		mu.Unlock()
+		dialed := make(chan error, 1)
+		go func() { dialed <- sck.Dial() }()
+		return sck, dialed
+	}
+
+	// the maximum is reached...
+	occupied, _ := mockSocket(t, &rdtp.Addr{Host: local.Host, Port: 1001}, remote)
+	assert.Nil(t, m.Put(occupied))
+	assert.Equal(t, 1, m.ConnectionCount())
+
+	// ...so the next connection request is refused
+	_, dialed := dial()
+	select {
+	case err := <-dialed:
+		assert.True(t, errors.Is(err, handshake.ErrConnectionRefused), "%v", err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("connection request not refused")
+	}
+	assert.Equal(t, 0, len(notified), "listener not notified")
+	refused, _ := mockSocket(t, local, remote)
+	assert.Equal(t, ErrTooManyConnections, m.Put(refused))
+	assert.Equal(t, 1, m.ConnectionCount())
+
+	// once a connection is freed, a new one succeeds
+	assert.Nil(t, m.Evict(occupied.ID()))
+	assert.Equal(t, 0, m.ConnectionCount())
+	sck, dialed := dial()
+	defer sck.Close()
+	<-notified
+
+	_, app := net.Pipe()
+	acceptor, err := socket.New(socket.Config{
+		LocalAddr:   local,
+		RemoteAddr:  remote,
+		Application: app,
+		Network:     lo.Host(local.Host),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, m.Put(acceptor))
+	assert.Nil(t, acceptor.Accept())
+	assert.Nil(t, <-dialed)
+	assert.Equal(t, 1, m.ConnectionCount())
+	m.Evict(acceptor.ID())
+}
+
+func TestSocketKey(t *testing.T) {
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	remote := &rdtp.Addr{Host: "10.0.0.2", Port: 2000}
+	sck, _ := mockSocket(t, local, remote)
+
+	fromSocket, err := keyFromSocket(sck)
+	assert.Nil(t, err)
+	assert.Equal(t, sck.ID(), fromSocket.String())
+
+	fromID, err := keyFromID(sck.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, fromSocket, fromID)
+
+	// inbound packets are keyed alike, whatever the form of their addresses
+	p := mockDataPacket(remote, local, nil)
+	p.SetSourceIPv4(net.IPv4(10, 0, 0, 2).To4())
+	fromPacket, err := keyFromPacket(p)
+	assert.Nil(t, err)
+	assert.Equal(t, fromSocket, fromPacket)
+
+	for _, id := range []string{"", "10.0.0.1:1000", "10.0.0.1 10.0.0.2:2000", "10.0.0.1:1000 host:2000", "10.0.0.1:1000 10.0.0.2:70000"} {
+		_, err := keyFromID(id)
+		assert.NotNil(t, err, id)
+	}
+}
+
+func BenchmarkDeliver(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	m := NewMemoryController()
+	local := &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+
+	// packets for one of many connections (its inbound channel full,
+	// so the socket only counts them dropped)
+	var p *packet.Packet
+	for i := 0; i < 10000; i++ {
+		remote := &rdtp.Addr{Host: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), Port: 2000}
+		sck, _ := mockSocket(b, local, remote)
+		if err := m.Put(sck); err != nil {
+			b.Fatal(err)
+		}
+		p = mockDataPacket(remote, local, []byte("data"))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.Deliver(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -27,12 +27,40 @@ func NewService() (*Service, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "could not acquire network")
 	}
+	ports := controller.NewMemoryController()
+	ports.SetNetwork(ipv4Network) // to refuse connections past the maximum
 	return &Service{
-		ports:   controller.NewMemoryController(),
+		ports:   ports,
 		network: ipv4Network,
 	}, nil
 }
 
+// SetMaxConnections sets the maximum number of connections the service
+// handles at once, unlimited when not positive (the default). Connection
+// requests past it are refused (see controller.MemoryController)
+func (s *Service) SetMaxConnections(max int) {
+	s.ports.SetMaxConnections(max)
+}
+
+// SetTrafficClass sets the IP traffic class (the DSCP/ToS byte) of the
+// packets the service sends, for every connection, as the network does
+// (see network.IPv4.SetTrafficClass)
+func (s *Service) SetTrafficClass(tc int) error {
+	tcs, ok := s.network.(network.TrafficClassSetter)
+	if !ok {
+		return errors.New("network does not support traffic classes")
+	}
+	return tcs.SetTrafficClass(tc)
+}
+
+// Healthy returns true while the service's network is able to send and
+// forward packets received to sockets, e.g. for health checks by load
+// balancers or orchestration. It never blocks
+func (s *Service) Healthy() bool {
+	hc, ok := s.network.(network.HealthChecker)
+	return ok && hc.Healthy()
+}
+
 // Run runs the rdtp service
 func (s *Service) Run() error {
 	// receive all rdtp packets passed on by the network
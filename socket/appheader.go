@@ -0,0 +1,36 @@
+package socket
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxAppHeaderBytes is the maximum size of
+// an application header (see Config.AppHeaderSize)
+const MaxAppHeaderBytes = 8
+
+// WriteWithHeader sends data to the remote host as Write does, on packets
+// carrying the given application header (see Config.AppHeaderSize), which
+// must be of the size agreed to at handshake. The header is carried over
+// when data is split or re-sent, and the remote host surfaces it with every
+// run of the data (see Config.OnDataWithHeader). The header is not retained
+func (s *Socket) WriteWithHeader(header, payload []byte) (int, error) {
+	if s.appHeaderSize == 0 || len(header) != s.appHeaderSize {
+		return 0, fmt.Errorf("invalid application header of %d bytes, the connection carries headers of %d", len(header), s.appHeaderSize)
+	}
+	return s.writeBuffers([][]byte{payload}, time.Time{}, 0, append([]byte(nil), header...))
+}
+
+// negotiateAppHeaders returns an error unless the remote host offered
+// application headers of the same size as this host's in the options
+// of the SYN (or SYN ACK) received, none if neither carries any
+func (s *Socket) negotiateAppHeaders(option []byte) error {
+	size := 0
+	if len(option) == 1 {
+		size = int(option[0])
+	}
+	if size != s.appHeaderSize {
+		return fmt.Errorf("connect handshake failed to negotiate application headers of %d bytes, the remote host carries %d", s.appHeaderSize, size)
+	}
+	return nil
+}
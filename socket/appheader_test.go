@@ -0,0 +1,155 @@
+package socket
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func withAppHeaders(size int) func(c *Config) {
+	return func(c *Config) { c.AppHeaderSize = size }
+}
+
+func TestAppHeaders(t *testing.T) {
+	for name, opt := range map[string]func(c *Config){
+		"application headers": withAppHeaders(4),
+		"application headers, trace tags, compressed and encrypted": func(c *Config) {
+			withAppHeaders(4)(c)
+			withTraceTags(c)
+			withCompression(c)
+			withEncryption(c)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var lock sync.Mutex
+			var received []tracedData
+			dialer, acceptor, dialerApp, _, dialErr, acceptErr := mockConnPair(t, nil, opt, func(c *Config) {
+				opt(c)
+				c.OnDataWithHeader = func(header, data []byte) {
+					lock.Lock()
+					defer lock.Unlock()
+					received = append(received, tracedData{
+						tag:  string(header),
+						data: append([]byte(nil), data...),
+					})
+				}
+			})
+			assert.Nil(t, dialErr)
+			assert.Nil(t, acceptErr)
+			go dialer.Run()
+			go acceptor.Run()
+			defer dialer.Close()
+
+			info, _ := acceptor.ConnInfo()
+			assert.Equal(t, 4, info.AppHeaderSize)
+			assert.Equal(t, dialer.packetizer.Size(), info.PayloadSize)
+			assert.True(t, info.PayloadSize <= packet.MaxPayloadBytes-4, "room for the header")
+
+			_, err := dialer.WriteWithHeader([]byte("toolong"), []byte("a"))
+			assert.NotNil(t, err)
+
+			// each write is delivered with its header, data spanning
+			// several packets included, and zeros for data written
+			// without one
+			writes := []tracedData{
+				{tag: "hdr1", data: bytes.Repeat([]byte("a"), 3000)},
+				{tag: "hdr2", data: []byte("b")},
+				{tag: "\x00\x00\x00\x00", data: []byte("c")},
+			}
+			var sent int
+			for i, w := range writes {
+				if i < 2 {
+					n, err := dialer.WriteWithHeader([]byte(w.tag), w.data)
+					assert.Nil(t, err)
+					assert.Equal(t, len(w.data), n)
+				} else {
+					_, err := dialerApp.Write(w.data)
+					assert.Nil(t, err)
+				}
+				sent += len(w.data)
+				assert.Eventually(t, func() bool {
+					return acceptor.Stats().RxBytes == uint64(sent)
+				}, time.Second, time.Millisecond)
+			}
+
+			// sequence numbers do not count the headers
+			assert.Eventually(t, func() bool {
+				return dialer.NextSeqNo() == acceptor.NextAckNo()
+			}, time.Second, time.Millisecond)
+			assert.Equal(t, uint64(0), acceptor.Stats().Drops.Untagged)
+
+			lock.Lock()
+			defer lock.Unlock()
+			for _, w := range writes {
+				var data []byte
+				for len(received) > 0 && received[0].tag == w.tag && len(data) < len(w.data) {
+					data = append(data, received[0].data...)
+					received = received[1:]
+				}
+				assert.Equal(t, w.data, data, "with header %q", w.tag)
+			}
+			assert.Empty(t, received)
+		})
+	}
+}
+
+func TestAppHeadersNotNegotiated(t *testing.T) {
+	for name, opts := range map[string][2]func(c *Config){
+		"sizes differ":                   {withAppHeaders(4), withAppHeaders(2)},
+		"remote host carries no headers": {withAppHeaders(4), func(c *Config) {}},
+		"local host carries no headers":  {func(c *Config) {}, withAppHeaders(4)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dialer, acceptor, _, _, dialErr, acceptErr := mockConnPair(t, nil, opts[0], opts[1])
+			assert.NotNil(t, acceptErr)
+			assert.NotNil(t, dialErr)
+			assert.Equal(t, CloseHandshakeFailed, dialer.CloseReason())
+			assert.Equal(t, CloseHandshakeFailed, acceptor.CloseReason())
+		})
+	}
+
+	// no header can be written on a connection which carries none
+	dialer, _, _, _, dialErr, _ := mockConnPair(t, nil, nil, nil)
+	assert.Nil(t, dialErr)
+	_, err := dialer.WriteWithHeader(nil, []byte("data"))
+	assert.NotNil(t, err)
+}
+
+func TestAppHeadersMissingDrop(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	s.peerEpoch, s.rxNext = 1, 100
+	s.appHeaderSize = 2
+
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte{0x01, 0x02})
+	p.SetSeqNo(100)
+	p.SetEpoch(1)
+	p.SetSum()
+	assert.Equal(t, errUntagged, s.validate(p), "no data")
+
+	p, _ = packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte{0x01, 0x02, 'a'})
+	p.SetSeqNo(100)
+	p.SetEpoch(1)
+	p.SetSum()
+	assert.Nil(t, s.validate(p))
+	assert.Equal(t, []byte{0x01, 0x02}, p.AppHeader)
+	assert.Equal(t, []byte("a"), p.Payload)
+}
+
+func TestAppHeaderSizeConfig(t *testing.T) {
+	for _, size := range []int{-1, MaxAppHeaderBytes + 1} {
+		_, svc := net.Pipe()
+		_, err := New(Config{
+			LocalAddr:     testLocalAddr,
+			RemoteAddr:    testRemoteAddr,
+			Application:   svc,
+			Network:       &mockNetwork{},
+			AppHeaderSize: size,
+		})
+		assert.NotNil(t, err)
+	}
+}
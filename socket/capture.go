@@ -0,0 +1,22 @@
+package socket
+
+import (
+	"log"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/capture"
+)
+
+// capturePacket records a packet sent or received to the capture (if
+// any, see Config.Capture). Only the first error writing to it is logged
+func (s *Socket) capturePacket(dir capture.Direction, p *packet.Packet) {
+	if s.capture == nil {
+		return
+	}
+	if err := s.capture.Write(capture.Record{Time: time.Now(), Direction: dir, Packet: p}); err != nil {
+		s.captureErr.Do(func() {
+			log.Printf("[rdtp socket %s] Error capturing packet (further errors not logged): %s", s.logID(), err)
+		})
+	}
+}
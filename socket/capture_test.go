@@ -0,0 +1,89 @@
+package socket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/capture"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture(t *testing.T) {
+	var captured bytes.Buffer
+	acceptorConfig := func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		c.ISNSource = func() uint32 { return 5000 }
+		c.Capture, c.CapturePayloads = &captured, true
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, nil, acceptorConfig)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	dialerDone, acceptorDone := make(chan error, 1), make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go func() { acceptorDone <- acceptor.Run() }()
+	go io.Copy(ioutil.Discard, acceptorApp)
+
+	_, err := dialerApp.Write([]byte("hello capture"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return acceptor.Stats().RxBytes == 13 }, time.Second, time.Millisecond)
+	dialer.Close()
+	for _, done := range []chan error{dialerDone, acceptorDone} {
+		select {
+		case <-done:
+		case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+			t.Fatal("socket did not shut down after the connection was closed")
+		}
+	}
+
+	// the capture records the connection from the acceptor's point of view
+	r := capture.NewReader(bytes.NewReader(captured.Bytes()))
+	rec, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, capture.Received, rec.Direction)
+	assert.True(t, rec.Packet.IsSYN() && !rec.Packet.IsACK())
+	syn := rec.Packet
+	rec, err = r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, capture.Sent, rec.Direction)
+	assert.True(t, rec.Packet.IsSYN() && rec.Packet.IsACK())
+	assert.Equal(t, uint32(5000), rec.Packet.SeqNo)
+
+	// replaying the packets it received into a new socket reproduces
+	// the connection: the same data is delivered, then it is closed
+	replayed, replayedApp := mockSocket(t, &mockNetwork{}, acceptorConfig, func(c *Config) {
+		c.Capture = nil
+	})
+	accepted := make(chan error, 1)
+	replayed.Deliver(syn)
+	go func() { accepted <- replayed.Accept() }()
+	assert.Eventually(t, func() bool { return replayed.State() == StateSynReceived }, time.Second, time.Millisecond)
+	replayDone := make(chan error, 1)
+	go func() {
+		replayDone <- capture.Replay(bytes.NewReader(captured.Bytes()), capture.Received, func(p *packet.Packet) error {
+			if !p.IsSYN() { // delivered before Accept
+				replayed.Deliver(p)
+			}
+			return nil
+		})
+	}()
+	assert.Nil(t, <-accepted)
+	go func() { acceptorDone <- replayed.Run() }()
+
+	received := make([]byte, 13)
+	replayedApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(replayedApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello capture", string(received))
+	assert.Nil(t, <-replayDone)
+	select {
+	case <-acceptorDone:
+	case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+		t.Fatal("replayed socket did not shut down after the connection was closed")
+	}
+	assert.Equal(t, ClosePeer, replayed.CloseReason())
+}
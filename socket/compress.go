@@ -0,0 +1,93 @@
+package socket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sync/atomic"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/compress"
+	"github.com/pkg/errors"
+)
+
+// compress returns the packet to send in place of the given one when
+// compressing (see Config.Compression): a copy of a data packet with its
+// payload compressed (and the CMP flag set) if compression makes it
+// smaller. Other packets, and every packet of a connection which is not
+// compressed, are sent as is. Retransmissions are compressed again the same
+// way, as sequence numbers count the data rather than the bytes compressed
+func (s *Socket) compress(p *packet.Packet) *packet.Packet {
+	if atomic.LoadUint32(&s.compressing) == 0 || !carriesData(p) {
+		return p
+	}
+	payload, ok := compress.Payload(s.compression, p.Payload)
+	if !ok {
+		return p
+	}
+	compressed := *p
+	compressed.Payload = payload
+	compressed.Length = uint16(len(payload))
+	compressed.SetFlagCMP()
+	compressed.SetSum()
+	return &compressed
+}
+
+// decompress decompresses the payload of a data packet received in place
+// (and clears its CMP flag), if compressed. It returns an error if the
+// payload fails to decompress, or if the connection is not compressed
+func (s *Socket) decompress(p *packet.Packet) error {
+	if !p.IsCMP() {
+		return nil
+	}
+	if atomic.LoadUint32(&s.compressing) == 0 {
+		return errors.New("compressed payload received, compression not negotiated")
+	}
+	payload, err := compress.Restore(s.compression, p.Payload)
+	if err != nil {
+		return err
+	}
+	p.Payload = payload
+	p.Length = uint16(len(payload))
+	p.Flags &^= uint8(packet.FlagCMP)
+	p.SetSum()
+	return nil
+}
+
+// compressionOptionBytes is the size of the value of the compression option
+// of a SYN: the compressor's ID followed by the digest of its dictionary
+// (see dictDigest)
+const compressionOptionBytes = 1 + dictDigestBytes
+
+// dictDigestBytes is the size of the digest of a compression dictionary
+const dictDigestBytes = 4
+
+// compressionOption returns the compression option offered on the SYN
+func (s *Socket) compressionOption() []byte {
+	return append([]byte{s.compression.ID()}, s.dictDigest...)
+}
+
+// negotiateCompression compresses the connection if the remote host offered
+// compression, in the options of the SYN (or SYN ACK) received, with a
+// compressor of the same ID (see compress.Compressor) as this host's. It
+// returns an error if the compressor is primed with another dictionary
+// (see Config.CompressionDict) than this host's
+func (s *Socket) negotiateCompression(option []byte) error {
+	if s.compression == nil || len(option) != compressionOptionBytes || option[0] != s.compression.ID() {
+		return nil
+	}
+	if !bytes.Equal(option[1:], s.dictDigest) {
+		return errors.New("connect handshake failed to negotiate compression, dictionaries differ")
+	}
+	atomic.StoreUint32(&s.compressing, 1)
+	return nil
+}
+
+// dictDigest returns the digest of a compression dictionary sent on the
+// SYN: the first bytes of its SHA-256 hash, or zeros if there is none
+func dictDigest(dict []byte) []byte {
+	if len(dict) == 0 {
+		return make([]byte, dictDigestBytes)
+	}
+	sum := sha256.Sum256(dict)
+	return sum[:dictDigestBytes]
+}
@@ -0,0 +1,265 @@
+package socket
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/compress"
+	"github.com/stretchr/testify/assert"
+)
+
+func withCompression(c *Config) {
+	c.Compression, _ = compress.NewFlate(flate.BestSpeed)
+}
+
+// textData returns data which compresses well,
+// spanning several packets
+func textData() []byte {
+	return bytes.Repeat([]byte(`{"method":"GET","path":"/api/v1/items"}`), 150)
+}
+
+func TestCompression(t *testing.T) {
+	for name, opt := range map[string]func(c *Config){
+		"compressed": withCompression,
+		"compressed and encrypted": func(c *Config) {
+			withCompression(c)
+			withEncryption(c)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the first compressed packet is lost, and compressed
+			// again the same way when re-sent
+			var sent sync.Mutex
+			var compressed, raw int
+			var lost []byte
+			tap := func(p *packet.Packet) *packet.Packet {
+				if !carriesData(p) {
+					return p
+				}
+				sent.Lock()
+				defer sent.Unlock()
+				if !p.IsCMP() {
+					raw++
+					return p
+				}
+				compressed++
+				if lost == nil {
+					lost = append([]byte(nil), p.Payload...)
+					return nil
+				}
+				if bytes.Equal(lost, p.Payload) {
+					lost = []byte{} // re-sent
+				}
+				return p
+			}
+			dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, opt, opt)
+			assert.Nil(t, dialErr)
+			assert.Nil(t, acceptErr)
+			go dialer.Run()
+			go acceptor.Run()
+			defer dialer.Close()
+
+			for _, s := range []*Socket{dialer, acceptor} {
+				info, ok := s.ConnInfo()
+				assert.True(t, ok)
+				assert.True(t, info.Compressed)
+				opts, _ := s.RawHandshakeOptions()
+				assert.Equal(t, []byte{optCompression, 5, compress.FlateID}, opts.Sent[2:5], "after the MSS")
+			}
+
+			// text is compressed, random data is sent as is
+			text := textData()
+			random := make([]byte, 2000)
+			rand.Read(random)
+			data := append(append([]byte(nil), text...), random...)
+			go dialerApp.Write(data)
+			received := make([]byte, len(data))
+			_, err := io.ReadFull(acceptorApp, received)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, received))
+
+			sent.Lock()
+			assert.True(t, compressed >= 2)
+			assert.True(t, raw >= 1)
+			assert.Equal(t, []byte{}, lost, "the lost packet was re-sent as is")
+			sent.Unlock()
+
+			// sequence numbers count the data, not the bytes compressed
+			assert.Eventually(t, func() bool {
+				return acceptor.Stats().RxBytes == uint64(len(data))
+			}, time.Second, time.Millisecond)
+			assert.Equal(t, uint64(0), acceptor.Stats().Drops.BadCompression)
+		})
+	}
+}
+
+func TestCompressionNotNegotiated(t *testing.T) {
+	other := func(c *Config) {
+		c.Compression = &otherCompressor{}
+	}
+	for name, opts := range map[string][2]func(c *Config){
+		"remote host does not compress": {withCompression, func(c *Config) {}},
+		"local host does not compress":  {func(c *Config) {}, withCompression},
+		"compressors differ":            {withCompression, other},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var compressed bool
+			var sent sync.Mutex
+			tap := func(p *packet.Packet) *packet.Packet {
+				sent.Lock()
+				defer sent.Unlock()
+				compressed = compressed || (carriesData(p) && p.IsCMP())
+				return p
+			}
+			dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, opts[0], opts[1])
+			assert.Nil(t, dialErr)
+			assert.Nil(t, acceptErr)
+			go dialer.Run()
+			go acceptor.Run()
+			defer dialer.Close()
+
+			// the connection falls back to sending data as is
+			for _, s := range []*Socket{dialer, acceptor} {
+				info, _ := s.ConnInfo()
+				assert.False(t, info.Compressed)
+			}
+			data := textData()
+			go dialerApp.Write(data)
+			received := make([]byte, len(data))
+			_, err := io.ReadFull(acceptorApp, received)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, received))
+			sent.Lock()
+			assert.False(t, compressed)
+			sent.Unlock()
+		})
+	}
+}
+
+func TestCompressionNotNegotiatedDrop(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	s.peerEpoch, s.rxNext = 1, 100
+
+	// compressed data is dropped when compression was not negotiated
+	f, _ := compress.NewFlate(flate.BestSpeed)
+	payload, ok := compress.Payload(f, textData()[:1000])
+	assert.True(t, ok)
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, payload)
+	p.SetSeqNo(100)
+	p.SetEpoch(1)
+	p.SetFlagCMP()
+	p.SetSum()
+	assert.Equal(t, errBadCompression, s.validate(p))
+
+	// and when it fails to decompress
+	s.compression = f
+	s.compressing = 1
+	p.Payload[1]++ // not the length it decompresses to
+	p.SetSum()
+	assert.Equal(t, errBadCompression, s.validate(p))
+	p.Payload[1]--
+	p.SetSum()
+	assert.Nil(t, s.validate(p))
+	assert.False(t, p.IsCMP())
+	assert.Equal(t, 1000, len(p.Payload))
+}
+
+// otherCompressor is a compressor of another format than DEFLATE
+type otherCompressor struct{}
+
+func (otherCompressor) ID() uint8                         { return 42 }
+func (otherCompressor) Compress(b []byte) ([]byte, error) { return b[:1], nil }
+func (otherCompressor) Decompress(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func TestCompressionDict(t *testing.T) {
+	dict := []byte(`{"method":"GET","path":"/api/v1/items","status":200}`)
+	withDict := func(dict []byte) func(c *Config) {
+		return func(c *Config) {
+			c.Compression, _ = compress.NewFlate(flate.BestCompression)
+			c.CompressionDict = dict
+		}
+	}
+
+	// both hosts are configured with the same dictionary
+	var sent sync.Mutex
+	var compressed []int
+	tap := func(p *packet.Packet) *packet.Packet {
+		if carriesData(p) && p.IsCMP() {
+			sent.Lock()
+			compressed = append(compressed, len(p.Payload))
+			sent.Unlock()
+		}
+		return p
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, withDict(dict), withDict(dict))
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+
+	info, _ := acceptor.ConnInfo()
+	assert.True(t, info.Compressed)
+	opts, _ := dialer.RawHandshakeOptions()
+	assert.Equal(t, dictDigest(dict), opts.Sent[5:9], "after the compressor's ID")
+
+	msg := []byte(`{"method":"GET","path":"/api/v1/items/42","status":200}`)
+	go dialerApp.Write(msg)
+	received := make([]byte, len(msg))
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, received)
+	sent.Lock()
+	assert.Equal(t, 1, len(compressed), "a small message compresses with the dictionary")
+	sent.Unlock()
+
+	// the dictionaries differ, or only one host is configured with one
+	for name, opts := range map[string][2]func(c *Config){
+		"dictionaries differ":            {withDict(dict), withDict([]byte("another dictionary"))},
+		"remote host without dictionary": {withDict(dict), withCompression},
+		"local host without dictionary":  {withCompression, withDict(dict)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dialer, acceptor, _, _, dialErr, acceptErr := mockConnPair(t, nil, opts[0], opts[1])
+			assert.NotNil(t, acceptErr)
+			assert.NotNil(t, dialErr)
+			assert.Equal(t, CloseHandshakeFailed, dialer.CloseReason())
+			assert.Equal(t, CloseHandshakeFailed, acceptor.CloseReason())
+		})
+	}
+
+	// a host which does not compress at all is not refused
+	_, _, _, _, dialErr, acceptErr = mockConnPair(t, nil, withDict(dict), nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+}
+
+func TestCompressionDictConfig(t *testing.T) {
+	for _, opt := range []func(c *Config){
+		func(c *Config) { c.CompressionDict = []byte("no compressor") },
+		func(c *Config) {
+			c.Compression = &otherCompressor{} // cannot be primed
+			c.CompressionDict = []byte("dictionary")
+		},
+	} {
+		_, svc := net.Pipe()
+		c := Config{
+			LocalAddr:   testLocalAddr,
+			RemoteAddr:  testRemoteAddr,
+			Application: svc,
+			Network:     &mockNetwork{},
+		}
+		opt(&c)
+		_, err := New(c)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,178 @@
+package socket
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+// ErrReliable is the error returned by datagram operations
+// on a socket which is not in unreliable mode
+var ErrReliable = errors.New("datagrams are only supported by unreliable sockets")
+
+// ErrDatagramTooLarge is the error returned when writing a
+// datagram which does not fit in a single packet
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram sends data to the remote host as a single datagram, which
+// is sent once and may be lost, duplicated or received out of order. The
+// datagram must fit in a single packet, i.e. it can be no larger than the
+// socket's current payload size. Empty datagrams are not sent
+func (s *Socket) WriteDatagram(b []byte) error {
+	if !s.unreliable {
+		return ErrReliable
+	}
+	if err := s.writeErr(); err != nil {
+		return err
+	}
+	if len(b) > s.packetizer.Size() {
+		return ErrDatagramTooLarge
+	}
+
+	s.writes.acquire(0)
+	n, err := s.packetizer.PackAndForwardMessage(b)
+	s.writes.release()
+	atomic.AddUint64(&s.txPayloadBytes, uint64(n)) // stats
+	if n > 0 {
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not send datagram")
+	}
+	return nil
+}
+
+// WriteReliable sends data to the remote host as a single datagram, as
+// WriteDatagram does, except that the datagram is re-sent until the remote
+// host acknowledges it, e.g. for the few control messages of a protocol
+// whose other traffic is disposable. It is received (with ReadDatagram)
+// once, unless lost to a full datagram queue or a connection closing
+// first, but may be received out of order with regards to unreliable
+// datagrams. Reliable datagrams are sent one at a time: WriteReliable
+// waits for the previous one to be acknowledged before sending its own,
+// and returns once it is sent, rather than acknowledged
+func (s *Socket) WriteReliable(b []byte) error {
+	if !s.unreliable {
+		return ErrReliable
+	}
+	if err := s.writeErr(); err != nil {
+		return err
+	}
+	if len(b) > s.packetizer.Size() {
+		return ErrDatagramTooLarge
+	}
+
+	// only reliable datagrams are tracked, and acks are cumulative: the
+	// ack of a reliable datagram would clear any sent before it, lost or not
+	s.reliableWrites.Lock()
+	defer s.reliableWrites.Unlock()
+	select {
+	case <-s.atc.Idle():
+	case <-s.ctx.Done():
+	}
+	if err := s.writeErr(); err != nil {
+		return err
+	}
+
+	s.writes.acquire(0)
+	n, err := s.packetizer.PackAndForwardMessageWith(b, func(p *packet.Packet) error {
+		p.SetFlagREL()
+		p.SetSum()
+		s.tag(p)
+		return s.atc.Send(p)
+	})
+	s.writes.release()
+	atomic.AddUint64(&s.txPayloadBytes, uint64(n)) // stats
+	if n > 0 {
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not send reliable datagram")
+	}
+	return nil
+}
+
+// ReadDatagram blocks until a datagram is received from the remote host
+// and returns it, or returns an error once the socket is closed or shuts
+// down (ErrConnReset if the connection was reset, ErrConnClosed otherwise).
+// In non-blocking mode it returns ErrWouldBlock while no datagram is queued
+// (see ReadReady)
+func (s *Socket) ReadDatagram() ([]byte, error) {
+	if !s.unreliable {
+		return nil, ErrReliable
+	}
+
+	// datagrams already queued are read first
+	select {
+	case d := <-s.datagrams:
+		atomic.AddInt64(&s.datagramBytes, -int64(len(d)))
+		return d, nil
+	default:
+	}
+
+	if s.isNonBlocking() && s.ctx.Err() == nil {
+		return nil, ErrWouldBlock
+	}
+	select {
+	case d := <-s.datagrams:
+		atomic.AddInt64(&s.datagramBytes, -int64(len(d)))
+		return d, nil
+	case <-s.ctx.Done():
+		if err := s.writeErr(); err != nil {
+			return nil, err
+		}
+		return nil, ErrConnClosed
+	}
+}
+
+// queueDatagram queues a data packet's payload to be read with ReadDatagram,
+// dropping it (and counting it) if the queue is full, and returns whether
+// it was queued. Datagrams carry no ordering guarantees: the next expected
+// sequence number only moves forward, and only to keep the receive window
+// following the remote host's data
+func (s *Socket) queueDatagram(p *packet.Packet) bool {
+	if s.inReceiveWindow(p) {
+		s.rxNext = p.SeqNo + uint32(len(p.Payload))
+	}
+
+	// counted before it is queued, so that it is never read uncounted
+	atomic.AddInt64(&s.datagramBytes, int64(len(p.Payload)))
+	select {
+	case s.datagrams <- p.Payload:
+		atomic.AddUint64(&s.rxBytes, uint64(len(p.Payload))) // stats
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+		s.signalReadReady()
+		return true
+	default:
+		atomic.AddInt64(&s.datagramBytes, -int64(len(p.Payload)))
+		atomic.AddUint64(&s.dropped, 1)
+		atomic.AddUint64(&s.drops.DatagramQueueFull, 1) // stats
+		return false
+	}
+}
+
+// queueReliableDatagram queues a reliable datagram (see WriteReliable) as
+// queueDatagram does and acknowledges it, unless the queue is full, in
+// which case it is left to be re-sent. A retransmission of the last one
+// received (whose ACK was lost) is acknowledged again, but not queued twice
+func (s *Socket) queueReliableDatagram(p *packet.Packet) {
+	end := p.SeqNo + uint32(len(p.Payload))
+	if s.rxReliable && int32(end-s.rxReliableEnd) <= 0 {
+		atomic.AddUint64(&s.drops.Duplicate, 1) // stats
+	} else if s.queueDatagram(p) {
+		s.rxReliableEnd, s.rxReliable = end, true
+	} else {
+		return
+	}
+
+	// the datagram alone is acknowledged: the data before it may be lost
+	// unreliable datagrams, which the remote host does not wait on
+	atomic.AddUint64(&s.acksSent, 1) // stats
+	s.packetizer.SetAckNo(end)
+	if err := s.packetizer.SendControlPacket(false, true, false, false); err != nil {
+		log.Printf("[rdtp socket %s] Error sending ACK: %s", s.logID(), err)
+	}
+}
@@ -0,0 +1,162 @@
+package socket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDatagram(t *testing.T) {
+	sent := make(chan *packet.Packet, 10)
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	}, func(c *Config) {
+		c.Unreliable = true
+		c.AckWait = time.Millisecond * 5
+	})
+	defer s.atc.Close()
+
+	assert.Nil(t, s.WriteDatagram([]byte("first")))
+	assert.Nil(t, s.WriteDatagram([]byte("second")))
+	assert.Equal(t, ErrDatagramTooLarge, s.WriteDatagram(make([]byte, s.packetizer.Size()+1)))
+
+	// datagrams are sent once, as discrete packets, and never re-sent
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 2, len(sent))
+	assert.Equal(t, []byte("first"), (<-sent).Payload)
+	assert.Equal(t, []byte("second"), (<-sent).Payload)
+	assert.Equal(t, 0, s.atc.InFlight())
+}
+
+func TestReadDatagram(t *testing.T) {
+	sent := make(chan *packet.Packet, 10)
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	}, func(c *Config) {
+		c.Unreliable = true
+	})
+	s.rxNext = 1000
+
+	mockDatagram := func(seq uint32, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		return p
+	}
+
+	// a gap (lost data), a packet received out of order, and a duplicate
+	s.Deliver(mockDatagram(1000, "one"))
+	s.Deliver(mockDatagram(1020, "three"))
+	s.Deliver(mockDatagram(1010, "two"))
+	s.Deliver(mockDatagram(1020, "three"))
+	s.Deliver(mockDatagram(1000+1<<31, "injected")) // outside of the window
+	go s.Run()
+
+	for _, expected := range []string{"one", "three", "two", "three"} {
+		d, err := s.ReadDatagram()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(d))
+	}
+
+	// datagrams are not acknowledged
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, 0, len(sent))
+	assert.Equal(t, uint64(len("one")+len("three")*2+len("two")), s.RxBytes())
+
+	s.Close()
+	_, err := s.ReadDatagram()
+	assert.Equal(t, ErrConnClosed, err)
+}
+
+func TestDatagramsReliable(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+
+	assert.Equal(t, ErrReliable, s.WriteDatagram([]byte("datagram")))
+	assert.Equal(t, ErrReliable, s.WriteReliable([]byte("datagram")))
+	_, err := s.ReadDatagram()
+	assert.Equal(t, ErrReliable, err)
+}
+
+func TestWriteReliable(t *testing.T) {
+	// the first transmission of every data packet and the first ACK are
+	// lost, so only re-sent (i.e. reliable) datagrams are ever received
+	var lossy sync.Mutex
+	seen, ackLost := make(map[uint32]bool), false
+	lose := func(p *packet.Packet) bool {
+		lossy.Lock()
+		defer lossy.Unlock()
+
+		if len(p.Payload) == 0 {
+			lost := p.IsACK() && !ackLost
+			ackLost = ackLost || p.IsACK()
+			return lost
+		}
+		lost := !seen[p.SeqNo]
+		seen[p.SeqNo] = true
+		return lost
+	}
+	link := func(to **Socket) func(p *packet.Packet) error {
+		return func(p *packet.Packet) error {
+			if lose(p) {
+				return nil
+			}
+			// retransmissions must not share the packet with the receiver
+			cp := *p
+			cp.Payload = append([]byte(nil), p.Payload...)
+			time.AfterFunc(time.Millisecond, func() { (*to).Deliver(&cp) })
+			return nil
+		}
+	}
+
+	var a, b *Socket
+	a, _ = mockSocket(t, &mockNetwork{sendFunc: link(&b)}, func(c *Config) {
+		c.Unreliable = true
+		c.AckWait = time.Millisecond * 20
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	b, _ = mockSocket(t, &mockNetwork{sendFunc: link(&a)}, func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		c.Unreliable = true
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	go a.Run()
+	go b.Run()
+	defer a.Close()
+	defer b.Close()
+
+	assert.Nil(t, a.WriteDatagram([]byte("telemetry 1")))
+	assert.Nil(t, a.WriteReliable([]byte("control 1")))
+	assert.Nil(t, a.WriteDatagram([]byte("telemetry 2")))
+	assert.Nil(t, a.WriteReliable([]byte("control 2"))) // once control 1 is acknowledged
+	assert.Equal(t, ErrDatagramTooLarge, a.WriteReliable(make([]byte, a.packetizer.Size()+1)))
+
+	for _, expected := range []string{"control 1", "control 2"} {
+		d, err := b.ReadDatagram()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(d))
+	}
+	select {
+	case <-a.atc.Idle():
+	case <-time.After(time.Second):
+		t.Fatal("reliable datagram not acknowledged")
+	}
+
+	// the retransmission of control 1 (whose ACK was lost) is not queued
+	// twice, and the unreliable datagrams are never re-sent
+	time.Sleep(time.Millisecond * 50)
+	b.SetNonBlocking(true)
+	_, err := b.ReadDatagram()
+	assert.Equal(t, ErrWouldBlock, err)
+	assert.True(t, b.Stats().Drops.Duplicate >= 1)
+}
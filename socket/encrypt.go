@@ -0,0 +1,60 @@
+package socket
+
+import (
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/encrypt"
+	"github.com/pkg/errors"
+)
+
+// encrypt returns the packet to send in place of the given one when the
+// connection is encrypted (see Config.Encryption): a copy of a data packet
+// (or of a FWD, whose skip count is authenticated) with its payload sealed.
+// Other packets (SYNs carry this host's key share, see synOptions), and
+// every packet of a connection which is not encrypted, are sent as is
+func (s *Socket) encrypt(p *packet.Packet) (*packet.Packet, error) {
+	if s.encryption == nil {
+		return p, nil
+	}
+	if !carriesData(p) && !p.IsFWD() {
+		return p, nil
+	}
+	session, ok := s.session.Load().(*encrypt.Session)
+	if !ok {
+		return nil, errors.New("could not seal payload, no keys exchanged yet")
+	}
+	return session.Seal(p)
+}
+
+// decrypt opens the sealed payload of a data packet (or FWD) received in place,
+// when the connection is encrypted, or returns an error if it fails authentication
+func (s *Socket) decrypt(p *packet.Packet) error {
+	if s.encryption == nil {
+		return nil
+	}
+	session, ok := s.session.Load().(*encrypt.Session)
+	if !ok {
+		return errors.New("could not open payload, no keys exchanged yet")
+	}
+	return session.Open(p)
+}
+
+// exchangeKeys establishes the session of an encrypted connection from the
+// remote host's key share, carried by the options of the SYN (or SYN ACK)
+// received (see parseSynOptions). It returns an error (wrapping
+// encrypt.ErrNoKeyShare if there is none) unless the remote host encrypts
+// with the same suite
+func (s *Socket) exchangeKeys(share []byte) error {
+	if s.encryption == nil {
+		return nil
+	}
+	peerKey, err := s.encryption.PeerKey(share)
+	if err != nil {
+		return errors.Wrap(err, "connect handshake failed to negotiate encryption")
+	}
+	session, err := encrypt.NewSession(s.encryption, s.privateKey, s.publicKey, peerKey)
+	if err != nil {
+		return errors.Wrap(err, "connect handshake failed to negotiate encryption")
+	}
+	s.session.Store(session)
+	return nil
+}
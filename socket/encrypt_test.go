@@ -0,0 +1,229 @@
+package socket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/handshake"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/encrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func withEncryption(c *Config) { c.Encryption = encrypt.P256AES128GCM() }
+
+func TestEncryption(t *testing.T) {
+	var sent sync.Mutex
+	var sealed [][]byte
+	tap := func(p *packet.Packet) *packet.Packet {
+		if carriesData(p) {
+			sent.Lock()
+			sealed = append(sealed, append([]byte(nil), p.Payload...))
+			sent.Unlock()
+		}
+		return p
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, withEncryption, withEncryption)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+
+	for _, s := range []*Socket{dialer, acceptor} {
+		info, ok := s.ConnInfo()
+		assert.True(t, ok)
+		assert.True(t, info.Encrypted)
+		assert.Equal(t, packet.MaxPayloadBytes-16, info.PayloadSize, "room for the tag")
+		opts, _ := s.RawHandshakeOptions()
+		assert.Equal(t, 2+2+1+65, len(opts.Sent), "MSS and key share option")
+		assert.Equal(t, 2+2+1+65, len(opts.Received))
+		assert.NotEqual(t, opts.Sent, opts.Received)
+	}
+
+	// data spanning several packets, both ways
+	data := make([]byte, 5000)
+	rand.Read(data)
+	go dialerApp.Write(data)
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, received))
+
+	go acceptorApp.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(dialerApp, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("reply"), reply)
+
+	// no data was sent in the clear
+	sent.Lock()
+	defer sent.Unlock()
+	assert.True(t, len(sealed) >= 4)
+	for _, payload := range sealed {
+		assert.True(t, len(payload) <= packet.MaxPayloadBytes)
+		assert.False(t, bytes.Contains(data, payload[:32]))
+	}
+	assert.Equal(t, uint64(0), acceptor.Stats().Drops.Unauthentic)
+}
+
+func TestEncryptionNotNegotiated(t *testing.T) {
+	// the remote host does not encrypt (and is reset)
+	dialer, _, _, _, dialErr, _ := mockConnPair(t, nil, withEncryption, nil)
+	assert.True(t, errors.Is(dialErr, encrypt.ErrNoKeyShare), "%v", dialErr)
+	_, ok := dialer.ConnInfo()
+	assert.False(t, ok)
+	assert.Equal(t, CloseHandshakeFailed, dialer.CloseReason())
+
+	// nor does the local host
+	_, acceptor, _, _, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {}, withEncryption)
+	assert.True(t, errors.Is(acceptErr, encrypt.ErrNoKeyShare), "%v", acceptErr)
+	assert.True(t, errors.Is(dialErr, handshake.ErrConnectionRefused), "%v", dialErr)
+	assert.Equal(t, CloseHandshakeFailed, acceptor.CloseReason())
+
+	// the remote host encrypts with another suite
+	other := func(c *Config) {
+		c.Encryption = encrypt.P256AES128GCM()
+		c.Encryption.ID = 2
+	}
+	_, _, _, _, _, acceptErr = mockConnPair(t, nil, other, withEncryption)
+	assert.NotNil(t, acceptErr)
+}
+
+func TestEncryptionTamper(t *testing.T) {
+	// the first data packet is tampered with on the way, its
+	// checksum set accordingly (i.e. by an attacker on the path)
+	var tamper sync.Once
+	tap := func(p *packet.Packet) *packet.Packet {
+		if !carriesData(p) {
+			return p
+		}
+		tampered := p
+		tamper.Do(func() {
+			c := *p
+			c.Payload = append([]byte(nil), p.Payload...)
+			c.Payload[0] ^= 0x01
+			c.SetSum()
+			tampered = &c
+		})
+		return tampered
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, withEncryption, withEncryption)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+
+	// dropped, then delivered intact once re-sent
+	go dialerApp.Write([]byte("sensitive data"))
+	received := make([]byte, 14)
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("sensitive data"), received)
+	assert.Equal(t, uint64(1), acceptor.Stats().Drops.Unauthentic)
+	assert.Equal(t, uint64(0), acceptor.Stats().Drops.BadChecksum)
+
+	// data injected in the clear is dropped too
+	info, _ := acceptor.ConnInfo()
+	p, _ := packet.NewPacket(testLocalAddr.Port, testRemoteAddr.Port, []byte("injected data"))
+	p.SetSeqNo(info.RemoteISN + 1 + 14)
+	p.SetEpoch(info.RemoteEpoch) // sent in the clear
+	p.SetSum()
+	acceptor.Deliver(p)
+	assert.Eventually(t, func() bool {
+		return acceptor.Stats().Drops.Unauthentic == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(14), acceptor.Stats().RxBytes)
+}
+
+func TestEncryptionForward(t *testing.T) {
+	// data is lost until abandoned, and the FWD skipping it is sealed
+	var lock sync.Mutex
+	var fwd *packet.Packet
+	tap := func(p *packet.Packet) *packet.Packet {
+		lock.Lock()
+		defer lock.Unlock()
+		if p.IsFWD() && p.ForwardBytes() > 0 && fwd == nil {
+			fwd = p
+		}
+		if carriesData(p) && fwd == nil {
+			return nil
+		}
+		return p
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, withEncryption, withEncryption)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+
+	_, err := dialer.WriteWithDeadline([]byte("stale"), time.Now().Add(time.Millisecond*200))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return acceptor.NextAckNo() == dialer.NextSeqNo()
+	}, time.Second*5, time.Millisecond, "data skipped")
+	lock.Lock()
+	assert.Equal(t, 2+16, len(fwd.Payload), "skip count and tag")
+	lock.Unlock()
+
+	go dialerApp.Write([]byte("fresh"))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fresh"), received)
+
+	// a FWD forged on the path to skip data is dropped
+	info, _ := acceptor.ConnInfo()
+	forged := packet.NewForwardPacket(testLocalAddr.Port, testRemoteAddr.Port, dialer.NextSeqNo(), 5)
+	forged.SetEpoch(info.RemoteEpoch)
+	forged.SetSum()
+	acceptor.Deliver(forged)
+	assert.Eventually(t, func() bool {
+		return acceptor.Stats().Drops.Unauthentic == 1
+	}, time.Second, time.Millisecond)
+
+	// and the data it would have skipped is delivered
+	go dialerApp.Write([]byte("after"))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after"), received)
+}
+
+func TestEncryptionConfig(t *testing.T) {
+	for _, opt := range []func(c *Config){
+		func(c *Config) { c.Encryption = &encrypt.Suite{} },
+		func(c *Config) {
+			c.Encryption = encrypt.P256AES128GCM()
+			c.Encryption.KeySize = 7
+		},
+		func(c *Config) {
+			withEncryption(c)
+			c.MSS = packet.HeaderByteSize + 16 // no room for data
+		},
+	} {
+		_, svc := net.Pipe()
+		c := Config{
+			LocalAddr:   testLocalAddr,
+			RemoteAddr:  testRemoteAddr,
+			Application: svc,
+			Network:     &mockNetwork{},
+		}
+		opt(&c)
+		_, err := New(c)
+		assert.NotNil(t, err)
+	}
+
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		withEncryption(c)
+		c.MSS = packet.HeaderByteSize + 17
+	})
+	assert.Equal(t, 1, s.packetizer.Size())
+}
@@ -1,31 +1,409 @@
 package socket
 
 import (
+	"context"
+	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/adrianosela/rdtp/handshake"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
 )
 
 const (
 	handshakeResponseTimeout = time.Second * 1
 )
 
-// Dial sends a SYN, waits for a SYN ACK, and sends an ACK
+// ConnInfo describes the parameters a connection was established with.
+// rdtp packets carry no options in their header: both hosts exchange their
+// initial sequence numbers and epochs, and the MSS proposed by each is
+// carried in the payload of its SYN (see RawHandshakeOptions), along with
+// its options (see synOptions)
+type ConnInfo struct {
+	LocalISN      uint32 // initial sequence number sent
+	RemoteISN     uint32 // initial sequence number received
+	LocalEpoch    uint16 // sent on every packet (see Config.EpochSource)
+	RemoteEpoch   uint16 // received, packets bearing another are dropped
+	MSS           int    // settled on at handshake (see Config.MSS)
+	PayloadSize   int    // at handshake, may shrink later (see DebugInfo)
+	Encrypted     bool   // payloads are sealed (see Config.Encryption)
+	Compressed    bool   // payloads are compressed (see Config.Compression)
+	TraceTags     bool   // data packets carry trace tags (see Config.TraceTags)
+	AppHeaderSize int    // size of the application header of data packets (see Config.AppHeaderSize)
+}
+
+// HandshakeOptions are the raw option bytes exchanged at handshake,
+// i.e. the payloads of the SYN sent and of the SYN (or SYN ACK) received
+type HandshakeOptions struct {
+	Sent     []byte
+	Received []byte // nil if the remote host proposed nothing
+}
+
+// Dial sends a SYN, waits for a SYN ACK, and sends an ACK.
+// The SYN is re-sent with exponential backoff if the remote host does not respond.
+// If the remote host is dialing at the same time, their SYNs cross and the
+// connection is established by a simultaneous open (see handshake)
 func (s *Socket) Dial() error {
-	return handshake.InitiateConnection(s.inbound, handshakeResponseTimeout, s.packetizer.SendControlPacket)
+	return s.dial(nil)
+}
+
+// DialWithInitialData dials as Dial does, but the ACK completing the
+// handshake carries initial application data, which saves a round trip
+// (as TCP may send data on its final ACK). Unlike data sent on the SYN
+// (0-RTT), the data is only sent once the remote host answered the SYN, so
+// it never reaches a host which did not accept the connection. It is sent
+// as if written to the socket right after the handshake (i.e. re-sent until
+// acknowledged, and split onto several packets if need be, the first of
+// which completes the handshake), and delivered by the remote host once it
+// validated the handshake. After a simultaneous open, which completes with
+// no ACK, the data is sent right after the handshake
+func (s *Socket) DialWithInitialData(data []byte) error {
+	return s.dial(data)
 }
 
-// Accept sends a SYN ACK and waits for an ACK
+func (s *Socket) dial(initialData []byte) error {
+	sendCtrl := s.packetizer.SendControlPacket
+	if len(initialData) > 0 {
+		sendCtrl = func(syn, ack, fin, err bool) error {
+			if !syn && ack && !fin && !err {
+				return nil // carried by the initial data, once the MSS is settled on
+			}
+			return s.packetizer.SendControlPacket(syn, ack, fin, err)
+		}
+	}
+
+	s.setState(StateSynSent)
+	synack, err := handshake.InitiateConnectionWithRetries(s.inbound, handshakeResponseTimeout, s.maxSynRetries, sendCtrl)
+	if err != nil {
+		s.completeHandshake(err)
+		return err
+	}
+	s.rxNext = synack.SeqNo + 1 // the peer's SYN consumes a sequence number
+	s.peerEpoch = synack.Epoch
+	s.packetizer.SetAckNo(s.rxNext)
+	s.recordHandshakeOptions(synack.Payload)
+	if err := s.negotiate(synack); err != nil {
+		s.refuse()
+		s.completeHandshake(err)
+		return err
+	}
+	s.settleMSS(synack.MSS())
+	if len(initialData) > 0 {
+		if err := s.sendInitialData(initialData); err != nil {
+			s.completeHandshake(err)
+			return err
+		}
+	}
+	s.completeHandshake(nil)
+	return nil
+}
+
+// refuse answers the remote host with a reset (ERR) when the connection
+// cannot be established, e.g. as encryption failed to be negotiated
+func (s *Socket) refuse() {
+	if err := s.packetizer.SendControlPacket(false, false, false, true); err != nil {
+		log.Printf("[rdtp socket %s] Error refusing connection: %s", s.logID(), err)
+	}
+}
+
+// sendInitialData sends data as a write does, on packets acknowledging
+// the remote host's SYN (see DialWithInitialData)
+func (s *Socket) sendInitialData(data []byte) error {
+	s.writes.acquire(0)
+	n, err := s.packetizer.PackAndForwardMessageWith(data, func(p *packet.Packet) error {
+		p.SetFlagACK()
+		p.SetSum()
+		s.tag(p)
+		return s.atc.Send(p)
+	})
+	s.writes.release()
+	atomic.AddUint64(&s.txPayloadBytes, uint64(n)) // stats
+	atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	if err != nil {
+		return errors.Wrap(err, "connect handshake failed when sending initial data")
+	}
+	return nil
+}
+
+// Accept sends a SYN ACK and waits for an ACK. The SYN being answered
+// (and any re-sent SYN) may be delivered to the socket beforehand,
+// so that the MSS proposed by the remote host is taken into account.
+// It must be when encrypting (see Config.Encryption): the connection
+// is refused unless the SYN carries a key share of the same suite
 func (s *Socket) Accept() error {
-	return handshake.AcceptConnection(s.inbound, handshakeResponseTimeout, s.packetizer.SendControlPacket)
+	peerMSS := 0
+	var peerSyn *packet.Packet
+	for queued := true; queued; {
+		select {
+		case p := <-s.inbound:
+			if p.IsSYN() && !p.IsACK() {
+				peerMSS, peerSyn = p.MSS(), p
+			}
+		default:
+			queued = false
+		}
+	}
+	var peerOptions []byte
+	if peerSyn != nil {
+		peerOptions = peerSyn.Payload
+	}
+	s.recordHandshakeOptions(peerOptions)
+	if err := s.negotiate(peerSyn); err != nil {
+		s.refuse()
+		s.completeHandshake(err)
+		return err
+	}
+	s.settleMSS(peerMSS)
+
+	s.setState(StateSynReceived)
+	ack, err := handshake.AcceptConnection(s.inbound, handshakeResponseTimeout, s.packetizer.SendControlPacket)
+	if err != nil {
+		s.completeHandshake(err)
+		return err
+	}
+	s.rxNext = ack.SeqNo
+	s.peerEpoch = ack.Epoch
+	s.packetizer.SetAckNo(s.rxNext)
+	if len(ack.Payload) > 0 {
+		s.handshakeData = ack // delivered first thing once running (see receive)
+	}
+	s.completeHandshake(nil)
+	return nil
+}
+
+// MSS returns the maximum segment size (packet size incl. header) of the
+// connection: the smaller of the MSS proposed by each host at handshake,
+// or the MSS proposed by this host until the handshake completes
+func (s *Socket) MSS() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.mss
+}
+
+// settleMSS settles on the smaller of the MSS proposed by this host and
+// the one proposed by the remote host (zero if none), and sizes packets
+// accordingly. Packets are never grown, e.g. past a custom factory's size
+func (s *Socket) settleMSS(peerMSS int) {
+	s.Lock()
+	if peerMSS >= packet.MinMSS && peerMSS < s.mss {
+		s.mss = peerMSS
+	}
+	size := s.mss - packet.HeaderByteSize - s.sealOverhead - s.traceOverhead() - s.appHeaderSize
+	s.Unlock()
+
+	if size < s.packetizer.Size() {
+		s.shrinkPackets(size)
+		if !s.fixedMTU && !s.unreliable {
+			s.atc.DetectBlackHoles(size, s.shrinkPackets)
+		}
+	}
+}
+
+// kinds of the options a SYN (or SYN ACK) carries after the MSS, each
+// encoded as its kind and the length of its value (a byte each) followed
+// by its value. Options of unknown kinds are ignored
+const (
+	optCompression = 1 // the compressor's ID and dictionary digest (see Config.Compression)
+	optTraceTags   = 2 // no value (see Config.TraceTags)
+	optKeyShare    = 3 // the suite's ID and public key (see Config.Encryption)
+	optAppHeader   = 4 // the header's size, a byte (see Config.AppHeaderSize)
+)
+
+// withOptions returns the packet to send in place of the given one when
+// offering options (compression, trace tags or application headers) or
+// encrypting: a copy of a SYN (or SYN ACK) carrying this host's options
+// (see synOptions). Other packets are sent as is
+func (s *Socket) withOptions(p *packet.Packet) *packet.Packet {
+	if !p.IsSYN() || (s.compression == nil && !s.traceTags && s.appHeaderSize == 0 && s.encryption == nil) {
+		return p
+	}
+	syn := *p
+	syn.Payload = s.synOptions(p.Payload)
+	syn.Length = uint16(len(syn.Payload))
+	syn.SetSum()
+	return &syn
+}
+
+// synOptions returns the payload of a SYN (or SYN ACK): the MSS proposed
+// (zero if none), followed by the options of this host: the compression
+// offered (see Config.Compression), trace tags (see Config.TraceTags),
+// the size of application headers (see Config.AppHeaderSize) and its
+// key share when encrypting (see Config.Encryption)
+func (s *Socket) synOptions(mss []byte) []byte {
+	options := make([]byte, 2)
+	copy(options, mss)
+	if s.compression != nil {
+		options = appendOption(options, optCompression, s.compressionOption())
+	}
+	if s.traceTags {
+		options = appendOption(options, optTraceTags, nil)
+	}
+	if s.appHeaderSize > 0 {
+		options = appendOption(options, optAppHeader, []byte{uint8(s.appHeaderSize)})
+	}
+	if s.encryption != nil {
+		options = appendOption(options, optKeyShare, s.encryption.KeyShare(s.publicKey))
+	}
+	return options
+}
+
+// appendOption appends an option of the given kind to the options of a SYN
+func appendOption(options []byte, kind uint8, value []byte) []byte {
+	return append(append(options, kind, uint8(len(value))), value...)
+}
+
+// parseSynOptions returns the options carried by a SYN (or SYN ACK)
+// received after the MSS (if any), by kind. Options are parsed up to
+// the first one which is truncated
+func parseSynOptions(syn *packet.Packet) map[uint8][]byte {
+	options := make(map[uint8][]byte)
+	if syn == nil || len(syn.Payload) <= 2 {
+		return options
+	}
+	for b := syn.Payload[2:]; len(b) >= 2 && len(b) >= 2+int(b[1]); b = b[2+int(b[1]):] {
+		options[b[0]] = b[2 : 2+int(b[1])]
+	}
+	return options
+}
+
+// negotiate settles on the compression, trace tags and application headers,
+// and establishes the encryption (if any) of the connection from the options
+// of the SYN (or SYN ACK) received from the remote host, nil if none was. It
+// returns an error if the connection cannot be established, e.g. as
+// encryption failed to be negotiated or compression dictionaries differ
+func (s *Socket) negotiate(syn *packet.Packet) error {
+	options := parseSynOptions(syn)
+	if err := s.negotiateCompression(options[optCompression]); err != nil {
+		return err
+	}
+	if err := s.negotiateAppHeaders(options[optAppHeader]); err != nil {
+		return err
+	}
+	_, traceTags := options[optTraceTags]
+	s.negotiateTraceTags(traceTags)
+	return s.exchangeKeys(options[optKeyShare])
+}
+
+// recordHandshakeOptions records the option bytes received from the remote
+// host along with those sent, i.e. the MSS proposed by this host. Must be
+// called before the MSS is settled on
+func (s *Socket) recordHandshakeOptions(received []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	syn := &packet.Packet{Flags: uint8(packet.FlagSYN)}
+	syn.SetMSS(uint16(s.mss))
+	syn = s.withOptions(syn)
+	s.handshakeOpts = HandshakeOptions{Sent: syn.Payload}
+	if len(received) > 0 {
+		s.handshakeOpts.Received = append([]byte(nil), received...)
+	}
+}
+
+// HandshakeComplete blocks until the connection handshake (Dial or Accept)
+// completes or the context is done, whichever happens first. It returns
+// the handshake's error (if any), or the context's error if the context
+// is done first. It returns immediately if the handshake already completed
+func (s *Socket) HandshakeComplete(ctx context.Context) error {
+	select {
+	case <-s.handshakeDone:
+		return s.handshakeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ConnInfo returns the parameters the connection was established with,
+// and false if the connection handshake has not (successfully) completed
+func (s *Socket) ConnInfo() (ConnInfo, bool) {
+	select {
+	case <-s.handshakeDone:
+		return s.connInfo, s.handshakeErr == nil
+	default:
+		return ConnInfo{}, false
+	}
+}
+
+// RawHandshakeOptions returns the raw option bytes exchanged at handshake
+// (rather than the values interpreted from them, see ConnInfo), e.g. to
+// compare the wire-level behavior of implementations interoperating,
+// and false if the connection handshake has not (successfully) completed
+func (s *Socket) RawHandshakeOptions() (HandshakeOptions, bool) {
+	select {
+	case <-s.handshakeDone:
+		if s.handshakeErr != nil {
+			return HandshakeOptions{}, false
+		}
+	default:
+		return HandshakeOptions{}, false
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.handshakeOpts, true
+}
+
+// completeHandshake records the outcome of the connection handshake
+// (and, if successful, the parameters of the connection) and unblocks
+// all callers of HandshakeComplete. Only the first call has any effect
+func (s *Socket) completeHandshake(err error) {
+	s.handshakeOnce.Do(func() {
+		if err == nil {
+			// right after the handshake, each SYN consumed a sequence number
+			s.connInfo = ConnInfo{
+				LocalISN:      s.packetizer.SeqNo() - 1,
+				RemoteISN:     s.rxNext - 1,
+				LocalEpoch:    s.epoch,
+				RemoteEpoch:   s.peerEpoch,
+				MSS:           s.MSS(),
+				PayloadSize:   s.packetizer.Size(),
+				Encrypted:     s.session.Load() != nil,
+				Compressed:    atomic.LoadUint32(&s.compressing) == 1,
+				TraceTags:     atomic.LoadUint32(&s.tracing) == 1,
+				AppHeaderSize: s.appHeaderSize,
+			}
+		}
+		s.handshakeErr = err
+		if err != nil {
+			s.recordCloseReason(CloseHandshakeFailed)
+			s.setState(StateClosed)
+		} else {
+			s.setState(StateEstablished)
+		}
+		close(s.handshakeDone)
+	})
+}
+
+// sendFinControlPacket sends the control packets of the termination
+// handshake, attaching the final payload (if any, see CloseWith) to the FIN
+func (s *Socket) sendFinControlPacket(syn, ack, fin, err bool) error {
+	s.RLock()
+	payload := s.finPayload
+	s.RUnlock()
+
+	if fin && !ack && len(payload) > 0 {
+		if sendErr := s.packetizer.SendFIN(payload); sendErr != nil {
+			return sendErr
+		}
+		atomic.AddUint64(&s.txPayloadBytes, uint64(len(payload))) // stats
+		return nil
+	}
+	return s.packetizer.SendControlPacket(syn, ack, fin, err)
 }
 
 // finish manages the termination handshake
 func (s *Socket) finish() error {
 	select {
 	case <-s.fin:
+		s.recordCloseReason(ClosePeer)
+		s.setState(StateCloseWait)
 		return handshake.AcceptDisconnection(s.inbound, handshakeResponseTimeout, s.packetizer.SendControlPacket)
 	default:
-		return handshake.InitiateDisconnection(s.inbound, handshakeResponseTimeout, s.packetizer.SendControlPacket)
+		s.recordCloseReason(CloseLocal)
+		s.setState(StateFinWait)
+		return handshake.InitiateDisconnection(s.inbound, handshakeResponseTimeout, s.sendFinControlPacket)
 	}
 }
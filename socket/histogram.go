@@ -0,0 +1,152 @@
+package socket
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+)
+
+// default bucket boundaries of the histograms (see Config.RTTBuckets
+// and Config.PayloadBuckets)
+var (
+	defaultRTTBuckets = []time.Duration{
+		time.Millisecond, time.Millisecond * 2, time.Millisecond * 5,
+		time.Millisecond * 10, time.Millisecond * 20, time.Millisecond * 50,
+		time.Millisecond * 100, time.Millisecond * 200, time.Millisecond * 500,
+		time.Second, time.Second * 2, time.Second * 5,
+	}
+	defaultPayloadBuckets = []int{64, 128, 256, 512, 1024, packet.MaxPayloadBytes}
+)
+
+// Histograms are the distributions of a connection's samples, which
+// averages hide (e.g. tail latency)
+type Histograms struct {
+	// round trip times of pings only (see Ping and WarmUp), in
+	// nanoseconds: acknowledgements of data are not sampled, so the
+	// histogram stays empty on a connection which never pings
+	RTT Histogram
+
+	// payload sizes of the data packets sent to the network (incl.
+	// retransmissions) and of those received (incl. out of order ones)
+	TxPayload Histogram
+	RxPayload Histogram
+}
+
+// Histogram is a snapshot of the counts of samples by bucket: Counts[i]
+// counts the samples no greater than Bounds[i] (and greater than the
+// previous bound), and the last count those greater than every bound
+type Histogram struct {
+	Bounds []int64
+	Counts []uint64
+}
+
+// Total returns the number of samples counted
+func (h Histogram) Total() uint64 {
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	return total
+}
+
+// Quantile returns the upper bound of the bucket the given quantile of the
+// samples (e.g. 0.99 for the p99) falls within: math.MaxInt64 if greater
+// than every bound, zero if there are no samples
+func (h Histogram) Quantile(q float64) int64 {
+	total := h.Total()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		if seen += n; seen >= rank {
+			if i < len(h.Bounds) {
+				return h.Bounds[i]
+			}
+			break
+		}
+	}
+	return math.MaxInt64
+}
+
+// histogram counts samples by bucket. Its bounds are fixed and its counts
+// updated atomically, so that samples can be taken without locking
+type histogram struct {
+	bounds []int64
+	counts []uint64 // one more than bounds
+}
+
+// newHistogram returns a histogram of the given bucket bounds, which
+// must be positive and in increasing order
+func newHistogram(bounds []int64) (*histogram, error) {
+	for i, b := range bounds {
+		if b <= 0 || (i > 0 && b <= bounds[i-1]) {
+			return nil, fmt.Errorf("invalid histogram bucket bounds %v, must be positive and increasing", bounds)
+		}
+	}
+	return &histogram{
+		bounds: append([]int64(nil), bounds...),
+		counts: make([]uint64, len(bounds)+1),
+	}, nil
+}
+
+// sample counts a sample in its bucket
+func (h *histogram) sample(v int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return h.bounds[i] >= v })
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+// snapshot returns the histogram's current counts
+func (h *histogram) snapshot() Histogram {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return Histogram{Bounds: append([]int64(nil), h.bounds...), Counts: counts}
+}
+
+// Histograms returns a snapshot of the connection's histograms
+func (s *Socket) Histograms() Histograms {
+	return Histograms{
+		RTT:       s.rttHist.snapshot(),
+		TxPayload: s.txPayloadHist.snapshot(),
+		RxPayload: s.rxPayloadHist.snapshot(),
+	}
+}
+
+// newHistograms returns the histograms of the given (or default) bounds
+func newHistograms(c Config) (rtt, txPayload, rxPayload *histogram, err error) {
+	rttBuckets := c.RTTBuckets
+	if len(rttBuckets) == 0 {
+		rttBuckets = defaultRTTBuckets
+	}
+	rttBounds := make([]int64, len(rttBuckets))
+	for i, b := range rttBuckets {
+		rttBounds[i] = int64(b)
+	}
+	if rtt, err = newHistogram(rttBounds); err != nil {
+		return nil, nil, nil, err
+	}
+
+	payloadBuckets := c.PayloadBuckets
+	if len(payloadBuckets) == 0 {
+		payloadBuckets = defaultPayloadBuckets
+	}
+	payloadBounds := make([]int64, len(payloadBuckets))
+	for i, b := range payloadBuckets {
+		payloadBounds[i] = int64(b)
+	}
+	if txPayload, err = newHistogram(payloadBounds); err != nil {
+		return nil, nil, nil, err
+	}
+	rxPayload, _ = newHistogram(payloadBounds)
+	return rtt, txPayload, rxPayload, nil
+}
@@ -0,0 +1,114 @@
+package socket
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	c := Config{}
+	rtt, _, _, err := newHistograms(c)
+	assert.Nil(t, err)
+
+	for _, sample := range []time.Duration{
+		time.Microsecond * 500, // up to 1ms
+		time.Millisecond,       // bounds are inclusive
+		time.Millisecond * 3,   // up to 5ms
+		time.Millisecond * 40,  // up to 50ms
+		time.Millisecond * 45,
+		time.Millisecond * 45,
+		time.Second,
+		time.Second * 10, // greater than every bound
+	} {
+		rtt.sample(int64(sample))
+	}
+
+	h := rtt.snapshot()
+	assert.Equal(t, len(defaultRTTBuckets)+1, len(h.Counts))
+	assert.Equal(t, []uint64{2, 0, 1, 0, 0, 3, 0, 0, 0, 1, 0, 0, 1}, h.Counts)
+	assert.Equal(t, uint64(8), h.Total())
+	assert.Equal(t, int64(time.Millisecond*50), h.Quantile(0.5))
+	assert.Equal(t, int64(time.Second), h.Quantile(0.8))
+	assert.Equal(t, int64(math.MaxInt64), h.Quantile(0.99))
+	assert.Equal(t, int64(time.Millisecond), h.Quantile(0))
+
+	// snapshots are copies
+	rtt.sample(int64(time.Millisecond))
+	assert.Equal(t, uint64(2), h.Counts[0])
+	assert.Equal(t, int64(0), Histogram{}.Quantile(0.5), "no samples")
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	_, txPayload, _, err := newHistograms(Config{PayloadBuckets: []int{100, 1000}})
+	assert.Nil(t, err)
+	txPayload.sample(100)
+	txPayload.sample(101)
+	txPayload.sample(5000)
+	h := txPayload.snapshot()
+	assert.Equal(t, []int64{100, 1000}, h.Bounds)
+	assert.Equal(t, []uint64{1, 1, 1}, h.Counts)
+
+	for _, c := range []Config{
+		{PayloadBuckets: []int{1000, 100}},
+		{PayloadBuckets: []int{100, 100}},
+		{PayloadBuckets: []int{0, 100}},
+		{RTTBuckets: []time.Duration{-time.Millisecond}},
+	} {
+		_, _, _, err := newHistograms(c)
+		assert.NotNil(t, err, "%+v", c)
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	a, b := mockLink(t, time.Millisecond*20)
+	go a.Run()
+	go b.Run()
+
+	for i := 0; i < 3; i++ {
+		_, err := a.Ping(context.Background())
+		assert.Nil(t, err)
+	}
+
+	// round trips of 40ms and a bit over
+	h := a.Histograms()
+	assert.Equal(t, uint64(3), h.RTT.Total())
+	assert.True(t, h.RTT.Quantile(0.5) >= int64(time.Millisecond*50))
+	assert.True(t, h.RTT.Quantile(1) <= int64(time.Millisecond*500))
+	assert.Equal(t, uint64(0), h.TxPayload.Total(), "pings carry no data")
+	assert.Equal(t, uint64(0), b.Histograms().RxPayload.Total(), "pings carry no data")
+
+	var s *Socket
+	var app net.Conn
+	s, app = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			go s.atc.Ack(p.SeqNo + uint32(len(p.Payload)))
+			return nil
+		},
+	}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	defer s.atc.Close()
+	s.completeHandshake(nil)
+	go io.Copy(ioutil.Discard, app)
+
+	_, err := s.Write(make([]byte, 1000))
+	assert.Nil(t, err)
+	for _, seq := range []uint32{0, 100} { // in order, then out of order
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, make([]byte, 100))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		s.handle(p)
+	}
+
+	h = s.Histograms()
+	assert.Equal(t, []uint64{0, 0, 0, 0, 1, 0, 0}, h.TxPayload.Counts)
+	assert.Equal(t, []uint64{0, 2, 0, 0, 0, 0, 0}, h.RxPayload.Counts)
+}
@@ -0,0 +1,132 @@
+package socket
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWouldBlock is the error returned by writes (and datagram reads) on a
+// socket in non-blocking mode which would otherwise block (see SetNonBlocking)
+var ErrWouldBlock = errors.New("operation would block")
+
+// closedChan is an already closed channel
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// SetNonBlocking sets whether the socket is in non-blocking mode, e.g. for
+// applications driven by a single-threaded event loop. In non-blocking mode
+// writes accept only as much data as fits in the send buffer, returning
+// ErrWouldBlock (with the number of bytes accepted) rather than blocking
+// while it is full, and ReadDatagram returns ErrWouldBlock rather than
+// blocking while no datagram is queued. WriteReady and ReadReady signal
+// when to try again. Writes may still wait (briefly) for their turn
+// behind concurrent writes, or for their turn to be sent when paced
+func (s *Socket) SetNonBlocking(nonBlocking bool) {
+	var v int32
+	if nonBlocking {
+		v = 1
+	}
+	atomic.StoreInt32(&s.nonBlocking, v)
+}
+
+func (s *Socket) isNonBlocking() bool {
+	return atomic.LoadInt32(&s.nonBlocking) == 1
+}
+
+// WriteReady returns a channel which is closed once there is room in the
+// send buffer (see Config.WriteBufferBytes), i.e. once a write in
+// non-blocking mode would accept some data. A channel returned while there
+// is room is already closed. As with any readiness signal, a write may
+// still return ErrWouldBlock if a concurrent write used up the room first
+func (s *Socket) WriteReady() <-chan struct{} {
+	return s.atc.WindowReady()
+}
+
+// ReadReady returns a channel which is closed once a datagram is queued
+// to be read (see ReadDatagram) or the socket is closed, i.e. once
+// ReadDatagram in non-blocking mode would not return ErrWouldBlock. A
+// channel returned while a datagram is queued is already closed
+func (s *Socket) ReadReady() <-chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.datagrams) > 0 || s.closed {
+		return closedChan
+	}
+	if s.readReady == nil {
+		s.readReady = make(chan struct{})
+	}
+	return s.readReady
+}
+
+// signalReadReady closes the read ready channel (if waited on)
+func (s *Socket) signalReadReady() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.readReady != nil {
+		close(s.readReady)
+		s.readReady = nil
+	}
+}
+
+// BytesAvailable returns the number of bytes which can be read right away,
+// without blocking: those of the datagrams queued to be read (see
+// ReadDatagram). Reliable sockets buffer no data to be read, and return
+// zero: data is written to the application's connection as soon as it is
+// received in order (data received out of order is dropped rather than
+// reassembled, see DropStats), so it is that connection which buffers it
+func (s *Socket) BytesAvailable() int {
+	return int(atomic.LoadInt64(&s.datagramBytes))
+}
+
+// SendQueueDepth returns the number of application bytes accepted for
+// sending but not yet sent: those of writes waiting for room in the send
+// buffer (or their turn behind other writes), and those read from the
+// application's connection. Applications can stop producing while the
+// queue is deep, e.g. for backpressure beyond that of non-blocking writes.
+// Data sent but not yet acknowledged is in flight (see DebugInfo) instead
+func (s *Socket) SendQueueDepth() int {
+	return int(atomic.LoadInt64(&s.sendQueued))
+}
+
+// buffersLen returns the total number of bytes of the buffers
+func buffersLen(bufs [][]byte) int {
+	n := 0
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return n
+}
+
+// skipBuffers returns the buffers past their leading n bytes,
+// without modifying them
+func skipBuffers(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) == 0 || n == 0 {
+		return bufs
+	}
+	return append([][]byte{bufs[0][n:]}, bufs[1:]...)
+}
+
+// limitBuffers returns the leading bytes of the buffers, at most n bytes
+// (all of them when n is negative), and whether any bytes were left out
+func limitBuffers(bufs [][]byte, n int) ([][]byte, bool) {
+	if n < 0 {
+		return bufs, false
+	}
+	for i, b := range bufs {
+		if len(b) > n {
+			return append(bufs[:i:i], b[:n]), true
+		}
+		n -= len(b)
+	}
+	return bufs, false
+}
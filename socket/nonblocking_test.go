@@ -0,0 +1,197 @@
+package socket
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonBlockingWrite(t *testing.T) {
+	var last uint32
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			last = p.SeqNo + uint32(len(p.Payload))
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.WriteBufferBytes = 3000
+	})
+	defer s.atc.Close()
+	s.SetNonBlocking(true)
+
+	// only as much as fits in the send buffer is accepted
+	n, err := s.Write(make([]byte, 10000))
+	assert.Equal(t, ErrWouldBlock, err)
+	assert.Equal(t, 3000, n)
+
+	n, err = s.Write(make([]byte, 10))
+	assert.Equal(t, ErrWouldBlock, err)
+	assert.Equal(t, 0, n)
+
+	ready := s.WriteReady()
+	select {
+	case <-ready:
+		t.Fatal("write ready with the send buffer full")
+	default:
+	}
+
+	// acknowledging data makes room
+	s.atc.Ack(last)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("write not ready after an acknowledgement")
+	}
+	n, err = s.Write(make([]byte, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+
+	// writes block again in blocking mode
+	s.SetNonBlocking(false)
+	written := make(chan struct{})
+	go func() {
+		s.Write(make([]byte, 5000))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write not blocked by a full send buffer")
+	case <-time.After(time.Millisecond * 50):
+	}
+	s.atc.Close()
+	<-written
+}
+
+func TestSendQueueDepth(t *testing.T) {
+	size := packet.MaxPayloadBytes
+	var last uint32 // next sequence number after the data sent
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			atomic.StoreUint32(&last, p.SeqNo+uint32(len(p.Payload)))
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.WriteBufferBytes = 2 * size
+	})
+	defer s.atc.Close()
+	assert.Equal(t, 0, s.SendQueueDepth())
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, 10*size))
+		written <- err
+	}()
+
+	// all but the send buffer's worth of data queues up
+	depth := func() int { return s.SendQueueDepth() }
+	assert.Eventually(t, func() bool { return depth() == 8*size }, time.Second, time.Millisecond)
+	assert.Equal(t, 8*size, s.DebugInfo().SendQueueDepth)
+
+	// and drains as data is acknowledged
+	queued := depth()
+	for done := false; !done; {
+		s.atc.Ack(atomic.LoadUint32(&last))
+		select {
+		case err := <-written:
+			assert.Nil(t, err)
+			done = true
+		case <-time.After(time.Millisecond * 10):
+			assert.True(t, depth() <= queued, "queue grew while draining")
+			queued = depth()
+		}
+	}
+	assert.Equal(t, 0, s.SendQueueDepth())
+}
+
+func TestNonBlockingReadDatagram(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Unreliable = true
+	})
+	s.SetNonBlocking(true)
+	go s.Run()
+
+	_, err := s.ReadDatagram()
+	assert.Equal(t, ErrWouldBlock, err)
+
+	ready := s.ReadReady()
+	select {
+	case <-ready:
+		t.Fatal("read ready with no datagram queued")
+	default:
+	}
+
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("hello"))
+	p.SetSum()
+	s.Deliver(p)
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("read not ready after a datagram was received")
+	}
+	d, err := s.ReadDatagram()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(d))
+
+	// closing the socket makes reads ready (to return the error)
+	ready = s.ReadReady()
+	s.Close()
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("read not ready after the socket was closed")
+	}
+	_, err = s.ReadDatagram()
+	assert.Equal(t, ErrConnClosed, err)
+}
+
+func TestBytesAvailable(t *testing.T) {
+	data := func(seq int, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(uint32(seq))
+		p.SetSum()
+		return p
+	}
+
+	u, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Unreliable = true
+	})
+	assert.Equal(t, 0, u.BytesAvailable())
+	u.handle(data(0, "hello"))
+	u.handle(data(100, "datagrams")) // datagrams carry no ordering guarantees
+	assert.Equal(t, 14, u.BytesAvailable())
+
+	d, err := u.ReadDatagram()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(d))
+	assert.Equal(t, 9, u.BytesAvailable())
+	_, err = u.ReadDatagram()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, u.BytesAvailable())
+
+	// datagrams dropped on a full queue are not readable
+	for i := 0; i < cap(u.datagrams)+1; i++ {
+		u.handle(data(i, "x"))
+	}
+	assert.Equal(t, cap(u.datagrams), u.BytesAvailable())
+
+	// reliable sockets hand data received in order over to the
+	// application's connection, and drop data received out of order
+	s, app := mockSocket(t, &mockNetwork{})
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 5)
+		_, err := io.ReadFull(app, b)
+		assert.Nil(t, err)
+		received <- b
+	}()
+	s.handle(data(0, "hello"))
+	s.handle(data(100, "ahead"))
+	assert.Equal(t, "hello", string(<-received))
+	assert.Equal(t, 0, s.BytesAvailable())
+}
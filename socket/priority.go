@@ -0,0 +1,75 @@
+package socket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PriorityLevels is the number of write priorities (see WritePriority),
+// from 0, the lowest and that of Write and of the application's data,
+// to PriorityLevels-1, the highest
+const PriorityLevels = 4
+
+// ErrInvalidPriority is the error returned when writing
+// with a priority outside of [0, PriorityLevels)
+var ErrInvalidPriority = errors.New("invalid write priority")
+
+// writeScheduler serializes writers (Write, WritePriority, WriteWithDeadline,
+// WriteDatagram and the application data read by transmit) so that each
+// write is packetized contiguously and packets are forwarded in sequence
+// number order. Waiting writers are handed the right to send in priority
+// order, and in FIFO order within a priority, so that no writer of the
+// highest waiting priority starves
+type writeScheduler struct {
+	sync.Mutex
+
+	busy    bool                            // a writer is sending
+	waiting [PriorityLevels][]chan struct{} // closed when handed the turn
+}
+
+// acquire blocks until it is the turn of a writer of the given priority
+func (w *writeScheduler) acquire(priority int) {
+	w.Lock()
+	if !w.busy {
+		w.busy = true
+		w.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	w.waiting[priority] = append(w.waiting[priority], turn)
+	w.Unlock()
+
+	<-turn
+}
+
+// release hands the turn to the next waiting writer (if any)
+func (w *writeScheduler) release() {
+	w.Lock()
+	defer w.Unlock()
+
+	for p := PriorityLevels - 1; p >= 0; p-- {
+		if len(w.waiting[p]) > 0 {
+			turn := w.waiting[p][0]
+			w.waiting[p] = w.waiting[p][1:]
+			close(turn) // still busy, on behalf of the next writer
+			return
+		}
+	}
+	w.busy = false
+}
+
+// WritePriority sends data to the remote host as Write does, but ahead of
+// the writes of lower priority waiting for their turn to be sent (i.e. for
+// space in the send buffer), e.g. interactive messages ahead of a bulk
+// transfer on the same connection. Priorities range from 0 (that of Write)
+// to PriorityLevels-1. A write being sent is not interrupted, so bulk data
+// should be written in moderately sized chunks for higher priority data to
+// get ahead of it, and concurrent writers should frame their data
+func (s *Socket) WritePriority(b []byte, priority int) (int, error) {
+	if priority < 0 || priority >= PriorityLevels {
+		return 0, ErrInvalidPriority
+	}
+	return s.write(b, time.Time{}, priority)
+}
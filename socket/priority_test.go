@@ -0,0 +1,80 @@
+package socket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePriority(t *testing.T) {
+	sent := make(chan string, 10)
+	unblock := make(chan struct{})
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			if string(p.Payload) == "bulk" {
+				<-unblock // the network is busy with the write in progress
+			}
+			sent <- string(p.Payload)
+			return nil
+		},
+	})
+	defer s.atc.Close()
+
+	_, err := s.WritePriority([]byte("x"), PriorityLevels)
+	assert.Equal(t, ErrInvalidPriority, err)
+	_, err = s.WritePriority([]byte("x"), -1)
+	assert.Equal(t, ErrInvalidPriority, err)
+
+	// waits until a write is being sent and n writes are waiting
+	queued := func(n int) {
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			s.writes.Lock()
+			busy, waiting := s.writes.busy, 0
+			for _, w := range s.writes.waiting {
+				waiting += len(w)
+			}
+			s.writes.Unlock()
+			if busy && waiting == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d writes queued, expected %d", waiting, n)
+			}
+		}
+	}
+	write := func(data string, priority int) {
+		go func() {
+			_, err := s.WritePriority([]byte(data), priority)
+			assert.Nil(t, err)
+		}()
+	}
+
+	// low priority writes queue behind the write in progress,
+	// then a high priority write jumps ahead of them
+	go s.Write([]byte("bulk"))
+	queued(0)
+	write("low 1", 0)
+	queued(1)
+	write("low 2", 0)
+	queued(2)
+	write("mid", 1)
+	queued(3)
+	write("high", PriorityLevels-1)
+	queued(4)
+	close(unblock)
+
+	for _, expected := range []string{"bulk", "high", "mid", "low 1", "low 2"} {
+		select {
+		case data := <-sent:
+			assert.Equal(t, expected, data)
+		case <-time.After(time.Second):
+			t.Fatalf("%q not sent", expected)
+		}
+	}
+}
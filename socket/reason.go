@@ -0,0 +1,70 @@
+package socket
+
+// CloseReason is the reason a socket's connection was torn down
+type CloseReason int
+
+// close reasons, each of a different teardown path. Only the first
+// reason the connection is torn down for is reported
+const (
+	CloseNone             CloseReason = iota // not (yet) torn down
+	CloseLocal                               // closed by the application, FIN handshake initiated
+	ClosePeer                                // closed by the remote host, FIN handshake accepted
+	CloseReset                               // reset locally (see Reset)
+	ClosePeerReset                           // reset by the remote host
+	CloseIdleTimeout                         // no data sent nor received (see Config.IdleTimeout)
+	CloseKeepaliveTimeout                    // keepalive probes unanswered
+	CloseUserTimeout                         // data unacknowledged (see Config.UserTimeout)
+	CloseHandshakeFailed                     // the connection handshake failed
+	CloseNetworkError                        // data could not be sent, or re-sent too often
+	CloseContextDone                         // the connection's context is done (see Config.Context)
+	CloseMaxLifetime                         // open for too long (see Config.MaxLifetime), FIN handshake initiated
+)
+
+var closeReasonNames = map[CloseReason]string{
+	CloseNone:             "NONE",
+	CloseLocal:            "LOCAL_CLOSE",
+	ClosePeer:             "PEER_CLOSE",
+	CloseReset:            "RESET",
+	ClosePeerReset:        "PEER_RESET",
+	CloseIdleTimeout:      "IDLE_TIMEOUT",
+	CloseKeepaliveTimeout: "KEEPALIVE_TIMEOUT",
+	CloseUserTimeout:      "USER_TIMEOUT",
+	CloseHandshakeFailed:  "HANDSHAKE_FAILED",
+	CloseNetworkError:     "NETWORK_ERROR",
+	CloseContextDone:      "CONTEXT_DONE",
+	CloseMaxLifetime:      "MAX_LIFETIME",
+}
+
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// CloseReason returns the reason the socket's connection was torn down,
+// or CloseNone while it is not, e.g. for debugging and metrics. Unlike
+// Err, it tells graceful closes apart, and categorizes failures
+func (s *Socket) CloseReason() CloseReason {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.closeReason
+}
+
+// recordCloseReason records the reason the connection is torn down,
+// unless it is already torn down for another reason
+func (s *Socket) recordCloseReason(r CloseReason) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.setCloseReason(r)
+}
+
+// setCloseReason records the reason the connection is torn down as
+// recordCloseReason does. It must be called with the socket locked
+func (s *Socket) setCloseReason(r CloseReason) {
+	if s.closeReason == CloseNone {
+		s.closeReason = r
+	}
+}
@@ -0,0 +1,25 @@
+package socket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseReasonString(t *testing.T) {
+	assert.Equal(t, "PEER_RESET", ClosePeerReset.String())
+	assert.Equal(t, "LOCAL_CLOSE", CloseLocal.String())
+	assert.Equal(t, "MAX_LIFETIME", CloseMaxLifetime.String())
+	assert.Equal(t, "UNKNOWN", CloseReason(-1).String())
+}
+
+func TestCloseReasonSetOnce(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	assert.Equal(t, CloseNone, s.CloseReason())
+
+	// the first reason the connection is torn down for sticks
+	s.fail(CloseIdleTimeout, ErrIdleTimeout)
+	s.abort(ClosePeerReset, ErrConnectionReset)
+	assert.Equal(t, CloseIdleTimeout, s.CloseReason())
+	assert.Equal(t, ErrIdleTimeout, s.Err())
+}
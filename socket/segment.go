@@ -0,0 +1,66 @@
+package socket
+
+import "github.com/pkg/errors"
+
+// ErrSegmentsNotRecorded is the error returned by ReadSegment on a
+// socket which does not record segments (see Config.RecordSegments)
+var ErrSegmentsNotRecorded = errors.New("segments are not recorded")
+
+// segment is a chunk of data delivered to the application, along with the
+// range of sequence numbers [seqStart, seqEnd) it occupied on the wire
+type segment struct {
+	data     []byte
+	seqStart uint32
+	seqEnd   uint32
+}
+
+// ReadSegment blocks until data is delivered to the application and
+// returns a copy of it with the sequence numbers it occupied, for
+// debugging (see Config.RecordSegments). A segment is the part of a
+// single packet's payload delivered at once: the part of a retransmission
+// not delivered before, or a final payload carried by the FIN. Data is
+// still delivered to the application as usual: segments are a record of
+// it, in order and without gaps unless the queue was full. ReadSegment
+// returns an error once the socket is closed or shuts down (ErrConnReset
+// if the connection was reset, ErrConnClosed otherwise)
+func (s *Socket) ReadSegment() (data []byte, seqStart, seqEnd uint32, err error) {
+	if s.segments == nil {
+		return nil, 0, 0, ErrSegmentsNotRecorded
+	}
+
+	// segments already queued are read first
+	select {
+	case sg := <-s.segments:
+		return sg.data, sg.seqStart, sg.seqEnd, nil
+	default:
+	}
+
+	select {
+	case sg := <-s.segments:
+		return sg.data, sg.seqStart, sg.seqEnd, nil
+	case <-s.ctx.Done():
+		if err := s.writeErr(); err != nil {
+			return nil, 0, 0, err
+		}
+		return nil, 0, 0, ErrConnClosed
+	}
+}
+
+// recordSegment queues a copy of the data delivered from the given
+// sequence number on (if segments are recorded), dropping it if
+// the queue is full
+func (s *Socket) recordSegment(seqNo uint32, delivered []byte) {
+	if s.segments == nil || len(delivered) == 0 {
+		return
+	}
+
+	sg := segment{
+		data:     append([]byte(nil), delivered...),
+		seqStart: seqNo,
+		seqEnd:   seqNo + uint32(len(delivered)),
+	}
+	select {
+	case s.segments <- sg:
+	default:
+	}
+}
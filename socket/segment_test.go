@@ -0,0 +1,59 @@
+package socket
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSegment(t *testing.T) {
+	s, app := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.RecordSegments = true
+	})
+	s.rxNext = 1000
+	go ioutil.ReadAll(app)
+
+	mockData := func(seq uint32, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		return p
+	}
+
+	// in order, out of order (discarded), a duplicate (already delivered),
+	// and a retransmission overlapping data already delivered
+	s.Deliver(mockData(1000, "hello"))
+	s.Deliver(mockData(1012, "!"))
+	s.Deliver(mockData(1005, ", world"))
+	s.Deliver(mockData(1005, ", world"))
+	s.Deliver(mockData(1010, "ld!"))
+	go s.Run()
+
+	for _, expected := range []struct {
+		data       string
+		start, end uint32
+	}{
+		{"hello", 1000, 1005},
+		{", world", 1005, 1012},
+		{"!", 1012, 1013}, // the part of the packet not delivered before
+	} {
+		data, start, end, err := s.ReadSegment()
+		assert.Nil(t, err)
+		assert.Equal(t, expected.data, string(data))
+		assert.Equal(t, expected.start, start)
+		assert.Equal(t, expected.end, end)
+	}
+
+	s.Close()
+	_, _, _, err := s.ReadSegment()
+	assert.Equal(t, ErrConnClosed, err)
+}
+
+func TestReadSegmentNotRecorded(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+
+	_, _, _, err := s.ReadSegment()
+	assert.Equal(t, ErrSegmentsNotRecorded, err)
+}
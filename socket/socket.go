@@ -1,39 +1,193 @@
 package socket
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
-	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/adrianosela/rdtp"
+	"github.com/adrianosela/rdtp/atc"
+	"github.com/adrianosela/rdtp/clock"
 	"github.com/adrianosela/rdtp/network"
 	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/capture"
+	"github.com/adrianosela/rdtp/packet/compress"
+	"github.com/adrianosela/rdtp/packet/encrypt"
 	"github.com/adrianosela/rdtp/packet/factory"
 	"github.com/pkg/errors"
 )
 
 const (
 	inboundPacketChannelSize = 100
+	defaultMaxSynRetries     = 5
+
+	// generous enough for any path which delivers data at all
+	defaultRetransmitBudget      = 1000 // per second
+	defaultRetransmitBudgetBurst = 10000
+
+	// duplicate ACKs after which data is presumed lost (as TCP's)
+	defaultDupAckThreshold = 3
+
+	// sequence numbers accepted ahead of the next expected one, and data
+	// in flight, by default (see Config.ReadBufferBytes, WriteBufferBytes)
+	receiveWindowBytes = inboundPacketChannelSize * packet.MaxPayloadBytes
+
+	// packets queued on the inbound channel however small the read buffer,
+	// as control packets (e.g. of the handshakes) are queued there too
+	minInboundPackets = 8
+
+	// time to wait before re-trying a failed application read,
+	// doubled on every consecutive failure up to the maximum
+	minReadRetryTime = time.Millisecond * 5
+	maxReadRetryTime = time.Second
+
+	// data is read in chunks of this many full packets by ReadFrom
+	readFromChunkPackets = 64
+
+	// size of the header (without options) of the IPv4
+	// datagrams packets travel in (see Config.MTU)
+	ipv4HeaderBytes = 20
+
+	// time data in flight is given to be acknowledged when the
+	// socket shuts down, before the FIN handshake (see Run)
+	maxCloseDrainTime = time.Second * 3
+
+	// probes exchanged to sample the round trip time (see WarmUp)
+	warmUpProbes = 5
 )
 
+// ErrConnectionReset is the error a socket shuts down with
+// when the remote host aborts the connection
+var ErrConnectionReset = errors.New("connection reset by peer")
+
+// ErrConnClosed is the error returned by writes to a socket
+// after it is closed or shut down
+var ErrConnClosed net.Error = connError("use of closed connection")
+
+// ErrConnReset is the error returned by writes to a socket
+// after the connection is reset by either host
+var ErrConnReset net.Error = connError("connection reset")
+
+// connError is an error on a connection which can no longer be used
+type connError string
+
+func (e connError) Error() string   { return string(e) }
+func (e connError) Timeout() bool   { return false }
+func (e connError) Temporary() bool { return false }
+
+// ErrKeepaliveTimeout is the error a socket shuts down with when
+// the remote host does not answer keepalive probes
+var ErrKeepaliveTimeout = errors.New("connection timed out: keepalive probes unanswered")
+
+// ErrRetransmitBudgetExhausted is the error a socket shuts down with when
+// data is re-sent more often than the retransmission budget allows
+var ErrRetransmitBudgetExhausted = errors.New("connection failed: retransmission budget exhausted")
+
+// ErrSentWhileDraining is the error returned by Drain
+// when more data is sent while the socket is draining
+var ErrSentWhileDraining = errors.New("data sent while draining")
+
+// ErrIdleTimeout is the error a socket shuts down with when no
+// application data is sent or received for the configured idle timeout
+var ErrIdleTimeout = errors.New("connection idle timeout")
+
+// ErrUserTimeout is the error a socket shuts down with (and writes return)
+// when data sent is not acknowledged in time (see Config.UserTimeout)
+var ErrUserTimeout net.Error = timeoutError("connection timed out: data unacknowledged")
+
+// ErrWriteTimeout is the error returned by writes which time out
+// on a full send buffer (see Config.WriteTimeout)
+var ErrWriteTimeout net.Error = timeoutError("write timed out: send buffer full")
+
+// timeoutError is an error on a connection which timed out
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// ErrApplicationClosed is the error a socket shuts down with when data is
+// received after the application closed its connection (see deliver)
+var ErrApplicationClosed = errors.New("connection reset: data received after the application closed its connection")
+
+// ErrCloseForced is the error returned by CloseWithTimeout when
+// the socket did not shut down gracefully before the deadline
+var ErrCloseForced = errors.New("close forced: connection not shut down gracefully in time")
+
 // Socket represents a socket abstraction and carries all
 // necessary info and statistics about the socket
 type Socket struct {
+	// 64 bit fields accessed atomically go first (for 64 bit alignment)
+
+	txBytes        uint64 // bytes sent to the network, incl. headers (stats)
+	txPayloadBytes uint64 // application bytes sent (stats)
+	txRetransBytes uint64 // bytes re-sent to the network, incl. headers (stats)
+	rxBytes        uint64 // application bytes received (stats)
+
+	// application bytes accepted for sending but not yet sent
+	// (see SendQueueDepth)
+	sendQueued int64
+
+	// bytes of the datagrams queued to be read (see BytesAvailable)
+	datagramBytes int64
+
+	// inbound packets dropped due to a full inbound channel
+	// (or, in unreliable mode, a full datagram queue)
+	dropped uint64
+
+	// inbound packets dropped, by reason (stats)
+	drops DropStats
+
+	// ACKs sent, and in-order data packets they acknowledged (stats)
+	acksSent, ackedPackets uint64
+
+	// SYNs received on the established connection (stats)
+	duplicateSYNs uint64
+
+	// unix nano time application data was last sent or received
+	lastData int64
+
+	// unix nano time any packet was last sent or received
+	lastActivity int64
+
+	// throughput and goodput measurements (see Stats)
+	rates rateMeter
+
+	// distributions of RTTs and payload sizes (see Histograms)
+	rttHist, txPayloadHist, rxPayloadHist *histogram
+
+	sync.RWMutex
+
 	lAddr *rdtp.Addr // local rdtp address
 	rAddr *rdtp.Addr // remote rdtp address
+	rIP   net.IP     // remote IPv4 address (see validate)
 
-	txBytes uint32 // current sequence number
-	rxBytes uint32 // current ack number
+	// random identifier of the connection (see UID)
+	uid uint64
 
-	// connection to app layer
-	application net.Conn
+	// sequence number of the next byte expected from the peer
+	rxNext uint32
+
+	// connection to app layer (see SetApplication)
+	application atomic.Value // of *applicationLayer
+	appSwaps    sync.Mutex
 
 	// packetizes and forwards to network layer
-	packetizer *factory.PacketFactory
+	packetizer PacketFactory
+
+	// keeps track of (and re-forwards) unacknowledged data
+	atc *atc.AirTrafficCtrl
+
+	// serializes writers, by priority (see WritePriority)
+	writes writeScheduler
 
 	// packets received at the network
 	// are ultimately delivered in this
@@ -47,9 +201,179 @@ type Socket struct {
 
 	// used to notify socket of fin received
 	fin chan bool
+
+	// a FIN received while the inbound channel was full, handled by the
+	// receiver once the packets queued before it are (see Deliver)
+	finOverflow chan *packet.Packet
+
+	// sequence numbers accepted ahead of the next expected one (atomic,
+	// see SetReadBuffer)
+	receiveWindow uint32
+
+	// maximum number of in-order data packets per ACK, and the
+	// number received since the last ACK (receive goroutine only)
+	maxAckCoalesce int
+	unacked        int
+
+	// lifecycle of the socket's goroutines, cancelled when the
+	// socket is closed or shuts down, derived from the connection's
+	// context (see Config.Context)
+	ctx    context.Context
+	cancel context.CancelFunc
+	parent context.Context
+
+	// the receive goroutine outlives the others on shutdown, handling
+	// ACKs while data in flight drains, until this is closed (see Run)
+	stopReceiving chan struct{}
+
+	// the socket's goroutines, each waited on in turn as it shuts down
+	sending, receiving, reading sync.WaitGroup
+
+	// error which caused the socket to shut down (if any)
+	err error
+
+	// reason the connection was torn down (see CloseReason)
+	closeReason CloseReason
+
+	// set when the connection is reset (no FIN handshake on shutdown)
+	aborted bool
+
+	// set when the socket is closed or shuts down
+	closed bool
+
+	// carried by the FIN when closed with CloseWith
+	finPayload []byte
+
+	// how Close handles data in flight (see Config.Linger)
+	linger time.Duration
+
+	// time a write may block on a full send buffer (see Config.WriteTimeout),
+	// measured against the socket's source of time (see Config.Clock)
+	writeTimeout time.Duration
+	clock        clock.Clock
+
+	// set once the socket's channels are closed (see Run), after
+	// which packets delivered to the socket are discarded
+	released bool
+
+	// closed once Run returns, set if the socket shut down gracefully
+	// (data in flight drained and the FIN handshake completed)
+	stopped  chan struct{}
+	graceful bool
+
+	// errors signaled by the remote host (see Errors)
+	peerErrs chan error
+
+	// set in unreliable mode, in which data packets received
+	// are queued as datagrams (see Config.Unreliable)
+	unreliable bool
+	datagrams  chan []byte
+
+	// serializes reliable datagrams, sent one at a time, and the end of
+	// the last one received, if any (see WriteReliable)
+	reliableWrites sync.Mutex
+	rxReliableEnd  uint32
+	rxReliable     bool
+
+	// data delivered to the application, queued to be read with
+	// ReadSegment, nil unless recorded (see Config.RecordSegments)
+	segments chan segment
+
+	// records the packets sent and received, nil unless captured (see
+	// Config.Capture), and logs the first error writing to the capture
+	capture    *capture.Writer
+	captureErr sync.Once
+
+	// non-blocking mode (atomic, see SetNonBlocking), and closed once a
+	// datagram is queued (see ReadReady), nil while it is not waited on
+	nonBlocking int32
+	readReady   chan struct{}
+
+	// number of times a SYN is re-sent when dialing
+	maxSynRetries int
+
+	// maximum segment size proposed, then settled on at handshake
+	mss int
+
+	// tear down on the first permanent network error (see Config)
+	failFast bool
+
+	// state of the connection (see State and Config.OnStateChange)
+	connState     State
+	transitions   sync.Mutex
+	onStateChange func(old, new State)
+
+	// data received is passed to one of them rather than written to
+	// the application's connection (see Config.OnData and OnDataWithHeader)
+	onData           func(data []byte)
+	onDataWithHeader func(header, data []byte)
+
+	// custom validation of packets received (see Config.ValidatePacket)
+	validatePacket func(p *packet.Packet) error
+
+	// connection encryption (see Config.Encryption): the suite, this host's
+	// key pair, the bytes sealing adds to payloads and, once keys are
+	// exchanged at handshake, the session (of *encrypt.Session)
+	encryption   *encrypt.Suite
+	privateKey   []byte
+	publicKey    []byte
+	sealOverhead int
+	session      atomic.Value
+
+	// payload compression (see Config.Compression): the compressor, the
+	// digest of its dictionary (see Config.CompressionDict) and whether
+	// the remote host agreed to compress at handshake (atomic)
+	compression compress.Compressor
+	dictDigest  []byte
+	compressing uint32
+
+	// trace tags (see Config.TraceTags): whether offered, whether the
+	// remote host agreed to at handshake (atomic), and the tags (of
+	// []byte) of the data written and of the data last delivered
+	traceTags     bool
+	tracing       uint32
+	traceContext  atomic.Value
+	tracedContext atomic.Value
+
+	// size of the application header of data packets (see
+	// Config.AppHeaderSize), the same as the remote host's
+	appHeaderSize int
+
+	// closed when the connection handshake completes
+	handshakeDone chan struct{}
+	handshakeOnce sync.Once
+	handshakeErr  error
+	connInfo      ConnInfo         // set on a successful handshake
+	handshakeOpts HandshakeOptions // see RawHandshakeOptions
+	handshakeData *packet.Packet   // the ACK accepted, if carrying data (see DialWithInitialData)
+
+	// set when packets are sized to a known path MTU (see Config.MTU)
+	fixedMTU bool
+
+	// connection liveness (see Config)
+	keepaliveInterval time.Duration
+	idleTimeout       time.Duration
+	maxLifetime       time.Duration
+	userTimeout       time.Duration
+
+	// sends a packet to the network layer, bypassing air traffic control
+	toNetwork func(*packet.Packet) error
+
+	// epoch sent on every packet, and epoch of the remote host's
+	// packets as learnt at handshake (see Config.EpochSource)
+	epoch     uint16
+	peerEpoch uint16
+
+	// connection to the network layer (see SetNetwork)
+	network atomic.Value // of networkLayer
+
+	// pings awaiting an echo from the remote host, by ping identifier
+	pings  map[uint32]chan struct{}
+	pingID uint32
 }
 
-// Config is the necessary configuration to initialize a socket
+// Config is the necessary configuration to initialize a socket, where
+// fields not set take their defaults (see README for their rationale)
 type Config struct {
 	LocalAddr  *rdtp.Addr // local rdtp address
 	RemoteAddr *rdtp.Addr // remote rdtp address
@@ -59,9 +383,184 @@ type Config struct {
 
 	// connection to network layer
 	Network network.Network
+
+	// number of times a SYN is re-sent before a Dial gives up,
+	// defaults to 5. Use a negative value to disable
+	MaxSynRetries int
+
+	// source of the initial sequence number, cryptographically random by default
+	ISNSource func() uint32
+
+	// source of the epoch sent on every packet (see ConnInfo), random and
+	// non zero by default. An epoch of zero is none (see README)
+	EpochSource func() uint16
+
+	// source of randomness (e.g. of the ISN and keys), defaults to crypto/rand
+	Rand io.Reader
+
+	// initial retransmission timeout, defaults to 1 second
+	AckWait time.Duration
+
+	// source of time for timeouts and deadlines, defaults to the real clock
+	Clock clock.Clock
+
+	// maximum segment size (incl. header) proposed at handshake, the
+	// smaller proposal is settled on (see MSS). Defaults to the maximum
+	MSS int
+
+	// fixed path MTU (incl. the IP header), which disables black hole
+	// detection (see README). Mutually exclusive with MSS
+	MTU int
+
+	// constructor of the packet factory, defaults to factory.DefaultPacketFactory.
+	// The factory must forward packets with fw, so that data is tracked
+	NewPacketFactory func(lhost, rhost net.IP, lport, rport uint16, fw func(*packet.Packet) error) PacketFactory
+
+	// custom validation of packets received, once the built-in checks pass
+	// (see DropStats). It must not block nor modify the packet
+	ValidatePacket func(p *packet.Packet) error
+
+	// encrypts the connection with the given suite, e.g. encrypt.P256AES128GCM().
+	// The SYN must be delivered before Accept (see README)
+	Encryption *encrypt.Suite
+
+	// compresses data payloads when the remote host offers the same
+	// compressor at handshake (see README)
+	Compression compress.Compressor
+
+	// preset dictionary of the compressor (a compress.Primer), which both
+	// hosts must be configured with (see README)
+	CompressionDict []byte
+
+	// carries trace tags (see SetTraceContext) on data packets when the
+	// remote host does too (see README)
+	TraceTags bool
+
+	// size of the application header carried by every data packet (see
+	// WriteWithHeader), up to MaxAppHeaderBytes, the same on both hosts
+	AppHeaderSize int
+
+	// time without hearing from the remote host after which
+	// keepalive probes are sent, disabled when not set (see README)
+	KeepaliveInterval time.Duration
+
+	// time without application data after which the connection
+	// is closed, disabled when not set (see README)
+	IdleTimeout time.Duration
+
+	// time after which the connection is closed gracefully however
+	// active it is, disabled when not set (see README)
+	MaxLifetime time.Duration
+
+	// time data may stay unacknowledged (as TCP_USER_TIMEOUT) before
+	// the connection is aborted, disabled when not set (see README)
+	UserTimeout time.Duration
+
+	// how Close handles data not yet acknowledged (as SO_LINGER), Close
+	// returns immediately when not set (see README)
+	Linger time.Duration
+
+	// rate of retransmissions (per second) above which a (throttled)
+	// warning is logged, disabled when not set
+	LossWarnThreshold float64
+
+	// maximum number of data packets acknowledged by a single ACK, defaults
+	// to 1. ACKs are never held back while no further packets are queued
+	MaxAckCoalesce int
+
+	// capacity of the receive buffer (as SO_RCVBUF), i.e. the receive
+	// window, defaults to 100 full packets
+	ReadBufferBytes int
+
+	// capacity of the send buffer (as SO_SNDBUF), defaults to the default
+	// receive window. Use a negative value to not limit the data in flight
+	WriteBufferBytes int
+
+	// time a write may block on a full send buffer before it returns
+	// ErrWriteTimeout, writes block indefinitely when not set
+	WriteTimeout time.Duration
+
+	// maximum rate (per second) and burst of retransmissions beyond which the
+	// connection is aborted, default to 1000 and 10000. Negative to not limit
+	RetransmitBudget      float64
+	RetransmitBudgetBurst int
+
+	// duplicate ACKs after which the oldest data in flight is re-sent
+	// right away (fast retransmit), defaults to 3
+	DupAckThreshold int
+
+	// tears the connection down on the first permanent error sending
+	// data (see atc.IsPermanent) rather than re-sending it
+	FailFast bool
+
+	// granularity of a timer wheel running all retransmission timers,
+	// one timer per packet when not set
+	TimerGranularity time.Duration
+
+	// rate (in bytes per second, incl. headers) at which data packets
+	// are paced, not paced when not set
+	PacingRate float64
+
+	// disables reliability: data is sent as datagrams (see ReadDatagram,
+	// WriteDatagram and WriteReliable)
+	Unreliable bool
+
+	// called on every state transition (see State), synchronously and in
+	// order. It must not block, nor change the socket's state
+	OnStateChange func(old, new State)
+
+	// called with data received in order rather than writing it to the
+	// application (see README). It must not retain the data
+	OnData func(data []byte)
+
+	// called as OnData is (in its place), along with the application
+	// header (see AppHeaderSize). It must not retain the header either
+	OnDataWithHeader func(header, data []byte)
+
+	// for debugging: records data delivered along with the sequence
+	// numbers it occupied, to be read with ReadSegment
+	RecordSegments bool
+
+	// for debugging: records every packet sent and received to the writer
+	// (see packet/capture), with payloads if CapturePayloads is set
+	Capture         io.Writer
+	CapturePayloads bool
+
+	// upper bounds of the buckets of the histograms of RTTs and payload
+	// sizes (see Histograms), in increasing order
+	RTTBuckets     []time.Duration
+	PayloadBuckets []int
+
+	// the connection's context (defaults to context.Background),
+	// whose cancellation closes the socket (see Context)
+	Context context.Context
+}
+
+// PacketFactory packetizes data and control messages for a socket
+type PacketFactory interface {
+	SendControlPacket(syn, ack, fin, err bool) error
+	SendFIN(payload []byte) error
+	PackAndForwardMessage(msg []byte) (int, error)
+	PackAndForwardMessageWith(msg []byte, fw func(*packet.Packet) error) (int, error)
+	PackAndForwardBuffersWith(bufs [][]byte, fw func(*packet.Packet) error) (int, error)
+	SetISN(isn uint32)
+	SetAckNo(ack uint32)
+	AckNo() uint32
+	SetMSS(mss int) error
+	SeqNo() uint32
+	SetSize(size int) error
+	Size() int
 }
 
-// New is the socket constructor
+var _ PacketFactory = (*factory.PacketFactory)(nil)
+
+var _ io.ReaderFrom = (*Socket)(nil)
+
+// New is the socket constructor. It starts no goroutines: packets are only
+// processed once the socket is run (see Run), after its handshake (see Dial
+// and Accept), so the socket can be configured in between (e.g. with
+// SetReadBuffer, SetWriteBuffer or SetNonBlocking) and nothing is left
+// running if setup fails before then
 func New(c Config) (*Socket, error) {
 	if c.LocalAddr == nil || net.ParseIP(c.LocalAddr.Host) == nil {
 		return nil, errors.New("invalid local address")
@@ -75,27 +574,293 @@ func New(c Config) (*Socket, error) {
 	if c.Network == nil {
 		return nil, errors.New("connection to network layer cannot be nil")
 	}
+	if c.MSS != 0 && (c.MSS < packet.MinMSS || c.MSS > packet.MaxPacketBytes) {
+		return nil, fmt.Errorf("invalid MSS %d, must be between %d (the header and a byte of payload) and %d", c.MSS, packet.MinMSS, packet.MaxPacketBytes)
+	}
+
+	if c.MTU != 0 && c.MSS != 0 {
+		return nil, errors.New("MTU and MSS are mutually exclusive")
+	}
+	if c.DupAckThreshold < 0 {
+		return nil, fmt.Errorf("invalid duplicate ACK threshold %d, must be at least 1", c.DupAckThreshold)
+	}
+	if min, max := ipv4HeaderBytes+packet.MinMSS, ipv4HeaderBytes+packet.MaxPacketBytes; c.MTU != 0 && (c.MTU < min || c.MTU > max) {
+		return nil, fmt.Errorf("invalid MTU %d, must be between %d (the headers and a byte of payload) and %d", c.MTU, min, max)
+	}
+
+	mss := c.MSS
+	if c.MTU != 0 {
+		mss = c.MTU - ipv4HeaderBytes
+	}
+	if mss == 0 {
+		mss = packet.MaxPacketBytes
+	}
+
+	sealOverhead := 0
+	if c.Encryption != nil {
+		var err error
+		if sealOverhead, err = c.Encryption.Overhead(); err != nil {
+			return nil, err
+		}
+		if mss-packet.HeaderByteSize <= sealOverhead {
+			return nil, fmt.Errorf("invalid MSS %d, leaves no room for data past the header and the %d bytes sealing adds", mss, sealOverhead)
+		}
+	}
+
+	if c.AppHeaderSize < 0 || c.AppHeaderSize > MaxAppHeaderBytes {
+		return nil, fmt.Errorf("invalid application header size %d, must be at most %d bytes", c.AppHeaderSize, MaxAppHeaderBytes)
+	}
+
+	compression := c.Compression
+	if len(c.CompressionDict) > 0 {
+		primer, ok := compression.(compress.Primer)
+		if !ok {
+			return nil, errors.New("invalid compression dictionary, the compressor cannot be primed with one")
+		}
+		var err error
+		if compression, err = primer.Prime(c.CompressionDict); err != nil {
+			return nil, errors.Wrap(err, "could not prime compressor")
+		}
+	}
+
+	maxSynRetries := c.MaxSynRetries
+	if maxSynRetries == 0 {
+		maxSynRetries = defaultMaxSynRetries
+	}
+
+	readBufferBytes := c.ReadBufferBytes
+	if readBufferBytes <= 0 {
+		readBufferBytes = receiveWindowBytes
+	}
+	inboundPackets := readBufferBytes / packet.MaxPayloadBytes
+	if inboundPackets < minInboundPackets {
+		inboundPackets = minInboundPackets
+	}
 
+	maxAckCoalesce := c.MaxAckCoalesce
+	if maxAckCoalesce < 1 {
+		maxAckCoalesce = 1
+	}
+
+	rttHist, txPayloadHist, rxPayloadHist, err := newHistograms(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Socket{
+		lAddr:            c.LocalAddr,
+		rAddr:            c.RemoteAddr,
+		rIP:              net.ParseIP(c.RemoteAddr.Host),
+		inbound:          make(chan *packet.Packet, inboundPackets),
+		receiveWindow:    uint32(readBufferBytes),
+		shutdown:         make(chan bool, 1),
+		fin:              make(chan bool, 1),
+		finOverflow:      make(chan *packet.Packet, 1),
+		stopReceiving:    make(chan struct{}),
+		maxSynRetries:    maxSynRetries,
+		mss:              mss,
+		failFast:         c.FailFast,
+		onStateChange:    c.OnStateChange,
+		onData:           c.OnData,
+		onDataWithHeader: c.OnDataWithHeader,
+		validatePacket:   c.ValidatePacket,
+		encryption:       c.Encryption,
+		sealOverhead:     sealOverhead,
+		compression:      compression,
+		dictDigest:       dictDigest(c.CompressionDict),
+		traceTags:        c.TraceTags,
+		appHeaderSize:    c.AppHeaderSize,
+		maxAckCoalesce:   maxAckCoalesce,
+		rttHist:          rttHist,
+		txPayloadHist:    txPayloadHist,
+		rxPayloadHist:    rxPayloadHist,
+		handshakeDone:    make(chan struct{}),
+		stopped:          make(chan struct{}),
+		pings:            make(map[uint32]chan struct{}),
+		peerErrs:         make(chan error, 1),
+		unreliable:       c.Unreliable,
+		datagrams:        make(chan []byte, inboundPackets),
+
+		keepaliveInterval: c.KeepaliveInterval,
+		idleTimeout:       c.IdleTimeout,
+		maxLifetime:       c.MaxLifetime,
+		userTimeout:       c.UserTimeout,
+		linger:            c.Linger,
+		writeTimeout:      c.WriteTimeout,
+		fixedMTU:          c.MTU != 0,
+		clock:             clock.Real{},
+		lastData:          time.Now().UnixNano(),
+		lastActivity:      time.Now().UnixNano(),
+	}
+	s.parent = c.Context
+	if s.parent == nil {
+		s.parent = context.Background()
+	}
+	s.ctx, s.cancel = context.WithCancel(s.parent)
+	s.rates.record(statsSample{at: time.Now()})
+
+	// every packet (incl. control packets and retransmissions) goes through here
+	s.network.Store(networkLayer{c.Network})
+	s.application.Store(&applicationLayer{Conn: c.Application})
 	toNetwork := func(p *packet.Packet) error {
 		p.SetSourceIPv4(net.ParseIP(c.LocalAddr.Host))
 		p.SetDestinationIPv4(net.ParseIP(c.RemoteAddr.Host))
-		return c.Network.Send(p)
+		if p.Epoch != s.epoch { // once, retransmissions are stamped already
+			p.SetEpoch(s.epoch)
+			p.SetSum()
+		}
+		wire, err := s.encrypt(s.compress(s.frame(s.withOptions(p))))
+		if err != nil {
+			return err
+		}
+		if err := s.network.Load().(networkLayer).Send(wire); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.txBytes, uint64(packet.HeaderByteSize+len(wire.Payload))) // stats
+		if carriesData(p) {
+			s.txPayloadHist.sample(int64(len(p.Payload)))
+		}
+		atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+		s.capturePacket(capture.Sent, wire)
+		return nil
+	}
+
+	airTrafficCtrl := atc.NewAirTrafficCtrlWithAckWait(toNetwork, c.AckWait)
+	if c.Clock != nil {
+		s.clock = c.Clock
+		airTrafficCtrl.SetClock(c.Clock)
+	}
+	airTrafficCtrl.SetTimerGranularity(c.TimerGranularity)
+
+	writeBufferBytes := c.WriteBufferBytes
+	if writeBufferBytes == 0 {
+		writeBufferBytes = receiveWindowBytes
+	}
+	airTrafficCtrl.SetWindow(writeBufferBytes)
+	airTrafficCtrl.SetPacingRate(c.PacingRate)
+
+	// data packets are tracked until acknowledged (unless the socket is
+	// unreliable), control packets (incl. SYNs proposing an MSS and FINs
+	// carrying a final payload, see CloseWith) are not
+	send := func(p *packet.Packet) error {
+		if len(p.Payload) > 0 && !p.IsSYN() {
+			s.tag(p)
+		}
+		if len(p.Payload) > 0 && !p.IsSYN() && !p.IsFIN() && !c.Unreliable {
+			return airTrafficCtrl.Send(p)
+		}
+		return toNetwork(p)
+	}
+
+	newPacketFactory := c.NewPacketFactory
+	if newPacketFactory == nil {
+		newPacketFactory = func(lhost, rhost net.IP, lport, rport uint16, fw func(*packet.Packet) error) PacketFactory {
+			return factory.DefaultPacketFactory(lhost, rhost, lport, rport, fw)
+		}
+	}
+
+	packetizer := newPacketFactory(
+		net.ParseIP(c.LocalAddr.Host),
+		net.ParseIP(c.RemoteAddr.Host),
+		uint16(c.LocalAddr.Port),
+		uint16(c.RemoteAddr.Port),
+		send)
+	if c.ISNSource != nil {
+		packetizer.SetISN(c.ISNSource())
+	} else if c.Rand != nil {
+		packetizer.SetISN(factory.ISNFrom(c.Rand))
+	}
+	if c.Rand != nil {
+		s.uid = uidFrom(c.Rand)
+	} else {
+		s.uid = uidFrom(rand.Reader)
+	}
+	if c.EpochSource != nil {
+		s.epoch = c.EpochSource()
+	} else if c.Rand != nil {
+		s.epoch = epochFrom(c.Rand)
+	} else {
+		s.epoch = epochFrom(rand.Reader)
+	}
+	if c.Encryption != nil {
+		random := c.Rand
+		if random == nil {
+			random = rand.Reader
+		}
+		if s.privateKey, s.publicKey, err = c.Encryption.KeyExchange.GenerateKey(random); err != nil {
+			return nil, errors.Wrap(err, "could not generate encryption key")
+		}
+		if len(s.publicKey) >= 0xff {
+			return nil, fmt.Errorf("invalid encryption key share of %d bytes, must fit a SYN option", 1+len(s.publicKey))
+		}
+	}
+	if err := packetizer.SetMSS(mss); err != nil {
+		return nil, errors.Wrap(err, "could not set MSS")
+	}
+	if size := mss - packet.HeaderByteSize - sealOverhead; size < packetizer.Size() {
+		if err := packetizer.SetSize(size); err != nil {
+			return nil, errors.Wrap(err, "could not size packets to the MSS")
+		}
+	}
+	s.packetizer = packetizer
+	if c.RecordSegments {
+		s.segments = make(chan segment, inboundPackets)
+	}
+	if c.Capture != nil {
+		s.capture = capture.NewWriter(c.Capture, c.CapturePayloads)
+	}
+
+	// shrink packets if the path turns out to drop full-size ones,
+	// unless its MTU is known (or the data tracked is made of reliable
+	// datagrams, which must not be split, see WriteReliable)
+	if !s.fixedMTU && !c.Unreliable {
+		airTrafficCtrl.DetectBlackHoles(packetizer.Size(), s.shrinkPackets)
+	}
+
+	budget, burst := c.RetransmitBudget, c.RetransmitBudgetBurst
+	if budget == 0 {
+		budget = defaultRetransmitBudget
+	}
+	if burst <= 0 {
+		burst = defaultRetransmitBudgetBurst
+	}
+	airTrafficCtrl.SetRetransmitBudget(budget, burst, func() {
+		log.Printf("[rdtp socket %s] Retransmission budget exhausted, aborting connection", s.logID())
+		s.abort(CloseNetworkError, ErrRetransmitBudgetExhausted)
+	})
+
+	dupAckThreshold := c.DupAckThreshold
+	if dupAckThreshold == 0 {
+		dupAckThreshold = defaultDupAckThreshold
+	}
+	airTrafficCtrl.SetDupAckThreshold(dupAckThreshold)
+
+	airTrafficCtrl.OnRetransmit(func(p *packet.Packet) {
+		atomic.AddUint64(&s.txRetransBytes, uint64(packet.HeaderByteSize+len(p.Payload))) // stats
+	})
+
+	if c.FailFast {
+		airTrafficCtrl.FailFast(s.failOnNetworkError)
+	}
+
+	if c.LossWarnThreshold > 0 {
+		airTrafficCtrl.WarnOnLoss(c.LossWarnThreshold, func(rate float64) {
+			log.Printf("[rdtp socket %s] High packet loss: %.1f retransmissions per second", s.logID(), rate)
+		})
 	}
 
-	return &Socket{
-		lAddr:       c.LocalAddr,
-		rAddr:       c.RemoteAddr,
-		application: c.Application,
-		packetizer: factory.DefaultPacketFactory(
-			net.ParseIP(c.LocalAddr.Host),
-			net.ParseIP(c.RemoteAddr.Host),
-			uint16(c.LocalAddr.Port),
-			uint16(c.RemoteAddr.Port),
-			toNetwork),
-		inbound:  make(chan *packet.Packet, inboundPacketChannelSize),
-		shutdown: make(chan bool, 1),
-		fin:      make(chan bool, 1),
-	}, nil
+	s.atc = airTrafficCtrl
+	s.toNetwork = toNetwork
+
+	return s, nil
+}
+
+// shrinkPackets sizes the packets sent thereafter to the given payload
+// size, when the path turns out to drop full-size ones (see atc)
+func (s *Socket) shrinkPackets(size int) {
+	if err := s.packetizer.SetSize(size); err != nil {
+		log.Printf("[rdtp socket %s] Error shrinking packets: %s", s.logID(), err)
+	}
 }
 
 // ID returns the of unique identifier of the socket
@@ -103,86 +868,1411 @@ func (s *Socket) ID() string {
 	return fmt.Sprintf("%s %s", s.lAddr.String(), s.rAddr.String())
 }
 
-// LocalAddr returns the local network address.
-func (s *Socket) LocalAddr() net.Addr {
-	return s.lAddr
+// UID returns the connection's random 64 bit identifier, assigned on
+// creation and never changed. Unlike ID it tells apart connections over
+// the same addresses (e.g. one reusing those of a closed connection),
+// which makes it a stable key to correlate a connection's logs with.
+// It is drawn from Config.Rand when set
+func (s *Socket) UID() uint64 {
+	return s.uid
 }
 
-// RemoteAddr returns the remote network address.
-func (s *Socket) RemoteAddr() net.Addr {
-	return s.rAddr
+// logID identifies the socket in its logs, by its UID and addresses
+func (s *Socket) logID() string {
+	return fmt.Sprintf("%016x %s", s.uid, s.ID())
 }
 
-// Close closes a socket
-func (s *Socket) Close() {
-	s.application.Close()
+// uidFrom returns a connection identifier read from the given source of
+// randomness, falling back to the time when the source fails (as ISNs do)
+func uidFrom(r io.Reader) uint64 {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b)
 }
 
-// Deliver delivers a packet to a socket's inbound packet channel
-func (s *Socket) Deliver(p *packet.Packet) {
-	if p.IsFIN() && !p.IsACK() {
-		s.fin <- true
-		s.shutdown <- true
-		return
+// epochFrom returns a non zero epoch read from the given source
+// of randomness (see Config.EpochSource)
+func epochFrom(r io.Reader) uint16 {
+	b := make([]byte, 2)
+	epoch := uint16(time.Now().UnixNano())
+	if _, err := io.ReadFull(r, b); err == nil {
+		epoch = binary.BigEndian.Uint16(b)
 	}
-	s.inbound <- p
+	if epoch == 0 {
+		return 1
+	}
+	return epoch
 }
 
-// Run kicks-off socket processes
-func (s *Socket) Run() {
-	done := make(chan bool, 1)
+// NextSeqNo returns the sequence number of the next byte the socket sends
+// (the SYN and the FIN each consume one), e.g. to diagnose sequencing
+// issues or to build custom packets consistent with the connection
+func (s *Socket) NextSeqNo() uint32 {
+	return s.packetizer.SeqNo()
+}
 
-	go s.receive(done)
-	go s.transmit()
+// NextAckNo returns the acknowledgement number carried by the packets the
+// socket sends, i.e. the sequence number of the next byte expected from
+// the remote host as of the last ACK sent (in unreliable mode, the end of
+// the last reliable datagram acknowledged, see WriteReliable)
+func (s *Socket) NextAckNo() uint32 {
+	return s.packetizer.AckNo()
+}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+// networkLayer wraps a connection to the network layer, as an
+// atomic.Value must always hold values of the same concrete type
+type networkLayer struct {
+	network.Network
+}
 
-	for {
-		select {
-		case <-sigs:
-		case <-s.shutdown:
-			done <- true
-			s.finish()
-			close(s.inbound)
-			close(s.shutdown)
-			close(s.fin)
-			return
-		}
+// SetNetwork migrates a live socket to a new connection to the network
+// layer (e.g. after the underlying net.PacketConn changed) without dropping
+// the connection: every packet sent thereafter, incl. retransmissions of
+// data in flight, goes out the new network, and the connection's state is
+// preserved. A packet being sent as the network is swapped is sent on the
+// old one. Packets received on the new network must be delivered to the
+// socket (see Deliver), as they were from the old one
+func (s *Socket) SetNetwork(n network.Network) error {
+	if n == nil {
+		return errors.New("connection to network layer cannot be nil")
 	}
+	s.network.Store(networkLayer{n})
+	return nil
 }
 
-func (s *Socket) receive(done chan bool) {
+// applicationLayer wraps a connection to the application layer, with locks
+// held while reading from and writing to it (so that SetApplication can wait
+// for those operations to return). Each connection set is wrapped anew, which
+// tells them apart without comparing them (not every net.Conn is comparable)
+type applicationLayer struct {
+	net.Conn
+	reading sync.Mutex
+	writing sync.Mutex
+}
+
+// app returns the current connection to the application layer
+func (s *Socket) app() *applicationLayer {
+	return s.application.Load().(*applicationLayer)
+}
+
+// readApp reads from the current connection to the application
+// layer, and returns the connection read from
+func (s *Socket) readApp(b []byte) (*applicationLayer, int, error) {
 	for {
-		select {
-		case <-done:
-			close(done)
-			return
-		case p := <-s.inbound:
-			s.rxBytes += uint32(p.Length)  // stats
-			s.application.Write(p.Payload) // pass packet to application layer
+		app := s.app()
+		app.reading.Lock()
+		if app == s.app() {
+			n, err := app.Read(b)
+			app.reading.Unlock()
+			return app, n, err
 		}
+		app.reading.Unlock() // swapped meanwhile
 	}
 }
 
-func (s *Socket) transmit() {
-	buf := make([]byte, 1500)
+// writeApp writes to the current connection to the application
+// layer, and returns the connection written to
+func (s *Socket) writeApp(b []byte) (*applicationLayer, int, error) {
 	for {
-		n, err := s.application.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				s.shutdown <- true
-				return
-			}
-			continue
+		app := s.app()
+		app.writing.Lock()
+		if app == s.app() {
+			n, err := app.Write(b)
+			app.writing.Unlock()
+			return app, n, err
 		}
+		app.writing.Unlock() // swapped meanwhile
+	}
+}
 
-		n, err = s.packetizer.PackAndForwardMessage(buf[:n])
-		if err != nil {
-			log.Printf("[rdtp socket %s] Error packetizing and forwarding message: %s", s.ID(), err)
-			return
-		}
+// SetApplication swaps a live socket's connection to the application layer
+// for another (e.g. to hand the connection over after a protocol upgrade)
+// without dropping the connection: data received thereafter is written to
+// the new connection, and data to send is read from it. A read from the old
+// connection in progress is interrupted (by its read deadline), and what it
+// read is sent before anything read from the new connection. A write to the
+// old connection in progress is interrupted too (by its write deadline), and
+// the rest of the data written to the new one, so that the data received is
+// split between both connections, neither lost nor duplicated. Once
+// SetApplication returns the old connection is no longer used (its deadlines
+// are cleared), and it is left for the caller to close. The old connection
+// must support deadlines, otherwise SetApplication blocks until the read
+// and write in progress (if any) return. Setting the connection of a socket
+// which is closed returns ErrConnClosed
+func (s *Socket) SetApplication(c net.Conn) error {
+	if c == nil {
+		return errors.New("connection to application layer cannot be nil")
+	}
+
+	s.appSwaps.Lock()
+	defer s.appSwaps.Unlock()
+
+	if s.isClosed() {
+		return ErrConnClosed
+	}
+	old := s.app()
+	s.application.Store(&applicationLayer{Conn: c})
+	if s.isClosed() {
+		// closed meanwhile, which may only have closed the old connection
+		c.Close()
+	}
+	now := time.Now()
+	old.SetReadDeadline(now)
+	old.SetWriteDeadline(now)
+
+	// wait for the operations on the old connection to return
+	old.reading.Lock()
+	old.writing.Lock()
+	old.SetReadDeadline(time.Time{})
+	old.SetWriteDeadline(time.Time{})
+	old.writing.Unlock()
+	old.reading.Unlock()
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (s *Socket) LocalAddr() net.Addr {
+	return s.lAddr
+}
+
+// RemoteAddr returns the remote network address.
+func (s *Socket) RemoteAddr() net.Addr {
+	return s.rAddr
+}
 
-		s.txBytes += uint32(n) // stats
+// Close closes a socket: its connection to the application is
+// closed and, if it is running, the socket shuts down (with the
+// FIN handshake) and all of its goroutines exit. Whether Close
+// blocks (or resets the connection) is set by Config.Linger. Closing
+// an established socket which is not running (e.g. one pooled but
+// never used) is safe, and any number of times: it shuts down as
+// soon as it is run, if ever (see IsAlive)
+func (s *Socket) Close() {
+	switch {
+	case s.linger < 0:
+		if err := s.Reset(); err != nil {
+			log.Printf("[rdtp socket %s] Close: %s", s.logID(), err)
+		}
+	case s.linger > 0:
+		s.CloseWithTimeout(s.linger)
+	default:
+		s.close()
 	}
 }
+
+// close closes a socket without lingering (see Close)
+func (s *Socket) close() {
+	s.Lock()
+	s.closed = true
+	s.Unlock()
+
+	s.cancel()
+	s.app().Close()
+	s.signalReadReady()
+	s.atc.Resume()
+}
+
+// Pause stops sending new data, e.g. for application-level throttling on
+// behalf of an external rate limit, until resumed (see Resume): writes
+// block (or, in non-blocking mode, return ErrWouldBlock) meanwhile. Data
+// in flight is still re-sent until acknowledged, and data received still
+// acknowledged, so pausing does not time out data already sent. Closing
+// the socket resumes it, so that the data written is sent before the FIN
+func (s *Socket) Pause() {
+	s.atc.Pause()
+}
+
+// Resume resumes sending data after a Pause
+func (s *Socket) Resume() {
+	s.atc.Resume()
+}
+
+// CloseWith closes a socket (see Close) with a final payload attached to
+// the FIN, which saves a round trip for e.g. a trailer or a goodbye message
+// (at most as large as a packet's payload, see DebugInfo). The remote host
+// delivers it to its application after all the data sent before it, and
+// before the end of the stream. Like the FIN (and unlike data written to
+// the socket) it is sent once, not re-sent until acknowledged. It returns
+// an error if the payload does not fit or the socket is already closed
+func (s *Socket) CloseWith(payload []byte) error {
+	if size := s.packetizer.Size(); len(payload) > size {
+		return fmt.Errorf("final payload of %d bytes exceeds the payload size of %d bytes", len(payload), size)
+	}
+	if err := s.writeErr(); err != nil {
+		return err
+	}
+	s.Lock()
+	s.finPayload = append([]byte(nil), payload...)
+	s.Unlock()
+
+	s.Close()
+	return nil
+}
+
+// CloseWithTimeout closes a running socket (see Close) gracefully, bounded
+// by the given timeout: data in flight drains and the FIN handshake
+// completes, unless the timeout elapses first, in which case the connection
+// is reset (see Reset) without waiting any longer. It returns nil if the
+// socket shut down gracefully in time, and ErrCloseForced otherwise
+func (s *Socket) CloseWithTimeout(d time.Duration) error {
+	s.close()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.stopped:
+		s.RLock()
+		defer s.RUnlock()
+		if !s.graceful {
+			return ErrCloseForced
+		}
+		return nil
+	case <-timer.C:
+		if err := s.Reset(); err != nil {
+			log.Printf("[rdtp socket %s] Forced close: %s", s.logID(), err)
+		}
+		return ErrCloseForced
+	}
+}
+
+// Reset aborts the connection: data not yet acknowledged is discarded,
+// the remote host is sent a reset (ERR) and the socket shuts down
+// without the FIN handshake. Unlike Close, Reset does not wait for
+// anything to be acknowledged by the remote host
+func (s *Socket) Reset() error {
+	s.atc.Close()
+	err := s.packetizer.SendControlPacket(false, false, false, true)
+	s.abort(CloseReset, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not send reset")
+	}
+	return nil
+}
+
+// ResetReliability restarts the connection's reliability state without
+// tearing the connection down, e.g. after a migration or a detected desync:
+// the data in flight is no longer re-sent, and the state tracking what was
+// sent and acknowledged (incl. its counters, see atc.Reset) starts afresh.
+// The remote host is sent (until acknowledged) a FWD packet for each packet
+// abandoned, which tells it to skip over its data, as for data past its
+// deadline (see WriteWithDeadline). Sequence numbers carry on from where
+// they were, so the application's data is delivered in order from here on,
+// less what was in flight
+func (s *Socket) ResetReliability() error {
+	for _, f := range s.atc.Reset() {
+		fwd := packet.NewForwardPacket(uint16(s.lAddr.Port), uint16(s.rAddr.Port), f.SeqNo, uint16(f.Bytes))
+		fwd.SetAckNo(s.packetizer.AckNo())
+		fwd.SetSum()
+		if err := s.atc.Send(fwd); err != nil {
+			return errors.Wrap(err, "could not send FWD packet")
+		}
+	}
+	return nil
+}
+
+// abort records the reason for (and the error that caused, if any) the
+// connection to be reset, closes the connection to the application and
+// shuts the socket down
+func (s *Socket) abort(reason CloseReason, err error) {
+	s.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.setCloseReason(reason)
+	s.aborted = true
+	s.closed = true
+	s.Unlock()
+
+	s.app().Close()
+	s.signalShutdown()
+}
+
+// signalShutdown asks Run to shut the socket down (if not asked already),
+// unless the socket's channels were already closed (see Run), so that the
+// application's EOF, a FIN and Close racing each other (or arriving after
+// Run returned) never send on a closed channel
+func (s *Socket) signalShutdown() {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.released {
+		return
+	}
+	select {
+	case s.shutdown <- true:
+	default:
+	}
+}
+
+// Errors returns a channel on which errors signaled by the remote host
+// are received, i.e. ErrConnectionReset when the remote host resets the
+// connection. The socket shuts down on such an error, after which writes
+// return ErrConnReset. The channel is buffered and never closed
+func (s *Socket) Errors() <-chan error {
+	return s.peerErrs
+}
+
+// Err returns the error which put the connection in an error state: the
+// error it was reset with by the remote host (ErrConnectionReset), or
+// failed with (e.g. ErrKeepaliveTimeout or a permanent network error),
+// ErrConnReset if it was reset locally (see Reset), or the context's error
+// if the connection's context was cancelled. It returns nil while the
+// connection is healthy, and after it is closed gracefully. The error is
+// sticky, and terminal: a connection with an error is never usable again,
+// e.g. a pool should discard it rather than reuse it
+func (s *Socket) Err() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.err == nil && s.aborted {
+		return ErrConnReset
+	}
+	return s.err
+}
+
+func (s *Socket) isAborted() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.aborted
+}
+
+func (s *Socket) isClosed() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.closed
+}
+
+// writeErr returns the error for writes to the socket in its current
+// state: ErrConnReset if the connection was reset, the context's error if
+// the connection's context was cancelled, ErrConnClosed if the socket is
+// closed or shut down, and nil if the socket can be written to
+func (s *Socket) writeErr() error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.aborted {
+		if s.err == ErrUserTimeout {
+			return ErrUserTimeout
+		}
+		return ErrConnReset
+	}
+	if err := s.parent.Err(); err != nil {
+		return err
+	}
+	if s.closed {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// Context returns the connection's context (see Config.Context),
+// which is done once the socket is closed or shuts down
+func (s *Socket) Context() context.Context {
+	return s.ctx
+}
+
+// Deliver delivers a packet to a socket's inbound packet channel.
+// Deliver never blocks (but for writing to a capture, see Config.Capture):
+// if the inbound channel is full the packet is dropped (and counted) so
+// that a slow socket cannot stall the caller.
+// Packets delivered to a socket which has shut down are discarded
+func (s *Socket) Deliver(p *packet.Packet) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.released {
+		return
+	}
+	s.capturePacket(capture.Received, p)
+	if p.IsFIN() && !p.IsACK() {
+		atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+		// queued behind the data received before it (see receive), a
+		// FIN is not dropped when the inbound channel is full: it is
+		// set aside until the receiver drains it, and then validated
+		select {
+		case s.inbound <- p:
+		case s.finOverflow <- p:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			atomic.AddUint64(&s.drops.InboundFull, 1) // stats
+		}
+		return
+	}
+	select {
+	case s.inbound <- p:
+		atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		atomic.AddUint64(&s.drops.InboundFull, 1) // stats
+	}
+}
+
+// finReceived notifies the socket that the remote host closed
+// the connection, which shuts the socket down
+func (s *Socket) finReceived() {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.released {
+		return
+	}
+	s.signalFin()
+}
+
+// signalFin is finReceived for callers holding the socket's (read) lock,
+// and having checked it was not released, e.g. Deliver: read locking it
+// again would deadlock with a writer waiting in between (see sync.RWMutex)
+func (s *Socket) signalFin() {
+	select {
+	case s.fin <- true:
+	default:
+	}
+	select {
+	case s.shutdown <- true:
+	default:
+	}
+}
+
+// finPending returns true if the remote host closed the connection
+// and the termination handshake did not yet take over (see finish)
+func (s *Socket) finPending() bool {
+	return len(s.fin) > 0
+}
+
+// Dropped returns the number of inbound packets dropped because the
+// socket's inbound channel (or, in unreliable mode, its datagram queue)
+// was full
+func (s *Socket) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Run kicks-off socket processes (none run before, see New) and blocks until
+// the socket shuts down (see Close), returning the error which caused the shutdown (if any).
+// The socket shuts down in order: the transmit goroutine stops, data in
+// flight is given some time to be acknowledged, the receive goroutine
+// stops, the FIN handshake takes over the inbound channel and finally
+// the socket's channels are closed, with no goroutine left to use them
+func (s *Socket) Run() error {
+	s.receiving.Add(1)
+	go func() {
+		defer s.receiving.Done()
+		s.receive()
+	}()
+	s.sending.Add(1)
+	go func() {
+		defer s.sending.Done()
+		s.transmit()
+	}()
+
+	// process signals are left to the program embedding the socket
+	select {
+	case <-s.shutdown:
+	case <-s.ctx.Done(): // closed, or the connection's context cancelled
+	}
+
+	s.Lock()
+	if err := s.parent.Err(); err != nil && s.err == nil {
+		s.err = err // data in flight is abandoned, but the FIN still sent
+		s.setCloseReason(CloseContextDone)
+	}
+	s.closed = true
+	failed := s.aborted || s.err != nil
+	s.Unlock()
+
+	s.cancel() // stops the transmit goroutine and application reads
+	s.signalReadReady()
+	drained := true
+	if !failed && !s.finPending() {
+		drained = s.drain()
+	}
+	s.atc.Close() // abandons data in flight, unblocking a full write buffer
+	s.sending.Wait()
+
+	// an application which stopped reading must not block the receiver
+	s.app().SetWriteDeadline(time.Now().Add(maxCloseDrainTime))
+	close(s.stopReceiving)
+	s.receiving.Wait()
+	finished := false
+	if !s.isAborted() {
+		finished = s.finish() == nil
+	}
+	// the application reads any data already delivered, then EOF
+	s.app().Close()
+	s.reading.Wait()
+
+	s.setState(StateClosed)
+	s.Lock()
+	s.released = true
+	s.graceful = !failed && drained && finished && !s.aborted
+	close(s.inbound)
+	close(s.shutdown)
+	close(s.fin)
+	close(s.stopped)
+	s.Unlock()
+
+	s.RLock()
+	defer s.RUnlock()
+	return s.err
+}
+
+// drain waits (for a while at most) for the transmit goroutine to stop and
+// for the data it sent to be acknowledged, which the receive goroutine
+// (still running) handles. It returns false if the data did not drain
+func (s *Socket) drain() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), maxCloseDrainTime)
+	defer cancel()
+
+	sent := make(chan struct{})
+	go func() {
+		s.sending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		return false
+	}
+	if err := s.Drain(ctx); err != nil {
+		log.Printf("[rdtp socket %s] Data in flight not acknowledged on shutdown: %s", s.logID(), err)
+		return false
+	}
+	return true
+}
+
+// receive handles the packets received and runs the connection's timers
+// (see timers) until the socket shuts down or the remote host closes the
+// connection
+func (s *Socket) receive() {
+	t := s.startTimers()
+	defer t.stop()
+
+	// data carried by the ACK which completed the handshake
+	if p := s.handshakeData; p != nil {
+		s.handshakeData = nil
+		s.handle(p)
+		s.ackIfDue()
+	}
+
+	for {
+		select {
+		case <-s.stopReceiving:
+			return
+		case p, ok := <-s.inbound:
+			if !ok {
+				return // socket shut down
+			}
+			t.heard()
+			if p.IsFIN() && !p.IsACK() {
+				if s.receiveFin(p) {
+					return // the termination handshake takes over
+				}
+				continue
+			}
+			s.handle(p)
+			s.ackIfDue()
+		case fin := <-s.finOverflow:
+			// the packets queued before the FIN are handled first
+			for drained := false; !drained; {
+				select {
+				case p, ok := <-s.inbound:
+					if !ok {
+						return
+					}
+					if p.IsFIN() && !p.IsACK() {
+						if s.receiveFin(p) {
+							return
+						}
+						continue
+					}
+					s.handle(p)
+				default:
+					drained = true
+				}
+			}
+			s.ackIfDue()
+			if s.receiveFin(fin) {
+				return
+			}
+		case <-t.keepaliveC:
+			if s.keepaliveFired(t) {
+				return
+			}
+		case <-t.idleC:
+			if s.idleFired(t) {
+				return
+			}
+		case <-t.lifetimeC:
+			s.lifetimeFired(t)
+		case <-t.userC:
+			if s.userTimeoutFired(t) {
+				return
+			}
+		}
+	}
+}
+
+// receiveFin handles a FIN received once all data received before it was:
+// the FIN is validated as any packet is (see validate), and dropped if
+// invalid. Otherwise its final payload (if any) is delivered and the socket
+// shuts down, in which case it returns true (the termination handshake then
+// takes over)
+func (s *Socket) receiveFin(fin *packet.Packet) bool {
+	if err := s.validate(fin); err != nil {
+		s.countDrop(err)
+		return false
+	}
+	s.ackIfDue()
+	s.deliverFinal(fin)
+	s.finReceived()
+	return true
+}
+
+// deliverFinal delivers the final payload carried by a valid FIN (if any,
+// see CloseWith) when received in order, acknowledged by the FIN ACK rather
+// than by an ACK of its own, which the termination handshake would reject
+func (s *Socket) deliverFinal(fin *packet.Packet) {
+	if len(fin.Payload) == 0 || fin.SeqNo != s.rxNext {
+		return
+	}
+	s.tracedContext.Store(fin.TraceTag)
+	n := s.deliver(fin.AppHeader, fin.Payload)
+	s.recordSegment(fin.SeqNo, fin.Payload[:n])
+	s.rxNext += uint32(n)
+	atomic.AddUint64(&s.rxBytes, uint64(n)) // stats
+	s.packetizer.SetAckNo(s.rxNext)
+}
+
+// handle processes a packet received from the network. Packets are
+// validated (see validate) before their ACK is processed and before any
+// data is delivered, so that corrupt or spoofed packets are dropped without
+// effect. Data is only delivered to the application in order, and every
+// data packet which is not dropped is answered with a cumulative ACK of all
+// data received in order so far. This also re-acknowledges duplicates
+// (whose ACK may have been lost) and packets received out of order
+func (s *Socket) handle(p *packet.Packet) {
+	if err := s.validate(p); err != nil {
+		s.countDrop(err)
+		return
+	}
+
+	if p.IsERR() {
+		if s.inReceiveWindow(p) {
+			select {
+			case s.peerErrs <- ErrConnectionReset:
+			default:
+			}
+			s.abort(ClosePeerReset, ErrConnectionReset)
+		}
+		return
+	}
+
+	if p.IsSYN() {
+		s.challengeAck(p) // its payload is not data (see MSS)
+		return
+	}
+
+	// the ack number of an echoed ping carries no news, and would
+	// otherwise count as a duplicate ACK (see Config.DupAckThreshold)
+	if p.IsACK() && !p.IsPNG() {
+		s.atc.Ack(p.AckNo)
+	}
+
+	if p.IsPNG() {
+		if p.IsACK() {
+			s.pong(p.PingID())
+		} else {
+			s.echo(p)
+		}
+		return
+	}
+
+	// packets without payload (e.g. pure ACKs) are only processed for
+	// their flags: they consume no sequence numbers, and are neither
+	// delivered nor acknowledged (which would never end for pure ACKs)
+	if len(p.Payload) == 0 {
+		return
+	}
+	if carriesData(p) {
+		s.rxPayloadHist.sample(int64(len(p.Payload)))
+	}
+
+	if s.unreliable && !p.IsFWD() {
+		if p.IsREL() {
+			s.queueReliableDatagram(p)
+		} else {
+			s.queueDatagram(p)
+		}
+		return
+	}
+
+	if p.SeqNo == s.rxNext && p.IsFWD() {
+		s.rxNext += p.ForwardBytes() // data abandoned by the peer
+	} else if !p.IsFWD() {
+		// a retransmission may overlap data already delivered
+		// (e.g. after a short write to the application)
+		if offset := s.rxNext - p.SeqNo; offset < uint32(len(p.Payload)) {
+			s.tracedContext.Store(p.TraceTag)
+			n := s.deliver(p.AppHeader, p.Payload[offset:])
+			s.recordSegment(s.rxNext, p.Payload[offset:offset+uint32(n)])
+			s.rxNext += uint32(n)
+			atomic.AddUint64(&s.rxBytes, uint64(n)) // stats
+			if n < len(p.Payload[offset:]) && s.isAborted() {
+				return // reset (see resetOnApplicationClosed)
+			}
+
+			if offset == 0 && n == len(p.Payload) {
+				// in order and in full: the ACK may be coalesced
+				s.unacked++
+				s.ackIfDue()
+				return
+			}
+		} else if s.alreadyReceived(p) {
+			atomic.AddUint64(&s.drops.Duplicate, 1) // stats
+		} else {
+			atomic.AddUint64(&s.drops.OutOfOrder, 1) // stats
+		}
+	}
+
+	s.ack()
+}
+
+// Ping sends a ping to the remote host and waits for it to be echoed back,
+// returning the round trip time or the context's error if the context is
+// done first. Pings are independent of (and not delayed by) data transfer
+func (s *Socket) Ping(ctx context.Context) (time.Duration, error) {
+	id := atomic.AddUint32(&s.pingID, 1)
+	pong := make(chan struct{})
+
+	s.Lock()
+	s.pings[id] = pong
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.pings, id)
+		s.Unlock()
+	}()
+
+	p := packet.NewPingPacket(uint16(s.lAddr.Port), uint16(s.rAddr.Port), id)
+	p.SetSum()
+
+	start := time.Now()
+	if err := s.toNetwork(p); err != nil {
+		return 0, errors.Wrap(err, "could not send ping")
+	}
+
+	select {
+	case <-pong:
+		rtt := time.Since(start)
+		s.rttHist.sample(int64(rtt))
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// WarmUp exchanges a few small probes (pings) with the remote host and
+// feeds their round trip times to the RTT estimator, refining the
+// retransmission timeout (see CurrentRTO) before e.g. a bulk transfer,
+// rather than starting it with the initial guess (see Config.AckWait). It
+// can be called right after the handshake, once the socket is running
+// (see Run), and returns the context's error if it is done first
+func (s *Socket) WarmUp(ctx context.Context) error {
+	for i := 0; i < warmUpProbes; i++ {
+		rtt, err := s.Ping(ctx)
+		if err != nil {
+			return err
+		}
+		s.atc.SampleRTT(rtt)
+	}
+	return nil
+}
+
+// CurrentRTO returns the time data sent now is waited on to be acknowledged
+// before it is first re-sent, i.e. the initial retransmission timeout
+// (see Config.AckWait) until estimated from round trip times (see WarmUp)
+func (s *Socket) CurrentRTO() time.Duration {
+	return s.atc.Info().AckWait
+}
+
+// echo echoes a ping back to the remote host
+func (s *Socket) echo(ping *packet.Packet) {
+	p := packet.NewPingPacket(uint16(s.lAddr.Port), uint16(s.rAddr.Port), ping.PingID())
+	p.SetFlagACK()
+	p.SetAckNo(s.rxNext)
+	p.SetSum()
+	if err := s.toNetwork(p); err != nil {
+		log.Printf("[rdtp socket %s] Error echoing ping: %s", s.logID(), err)
+	}
+}
+
+// pong unblocks the Ping waiting for the echo of the given ping (if any)
+func (s *Socket) pong(id uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	if pong, ok := s.pings[id]; ok {
+		close(pong)
+		delete(s.pings, id)
+	}
+}
+
+// deliver passes data to the application layer, returning the number
+// of bytes written. Only data written is acknowledged: anything else
+// is retransmitted by the remote host and delivered later
+func (s *Socket) deliver(header, data []byte) int {
+	if s.onDataWithHeader != nil {
+		s.onDataWithHeader(header, data)
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+		return len(data)
+	}
+	if s.onData != nil {
+		s.onData(data)
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+		return len(data)
+	}
+
+	written := 0
+	for written < len(data) {
+		app, n, err := s.writeApp(data[written:])
+		written += n
+		if err != nil && app != s.app() {
+			continue // swapped mid-write, the rest goes to the new connection
+		}
+		if err != nil && isClosedConnErr(err) && !s.isClosed() {
+			s.resetOnApplicationClosed()
+			break
+		}
+		if err != nil {
+			log.Printf("[rdtp socket %s] Error writing to application (%d of %d bytes written): %s", s.logID(), written, len(data), err)
+			break
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if written > 0 {
+		atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	}
+	return written
+}
+
+// resetOnApplicationClosed resets the connection when data received cannot
+// be delivered because the application closed its connection (and not the
+// socket), as the remote host would otherwise keep re-sending data nobody
+// will ever read (and which is therefore never acknowledged)
+func (s *Socket) resetOnApplicationClosed() {
+	log.Printf("[rdtp socket %s] Data received after the application closed its connection, resetting connection", s.logID())
+	s.atc.Close()
+	if err := s.packetizer.SendControlPacket(false, false, false, true); err != nil {
+		log.Printf("[rdtp socket %s] Error sending reset: %s", s.logID(), err)
+	}
+	s.abort(CloseReset, ErrApplicationClosed)
+}
+
+// isClosedConnErr returns true if an error writing to a connection
+// is due to the connection being closed (by either end)
+func isClosedConnErr(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EPIPE)
+}
+
+// ack sends a cumulative acknowledgement of all data received in order
+func (s *Socket) ack() {
+	atomic.AddUint64(&s.acksSent, 1)                     // stats
+	atomic.AddUint64(&s.ackedPackets, uint64(s.unacked)) // stats
+	s.unacked = 0
+
+	s.packetizer.SetAckNo(s.rxNext)
+	if err := s.packetizer.SendControlPacket(false, true, false, false); err != nil {
+		log.Printf("[rdtp socket %s] Error sending ACK: %s", s.logID(), err)
+	}
+}
+
+// challengeAck answers a SYN received on the established connection, i.e.
+// a duplicate of the handshake, or a SYN from a restarted peer (or a stale
+// one), with an ACK of the connection's current state rather than
+// re-running the handshake or resetting the connection (as TCP does, see
+// RFC 5961). The SYN is otherwise ignored, which lets the peer detect a
+// stale connection while a duplicate does no harm
+func (s *Socket) challengeAck(syn *packet.Packet) {
+	atomic.AddUint64(&s.duplicateSYNs, 1) // stats
+	log.Printf("[rdtp socket %s] SYN (seq %d) received on the established connection, sending a challenge ACK", s.logID(), syn.SeqNo)
+	s.ack()
+}
+
+// ackIfDue acknowledges coalesced data once enough data packets are
+// unacknowledged, or as soon as no further packets are queued
+func (s *Socket) ackIfDue() {
+	if s.unacked > 0 && (s.unacked >= s.maxAckCoalesce || len(s.inbound) == 0) {
+		s.ack()
+	}
+}
+
+// SetReadBuffer resizes the receive buffer of a live connection (as setting
+// SO_RCVBUF on an open socket does), i.e. how far ahead of the next sequence
+// number expected data is accepted. Shrinking the receive window never
+// discards data: data is only ever delivered from the next sequence number
+// expected, which always falls within the window. The capacity of the
+// inbound channel stays as set on creation (see Config.ReadBufferBytes)
+func (s *Socket) SetReadBuffer(bytes int) error {
+	if bytes <= 0 {
+		return fmt.Errorf("invalid read buffer size %d, must be positive", bytes)
+	}
+	atomic.StoreUint32(&s.receiveWindow, uint32(bytes))
+	return nil
+}
+
+// SetWriteBuffer resizes the send buffer of a live connection (as setting
+// SO_SNDBUF on an open socket does), i.e. how many bytes may be in flight.
+// Data already in flight beyond a shrunk buffer is kept until acknowledged,
+// writes block until enough of it is. Use a negative value to not limit
+// the data in flight (see Config.WriteBufferBytes)
+func (s *Socket) SetWriteBuffer(bytes int) error {
+	if bytes == 0 {
+		return errors.New("invalid write buffer size 0, must be positive (or negative to not limit it)")
+	}
+	s.atc.SetWindow(bytes)
+	return nil
+}
+
+// reasons for which packets received are dropped (see validate)
+var (
+	errBadChecksum    = errors.New("bad checksum")
+	errMisaddressed   = errors.New("not addressed from the remote to the local address")
+	errAckNotSent     = errors.New("acknowledges data never sent")
+	errOutOfSeqWindow = errors.New("sequence number outside of the receive window")
+	errRejected       = errors.New("rejected by custom validation")
+	errUnauthentic    = errors.New("payload failed authentication")
+	errBadCompression = errors.New("payload failed to decompress")
+	errUntagged       = errors.New("payload carries no trace tag")
+	errStaleEpoch     = errors.New("bears the epoch of another connection")
+)
+
+// validate returns an error if a packet received is corrupt (its checksum
+// does not match), is not addressed from the remote to the local address,
+// or bears another epoch than the remote host's (i.e. is a stale packet of
+// a previous connection between the same addresses, see Config.EpochSource,
+// SYNs and resets are exempt as they may come from a new connection of the
+// remote host's, see challengeAck), or is implausible: acknowledging data
+// beyond any sent, a FIN outside of the receive window, or carrying data
+// (see handle) which is neither within the receive window nor a
+// retransmission of data already received, or if its payload fails
+// authentication when encrypted (see Config.Encryption, the payload is
+// then decrypted in place), or fails to decompress when compressed (see
+// Config.Compression, the payload is then decompressed in place, once
+// decrypted), or carries no trace tag when trace tags were agreed to (see
+// Config.TraceTags, the tag is then stripped off the payload in place, once
+// decompressed) or no application header when one was agreed to (see
+// Config.AppHeaderSize, stripped off along with the trace tag), or if
+// custom validation rejects it (see Config.ValidatePacket)
+func (s *Socket) validate(p *packet.Packet) error {
+	if !p.CheckSum() {
+		return errBadChecksum
+	}
+	if p.SrcPort != s.rAddr.Port || p.DstPort != s.lAddr.Port {
+		return errMisaddressed
+	}
+	if ip, err := p.GetSourceIPv4(); err == nil && s.rIP != nil && !ip.Equal(s.rIP) {
+		return errMisaddressed
+	}
+	if s.peerEpoch != 0 && p.Epoch != s.peerEpoch && !p.IsSYN() && !p.IsERR() {
+		return errStaleEpoch
+	}
+	if p.IsACK() && int32(p.AckNo-s.packetizer.SeqNo()) > 0 {
+		return errAckNotSent
+	}
+	if p.IsFIN() && !s.inReceiveWindow(p) {
+		return errOutOfSeqWindow // e.g. blindly injected to close the connection
+	}
+	if (carriesData(p) || p.IsFWD()) && !s.inReceiveWindow(p) && !s.alreadyReceived(p) {
+		return errOutOfSeqWindow
+	}
+	if (carriesData(p) || p.IsFWD()) && s.decrypt(p) != nil {
+		return errUnauthentic // incl. a FWD forged to skip data
+	}
+	if carriesData(p) && s.decompress(p) != nil {
+		return errBadCompression
+	}
+	if carriesData(p) && s.unframe(p) != nil {
+		return errUntagged
+	}
+	if s.validatePacket != nil && s.validatePacket(p) != nil {
+		return errRejected
+	}
+	return nil
+}
+
+// carriesData returns true for packets whose payload is application data
+// rather than that of a control packet (e.g. a ping's ID, see Histograms,
+// or the number of bytes a FWD skips)
+func carriesData(p *packet.Packet) bool {
+	return len(p.Payload) > 0 && !p.IsSYN() && !p.IsPNG() && !p.IsFWD() && !p.IsERR()
+}
+
+// inReceiveWindow returns true if a packet's sequence number falls within
+// [rxNext, rxNext + receive window), using serial number arithmetic.
+// The peer's sequence numbers start at its (random) initial sequence number,
+// learnt during the handshake, so packets outside of the window are either
+// stale or were not sent by the peer and are therefore rejected. This makes
+// blind injection of data into the connection by off-path hosts harder
+func (s *Socket) inReceiveWindow(p *packet.Packet) bool {
+	return p.SeqNo-s.rxNext < atomic.LoadUint32(&s.receiveWindow)
+}
+
+// alreadyReceived returns true if a packet's sequence number falls within
+// [rxNext - receive window, rxNext), i.e. the packet is a retransmission
+// of data which was already received and delivered to the application
+func (s *Socket) alreadyReceived(p *packet.Packet) bool {
+	return s.rxNext-p.SeqNo-1 < atomic.LoadUint32(&s.receiveWindow)
+}
+
+// transmit packetizes and forwards the data read from the application
+// (see readApplication) until the application closes its end of the
+// connection or the socket is closed
+func (s *Socket) transmit() {
+	reads := make(chan []byte)
+	free := make(chan []byte, 2)
+	free <- nil // two buffers: the next read while the last is forwarded
+	free <- nil
+	eof := make(chan struct{})
+	s.reading.Add(1)
+	go func() {
+		defer s.reading.Done()
+		s.readApplication(reads, free, eof)
+	}()
+
+	for {
+		select {
+		case b := <-reads:
+			atomic.AddInt64(&s.sendQueued, int64(len(b)))
+			s.writes.acquire(0)
+			n, err := s.packetizer.PackAndForwardMessage(b)
+			s.writes.release()
+			atomic.AddInt64(&s.sendQueued, -int64(len(b)))
+			free <- b
+			// as for writes, the packets forwarded before an error count as sent
+			atomic.AddUint64(&s.txPayloadBytes, uint64(n)) // stats
+			if n > 0 {
+				atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+			}
+			if err != nil && s.ctx.Err() != nil {
+				return // data in flight abandoned on shutdown (see Run)
+			}
+			if err != nil {
+				log.Printf("[rdtp socket %s] Error packetizing and forwarding message (%d of %d bytes forwarded): %s", s.logID(), n, len(b), err)
+				s.fail(CloseNetworkError, errors.Wrap(err, "could not packetize and forward message"))
+				return
+			}
+		case <-eof:
+			s.signalShutdown()
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// readApplication reads data from the application into the free buffers
+// and hands it to transmit, until the application closes its end of the
+// connection (closing eof) or the socket is closed. Failed reads are
+// re-tried with exponential backoff rather than in a tight loop
+func (s *Socket) readApplication(reads chan<- []byte, free chan []byte, eof chan<- struct{}) {
+	var retry time.Duration
+	for {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-s.ctx.Done():
+			return
+		}
+
+		// each read fills at most one packet, sized to the
+		// current payload size (which may shrink mid-connection)
+		if size := s.packetizer.Size(); cap(buf) < size {
+			buf = make([]byte, size)
+		} else {
+			buf = buf[:size]
+		}
+
+		app, n, err := s.readApp(buf)
+		if n > 0 {
+			select {
+			case reads <- buf[:n]:
+			case <-s.ctx.Done():
+				return
+			}
+		} else {
+			free <- buf
+		}
+		if err == nil || app != s.app() { // swapped mid-read, read on from the new connection
+			retry = 0
+			continue
+		}
+		if err == io.EOF {
+			close(eof)
+			return
+		}
+		if s.isAborted() || s.ctx.Err() != nil {
+			return // application closed by a reset or by Close
+		}
+
+		if retry *= 2; retry < minReadRetryTime {
+			retry = minReadRetryTime
+		} else if retry > maxReadRetryTime {
+			retry = maxReadRetryTime
+		}
+		select {
+		case <-time.After(retry):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// TxBytes returns the number of bytes sent to the network, including
+// packet headers, control packets and retransmissions
+func (s *Socket) TxBytes() uint64 {
+	return atomic.LoadUint64(&s.txBytes)
+}
+
+// TxPayloadBytes returns the number of application bytes sent
+func (s *Socket) TxPayloadBytes() uint64 {
+	return atomic.LoadUint64(&s.txPayloadBytes)
+}
+
+// LastActivity returns the last time a packet (of any kind, incl. control
+// packets and retransmissions) was sent to or received from the network,
+// or the time the socket was created if no packet was sent or received
+func (s *Socket) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+// RxBytes returns the number of application bytes received
+func (s *Socket) RxBytes() uint64 {
+	return atomic.LoadUint64(&s.rxBytes)
+}
+
+// Write sends data to the remote host, re-sending it until acknowledged.
+// Data of any size is accepted: it is sent in packet-sized chunks, and
+// Write blocks whenever the send buffer is full (see Config.WriteBufferBytes)
+// until enough data is acknowledged (or Config.WriteTimeout elapses). The number of bytes returned is the
+// number of bytes of b accepted for sending, which is less than len(b)
+// only when an error is returned.
+// Write is safe for concurrent use, also with the application writing
+// data: the bytes of each call are sent contiguously and never corrupted,
+// but the order in which concurrent writes are sent is undefined (unless
+// prioritized, see WritePriority), so concurrent writers should frame
+// their data (e.g. rdtp.MessageConn).
+// Writing to a socket which is closed returns ErrConnClosed, and writing
+// to a socket whose connection is reset returns ErrConnReset
+func (s *Socket) Write(b []byte) (int, error) {
+	return s.WriteWithDeadline(b, time.Time{})
+}
+
+// WriteWithDeadline sends data to the remote host with partial reliability:
+// data which is not acknowledged by the deadline is abandoned rather than
+// re-sent, and the remote host skips over it. This suits applications for
+// which fresh data is worth more than complete data (e.g. media streaming).
+// The deadline is measured against the socket's clock (see Config.Clock).
+// Like Write, WriteWithDeadline is safe for concurrent use.
+// The number of bytes returned is always the number of bytes of b
+// accepted for sending, not the number of bytes put on the wire
+func (s *Socket) WriteWithDeadline(b []byte, deadline time.Time) (int, error) {
+	return s.write(b, deadline, 0)
+}
+
+// WriteBuffers sends the data of the given buffers, one after the other,
+// as a single Write of their concatenation would, without concatenating
+// them first: packets are filled across buffer boundaries (as writev does).
+// The buffers are not modified. The number of bytes returned is the number
+// of bytes accepted for sending, across all buffers
+func (s *Socket) WriteBuffers(bufs net.Buffers) (int64, error) {
+	n, err := s.writeBuffers(bufs, time.Time{}, 0, nil)
+	return int64(n), err
+}
+
+// write sends data with the given deadline (if any) once it
+// is the turn of writes of the given priority to be sent
+func (s *Socket) write(b []byte, deadline time.Time, priority int) (int, error) {
+	return s.writeBuffers([][]byte{b}, deadline, priority, nil)
+}
+
+// writeBuffers sends the data of buffers as write does, on packets
+// carrying the given application header (see WriteWithHeader), if any
+func (s *Socket) writeBuffers(bufs [][]byte, deadline time.Time, priority int, header []byte) (n int, err error) {
+	// queued until sent, packet by packet (see sendBuffers)
+	queued := buffersLen(bufs)
+	atomic.AddInt64(&s.sendQueued, int64(queued))
+	defer func() { atomic.AddInt64(&s.sendQueued, int64(n-queued)) }()
+
+	nonBlocking := s.isNonBlocking()
+	if s.writeTimeout > 0 && !nonBlocking {
+		return s.writeBuffersWithTimeout(bufs, deadline, priority, header)
+	}
+	return s.sendBuffers(bufs, deadline, priority, header, nonBlocking)
+}
+
+// writeBuffersWithTimeout sends the data of buffers as much as fits in the
+// send buffer at a time, waiting for room in it until the write timeout
+// elapses (see Config.WriteTimeout). Data is never packetized before there
+// is room for it, so a write which times out leaves no gap in the stream
+func (s *Socket) writeBuffersWithTimeout(bufs [][]byte, deadline time.Time, priority int, header []byte) (int, error) {
+	expired := make(chan struct{})
+	timer := s.clock.AfterFunc(s.writeTimeout, func() { close(expired) })
+	defer timer.Stop()
+
+	total := 0
+	for {
+		n, err := s.sendBuffers(bufs, deadline, priority, header, true)
+		total += n
+		if err != ErrWouldBlock {
+			return total, err
+		}
+		bufs = skipBuffers(bufs, n)
+		select {
+		case <-s.WriteReady():
+		case <-expired:
+			return total, ErrWriteTimeout
+		}
+	}
+}
+
+// sendBuffers sends the data of buffers or, if limited, only as much
+// of it as fits in the send buffer, returning ErrWouldBlock (with the
+// number of bytes sent) if that is not all of it
+func (s *Socket) sendBuffers(bufs [][]byte, deadline time.Time, priority int, header []byte, limited bool) (int, error) {
+	if err := s.writeErr(); err != nil {
+		return 0, err
+	}
+	s.writes.acquire(priority)
+	var wouldBlock bool
+	if limited {
+		// only as much data as fits in the send buffer (see SetNonBlocking)
+		room := s.atc.Room()
+		if room == 0 {
+			s.writes.release()
+			return 0, ErrWouldBlock
+		}
+		bufs, wouldBlock = limitBuffers(bufs, room)
+	}
+	n, err := s.packetizer.PackAndForwardBuffersWith(bufs, func(p *packet.Packet) error {
+		s.tag(p)
+		p.AppHeader = header
+		if err := s.atc.SendWithDeadline(p, deadline); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.sendQueued, -int64(len(p.Payload)))
+		return nil
+	})
+	s.writes.release()
+	atomic.AddUint64(&s.txPayloadBytes, uint64(n)) // stats
+	atomic.StoreInt64(&s.lastData, time.Now().UnixNano())
+	if err != nil && s.failFast && atc.IsPermanent(err) {
+		s.failOnNetworkError(err)
+	}
+	if err != nil && s.writeErr() == ErrUserTimeout {
+		return n, ErrUserTimeout // unblocked by the connection timing out
+	}
+	if err != nil {
+		return n, errors.Wrap(err, "could not packetize and forward message")
+	}
+	if wouldBlock {
+		return n, ErrWouldBlock
+	}
+	return n, nil
+}
+
+// ReadFrom sends the data read from r until EOF (or an error) to the remote
+// host, as Write does, so that io.Copy to a socket reads data in chunks of
+// many packets straight into a single buffer rather than through its own
+// (smaller) buffer. Writes block whenever the send buffer is full, and
+// writes of higher priority (see WritePriority) get ahead between chunks,
+// also in non-blocking mode, as data read from r cannot be un-read.
+// The number of bytes returned is the number of bytes accepted for sending
+func (s *Socket) ReadFrom(r io.Reader) (int64, error) {
+	var buf []byte
+	var total int64
+	for {
+		// sized to the current payload size (which may shrink mid-connection)
+		if size := s.packetizer.Size() * readFromChunkPackets; cap(buf) < size {
+			buf = make([]byte, size)
+		} else {
+			buf = buf[:size]
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			written, werr := s.write(buf[:n], time.Time{}, 0)
+			for werr == ErrWouldBlock {
+				<-s.WriteReady()
+				var more int
+				more, werr = s.write(buf[written:n], time.Time{}, 0)
+				written += more
+			}
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Drain blocks until all data sent so far is acknowledged by the remote
+// host (e.g. before a graceful Close or a connection handoff), or until the
+// context is done, returning the context's error. Drain returns
+// ErrSentWhileDraining if more data is sent before it returns, and
+// ErrConnReset if the connection is reset (its data being discarded).
+// Data written by the application but not yet read by the socket is not
+// waited for
+func (s *Socket) Drain(ctx context.Context) error {
+	seqNo := s.packetizer.SeqNo()
+	for {
+		select {
+		case <-s.atc.Idle():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if s.isAborted() {
+			return ErrConnReset
+		}
+		if s.atc.InFlight() == 0 {
+			break
+		}
+	}
+	if s.packetizer.SeqNo() != seqNo {
+		return ErrSentWhileDraining
+	}
+	return nil
+}
+
+// failOnNetworkError tears the connection down on a permanent error
+// sending data to the network (see Config.FailFast)
+func (s *Socket) failOnNetworkError(err error) {
+	log.Printf("[rdtp socket %s] Permanent network error, aborting connection: %s", s.logID(), err)
+	s.abort(CloseNetworkError, errors.Wrap(err, "connection failed on a permanent network error"))
+}
+
+// fail records the reason for (and the error that caused) the socket to
+// stop working, closes the connection to the application and shuts the
+// socket down
+func (s *Socket) fail(reason CloseReason, err error) {
+	s.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.setCloseReason(reason)
+	s.closed = true
+	s.Unlock()
+
+	s.app().Close()
+	s.signalShutdown()
+}
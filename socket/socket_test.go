@@ -0,0 +1,3547 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/adrianosela/rdtp"
+	"github.com/adrianosela/rdtp/clock"
+	"github.com/adrianosela/rdtp/network"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/packet/factory"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testLocalAddr  = &rdtp.Addr{Host: "10.0.0.94", Port: 1234}
+	testRemoteAddr = &rdtp.Addr{Host: "10.0.0.95", Port: 5678}
+)
+
+type mockNetwork struct {
+	sendFunc func(p *packet.Packet) error
+}
+
+func (n *mockNetwork) Send(p *packet.Packet) error {
+	if n.sendFunc != nil {
+		return n.sendFunc(p)
+	}
+	return nil
+}
+
+func (n *mockNetwork) StartReceiver(fn func(p *packet.Packet) error) {}
+
+func mockSocket(t testing.TB, nw *mockNetwork, opts ...func(c *Config)) (*Socket, net.Conn) {
+	app, svc := net.Pipe()
+	c := Config{
+		LocalAddr:   testLocalAddr,
+		RemoteAddr:  testRemoteAddr,
+		Application: svc,
+		Network:     nw,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	s, err := New(c)
+	assert.Nil(t, err)
+	return s, app
+}
+
+// tapNetwork passes the packets sent through it to a function,
+// which sends them on (or not) in their place
+type tapNetwork struct {
+	network.Network
+	tap func(p *packet.Packet) *packet.Packet
+}
+
+func (n *tapNetwork) Send(p *packet.Packet) error {
+	if p = n.tap(p); p == nil {
+		return nil
+	}
+	return n.Network.Send(p)
+}
+
+// mockConnPair dials a connection over a loopback network, the packets
+// sent by the dialer passed through tap when set, delivering the SYN to the
+// acceptor before Accept (as the ports controller does), and returns both
+// sockets (not running yet) and applications along with the handshakes'
+// errors. The dialer retransmits quickly, without black hole detection
+func mockConnPair(t *testing.T, tap func(p *packet.Packet) *packet.Packet, dialerOpt, acceptorOpt func(c *Config)) (dialer, acceptor *Socket, dialerApp, acceptorApp net.Conn, dialErr, acceptErr error) {
+	return mockConnPairDial(t, tap, dialerOpt, acceptorOpt, (*Socket).Dial)
+}
+
+// mockConnPairDial is mockConnPair, the dialer dialing with the given function
+func mockConnPairDial(t *testing.T, tap func(p *packet.Packet) *packet.Packet, dialerOpt, acceptorOpt func(c *Config), dial func(s *Socket) error) (dialer, acceptor *Socket, dialerApp, acceptorApp net.Conn, dialErr, acceptErr error) {
+	lo, err := network.NewLoopback(time.Millisecond, 0)
+	assert.Nil(t, err)
+	t.Cleanup(lo.Close)
+
+	var dialerNetwork network.Network = lo.Host(testLocalAddr.Host)
+	if tap != nil {
+		dialerNetwork = &tapNetwork{Network: dialerNetwork, tap: tap}
+	}
+	dialer, dialerApp = mockSocket(t, nil, func(c *Config) {
+		c.Network = dialerNetwork
+		c.MTU = ipv4HeaderBytes + packet.MaxPacketBytes
+		c.AckWait = time.Millisecond * 50
+		if dialerOpt != nil {
+			dialerOpt(c)
+		}
+	})
+	acceptor, acceptorApp = mockSocket(t, nil, func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		c.Network = lo.Host(testRemoteAddr.Host)
+		if acceptorOpt != nil {
+			acceptorOpt(c)
+		}
+	})
+
+	accepted := make(chan error, 1)
+	var accept sync.Once
+	lo.Host(testRemoteAddr.Host).StartReceiver(func(p *packet.Packet) error {
+		syn := p.IsSYN() && !p.IsACK() // before the packet is handed over
+		acceptor.Deliver(p)
+		if syn {
+			accept.Do(func() { go func() { accepted <- acceptor.Accept() }() })
+		}
+		return nil
+	})
+	lo.Host(testLocalAddr.Host).StartReceiver(func(p *packet.Packet) error {
+		dialer.Deliver(p)
+		return nil
+	})
+	dialErr = dial(dialer)
+	acceptErr = <-accepted
+	return dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr
+}
+
+func TestDeliverFullInboundDrops(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < inboundPacketChannelSize+10; i++ {
+			p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("data"))
+			p.SetSum()
+			s.Deliver(p)
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Deliver blocked on a full inbound channel")
+	}
+
+	assert.Equal(t, inboundPacketChannelSize, len(s.inbound))
+	assert.Equal(t, uint64(10), s.Dropped())
+}
+
+// armedWriter calls a function on the first write once armed
+type armedWriter struct {
+	armed int32
+	once  sync.Once
+	fire  func()
+}
+
+func (w *armedWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&w.armed) == 1 {
+		w.once.Do(w.fire)
+	}
+	return len(b), nil
+}
+
+func TestDeliverFinFullInboundWithPing(t *testing.T) {
+	// a ping waits for the socket's lock while Deliver holds it (as a
+	// FIN is captured), before finding the inbound channel full
+	var s *Socket
+	w := &armedWriter{}
+	w.fire = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		go func() {
+			defer cancel()
+			s.Ping(ctx)
+		}()
+		time.Sleep(time.Millisecond * 50)
+	}
+	s, _ = mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Capture = w
+	})
+	for i := 0; i < inboundPacketChannelSize; i++ {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("data"))
+		p.SetSum()
+		s.Deliver(p)
+	}
+
+	fin, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+	fin.SetFlagFIN()
+	fin.SetSum()
+	atomic.StoreInt32(&w.armed, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Deliver(fin)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Deliver deadlocked on a FIN with a full inbound channel")
+	}
+	assert.Equal(t, 1, len(s.finOverflow), "set aside, to be validated")
+	assert.Equal(t, 0, len(s.fin))
+}
+
+func TestDeliverBogusFinFullInbound(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.OnData = func(data []byte) {}
+	})
+	for i := 0; i < inboundPacketChannelSize; i++ {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("data"))
+		p.SetSum()
+		s.Deliver(p)
+	}
+
+	// set aside, and validated once the data queued before it is handled
+	fin, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+	fin.SetFlagFIN()
+	fin.SetSeqNo(4)
+	fin.SetSum()
+	fin.Checksum = ^fin.Checksum
+	s.Deliver(fin)
+	result := make(chan error, 1)
+	go func() { result <- s.Run() }()
+	assert.Eventually(t, func() bool {
+		return s.Stats().Drops.BadChecksum == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, CloseNone, s.CloseReason())
+
+	fin.SetSum()
+	s.Deliver(fin)
+	select {
+	case <-result:
+	case <-time.After(time.Second * 5):
+		t.Fatal("socket did not shut down on a valid FIN")
+	}
+	assert.Equal(t, ClosePeer, s.CloseReason())
+}
+
+// bogusFin returns a FIN the dialer of a connection could send to the
+// acceptor next, which bogus FINs are made of
+func bogusFin(dialer, acceptor *Socket) *packet.Packet {
+	info, _ := acceptor.ConnInfo()
+	fin, _ := packet.NewPacket(testLocalAddr.Port, testRemoteAddr.Port, nil)
+	fin.SetFlagFIN()
+	fin.SetSeqNo(dialer.NextSeqNo())
+	fin.SetEpoch(info.RemoteEpoch)
+	fin.SetSum()
+	return fin
+}
+
+func TestBogusFin(t *testing.T) {
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, nil, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+
+	// FINs are validated as any packet is before closing the connection
+	for name, test := range map[string]struct {
+		bogus   func(fin *packet.Packet)
+		dropped func(d DropStats) uint64
+	}{
+		"bad checksum": {
+			bogus:   func(fin *packet.Packet) { fin.Checksum = ^fin.Checksum },
+			dropped: func(d DropStats) uint64 { return d.BadChecksum },
+		},
+		"wrong ports": {
+			bogus: func(fin *packet.Packet) {
+				fin.SrcPort++
+				fin.SetSum()
+			},
+			dropped: func(d DropStats) uint64 { return d.Misaddressed },
+		},
+		"another sequence number": {
+			bogus: func(fin *packet.Packet) {
+				fin.SetSeqNo(fin.SeqNo - 1) // just behind the receive window
+				fin.SetSum()
+			},
+			dropped: func(d DropStats) uint64 { return d.OutOfWindow },
+		},
+		"off-path, without guessing the sequence number": {
+			bogus: func(fin *packet.Packet) {
+				fin.SetSeqNo(fin.SeqNo + 1<<31) // random ISNs make it unknown
+				fin.SetSum()
+			},
+			dropped: func(d DropStats) uint64 { return d.OutOfWindow },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fin := bogusFin(dialer, acceptor)
+			test.bogus(fin)
+			before := test.dropped(acceptor.Stats().Drops)
+			acceptor.Deliver(fin)
+			assert.Eventually(t, func() bool {
+				return test.dropped(acceptor.Stats().Drops) == before+1
+			}, time.Second, time.Millisecond)
+			assert.Equal(t, StateEstablished, acceptor.State())
+		})
+	}
+
+	// the connection is still up
+	go dialerApp.Write([]byte("still up"))
+	received := make([]byte, 8)
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "still up", string(received))
+
+	// while a valid FIN closes it
+	acceptor.Deliver(bogusFin(dialer, acceptor))
+	assert.Eventually(t, func() bool {
+		return acceptor.CloseReason() == ClosePeer
+	}, time.Second*5, time.Millisecond)
+}
+
+func TestDeliverStalledReceiver(t *testing.T) {
+	// the receiver of a socket whose application does not read stalls
+	// writing to it, while another socket's application keeps up
+	slow, _ := mockSocket(t, &mockNetwork{})
+	fast, fastApp := mockSocket(t, &mockNetwork{})
+	go slow.Run()
+	go fast.Run()
+	defer slow.Close()
+	defer fast.Close()
+	go io.Copy(ioutil.Discard, fastApp)
+
+	// a demux delivering to both in turn is never held up by the
+	// stalled socket, which drops what no longer fits
+	data := func(seq int) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("data"))
+		p.SetSeqNo(uint32(seq))
+		p.SetSum()
+		return p
+	}
+	for i := 0; i < cap(slow.inbound)+10; i++ {
+		delivered := make(chan struct{})
+		go func(seq int) {
+			slow.Deliver(data(seq))
+			fast.Deliver(data(seq))
+			close(delivered)
+		}(i * 4)
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("Deliver blocked by a stalled receiver")
+		}
+		rx := uint64((i + 1) * 4)
+		assert.Eventually(t, func() bool { return fast.Stats().RxBytes == rx }, time.Second, time.Millisecond)
+	}
+	assert.True(t, slow.Stats().Drops.InboundFull >= 9, "dropped %d", slow.Stats().Drops.InboundFull)
+	assert.Equal(t, uint64(0), fast.Stats().Dropped)
+}
+
+func TestDeliverAfterClose(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	// packets keep arriving while the socket shuts down...
+	stop := make(chan struct{})
+	delivering := make(chan struct{})
+	go func() {
+		defer close(delivering)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("data"))
+			p.SetSum()
+			s.Deliver(p)
+			runtime.Gosched()
+		}
+	}()
+
+	s.Close()
+	select {
+	case <-result:
+	case <-time.After(time.Second * 3):
+		t.Fatal("socket did not shut down")
+	}
+
+	// ...and after it has shut down, when they are discarded
+	for _, flags := range [][]bool{{false, false}, {false, true}, {true, false}} {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("data"))
+		if flags[0] {
+			p.SetFlagFIN()
+		}
+		if flags[1] {
+			p.SetFlagACK()
+		}
+		assert.NotPanics(t, func() { s.Deliver(p) })
+	}
+	close(stop)
+	<-delivering
+}
+
+func TestTransmitErrorShutsDownSocket(t *testing.T) {
+	// a permanent error when failing fast (errors are otherwise
+	// re-tried, see TestFlakyNetwork)
+	mockErr := fmt.Errorf("mock network error: %w", syscall.ENETUNREACH)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error { return mockErr },
+	}, func(c *Config) {
+		c.FailFast = true
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	_, err := app.Write([]byte("this will never make it to the network"))
+	assert.Nil(t, err)
+
+	select {
+	case err = <-result:
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasSuffix(err.Error(), mockErr.Error()))
+	case <-time.After(time.Second * 3):
+		t.Fatal("socket did not shut down after a network error")
+	}
+
+	// the application side of the connection must be closed
+	_, err = app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestConfigRand(t *testing.T) {
+	isn := func() uint32 {
+		s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+			c.Rand = bytes.NewReader([]byte{0, 0, 0x30, 0x39})
+		})
+		return s.packetizer.SeqNo()
+	}
+	assert.Equal(t, uint32(12345), isn())
+	assert.Equal(t, isn(), isn(), "initial sequence numbers are reproducible")
+
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Rand = bytes.NewReader([]byte{0, 0, 0x30, 0x39})
+		c.ISNSource = func() uint32 { return 1000 }
+	})
+	assert.Equal(t, uint32(1000), s.packetizer.SeqNo(), "ISNSource takes precedence")
+}
+
+func TestReceiveWindowValidation(t *testing.T) {
+	peerISN := uint32(4294967290) // data wraps around the sequence space
+
+	nw := &mockNetwork{}
+	s, app := mockSocket(t, nw, func(c *Config) {
+		c.ISNSource = func() uint32 { return 12345 }
+	})
+
+	// mock the remote host's final handshake ACK
+	nw.sendFunc = func(p *packet.Packet) error {
+		if p.IsSYN() && p.IsACK() {
+			assert.Equal(t, uint32(12345), p.SeqNo)
+			ack, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+			ack.SetFlagACK()
+			ack.SetSeqNo(peerISN + 1)
+			ack.SetSum()
+			go s.Deliver(ack)
+		}
+		return nil
+	}
+	assert.Nil(t, s.Accept())
+	go s.Run()
+
+	deliver := func(seq uint32, payload string) {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		s.Deliver(p)
+	}
+
+	deliver(peerISN+1, "hello ")
+	deliver(peerISN+1-5000, "stale")                    // behind the window
+	deliver(peerISN+1+receiveWindowBytes*2, "injected") // way ahead of the window
+	deliver(peerISN+7, "world")
+
+	var rx []byte
+	for len(rx) < len("hello world") {
+		buf := make([]byte, 1024)
+		app.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := app.Read(buf)
+		assert.Nil(t, err)
+		if err != nil {
+			break
+		}
+		rx = append(rx, buf[:n]...)
+	}
+	assert.Equal(t, "hello world", string(rx))
+}
+
+func TestHandleDeliversInOrderAndAcks(t *testing.T) {
+	acks := make(chan uint32, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsACK() {
+				acks <- p.AckNo
+			}
+			return nil
+		},
+	})
+	s.rxNext = 100
+
+	rx := make(chan string, 10)
+	go func() {
+		for {
+			buf := make([]byte, 1024)
+			n, err := app.Read(buf)
+			if err != nil {
+				return
+			}
+			rx <- string(buf[:n])
+		}
+	}()
+
+	mockData := func(seq uint32, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		return p
+	}
+
+	// out of order data is not delivered, and is answered with a duplicate ACK
+	s.handle(mockData(105, "world"))
+	assert.Equal(t, uint32(100), <-acks)
+
+	// in order data is delivered and acknowledged
+	s.handle(mockData(100, "hello"))
+	assert.Equal(t, "hello", <-rx)
+	assert.Equal(t, uint32(105), <-acks)
+
+	// a retransmission of delivered data is only re-acknowledged
+	s.handle(mockData(100, "hello"))
+	assert.Equal(t, uint32(105), <-acks)
+
+	s.handle(mockData(105, "world"))
+	assert.Equal(t, "world", <-rx)
+	assert.Equal(t, uint32(110), <-acks)
+
+	// pure ACKs are not acknowledged
+	pureAck := mockData(110, "")
+	pureAck.SetFlagACK()
+	pureAck.SetSum()
+	s.handle(pureAck)
+
+	select {
+	case <-rx:
+		t.Fatal("no data expected")
+	case <-acks:
+		t.Fatal("no ACK expected")
+	case <-time.After(time.Millisecond * 10):
+	}
+}
+
+func TestValidateBeforeAck(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	defer s.atc.Close()
+	s.rxNext = 1000
+
+	_, err := s.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, s.atc.Info().BytesInFlight)
+
+	mockAck := func(opts ...func(p *packet.Packet)) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+		p.SetFlagACK()
+		p.SetSeqNo(1000)
+		p.SetAckNo(5)
+		p.SetSourceIPv4(net.ParseIP(testRemoteAddr.Host))
+		for _, opt := range opts {
+			opt(p)
+		}
+		p.SetSum()
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		packet   *packet.Packet
+		expected error
+	}{
+		{
+			name: "bad checksum",
+			packet: func() *packet.Packet {
+				p := mockAck()
+				p.Checksum++
+				return p
+			}(),
+			expected: errBadChecksum,
+		},
+		{
+			name:     "wrong source port",
+			packet:   mockAck(func(p *packet.Packet) { p.SrcPort++ }),
+			expected: errMisaddressed,
+		},
+		{
+			name:     "wrong destination port",
+			packet:   mockAck(func(p *packet.Packet) { p.DstPort++ }),
+			expected: errMisaddressed,
+		},
+		{
+			name:     "wrong source address",
+			packet:   mockAck(func(p *packet.Packet) { p.SetSourceIPv4(net.ParseIP("10.0.0.96")) }),
+			expected: errMisaddressed,
+		},
+		{
+			name:     "acknowledges data never sent",
+			packet:   mockAck(func(p *packet.Packet) { p.SetAckNo(6) }),
+			expected: errAckNotSent,
+		},
+		{
+			name: "data outside of the receive window",
+			packet: mockAck(func(p *packet.Packet) {
+				p.Payload = []byte("injected")
+				p.Length = uint16(len(p.Payload))
+				p.SetSeqNo(1000 + 1<<31)
+			}),
+			expected: errOutOfSeqWindow,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, s.validate(test.packet))
+
+			// rejected packets do not advance the ack state
+			s.handle(test.packet)
+			assert.Equal(t, 5, s.atc.Info().BytesInFlight)
+			assert.Equal(t, uint32(1000), s.rxNext)
+		})
+	}
+
+	valid := mockAck()
+	assert.Nil(t, s.validate(valid))
+	s.handle(valid)
+	assert.Equal(t, 0, s.atc.Info().BytesInFlight)
+}
+
+func TestPureAck(t *testing.T) {
+	for _, unreliable := range []bool{false, true} {
+		var sent int32
+		s, app := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				atomic.AddInt32(&sent, 1)
+				return nil
+			},
+		}, func(c *Config) {
+			c.AckWait = time.Minute // no retransmissions
+			c.ISNSource = func() uint32 { return 0 }
+			c.Unreliable = unreliable
+		})
+		s.rxNext = 1000
+
+		_, err := s.Write([]byte("hello"))
+		assert.Nil(t, err)
+		sentData := atomic.LoadInt32(&sent)
+
+		// a pure ACK, and a packet carrying nothing at all
+		pureAck, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+		pureAck.SetFlagACK()
+		pureAck.SetSeqNo(1000)
+		pureAck.SetAckNo(5)
+		pureAck.SetSum()
+		empty, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+		empty.SetSeqNo(1000)
+		empty.SetSum()
+		s.handle(pureAck)
+		s.handle(empty)
+
+		// the ACK is processed...
+		if !unreliable {
+			assert.Equal(t, 0, s.atc.Info().BytesInFlight)
+		}
+
+		// ...but neither is data: nothing is delivered (nor queued
+		// as a datagram), acknowledged, counted or dropped
+		app.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+		_, err = app.Read(make([]byte, 1))
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), "no data expected")
+		assert.Equal(t, 0, len(s.datagrams))
+		assert.Equal(t, uint32(1000), s.rxNext)
+		assert.Equal(t, sentData, atomic.LoadInt32(&sent), "no ACK expected")
+
+		stats := s.Stats()
+		assert.Equal(t, uint64(0), stats.RxBytes)
+		assert.Equal(t, DropStats{}, stats.Drops)
+		assert.Equal(t, float64(0), stats.PacketsPerAck)
+		s.atc.Close()
+	}
+}
+
+func TestConfigAckWait(t *testing.T) {
+	sent := make(chan uint32, 10)
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				sent <- p.SeqNo
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Millisecond * 10
+	})
+	defer s.atc.Close()
+
+	_, err := s.packetizer.PackAndForwardMessage([]byte("data"))
+	assert.Nil(t, err)
+	first := <-sent
+
+	// unacknowledged data is re-sent well before the default wait time
+	select {
+	case seqNo := <-sent:
+		assert.Equal(t, first, seqNo)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("data was not re-sent after the configured ack wait")
+	}
+}
+
+func TestConfigDupAckThreshold(t *testing.T) {
+	_, err := New(Config{
+		LocalAddr:       testLocalAddr,
+		RemoteAddr:      testRemoteAddr,
+		Application:     &net.TCPConn{},
+		Network:         &mockNetwork{},
+		DupAckThreshold: -1,
+	})
+	assert.NotNil(t, err)
+
+	sent := make(chan uint32, 10)
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				sent <- p.SeqNo
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions after timing out
+		c.ISNSource = func() uint32 { return 0 }
+		c.DupAckThreshold = 2
+	})
+	defer s.atc.Close()
+	s.rxNext = 1000
+
+	for _, msg := range []string{"one", "two", "three"} {
+		_, err := s.Write([]byte(msg))
+		assert.Nil(t, err)
+		<-sent
+	}
+
+	mockAck := func(ackNo uint32) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+		p.SetFlagACK()
+		p.SetSeqNo(1000)
+		p.SetAckNo(ackNo)
+		p.SetSourceIPv4(net.ParseIP(testRemoteAddr.Host))
+		p.SetSum()
+		return p
+	}
+
+	// "two" is lost, the remote host acknowledges "one" once
+	// when received and again for each packet received after
+	s.handle(mockAck(3))
+	s.handle(mockAck(3))
+	assert.Equal(t, 0, len(sent), "re-sent after a single duplicate ACK")
+	s.handle(mockAck(3))
+	select {
+	case seqNo := <-sent:
+		assert.Equal(t, uint32(3), seqNo)
+	case <-time.After(time.Second):
+		t.Fatal("data was not re-sent after two duplicate ACKs")
+	}
+	assert.Equal(t, uint64(1), s.DebugInfo().FastRetransmits)
+
+	// echoed pings are not duplicate ACKs
+	pong := packet.NewPingPacket(testRemoteAddr.Port, testLocalAddr.Port, 1)
+	pong.SetFlagACK()
+	pong.SetAckNo(6)
+	pong.SetSourceIPv4(net.ParseIP(testRemoteAddr.Host))
+	pong.SetSum()
+	s.handle(mockAck(6))
+	s.handle(pong)
+	s.handle(pong)
+	s.handle(pong)
+	assert.Equal(t, 0, len(sent))
+	assert.Equal(t, 1, s.atc.InFlight())
+}
+
+func TestReset(t *testing.T) {
+	sent := make(chan *packet.Packet, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	_, err := s.packetizer.PackAndForwardMessage([]byte("never acknowledged"))
+	assert.Nil(t, err)
+	<-sent
+	assert.Equal(t, 1, s.atc.InFlight())
+
+	assert.Nil(t, s.Reset())
+
+	select {
+	case err = <-result:
+		assert.Nil(t, err)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("socket did not shut down immediately after a reset")
+	}
+	assert.Equal(t, CloseReset, s.CloseReason())
+
+	// unacknowledged data is discarded
+	assert.Equal(t, 0, s.atc.InFlight())
+
+	// the remote host is only sent the reset, no FIN handshake
+	rst := <-sent
+	assert.True(t, rst.IsERR())
+	assert.False(t, rst.IsFIN())
+	assert.Equal(t, 0, len(sent))
+
+	// the application side of the connection must be closed
+	_, err = app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestResetReliability(t *testing.T) {
+	var lossy int32
+	tap := func(p *packet.Packet) *packet.Packet {
+		if atomic.LoadInt32(&lossy) == 1 {
+			return nil
+		}
+		return p
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, nil, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	// data lost on the way, and in flight since
+	atomic.StoreInt32(&lossy, 1)
+	_, err := dialerApp.Write([]byte("lost"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return dialer.atc.InFlight() == 1 }, time.Second, time.Millisecond)
+	atomic.StoreInt32(&lossy, 0)
+
+	// is abandoned (rather than re-sent) once reset, and skipped
+	// by the remote host: sequence numbers stay in step
+	assert.Nil(t, dialer.ResetReliability())
+	assert.Eventually(t, func() bool { return dialer.atc.InFlight() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(0), dialer.atc.Info().Retransmits)
+	assert.Equal(t, dialer.NextSeqNo(), acceptor.NextAckNo())
+
+	// and the connection carries on
+	_, err = dialerApp.Write([]byte("hello"))
+	assert.Nil(t, err)
+	received := make([]byte, 5)
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(received))
+	assert.Eventually(t, func() bool { return dialer.atc.InFlight() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestDataBeforeFINDelivered(t *testing.T) {
+	var s *Socket
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsFIN() && p.IsACK() {
+				// the remote host completes the termination handshake
+				ack, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+				ack.SetFlagACK()
+				ack.SetSum()
+				go s.Deliver(ack)
+			}
+			return nil
+		},
+	})
+	s.rxNext = 100
+
+	mockPacket := func(seq uint32, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		return p
+	}
+
+	// the FIN arrives right behind data not yet handled by the socket
+	s.Deliver(mockPacket(100, "hello "))
+	s.Deliver(mockPacket(106, "world"))
+	fin := mockPacket(111, "")
+	fin.SetFlagFIN()
+	fin.SetSum()
+	s.Deliver(fin)
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	// all data is read before EOF
+	received, err := ioutil.ReadAll(app)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(received))
+
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("socket did not shut down after FIN")
+	}
+}
+
+func TestCloseWith(t *testing.T) {
+	var a, b *Socket
+	a, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+			return nil
+		},
+	}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 0 } // as expected by the peer, without a handshake
+	})
+	b, bApp := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			time.AfterFunc(time.Millisecond, func() { a.Deliver(p) })
+			return nil
+		},
+	}, func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+	})
+	aDone, bDone := make(chan error, 1), make(chan error, 1)
+	go func() { aDone <- a.Run() }()
+	go func() { bDone <- b.Run() }()
+
+	assert.NotNil(t, a.CloseWith(make([]byte, a.packetizer.Size()+1)), "larger than a packet")
+
+	_, err := a.Write([]byte("hello, "))
+	assert.Nil(t, err)
+	assert.Nil(t, a.CloseWith([]byte("goodbye")))
+	assert.Equal(t, ErrConnClosed, a.CloseWith([]byte("again")))
+
+	// the final payload is delivered after the data sent before it, then EOF
+	received, err := ioutil.ReadAll(bApp)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello, goodbye", string(received))
+
+	for _, done := range []chan error{aDone, bDone} {
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+			t.Fatal("socket did not shut down after the connection was closed")
+		}
+	}
+	assert.Equal(t, uint32(len("hello, goodbye")+1), a.packetizer.SeqNo(), "the FIN consumes a sequence number")
+	assert.Equal(t, uint64(len("hello, goodbye")), a.TxPayloadBytes())
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	t.Run("graceful", func(t *testing.T) {
+		var a, b *Socket
+		a, _ = mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.ISNSource = func() uint32 { return 0 } // as expected by the peer, without a handshake
+		})
+		b, bApp := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { a.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		})
+		go a.Run()
+		go b.Run()
+		go ioutil.ReadAll(bApp)
+
+		_, err := a.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Nil(t, a.CloseWithTimeout(maxCloseDrainTime+handshakeResponseTimeout*2))
+		assert.Equal(t, StateClosed, a.State())
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		sent := make(chan *packet.Packet, 100)
+
+		// a remote host which never answers
+		s, _ := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				select {
+				case sent <- p:
+				default:
+				}
+				return nil
+			},
+		})
+		go s.Run()
+
+		_, err := s.Write([]byte("never acknowledged"))
+		assert.Nil(t, err)
+
+		start := time.Now()
+		assert.Equal(t, ErrCloseForced, s.CloseWithTimeout(time.Millisecond*100))
+		assert.True(t, time.Since(start) < maxCloseDrainTime, "close not forced at the deadline")
+
+		// the connection is reset
+		for {
+			select {
+			case p := <-sent:
+				if !p.IsERR() {
+					continue
+				}
+			case <-time.After(time.Second):
+				t.Fatal("connection not reset on a forced close")
+			}
+			break
+		}
+		assert.Equal(t, ErrConnReset, s.writeErr())
+	})
+}
+
+func TestLinger(t *testing.T) {
+	// a remote host which never answers, and Close's effect on the data in flight
+	silent := func(t *testing.T, linger time.Duration) (elapsed time.Duration, inFlight int, reset bool) {
+		var mu sync.Mutex
+		s, _ := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				mu.Lock()
+				defer mu.Unlock()
+				reset = reset || p.IsERR()
+				return nil
+			},
+		}, func(c *Config) {
+			c.Linger = linger
+		})
+		go s.Run()
+
+		_, err := s.Write([]byte("never acknowledged"))
+		assert.Nil(t, err)
+
+		start := time.Now()
+		s.Close()
+		elapsed = time.Since(start)
+
+		mu.Lock()
+		defer mu.Unlock()
+		return elapsed, s.atc.InFlight(), reset
+	}
+
+	t.Run("background", func(t *testing.T) {
+		elapsed, inFlight, reset := silent(t, 0)
+		assert.True(t, elapsed < time.Millisecond*100, "Close blocked for %s", elapsed)
+		assert.Equal(t, 1, inFlight, "data in flight discarded")
+		assert.False(t, reset)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		elapsed, inFlight, reset := silent(t, -1)
+		assert.True(t, elapsed < time.Millisecond*100, "Close blocked for %s", elapsed)
+		assert.Equal(t, 0, inFlight, "data in flight not discarded")
+		assert.True(t, reset, "connection not reset")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		elapsed, inFlight, reset := silent(t, time.Millisecond*200)
+		assert.True(t, elapsed >= time.Millisecond*200, "Close returned after %s", elapsed)
+		assert.True(t, elapsed < maxCloseDrainTime, "Close returned after %s", elapsed)
+		assert.Equal(t, 0, inFlight, "data in flight not discarded")
+		assert.True(t, reset, "connection not reset")
+	})
+
+	t.Run("acknowledged", func(t *testing.T) {
+		var a, b *Socket
+		a, _ = mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.ISNSource = func() uint32 { return 0 } // as expected by the peer, without a handshake
+			c.Linger = maxCloseDrainTime + handshakeResponseTimeout*2
+		})
+		b, bApp := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { a.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		})
+		go a.Run()
+		go b.Run()
+		received := make(chan []byte, 1)
+		go func() {
+			data, _ := ioutil.ReadAll(bApp)
+			received <- data
+		}()
+
+		_, err := a.Write([]byte("hello"))
+		assert.Nil(t, err)
+
+		// Close blocks until the socket shut down gracefully
+		a.Close()
+		assert.Equal(t, StateClosed, a.State())
+		assert.Equal(t, 0, a.atc.InFlight())
+		assert.Equal(t, "hello", string(<-received))
+	})
+}
+
+func TestSetNetwork(t *testing.T) {
+	var a, b *Socket
+	var mu sync.Mutex
+	oldPathDown := false
+	carried := 0 // data packets carried by the new path
+
+	oldPath := &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !oldPathDown {
+				time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+			}
+			return nil
+		},
+	}
+	newPath := &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			mu.Lock()
+			if len(p.Payload) > 0 {
+				carried++
+			}
+			mu.Unlock()
+			time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+			return nil
+		},
+	}
+	a, _ = mockSocket(t, oldPath, func(c *Config) {
+		c.ISNSource = func() uint32 { return 0 } // as expected by the peer, without a handshake
+		c.AckWait = time.Millisecond * 20
+	})
+	b, bApp := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			time.AfterFunc(time.Millisecond, func() { a.Deliver(p) })
+			return nil
+		},
+	}, func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+	})
+	go a.Run()
+	go b.Run()
+	defer a.Close()
+	defer b.Close()
+
+	assert.NotNil(t, a.SetNetwork(nil))
+
+	_, err := a.Write([]byte("before, "))
+	assert.Nil(t, err)
+	received := make([]byte, len("before, "))
+	bApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(bApp, received)
+	assert.Nil(t, err)
+
+	// the old path goes down with data in flight, which is
+	// re-sent on the new path once the socket migrates to it
+	mu.Lock()
+	oldPathDown = true
+	mu.Unlock()
+	_, err = a.Write([]byte("in flight, "))
+	assert.Nil(t, err)
+	assert.Nil(t, a.SetNetwork(newPath))
+	_, err = a.Write([]byte("after"))
+	assert.Nil(t, err)
+
+	received = make([]byte, len("in flight, after"))
+	_, err = io.ReadFull(bApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "in flight, after", string(received))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, a.Drain(ctx))
+	mu.Lock()
+	assert.True(t, carried >= 2, "%d data packets carried by the new path", carried)
+	mu.Unlock()
+}
+
+func TestFailFast(t *testing.T) {
+	unreachable := fmt.Errorf("could not send data to network socket: %w", syscall.ENETUNREACH)
+
+	for _, test := range []struct {
+		name     string
+		failFast bool
+		sent     int // data packets sent before the network becomes unreachable
+	}{
+		{name: "retransmission", failFast: true, sent: 1},
+		{name: "first transmission", failFast: true, sent: 0},
+		{name: "disabled", failFast: false, sent: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			sent := 0
+			s, _ := mockSocket(t, &mockNetwork{
+				sendFunc: func(p *packet.Packet) error {
+					if len(p.Payload) == 0 {
+						return nil
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if sent++; sent > test.sent {
+						return unreachable
+					}
+					return nil
+				},
+			}, func(c *Config) {
+				c.AckWait = time.Millisecond * 5
+				c.FailFast = test.failFast
+			})
+
+			result := make(chan error, 1)
+			go func() { result <- s.Run() }()
+			defer s.Close()
+
+			_, err := s.Write([]byte("hello"))
+			assert.Equal(t, test.sent == 0, err != nil)
+
+			select {
+			case err := <-result:
+				assert.True(t, test.failFast, "connection failed without failing fast")
+				assert.True(t, errors.Is(err, syscall.ENETUNREACH), "unexpected error %v", err)
+				assert.Equal(t, CloseNetworkError, s.CloseReason())
+			case <-time.After(time.Millisecond * 200):
+				assert.False(t, test.failFast, "connection not failed on a permanent network error")
+				return
+			}
+
+			_, err = s.Write([]byte("after failure"))
+			assert.Equal(t, ErrConnReset, err)
+		})
+	}
+}
+
+func TestRetransmitBudgetExhausted(t *testing.T) {
+	var mu sync.Mutex
+	dataSends := 0
+
+	// a path which drops everything
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				mu.Lock()
+				dataSends++
+				mu.Unlock()
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Millisecond
+		c.RetransmitBudget = 10
+		c.RetransmitBudgetBurst = 20
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	for i := 0; i < 5; i++ {
+		_, err := s.Write([]byte("never delivered"))
+		assert.Nil(t, err)
+	}
+
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrRetransmitBudgetExhausted, err)
+		assert.Equal(t, CloseNetworkError, s.CloseReason())
+	case <-time.After(time.Second * 5):
+		t.Fatal("connection not failed after exhausting its retransmission budget")
+	}
+
+	mu.Lock()
+	assert.True(t, dataSends <= 5+20+5, "%d data packets sent", dataSends)
+	mu.Unlock()
+
+	_, err := s.Write([]byte("after failure"))
+	assert.Equal(t, ErrConnReset, err)
+	_, err = app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestResetByPeer(t *testing.T) {
+	sent := make(chan *packet.Packet, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	})
+	s.rxNext = 100
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	mockReset := func(seq uint32) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+		p.SetFlagERR()
+		p.SetSeqNo(seq)
+		p.SetSum()
+		return p
+	}
+
+	// resets outside of the receive window are ignored
+	s.Deliver(mockReset(100 - 5000 + 1<<32))
+
+	select {
+	case <-result:
+		t.Fatal("socket reset by an out of window reset")
+	case <-time.After(time.Millisecond * 50):
+	}
+	assert.Equal(t, CloseNone, s.CloseReason())
+
+	s.Deliver(mockReset(100))
+
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrConnectionReset, err)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("socket did not shut down after being reset by peer")
+	}
+	assert.Equal(t, ClosePeerReset, s.CloseReason())
+
+	// no FIN handshake after a reset
+	assert.Equal(t, 0, len(sent))
+
+	// the application side of the connection must be closed
+	_, err := app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestErr(t *testing.T) {
+	t.Run("reset by peer", func(t *testing.T) {
+		s, _ := mockSocket(t, &mockNetwork{})
+		s.rxNext = 100
+		result := make(chan error)
+		go func() { result <- s.Run() }()
+		assert.Nil(t, s.Err(), "healthy connection")
+
+		rst, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+		rst.SetFlagERR()
+		rst.SetSeqNo(100)
+		rst.SetSum()
+		s.Deliver(rst)
+		<-result
+		assert.Equal(t, ErrConnectionReset, s.Err())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		s, _ := mockSocket(t, &mockNetwork{})
+		result := make(chan error)
+		go func() { result <- s.Run() }()
+
+		assert.Nil(t, s.Reset())
+		<-result
+		assert.Equal(t, ErrConnReset, s.Err())
+	})
+
+	t.Run("graceful close", func(t *testing.T) {
+		var a, b *Socket
+		a, _ = mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.ISNSource = func() uint32 { return 0 } // as expected by the peer, without a handshake
+		})
+		b, bApp := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { a.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		})
+		go a.Run()
+		go b.Run()
+		go ioutil.ReadAll(bApp)
+
+		_, err := a.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Nil(t, a.CloseWithTimeout(maxCloseDrainTime+handshakeResponseTimeout*2))
+		assert.Nil(t, a.Err())
+	})
+}
+
+func TestErrorsOnResetByPeer(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	s.rxNext = 100
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	select {
+	case err := <-s.Errors():
+		t.Fatalf("unexpected error %s before reset", err)
+	default:
+	}
+
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+	p.SetFlagERR()
+	p.SetSeqNo(100)
+	p.SetSum()
+	s.Deliver(p)
+
+	select {
+	case err := <-s.Errors():
+		assert.Equal(t, ErrConnectionReset, err)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("reset by peer not signaled")
+	}
+	assert.Equal(t, ErrConnectionReset, <-result)
+
+	_, err := s.Write([]byte("after reset"))
+	assert.Equal(t, ErrConnReset, err)
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	s, app := mockSocket(t, &mockNetwork{})
+	defer s.atc.Close()
+
+	n, err := s.Write([]byte("before close"))
+	assert.Nil(t, err)
+	assert.Equal(t, len("before close"), n)
+
+	s.Close()
+
+	n, err = s.Write([]byte("after close"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrConnClosed, err)
+	_, isNetErr := err.(net.Error)
+	assert.True(t, isNetErr)
+
+	// reads on the application side of a closed socket see the end of stream
+	_, err = app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// socketGoroutines returns the number of goroutines running socket processes
+func TestConfigContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, app := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Context = ctx
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	cancel()
+	select {
+	case err := <-result:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(handshakeResponseTimeout * 2):
+		t.Fatal("socket did not shut down after its context was cancelled")
+	}
+	assert.Equal(t, CloseContextDone, s.CloseReason())
+	assert.Equal(t, context.Canceled, s.Context().Err())
+
+	_, err := s.Write([]byte("after cancel"))
+	assert.Equal(t, context.Canceled, err)
+
+	// reads on the application side see the end of stream
+	_, err = app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func socketGoroutines() int {
+	buf := make([]byte, 1<<20)
+	stacks := string(buf[:runtime.Stack(buf, true)])
+	return strings.Count(stacks, "socket.(*Socket).receive(") +
+		strings.Count(stacks, "socket.(*Socket).transmit(")
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	s, app := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.KeepaliveInterval = time.Millisecond * 10
+	})
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	time.Sleep(time.Millisecond * 20)
+	running := socketGoroutines() // incl. those of sockets other tests left running
+
+	s.Close()
+
+	select {
+	case <-result:
+	case <-time.After(handshakeResponseTimeout * 2):
+		t.Fatal("running socket did not shut down when closed")
+	}
+
+	// the application side of the connection is closed
+	_, err := app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	for deadline := time.Now().Add(time.Second); socketGoroutines() > running-2; {
+		if time.Now().After(deadline) {
+			t.Fatal("receive and transmit goroutines still running after close")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestOpenCloseStress(t *testing.T) {
+	running := socketGoroutines() // incl. those of sockets other tests left running
+
+	for i := 0; i < 50; i++ {
+		var a, b *Socket
+		a, aApp := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { b.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.ISNSource = func() uint32 { return 0 } // as expected by the peer, without a handshake
+		})
+		b, bApp := mockSocket(t, &mockNetwork{
+			sendFunc: func(p *packet.Packet) error {
+				time.AfterFunc(time.Millisecond, func() { a.Deliver(p) })
+				return nil
+			},
+		}, func(c *Config) {
+			c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+			c.ISNSource = func() uint32 { return 0 }
+		})
+		go io.Copy(ioutil.Discard, aApp)
+		go io.Copy(ioutil.Discard, bApp)
+
+		done := make(chan error, 2)
+		go func() { done <- a.Run() }()
+		go func() { done <- b.Run() }()
+
+		// either end closes with data in flight both ways and packets
+		// still being delivered (also after the sockets shut down)
+		_, err := a.Write([]byte("hello"))
+		assert.Nil(t, err)
+		_, err = b.Write([]byte("world"))
+		assert.Nil(t, err)
+		if i%2 == 0 {
+			a.Close()
+		} else {
+			b.Close()
+		}
+		for n := 0; n < 2; n++ {
+			select {
+			case <-done:
+			case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+				t.Fatalf("socket did not shut down when closed (connection %d)", i)
+			}
+		}
+	}
+
+	// every goroutine was waited on before Run returned
+	assert.True(t, socketGoroutines() <= running)
+}
+
+func TestCloseRacingEOF(t *testing.T) {
+	// the sockets shut down concurrently, each waiting out its FIN handshake
+	var sockets sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		s, app := mockSocket(t, &mockNetwork{})
+		result := make(chan error, 1)
+		go func() { result <- s.Run() }()
+
+		sockets.Add(1)
+		go func(i int) {
+			defer sockets.Done()
+
+			// the application's EOF (seen by the transmit goroutine) and
+			// Close both shut the socket down, in either order or at once
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() { defer wg.Done(); app.Close() }()
+			go func() { defer wg.Done(); s.Close() }()
+			wg.Wait()
+
+			select {
+			case <-result:
+			case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+				t.Errorf("socket did not shut down (socket %d)", i)
+				return
+			}
+
+			// and shutting down again after Run returned is a no-op
+			assert.NotPanics(t, func() {
+				s.Close()
+				s.signalShutdown()
+				s.finReceived()
+			})
+		}(i)
+	}
+	sockets.Wait()
+}
+
+func TestWriteAfterReset(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	assert.Nil(t, s.Reset())
+	<-result
+
+	n, err := s.WriteWithDeadline([]byte("after reset"), time.Time{})
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrConnReset, err)
+	_, isNetErr := err.(net.Error)
+	assert.True(t, isNetErr)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	var mu sync.Mutex
+	var stream []byte
+	var nextSeqNo uint32
+	var outOfOrder int
+
+	var s *Socket
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			mu.Lock()
+			if len(stream) == 0 {
+				nextSeqNo = p.SeqNo
+			}
+			if p.SeqNo != nextSeqNo {
+				outOfOrder++
+			}
+			nextSeqNo = p.SeqNo + uint32(len(p.Payload))
+			stream = append(stream, p.Payload...)
+			mu.Unlock()
+			go s.atc.Ack(p.SeqNo + uint32(len(p.Payload)))
+			runtime.Gosched() // let other writers interleave, if they can
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+	})
+	defer s.atc.Close()
+
+	// every write spans several packets, and is made of a single byte
+	writers, writes, size := 20, 50, s.packetizer.Size()*5/2
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				n, err := s.Write(bytes.Repeat([]byte{b}, size))
+				assert.Nil(t, err)
+				assert.Equal(t, size, n)
+			}
+		}(byte('A' + w))
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, 0, outOfOrder, "packets forwarded out of sequence number order")
+	assert.Equal(t, writers*writes*size, len(stream))
+	assert.Equal(t, uint64(writers*writes*size), s.TxPayloadBytes())
+
+	// the bytes of each write are contiguous
+	perWriter := make(map[byte]int)
+	for len(stream) >= size {
+		assert.Equal(t, bytes.Repeat(stream[:1], size), stream[:size])
+		perWriter[stream[0]]++
+		stream = stream[size:]
+	}
+	assert.Equal(t, writers, len(perWriter))
+	for b, n := range perWriter {
+		assert.Equal(t, writes, n, "writes by writer %c", b)
+	}
+}
+
+func TestWriteLargeBuffer(t *testing.T) {
+	var mu sync.Mutex
+	var received []byte
+	var rxNext uint32
+	maxAhead := 0
+
+	// the remote host delivers data in order and acknowledges it
+	var s *Socket
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) == 0 {
+				rxNext = p.SeqNo
+			}
+			if ahead := int(p.SeqNo + uint32(len(p.Payload)) - rxNext); ahead > maxAhead {
+				maxAhead = ahead
+			}
+			if p.SeqNo == rxNext {
+				received = append(received, p.Payload...)
+				rxNext += uint32(len(p.Payload))
+			}
+			go s.atc.Ack(rxNext)
+			return nil
+		},
+	})
+	defer s.atc.Close()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	n, err := s.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, bytes.Equal(data, received), "data received differs from data written")
+	assert.True(t, maxAhead <= receiveWindowBytes, "%d bytes in flight, beyond the send buffer", maxAhead)
+}
+
+func TestReadFrom(t *testing.T) {
+	var mu sync.Mutex
+	var received []byte
+	var rxNext uint32
+	maxAhead := 0
+
+	// the remote host delivers data in order and acknowledges it
+	var s *Socket
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) == 0 {
+				rxNext = p.SeqNo
+			}
+			if ahead := int(p.SeqNo + uint32(len(p.Payload)) - rxNext); ahead > maxAhead {
+				maxAhead = ahead
+			}
+			if p.SeqNo == rxNext {
+				received = append(received, p.Payload...)
+				rxNext += uint32(len(p.Payload))
+			}
+			go s.atc.Ack(rxNext)
+			return nil
+		},
+	}, func(c *Config) {
+		c.WriteBufferBytes = 3 * packet.MaxPayloadBytes
+	})
+	defer s.atc.Close()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// hide bytes.Reader's WriteTo, for io.Copy to use the socket's ReadFrom
+	n, err := io.Copy(s, struct{ io.Reader }{bytes.NewReader(data)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	mu.Lock()
+	assert.True(t, bytes.Equal(data, received), "data received differs from data written")
+	assert.True(t, maxAhead <= 3*packet.MaxPayloadBytes, "%d bytes in flight, beyond the send buffer", maxAhead)
+	mu.Unlock()
+
+	// data read before a read error is sent
+	readErr := errors.New("mock read error")
+	n, err = s.ReadFrom(io.MultiReader(bytes.NewReader(data[:1000]), iotest.ErrReader(readErr)))
+	assert.Equal(t, readErr, err)
+	assert.Equal(t, int64(1000), n)
+}
+
+// flakyNetwork is a network failing to send packets on a schedule:
+// the nth packet sent (from one) fails when fails(n) returns true
+type flakyNetwork struct {
+	network.Network
+
+	sync.Mutex
+	sent  int
+	fails func(n int) bool
+	err   error // transient unless set
+}
+
+func (n *flakyNetwork) Send(p *packet.Packet) error {
+	n.Lock()
+	n.sent++
+	fail := n.fails != nil && n.fails(n.sent)
+	err := n.err
+	n.Unlock()
+
+	if fail && err != nil {
+		return err
+	}
+	if fail {
+		return errors.New("mock transient network error")
+	}
+	return n.Network.Send(p)
+}
+
+func (n *flakyNetwork) setSchedule(fails func(n int) bool) {
+	n.Lock()
+	defer n.Unlock()
+	n.sent, n.fails = 0, fails
+}
+
+func TestFlakyNetwork(t *testing.T) {
+	// send errors are not taken for an MTU black hole either way, but the
+	// packets dropped out of order behind a failed one would be, were
+	// black holes detected (see mockConnPair)
+	var flaky *flakyNetwork
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		flaky = &flakyNetwork{Network: c.Network}
+		c.Network = flaky
+		c.AckWait = time.Millisecond * 20
+	}, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	// packets which fail to be sent (e.g. on a short write), incl. a
+	// retransmission, are re-sent whole once timed out rather than
+	// failing the connection
+	flaky.setSchedule(func(n int) bool { return n == 2 || n == 5 || n == 7 })
+	data := make([]byte, packet.MaxPayloadBytes*6)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go dialerApp.Write(data)
+
+	received := make([]byte, len(data))
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 10))
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, received), "data received differs from data written")
+	assert.True(t, dialer.atc.Info().Retransmits > 0)
+	assert.True(t, dialer.IsAlive())
+
+	// without FailFast, nor do permanent errors sending data first fail
+	// the write, which would leave a hole behind the data written next
+	flaky.Lock()
+	flaky.err = fmt.Errorf("could not send data to network socket: %w", syscall.ENETUNREACH)
+	flaky.Unlock()
+	flaky.setSchedule(func(n int) bool { return n == 1 })
+	_, err = dialer.Write([]byte("unreachable, "))
+	assert.Nil(t, err)
+	_, err = dialer.Write([]byte("then reachable"))
+	assert.Nil(t, err)
+	received = make([]byte, len("unreachable, then reachable"))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "unreachable, then reachable", string(received))
+	assert.True(t, dialer.IsAlive())
+}
+
+func TestWriteErrorCountsBytesSent(t *testing.T) {
+	mockErr := fmt.Errorf("mock network error: %w", syscall.ENETUNREACH)
+
+	packets := 0
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if packets++; packets == 3 {
+				return mockErr
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.FailFast = true
+	})
+	defer s.atc.Close()
+
+	// the network fails part way through a write split across packets
+	n, err := s.Write(make([]byte, packet.MaxPayloadBytes*4))
+	assert.NotNil(t, err)
+	assert.Equal(t, packet.MaxPayloadBytes*2, n)
+
+	// only the application bytes of the packets forwarded count as sent
+	assert.Equal(t, uint64(packet.MaxPayloadBytes*2), s.TxPayloadBytes())
+	assert.Equal(t, uint64((packet.HeaderByteSize+packet.MaxPayloadBytes)*2), s.TxBytes())
+}
+
+func TestWriteBuffers(t *testing.T) {
+	var mu sync.Mutex
+	var payloads [][]byte
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				mu.Lock()
+				payloads = append(payloads, p.Payload)
+				mu.Unlock()
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+	})
+	defer s.atc.Close()
+
+	header := []byte("HEADER\n")
+	body := bytes.Repeat([]byte("body "), packet.MaxPayloadBytes/5)
+	trailer := []byte("\nTRAILER")
+
+	n, err := s.WriteBuffers(net.Buffers{header, body, trailer})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(header)+len(body)+len(trailer)), n)
+
+	// full packets, filled across buffer boundaries
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, len(payloads))
+	assert.Equal(t, packet.MaxPayloadBytes, len(payloads[0]))
+	assert.Equal(t, bytes.Join([][]byte{header, body, trailer}, nil), bytes.Join(payloads, nil))
+}
+
+func TestWriteDeadlineFakeClock(t *testing.T) {
+	start := time.Now()
+	clk := clock.NewFake(start)
+
+	var mu sync.Mutex
+	var sent []*packet.Packet
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, p) // never acknowledged
+			return nil
+		},
+	}, func(c *Config) {
+		c.Clock = clk
+		c.AckWait = time.Second
+	})
+	defer s.atc.Close()
+
+	_, err := s.WriteWithDeadline([]byte("stale in 5 seconds"), start.Add(time.Second*5))
+	assert.Nil(t, err)
+
+	// re-sent at 1s and 3s, abandoned at 7s
+	clk.Advance(time.Second * 4)
+	mu.Lock()
+	assert.Equal(t, 3, len(sent))
+	assert.False(t, sent[2].IsFWD())
+	mu.Unlock()
+
+	clk.Advance(time.Second * 3)
+	mu.Lock()
+	assert.Equal(t, 4, len(sent))
+	assert.True(t, sent[3].IsFWD(), "data not abandoned past its deadline")
+	mu.Unlock()
+
+	info := s.atc.InFlightSnapshot()
+	assert.Equal(t, 1, len(info))
+	assert.True(t, info[0].Abandoned)
+	assert.Equal(t, start.Add(time.Second*7), info[0].LastSentAt)
+}
+
+func TestDrain(t *testing.T) {
+	var mu sync.Mutex
+	acking := true
+	var pending []uint32
+
+	var s *Socket
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			end := p.SeqNo + uint32(len(p.Payload))
+			if !acking {
+				pending = append(pending, end)
+				return nil
+			}
+			time.AfterFunc(time.Millisecond*5, func() { s.atc.Ack(end) })
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+	})
+	defer s.atc.Close()
+
+	_, err := s.Write(make([]byte, 50000))
+	assert.Nil(t, err)
+	assert.True(t, s.atc.InFlight() > 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.Drain(ctx))
+	assert.Equal(t, 0, s.atc.InFlight())
+
+	// nothing in flight
+	assert.Nil(t, s.Drain(ctx))
+
+	// data which is never acknowledged
+	mu.Lock()
+	acking = false
+	mu.Unlock()
+	_, err = s.Write([]byte("unacknowledged"))
+	assert.Nil(t, err)
+
+	short, cancelShort := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancelShort()
+	assert.Equal(t, context.DeadlineExceeded, s.Drain(short))
+
+	// data sent while draining
+	drained := make(chan error)
+	go func() { drained <- s.Drain(ctx) }()
+	time.Sleep(time.Millisecond * 10)
+	_, err = s.Write([]byte("sent while draining"))
+	assert.Nil(t, err)
+
+	mu.Lock()
+	acks := pending
+	mu.Unlock()
+	for _, end := range acks {
+		s.atc.Ack(end)
+	}
+	assert.Equal(t, ErrSentWhileDraining, <-drained)
+}
+
+func TestReadBufferBytes(t *testing.T) {
+	acks := make(chan uint32, 10)
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsACK() {
+				acks <- p.AckNo
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.ReadBufferBytes = 10 * packet.MaxPayloadBytes
+	})
+	s.rxNext = 1000
+	assert.Equal(t, 10, cap(s.inbound))
+
+	ahead := func(n int) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("ahead"))
+		p.SetSeqNo(uint32(1000 + n))
+		p.SetSum()
+		return p
+	}
+
+	// data within the receive window is answered, data beyond it dropped
+	s.handle(ahead(10*packet.MaxPayloadBytes - 1))
+	assert.Equal(t, 1, len(acks))
+	assert.Equal(t, uint32(1000), <-acks)
+	s.handle(ahead(10 * packet.MaxPayloadBytes))
+	assert.Equal(t, 0, len(acks))
+
+	// the inbound channel always fits the handshakes' control packets
+	s, _ = mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.ReadBufferBytes = 100
+	})
+	assert.Equal(t, minInboundPackets, cap(s.inbound))
+	assert.Equal(t, uint32(100), s.receiveWindow)
+}
+
+func TestOnData(t *testing.T) {
+	var runs []string
+	s, app := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.OnData = func(data []byte) { runs = append(runs, string(data)) }
+	})
+
+	data := func(seq int, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(uint32(seq))
+		p.SetSum()
+		return p
+	}
+	s.handle(data(0, "hello "))
+	s.handle(data(11, "!"))       // out of order, dropped
+	s.handle(data(3, "lo world")) // overlaps data already delivered
+	s.handle(data(0, "hello "))   // duplicate
+	s.handle(data(11, "!"))
+
+	// each run of new data is passed on once, in order
+	assert.Equal(t, []string{"hello ", "world", "!"}, runs)
+	assert.Equal(t, uint32(12), s.rxNext)
+	assert.Equal(t, uint64(12), s.Stats().RxBytes)
+
+	// and nothing is written to the application's connection
+	app.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+	_, err := app.Read(make([]byte, 1))
+	assert.True(t, err.(net.Error).Timeout())
+}
+
+func TestSetReadBuffer(t *testing.T) {
+	acks := make(chan uint32, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsACK() {
+				acks <- p.AckNo
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.ReadBufferBytes = 2000
+	})
+	s.rxNext = 1000
+	received := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(app)
+		received <- b
+	}()
+
+	assert.NotNil(t, s.SetReadBuffer(0))
+	assert.NotNil(t, s.SetReadBuffer(-1))
+
+	data := func(seq int, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(uint32(seq))
+		p.SetSum()
+		return p
+	}
+
+	s.handle(data(1000, "hello "))
+	assert.Equal(t, uint32(1006), <-acks)
+
+	// data 3000 bytes ahead is beyond the window...
+	s.handle(data(1006+3000, "ahead"))
+	assert.Equal(t, 0, len(acks))
+
+	// ...until the receive buffer grows mid-transfer
+	assert.Nil(t, s.SetReadBuffer(6000))
+	assert.Equal(t, 6000, s.DebugInfo().ReceiveWindow)
+	s.handle(data(1006+3000, "ahead"))
+	assert.Equal(t, uint32(1006), <-acks)
+
+	// shrinking it does not discard data being received
+	assert.Nil(t, s.SetReadBuffer(1))
+	assert.Equal(t, 1, s.DebugInfo().ReceiveWindow)
+	s.handle(data(1006, "world"))
+	assert.Equal(t, uint32(1011), <-acks)
+	s.handle(data(1011+1, "ahead"))
+	assert.Equal(t, 0, len(acks))
+
+	s.app().Close()
+	assert.Equal(t, []byte("hello world"), <-received)
+}
+
+func TestConfigureBeforeRun(t *testing.T) {
+	// construction starts no goroutines (some of previous tests may
+	// still be on their way out)
+	goroutines := runtime.NumGoroutine()
+	mockSocket(t, &mockNetwork{})
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines started by construction", runtime.NumGoroutine()-goroutines)
+		}
+	}
+
+	// settings made before the socket is started apply once it is
+	dialer, acceptor, _, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, nil, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	assert.Nil(t, dialer.SetWriteBuffer(1000))
+	dialer.SetNonBlocking(true)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	n, err := dialer.Write(make([]byte, 3000))
+	assert.Equal(t, ErrWouldBlock, err)
+	assert.Equal(t, 1000, n)
+
+	received := make([]byte, 1000)
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+}
+
+func TestSetWriteBuffer(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.WriteBufferBytes = 1000
+	})
+	defer s.atc.Close()
+
+	assert.NotNil(t, s.SetWriteBuffer(0))
+
+	written := make(chan int)
+	go func() {
+		n, err := s.Write(make([]byte, 3000))
+		assert.Nil(t, err)
+		written <- n
+	}()
+
+	// the write blocks with the send buffer full...
+	select {
+	case <-written:
+		t.Fatal("write not blocked by a full send buffer")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// ...until the send buffer grows
+	assert.Nil(t, s.SetWriteBuffer(3000))
+	select {
+	case n := <-written:
+		assert.Equal(t, 3000, n)
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked after growing the send buffer")
+	}
+	assert.Equal(t, 3000, s.DebugInfo().WriteBuffer)
+}
+
+func TestWriteBufferBytes(t *testing.T) {
+	var mu sync.Mutex
+	var ends []uint32
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				mu.Lock()
+				ends = append(ends, p.SeqNo+uint32(len(p.Payload)))
+				mu.Unlock()
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.WriteBufferBytes = 3000
+	})
+	defer s.atc.Close()
+
+	written := make(chan int)
+	go func() {
+		n, err := s.Write(make([]byte, 10000))
+		assert.Nil(t, err)
+		written <- n
+	}()
+
+	// the write blocks with the send buffer full
+	select {
+	case <-written:
+		t.Fatal("write not blocked by a full send buffer")
+	case <-time.After(time.Millisecond * 50):
+	}
+	assert.True(t, s.atc.Info().BytesInFlight <= 3000)
+
+	// acknowledging data makes room for the rest
+	for {
+		mu.Lock()
+		last := ends[len(ends)-1]
+		mu.Unlock()
+		s.atc.Ack(last)
+
+		select {
+		case n := <-written:
+			assert.Equal(t, 10000, n)
+			return
+		case <-time.After(time.Millisecond * 10):
+			assert.True(t, s.atc.Info().BytesInFlight <= 3000)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// a stalled remote host, which never acknowledges anything
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.WriteBufferBytes = 2 * packet.MaxPayloadBytes
+		c.WriteTimeout = time.Millisecond * 100
+	})
+	defer s.atc.Close()
+
+	// the send buffer fills up, and the write times out with the rest
+	start := time.Now()
+	n, err := s.Write(make([]byte, 10000))
+	elapsed := time.Since(start)
+	assert.Equal(t, ErrWriteTimeout, err)
+	assert.True(t, ErrWriteTimeout.Timeout())
+	assert.Equal(t, 2*packet.MaxPayloadBytes, n)
+	assert.True(t, elapsed >= time.Millisecond*100, "timed out after %s", elapsed)
+	assert.True(t, elapsed < time.Second, "timed out after %s", elapsed)
+
+	// as do writes while the send buffer stays full
+	n, err = s.Write([]byte("more"))
+	assert.Equal(t, ErrWriteTimeout, err)
+	assert.Equal(t, 0, n)
+
+	// the socket is still usable once data is acknowledged
+	s.atc.Ack(s.packetizer.SeqNo())
+	n, err = s.Write([]byte("more"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+}
+
+func TestPause(t *testing.T) {
+	var lock sync.Mutex
+	sent := make(map[uint32]int) // data packets sent, by sequence number
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				lock.Lock()
+				sent[p.SeqNo]++
+				lock.Unlock()
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 0 }
+		c.AckWait = time.Millisecond * 20
+	})
+	defer s.atc.Close()
+	count := func(seqNo uint32) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return sent[seqNo]
+	}
+
+	_, err := s.Write([]byte("hello"))
+	assert.Nil(t, err)
+	s.Pause()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write([]byte("world"))
+		written <- err
+	}()
+
+	// no new data goes out, but data in flight is still re-sent
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 0, count(5), "data sent while paused")
+	assert.True(t, count(0) > 1, "data in flight not re-sent while paused")
+	select {
+	case <-written:
+		t.Fatal("write returned while paused")
+	default:
+	}
+
+	// nor do acks stall
+	s.atc.Ack(5)
+	assert.Equal(t, 0, s.atc.InFlight())
+
+	s.Resume()
+	select {
+	case err := <-written:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write blocked after resuming")
+	}
+	assert.True(t, count(5) > 0, "data not sent after resuming")
+}
+
+func TestHandleForward(t *testing.T) {
+	acks := make(chan uint32, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsACK() {
+				acks <- p.AckNo
+			}
+			return nil
+		},
+	})
+	s.rxNext = 100
+
+	rx := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		n, err := app.Read(buf)
+		if err == nil {
+			rx <- string(buf[:n])
+		}
+	}()
+
+	// the peer abandoned 5 bytes at 100
+	fwd := packet.NewForwardPacket(testRemoteAddr.Port, testLocalAddr.Port, 100, 5)
+	fwd.SetSum()
+	s.handle(fwd)
+	assert.Equal(t, uint32(105), <-acks)
+
+	data, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("fresh"))
+	data.SetSeqNo(105)
+	data.SetSum()
+	s.handle(data)
+	assert.Equal(t, "fresh", <-rx)
+	assert.Equal(t, uint32(110), <-acks)
+}
+
+func TestWriteWithDeadline(t *testing.T) {
+	sent := make(chan *packet.Packet, 100)
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Millisecond * 5
+	})
+	defer s.atc.Close()
+
+	n, err := s.WriteWithDeadline([]byte("frame"), time.Now().Add(time.Millisecond*20))
+	assert.Nil(t, err)
+	assert.Equal(t, len("frame"), n)
+
+	for {
+		select {
+		case p := <-sent:
+			if p.IsFWD() {
+				assert.Equal(t, uint32(len("frame")), p.ForwardBytes())
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("unacknowledged data was not abandoned after its deadline")
+		}
+	}
+}
+
+func TestTxByteCounts(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	defer s.atc.Close()
+
+	n, err := s.WriteWithDeadline([]byte("hello"), time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, uint64(5), s.TxPayloadBytes())
+	assert.Equal(t, uint64(packet.HeaderByteSize+5), s.TxBytes())
+
+	// control packets count towards wire bytes only
+	s.ack()
+	assert.Equal(t, uint64(5), s.TxPayloadBytes())
+	assert.Equal(t, uint64(packet.HeaderByteSize*2+5), s.TxBytes())
+
+	// a large write is split across packets, but reports the bytes accepted
+	n, err = s.WriteWithDeadline(make([]byte, packet.MaxPayloadBytes+1), time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, packet.MaxPayloadBytes+1, n)
+	assert.Equal(t, uint64(packet.MaxPayloadBytes+6), s.TxPayloadBytes())
+	assert.Equal(t, uint64(packet.HeaderByteSize*4+packet.MaxPayloadBytes+6), s.TxBytes())
+}
+
+// recordingFactory records every control packet sent by a socket
+type recordingFactory struct {
+	PacketFactory
+	ctrl [][4]bool
+}
+
+func (f *recordingFactory) SendControlPacket(syn, ack, fin, err bool) error {
+	f.ctrl = append(f.ctrl, [4]bool{syn, ack, fin, err})
+	return f.PacketFactory.SendControlPacket(syn, ack, fin, err)
+}
+
+func TestConfigNewPacketFactory(t *testing.T) {
+	var rf *recordingFactory
+	var sent []*packet.Packet
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent = append(sent, p)
+			return nil
+		},
+	}, func(c *Config) {
+		c.NewPacketFactory = func(lhost, rhost net.IP, lport, rport uint16, fw func(*packet.Packet) error) PacketFactory {
+			pf, err := factory.New(lhost, rhost, lport, rport, 10, fw)
+			assert.Nil(t, err)
+			rf = &recordingFactory{PacketFactory: pf}
+			return rf
+		}
+	})
+	defer s.atc.Close()
+
+	s.ack()
+	assert.Equal(t, [][4]bool{{false, true, false, false}}, rf.ctrl)
+
+	// the injected factory's options are honoured, and data is still tracked
+	n, err := s.WriteWithDeadline([]byte("sixteen bytes!!!"), time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 16, n)
+	assert.Equal(t, 3, len(sent))
+	assert.Equal(t, 2, s.atc.InFlight())
+}
+
+func TestTransmitReadsOnePacketAtATime(t *testing.T) {
+	sent := make(chan *packet.Packet, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	})
+	defer s.atc.Close()
+	go s.transmit()
+
+	msg := make([]byte, packet.MaxPayloadBytes+100)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	_, err := app.Write(msg)
+	assert.Nil(t, err)
+
+	first, second := <-sent, <-sent
+	assert.Equal(t, msg[:packet.MaxPayloadBytes], first.Payload)
+	assert.Equal(t, msg[packet.MaxPayloadBytes:], second.Payload)
+	assert.Equal(t, first.SeqNo+uint32(packet.MaxPayloadBytes), second.SeqNo)
+
+	// reads follow the payload size when it changes
+	assert.Nil(t, s.packetizer.SetSize(600))
+	_, err = app.Write(msg[:1000])
+	assert.Nil(t, err)
+
+	// (a read with the previous buffer size may already be pending, the
+	// factory splits its data according to the new payload size anyway)
+	var sizes []int
+	for total := 0; total < 1000; {
+		p := <-sent
+		sizes = append(sizes, len(p.Payload))
+		total += len(p.Payload)
+	}
+	assert.Equal(t, []int{600, 400}, sizes)
+}
+
+func TestHandshakeComplete(t *testing.T) {
+	nw := &mockNetwork{}
+	s, _ := mockSocket(t, nw)
+
+	// mock the remote host's final handshake ACK
+	nw.sendFunc = func(p *packet.Packet) error {
+		if p.IsSYN() && p.IsACK() {
+			ack, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+			ack.SetFlagACK()
+			ack.SetSeqNo(1000)
+			ack.SetSum()
+			go func() {
+				time.Sleep(time.Millisecond * 20)
+				s.Deliver(ack)
+			}()
+		}
+		return nil
+	}
+
+	// a context done before the handshake completes unblocks the caller
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.HandshakeComplete(ctx))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, s.HandshakeComplete(context.Background()))
+		}()
+	}
+
+	assert.Nil(t, s.Accept())
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("callers of HandshakeComplete not unblocked on completion")
+	}
+
+	// returns immediately once completed
+	assert.Nil(t, s.HandshakeComplete(context.Background()))
+}
+
+func TestHandshakeCompleteError(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error { return errors.New("mock network error") },
+	})
+
+	assert.NotNil(t, s.Accept())
+	assert.NotNil(t, s.HandshakeComplete(context.Background()))
+	assert.Equal(t, CloseHandshakeFailed, s.CloseReason())
+}
+
+func TestConnInfo(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	_, ok := s.ConnInfo()
+	assert.False(t, ok, "no connection info before the handshake")
+
+	dialer, acceptor, _, _, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		c.ISNSource = func() uint32 { return 1000 }
+		c.EpochSource = func() uint16 { return 7 }
+	}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 5000 }
+		c.EpochSource = func() uint16 { return 9 }
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	dialerInfo, ok := dialer.ConnInfo()
+	assert.True(t, ok)
+	acceptorInfo, ok := acceptor.ConnInfo()
+	assert.True(t, ok)
+	assert.Equal(t, ConnInfo{LocalISN: 1000, RemoteISN: 5000, LocalEpoch: 7, RemoteEpoch: 9, MSS: packet.MaxPacketBytes, PayloadSize: packet.MaxPayloadBytes}, dialerInfo)
+	assert.Equal(t, ConnInfo{LocalISN: 5000, RemoteISN: 1000, LocalEpoch: 9, RemoteEpoch: 7, MSS: packet.MaxPacketBytes, PayloadSize: packet.MaxPayloadBytes}, acceptorInfo)
+}
+
+func TestEpoch(t *testing.T) {
+	// connects over a new loopback network, with fixed initial sequence
+	// numbers: every connection between the same addresses starts at
+	// the same sequence numbers, i.e. only epochs tell them apart
+	connect := func(epoch uint16, tap func(p *packet.Packet) *packet.Packet) (dialer, acceptor *Socket, dialerApp, acceptorApp net.Conn) {
+		dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, tap, func(c *Config) {
+			c.ISNSource = func() uint32 { return 1000 }
+			c.EpochSource = func() uint16 { return epoch }
+		}, func(c *Config) {
+			c.ISNSource = func() uint32 { return 5000 }
+			c.EpochSource = func() uint16 { return epoch + 1 }
+		})
+		assert.Nil(t, dialErr)
+		assert.Nil(t, acceptErr)
+		go dialer.Run()
+		go acceptor.Run()
+		return dialer, acceptor, dialerApp, acceptorApp
+	}
+
+	// a copy of the first data packet of the old connection lingers
+	// on the network (e.g. delayed), while it is delivered in time
+	stale := make(chan *packet.Packet, 1)
+	var delayed sync.Once
+	dialer, acceptor, dialerApp, acceptorApp := connect(1, func(p *packet.Packet) *packet.Packet {
+		if carriesData(p) {
+			delayed.Do(func() {
+				c := *p
+				c.Payload = append([]byte(nil), p.Payload...)
+				stale <- &c
+			})
+		}
+		return p
+	})
+	go dialerApp.Write([]byte("old data"))
+	received := make([]byte, 8)
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "old data", string(received))
+	dialer.Close()
+	acceptor.Close()
+
+	// the connection is opened again between the same addresses
+	noTap := func(p *packet.Packet) *packet.Packet { return p }
+	dialer, acceptor, dialerApp, acceptorApp = connect(3, noTap)
+	defer dialer.Close()
+	info, _ := acceptor.ConnInfo()
+	assert.Equal(t, uint16(3), info.RemoteEpoch)
+
+	// the stale packet falls within the new connection's receive
+	// window (its sequence number is the one expected next), but
+	// bears the old connection's epoch, and is dropped
+	p := <-stale
+	assert.Equal(t, uint16(1), p.Epoch)
+	assert.Equal(t, info.RemoteISN+1, p.SeqNo)
+	assert.True(t, p.CheckSum())
+	acceptor.Deliver(p)
+	assert.Eventually(t, func() bool {
+		return acceptor.Stats().Drops.StaleEpoch == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(0), acceptor.Stats().RxBytes)
+
+	// while the new connection's data is delivered
+	go dialerApp.Write([]byte("new data"))
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "new data", string(received))
+
+	// a delayed FIN of the old connection, at the next sequence number
+	// expected too, does not tear the new connection down
+	fin, _ := packet.NewPacket(testLocalAddr.Port, testRemoteAddr.Port, nil)
+	fin.SetFlagFIN()
+	fin.SetSeqNo(dialer.NextSeqNo())
+	fin.SetEpoch(1)
+	fin.SetSum()
+	acceptor.Deliver(fin)
+	assert.Eventually(t, func() bool {
+		return acceptor.Stats().Drops.StaleEpoch == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, StateEstablished, acceptor.State())
+	go dialerApp.Write([]byte("still up"))
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "still up", string(received))
+}
+
+func TestRawHandshakeOptions(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	_, ok := s.RawHandshakeOptions()
+	assert.False(t, ok, "no options before the handshake")
+
+	dialer, acceptor, _, _, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		c.MTU, c.MSS = 0, 1200 // mutually exclusive
+	}, func(c *Config) {
+		c.MSS = 1000
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	// the raw bytes decode to the values reported by ConnInfo
+	decode := func(options []byte) int {
+		return (&packet.Packet{Flags: uint8(packet.FlagSYN), Payload: options}).MSS()
+	}
+	for _, s := range []*Socket{dialer, acceptor} {
+		options, ok := s.RawHandshakeOptions()
+		assert.True(t, ok)
+		info, _ := s.ConnInfo()
+		settled := decode(options.Sent)
+		if received := decode(options.Received); received < settled {
+			settled = received
+		}
+		assert.Equal(t, info.MSS, settled)
+	}
+
+	dialerOptions, _ := dialer.RawHandshakeOptions()
+	acceptorOptions, _ := acceptor.RawHandshakeOptions()
+	assert.Equal(t, []byte{0x04, 0xb0}, dialerOptions.Sent) // 1200
+	assert.Equal(t, dialerOptions.Sent, acceptorOptions.Received)
+	assert.Equal(t, acceptorOptions.Sent, dialerOptions.Received)
+	assert.Equal(t, 1000, decode(dialerOptions.Received))
+}
+
+func TestParseSynOptions(t *testing.T) {
+	syn := &packet.Packet{Flags: uint8(packet.FlagSYN)}
+	assert.Empty(t, parseSynOptions(syn), "no options after the MSS")
+	assert.Empty(t, parseSynOptions(nil))
+
+	s, _ := mockSocket(t, &mockNetwork{}, withCompression, withTraceTags)
+	syn.Payload = s.synOptions([]byte{0x04, 0xb0})
+	options := parseSynOptions(syn)
+	assert.Equal(t, 2, len(options))
+	assert.Equal(t, s.compressionOption(), options[optCompression])
+	_, ok := options[optTraceTags]
+	assert.True(t, ok)
+
+	// options of unknown kinds are skipped, truncated ones are not parsed
+	syn.Payload = []byte{0x04, 0xb0, 0xfe, 2, 0x00, 0x00, optTraceTags, 0, optKeyShare, 10, 0x01}
+	options = parseSynOptions(syn)
+	assert.Equal(t, 2, len(options))
+	_, ok = options[optTraceTags]
+	assert.True(t, ok)
+	assert.Nil(t, options[optKeyShare])
+}
+
+func TestDuplicateSYNChallengeAck(t *testing.T) {
+	toDialer := make(chan *packet.Packet, 100)
+	dialer, acceptor, _, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		c.ISNSource = func() uint32 { return 1000 }
+	}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 5000 }
+		c.Network = &tapNetwork{Network: c.Network, tap: func(p *packet.Packet) *packet.Packet {
+			select {
+			case toDialer <- p:
+			default:
+			}
+			return p
+		}}
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+	defer acceptor.Close()
+	for len(toDialer) > 0 {
+		<-toDialer // the handshake
+	}
+
+	// a SYN from the (restarted) peer, with a new initial sequence number
+	syn, _ := packet.NewPacket(testLocalAddr.Port, testRemoteAddr.Port, nil)
+	syn.SetFlagSYN()
+	syn.SetSeqNo(9000)
+	syn.SetMSS(packet.MaxPacketBytes)
+	syn.SetSum()
+	acceptor.Deliver(syn)
+
+	// is answered with an ACK of the current state, not a SYN ACK
+	select {
+	case p := <-toDialer:
+		assert.True(t, p.IsACK())
+		assert.False(t, p.IsSYN(), "handshake re-run")
+		assert.False(t, p.IsERR(), "connection reset")
+		assert.Equal(t, uint32(1001), p.AckNo)
+	case <-time.After(time.Second):
+		t.Fatal("no challenge ACK sent")
+	}
+	assert.Equal(t, uint64(1), acceptor.Stats().DuplicateSYNs)
+
+	// and the connection is not disrupted
+	assert.Equal(t, StateEstablished, acceptor.State())
+	_, err := dialer.Write([]byte("hello"))
+	assert.Nil(t, err)
+	received := make([]byte, 5)
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(received))
+}
+
+func TestDialWithInitialData(t *testing.T) {
+	toAcceptor := make(chan *packet.Packet, 100)
+	tap := func(p *packet.Packet) *packet.Packet {
+		if !p.IsSYN() {
+			toAcceptor <- p
+		}
+		return p
+	}
+	dialer, acceptor, _, acceptorApp, dialErr, acceptErr := mockConnPairDial(t, tap, nil, nil, func(s *Socket) error {
+		return s.DialWithInitialData([]byte("hello"))
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	// the ACK completing the handshake carries the data
+	ack := <-toAcceptor
+	assert.True(t, ack.IsACK())
+	assert.Equal(t, "hello", string(ack.Payload))
+	assert.Equal(t, 0, len(toAcceptor), "ACK sent on its own")
+
+	// which is delivered as soon as the acceptor runs
+	go acceptor.Run()
+	defer acceptor.Close()
+	received := make([]byte, 5)
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(received))
+
+	// and acknowledged
+	go dialer.Run()
+	defer dialer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, dialer.Drain(ctx))
+	assert.Equal(t, uint64(5), dialer.TxPayloadBytes())
+}
+
+func TestNextSeqNo(t *testing.T) {
+	isn := func(c *Config) { c.ISNSource = func() uint32 { return 1000 } }
+	s, _ := mockSocket(t, &mockNetwork{}, isn)
+	assert.Equal(t, uint32(1000), s.NextSeqNo())
+
+	// the SYNs consume a sequence number each
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, isn, func(c *Config) {
+		c.ISNSource = func() uint32 { return 5000 }
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	assert.Equal(t, uint32(1001), dialer.NextSeqNo())
+	assert.Equal(t, uint32(5001), dialer.NextAckNo())
+	assert.Equal(t, uint32(5001), acceptor.NextSeqNo())
+	assert.Equal(t, uint32(1001), acceptor.NextAckNo())
+
+	dialerDone := make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go acceptor.Run()
+	defer acceptor.Close()
+
+	// data advances the sequence number by its length
+	for _, msg := range []string{"hello", ", world"} {
+		_, err := dialerApp.Write([]byte(msg))
+		assert.Nil(t, err)
+		received := make([]byte, len(msg))
+		acceptorApp.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(acceptorApp, received)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint32(1013), dialer.NextSeqNo())
+	assert.Eventually(t, func() bool { return acceptor.NextAckNo() == 1013 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint32(5001), acceptor.NextSeqNo())
+
+	// and so does the FIN
+	dialer.Close()
+	select {
+	case <-dialerDone:
+	case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+		t.Fatal("socket did not shut down when closed")
+	}
+	assert.Equal(t, uint32(1014), dialer.NextSeqNo())
+}
+
+func TestUID(t *testing.T) {
+	// connections over the same addresses (e.g. reusing
+	// those of a closed connection) are told apart
+	uids := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		s, _ := mockSocket(t, &mockNetwork{})
+		assert.Equal(t, testLocalAddr.String()+" "+testRemoteAddr.String(), s.ID())
+		assert.False(t, uids[s.UID()], "connection identifiers are unique")
+		uids[s.UID()] = true
+	}
+
+	// and the identifier lasts the connection's lifetime
+	s, _ := mockSocket(t, &mockNetwork{})
+	uid := s.UID()
+	assert.Contains(t, s.logID(), fmt.Sprintf("%016x", uid))
+	s.Close()
+	assert.Equal(t, uid, s.UID())
+
+	// with a deterministic source, drawn after the ISN
+	s, _ = mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Rand = bytes.NewReader([]byte{0, 0, 0x30, 0x39, 1, 2, 3, 4, 5, 6, 7, 8})
+	})
+	assert.Equal(t, uint32(12345), s.packetizer.SeqNo())
+	assert.Equal(t, uint64(0x0102030405060708), s.UID())
+}
+
+func TestMSS(t *testing.T) {
+	for _, mss := range []int{packet.HeaderByteSize, packet.MaxPacketBytes + 1} {
+		_, err := New(Config{
+			LocalAddr:   testLocalAddr,
+			RemoteAddr:  testRemoteAddr,
+			Application: &net.TCPConn{},
+			Network:     &mockNetwork{},
+			MSS:         mss,
+		})
+		assert.NotNil(t, err, "MSS %d accepted", mss)
+	}
+
+	proposed := func(c *Config) { c.MTU, c.MSS = 0, 1200 } // mutually exclusive
+	s, _ := mockSocket(t, &mockNetwork{}, proposed)
+	assert.Equal(t, 1200, s.MSS(), "proposed until the handshake completes")
+
+	// data packets are recorded
+	payloads := make(chan int, 10)
+	tap := func(p *packet.Packet) *packet.Packet {
+		if carriesData(p) {
+			select {
+			case payloads <- len(p.Payload):
+			default:
+			}
+		}
+		return p
+	}
+	dialer, acceptor, dialerApp, _, dialErr, acceptErr := mockConnPair(t, tap, proposed, func(c *Config) {
+		c.MSS = 1000
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	// both hosts settle on the smaller MSS
+	assert.Equal(t, 1000, dialer.MSS())
+	assert.Equal(t, 1000, acceptor.MSS())
+	info, _ := dialer.ConnInfo()
+	assert.Equal(t, 1000, info.MSS)
+	assert.Equal(t, 1000-packet.HeaderByteSize, info.PayloadSize)
+	info, _ = acceptor.ConnInfo()
+	assert.Equal(t, 1000, info.MSS)
+
+	// which sizes the packets sent
+	go dialer.Run()
+	go acceptor.Run()
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	go dialerApp.Write(make([]byte, 1500))
+	for _, expected := range []int{1000 - packet.HeaderByteSize, 1500 - (1000 - packet.HeaderByteSize)} {
+		select {
+		case n := <-payloads:
+			assert.Equal(t, expected, n)
+		case <-time.After(time.Second * 2):
+			t.Fatal("data not sent")
+		}
+	}
+}
+
+func TestMTU(t *testing.T) {
+	for _, config := range []Config{
+		{MTU: ipv4HeaderBytes + packet.HeaderByteSize},
+		{MTU: ipv4HeaderBytes + packet.MaxPacketBytes + 1},
+		{MTU: 1000, MSS: 1000},
+	} {
+		config.LocalAddr, config.RemoteAddr = testLocalAddr, testRemoteAddr
+		config.Application, config.Network = &net.TCPConn{}, &mockNetwork{}
+		_, err := New(config)
+		assert.NotNil(t, err, "MTU %d (and MSS %d) accepted", config.MTU, config.MSS)
+	}
+
+	// a path which drops everything, which would otherwise
+	// be taken for an MTU black hole after a few timeouts
+	var lock sync.Mutex
+	var payloads []int
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				lock.Lock()
+				payloads = append(payloads, len(p.Payload))
+				lock.Unlock()
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.MTU = 1000
+		c.AckWait = time.Millisecond * 5
+	})
+	defer s.atc.Close()
+
+	size := 1000 - ipv4HeaderBytes - packet.HeaderByteSize
+	assert.Equal(t, 1000-ipv4HeaderBytes, s.MSS(), "proposed at handshake")
+	assert.Equal(t, size, s.DebugInfo().PayloadSize)
+
+	_, err := s.Write(make([]byte, size))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 200) // many timeouts
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.True(t, len(payloads) > 5, "%d data packets sent", len(payloads))
+	for _, n := range payloads {
+		assert.Equal(t, size, n, "packets resized")
+	}
+	assert.Equal(t, size, s.DebugInfo().PayloadSize)
+	assert.Equal(t, 0, s.atc.Info().PayloadSize, "black hole detection enabled")
+}
+
+// failingReader is an application connection whose reads fail
+// (e.g. transiently, like a read timing out) while failing is set
+type failingReader struct {
+	net.Conn
+	failing int32
+	reads   int64
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&r.failing) == 1 {
+		atomic.AddInt64(&r.reads, 1)
+		return 0, errors.New("resource temporarily unavailable")
+	}
+	return r.Conn.Read(b)
+}
+
+func TestTransmitBacksOffOnReadErrors(t *testing.T) {
+	sent := make(chan []byte, 10)
+	var app *failingReader
+	s, appConn := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) > 0 {
+				sent <- p.Payload
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		app = &failingReader{Conn: c.Application, failing: 1}
+		c.Application = app
+	})
+	go s.Run()
+	defer s.Close()
+
+	// failing reads are re-tried with backoff rather than in a tight loop
+	time.Sleep(time.Millisecond * 300)
+	reads := atomic.LoadInt64(&app.reads)
+	assert.True(t, reads > 1, "failed read not re-tried")
+	assert.True(t, reads <= 10, "%d reads in 300ms", reads)
+
+	// data is sent once reads no longer fail
+	atomic.StoreInt32(&app.failing, 0)
+	go appConn.Write([]byte("hello"))
+	select {
+	case b := <-sent:
+		assert.Equal(t, []byte("hello"), b)
+	case <-time.After(time.Second * 2):
+		t.Fatal("data not sent once reads no longer fail")
+	}
+}
+
+// shortWriter is an application connection whose first write is short
+type shortWriter struct {
+	net.Conn
+	short int
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if w.short > 0 && len(b) > w.short {
+		n, err := w.Conn.Write(b[:w.short])
+		w.short = 0
+		if err != nil {
+			return n, err
+		}
+		return n, errors.New("short write")
+	}
+	return w.Conn.Write(b)
+}
+
+func TestHandleShortApplicationWrite(t *testing.T) {
+	acks := make(chan uint32, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsACK() {
+				acks <- p.AckNo
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.Application = &shortWriter{Conn: c.Application, short: 3}
+	})
+	s.rxNext = 100
+
+	rx := make(chan string, 10)
+	go func() {
+		for {
+			buf := make([]byte, 1024)
+			n, err := app.Read(buf)
+			if err != nil {
+				return
+			}
+			rx <- string(buf[:n])
+		}
+	}()
+
+	mockData := func(seq uint32, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		p.SetSum()
+		return p
+	}
+
+	// only the bytes written to the application are acknowledged
+	s.handle(mockData(100, "hello"))
+	assert.Equal(t, "hel", <-rx)
+	assert.Equal(t, uint32(103), <-acks)
+
+	// so the remote host retransmits, and only the remainder is delivered
+	s.handle(mockData(100, "hello"))
+	assert.Equal(t, "lo", <-rx)
+	assert.Equal(t, uint32(105), <-acks)
+
+	s.handle(mockData(105, " world"))
+	assert.Equal(t, " world", <-rx)
+	assert.Equal(t, uint32(111), <-acks)
+}
+
+// mockLink connects two sockets through mock networks
+// which deliver every packet after the given latency
+func TestHandleAfterApplicationClosed(t *testing.T) {
+	sent := make(chan *packet.Packet, 10)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			sent <- p
+			return nil
+		},
+	})
+	s.rxNext = 100
+	app.Close()
+
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("hello"))
+	p.SetSeqNo(100)
+	p.SetSum()
+	s.handle(p)
+
+	// the connection is reset rather than left to receive data nobody reads
+	reset := <-sent
+	assert.True(t, reset.IsERR())
+	assert.Equal(t, 0, len(sent), "data not delivered must not be acknowledged")
+	assert.Equal(t, uint32(100), s.rxNext)
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrApplicationClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("socket did not shut down after the application closed its connection")
+	}
+
+	_, err := s.Write([]byte("more"))
+	assert.Equal(t, ErrConnReset, err)
+}
+
+func TestSetApplication(t *testing.T) {
+	a, b, aApp, oldApp, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		c.AckWait = time.Millisecond * 20
+	}, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	go a.Run()
+	go b.Run()
+	defer a.Close()
+	defer b.Close()
+
+	assert.NotNil(t, b.SetApplication(nil))
+
+	// a stream of data, swapped to a new connection mid-stream
+	data := make([]byte, 8000)
+	rand.Read(data)
+	go aApp.Write(data)
+
+	var mu sync.Mutex
+	var before []byte
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		buf := make([]byte, 1000)
+		for {
+			n, err := oldApp.Read(buf)
+			mu.Lock()
+			before = append(before, buf[:n]...)
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(before) >= 3000
+	}, time.Second*5, time.Millisecond)
+
+	newApp, newSvc := net.Pipe()
+	defer newApp.Close()
+	assert.Nil(t, b.SetApplication(newSvc))
+	oldApp.SetReadDeadline(time.Now())
+	<-stopped
+
+	// the rest of the data, neither lost nor duplicated
+	after := make([]byte, len(data)-len(before))
+	newApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(newApp, after)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, append(before, after...)))
+
+	// data is sent from the new connection only
+	oldApp.SetWriteDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err = oldApp.Write([]byte("stale"))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "%v", err)
+	go newApp.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	aApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(aApp, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("reply"), reply)
+
+	// the connection of a closed socket is not set
+	b.Close()
+	_, closedSvc := net.Pipe()
+	assert.Equal(t, ErrConnClosed, b.SetApplication(closedSvc))
+	assert.Equal(t, newSvc, b.app().Conn)
+}
+
+func mockLink(t *testing.T, latency time.Duration) (*Socket, *Socket) {
+	var a, b *Socket
+	// without a handshake, both ends start at sequence number 0 (matching
+	// the sequence number expected from the remote host)
+	a, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			time.AfterFunc(latency, func() { b.Deliver(p) })
+			return nil
+		},
+	}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	b, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			time.AfterFunc(latency, func() { a.Deliver(p) })
+			return nil
+		},
+	}, func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	return a, b
+}
+
+func TestPing(t *testing.T) {
+	latency := time.Millisecond * 20
+
+	a, b := mockLink(t, latency)
+	go a.Run()
+	go b.Run()
+
+	for i := 0; i < 3; i++ {
+		rtt, err := a.Ping(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, rtt >= 2*latency, "rtt %s shorter than twice the latency", rtt)
+		assert.True(t, rtt < 2*latency+time.Millisecond*200, "rtt %s way longer than twice the latency", rtt)
+	}
+
+	// pings work both ways
+	_, err := b.Ping(context.Background())
+	assert.Nil(t, err)
+}
+
+func TestPingContextDone(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{}) // pings are never echoed
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	_, err := s.Ping(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, len(s.pings))
+}
+
+func TestWarmUp(t *testing.T) {
+	latency := time.Millisecond * 50
+
+	a, b := mockLink(t, latency)
+	go a.Run()
+	go b.Run()
+	assert.Equal(t, time.Second, a.CurrentRTO(), "initial guess")
+
+	assert.Nil(t, a.WarmUp(context.Background()))
+	info := a.DebugInfo()
+	assert.True(t, info.SRTT >= 2*latency, "smoothed rtt %s shorter than twice the latency", info.SRTT)
+	assert.True(t, info.SRTT < 2*latency+time.Millisecond*200, "smoothed rtt %s way longer than twice the latency", info.SRTT)
+	rto := a.CurrentRTO()
+	assert.True(t, rto >= info.SRTT, "rto %s shorter than the smoothed rtt", rto)
+	assert.True(t, rto < time.Second/2, "rto %s not refined", rto)
+	assert.Equal(t, rto, info.AckWait)
+
+	// the context bounds the warm-up
+	s, _ := mockSocket(t, &mockNetwork{}) // probes are never echoed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.WarmUp(ctx))
+	assert.Equal(t, time.Second, s.CurrentRTO())
+}
+
+func TestLastActivity(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	defer s.atc.Close()
+
+	created := s.LastActivity()
+	assert.False(t, created.IsZero())
+
+	time.Sleep(time.Millisecond * 5)
+	assert.Nil(t, s.packetizer.SendControlPacket(false, true, false, false))
+	sent := s.LastActivity()
+	assert.True(t, sent.After(created), "sending advances the last activity")
+
+	time.Sleep(time.Millisecond * 5)
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+	p.SetFlagACK()
+	p.SetSum()
+	s.Deliver(p)
+	assert.True(t, s.LastActivity().After(sent), "receiving advances the last activity")
+}
+
+func TestByteCountsDoNotWrap(t *testing.T) {
+	s, app := mockSocket(t, &mockNetwork{})
+	defer s.atc.Close()
+	go io.Copy(ioutil.Discard, app)
+
+	// a long lived connection which already moved 4GB each way
+	atomic.StoreUint64(&s.txBytes, math.MaxUint32)
+	atomic.StoreUint64(&s.txPayloadBytes, math.MaxUint32)
+	atomic.StoreUint64(&s.rxBytes, math.MaxUint32)
+
+	_, err := s.WriteWithDeadline([]byte("more"), time.Time{})
+	assert.Nil(t, err)
+
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte("more"))
+	p.SetSeqNo(s.rxNext)
+	p.SetSum()
+	s.handle(p)
+
+	assert.Equal(t, uint64(math.MaxUint32+4), s.TxPayloadBytes())
+	assert.Equal(t, uint64(math.MaxUint32+4), s.RxBytes())
+	assert.True(t, s.TxBytes() > math.MaxUint32)
+}
+
+func TestLoopbackConnectTransferClose(t *testing.T) {
+	// one in every 50 packets sent either way is lost while lossy
+	var lossy int32
+	var sent uint64
+	lose := func(p *packet.Packet) *packet.Packet {
+		if atomic.LoadInt32(&lossy) == 1 && atomic.AddUint64(&sent, 1)%50 == 0 {
+			return nil
+		}
+		return p
+	}
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, lose, func(c *Config) {
+		c.AckWait = time.Millisecond * 20
+	}, func(c *Config) {
+		c.Network = &tapNetwork{Network: c.Network, tap: lose}
+		c.AckWait = time.Millisecond * 20
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	dialerDone, acceptorDone := make(chan error, 1), make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go func() { acceptorDone <- acceptor.Run() }()
+
+	// data is transferred in full and in order despite packet loss
+	atomic.StoreInt32(&lossy, 1)
+
+	msg := []byte(strings.Repeat("over the loopback network ", 400))
+	go func() {
+		for off := 0; off < len(msg); off += 1000 {
+			end := off + 1000
+			if end > len(msg) {
+				end = len(msg)
+			}
+			dialerApp.Write(msg[off:end])
+		}
+	}()
+
+	received := make([]byte, len(msg))
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 20))
+	n, err := io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(msg, received), "received %d of %d bytes", n, len(msg))
+
+	// closing the dialing application terminates the connection at both ends
+	atomic.StoreInt32(&lossy, 0)
+	time.Sleep(time.Millisecond * 100) // let the last acks through
+	assert.Equal(t, CloseNone, dialer.CloseReason())
+	dialerApp.Close()
+
+	for _, done := range []chan error{dialerDone, acceptorDone} {
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("socket did not shut down after the connection was closed")
+		}
+	}
+	assert.Equal(t, CloseLocal, dialer.CloseReason())
+	assert.Equal(t, ClosePeer, acceptor.CloseReason())
+}
+
+func TestLoopbackSimultaneousOpen(t *testing.T) {
+	lo, err := network.NewLoopback(time.Millisecond*2, 0)
+	assert.Nil(t, err)
+	defer lo.Close()
+
+	a, aApp := mockSocket(t, nil, func(c *Config) {
+		c.Network = lo.Host(testLocalAddr.Host)
+	})
+	b, bApp := mockSocket(t, nil, func(c *Config) {
+		c.LocalAddr, c.RemoteAddr = testRemoteAddr, testLocalAddr
+		c.Network = lo.Host(testRemoteAddr.Host)
+	})
+	lo.Host(testLocalAddr.Host).StartReceiver(func(p *packet.Packet) error {
+		a.Deliver(p)
+		return nil
+	})
+	lo.Host(testRemoteAddr.Host).StartReceiver(func(p *packet.Packet) error {
+		b.Deliver(p)
+		return nil
+	})
+
+	// both hosts dial each other, their SYNs cross
+	dialed := make(chan error, 2)
+	go func() { dialed <- a.Dial() }()
+	go func() { dialed <- b.Dial() }()
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, <-dialed)
+	}
+	assert.Equal(t, "established", a.DebugInfo().State)
+	assert.Equal(t, "established", b.DebugInfo().State)
+
+	go a.Run()
+	go b.Run()
+	defer a.Close()
+	defer b.Close()
+
+	// data flows both ways
+	for _, c := range []struct{ from, to net.Conn }{{aApp, bApp}, {bApp, aApp}} {
+		_, err := c.from.Write([]byte("hello"))
+		assert.Nil(t, err)
+		received := make([]byte, 5)
+		c.to.SetReadDeadline(time.Now().Add(time.Second * 5))
+		_, err = io.ReadFull(c.to, received)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello"), received)
+	}
+}
+
+func benchmarkCopy(b *testing.B, copy func(s *Socket, r io.Reader) (int64, error)) {
+	s, _ := mockSocket(b, &mockNetwork{}, func(c *Config) {
+		c.AckWait = time.Minute // no retransmissions
+		c.WriteBufferBytes = -1
+	})
+	defer s.atc.Close()
+
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// hide bytes.Reader's WriteTo, as a network connection would
+		if _, err := copy(s, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+			b.Fatal(err)
+		}
+		s.atc.Ack(s.packetizer.SeqNo())
+	}
+}
+
+func BenchmarkCopyReadFrom(b *testing.B) {
+	benchmarkCopy(b, func(s *Socket, r io.Reader) (int64, error) {
+		return io.Copy(s, r)
+	})
+}
+
+func BenchmarkCopyGeneric(b *testing.B) {
+	benchmarkCopy(b, func(s *Socket, r io.Reader) (int64, error) {
+		return io.Copy(struct{ io.Writer }{s}, r) // hides ReadFrom
+	})
+}
@@ -0,0 +1,188 @@
+// Package sockettest provides a throughput self-test of rdtp sockets, which
+// connects two sockets over an in-memory loopback network (see
+// network.Loopback) and transfers data from one to the other. It serves both
+// as an end to end smoke test and as a benchmark harness
+package sockettest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adrianosela/rdtp"
+	"github.com/adrianosela/rdtp/network"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/adrianosela/rdtp/socket"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBytes   = 1 << 20
+	defaultTimeout = time.Second * 30
+)
+
+var (
+	dialerAddr   = &rdtp.Addr{Host: "10.0.0.1", Port: 1000}
+	acceptorAddr = &rdtp.Addr{Host: "10.0.0.2", Port: 2000}
+)
+
+// Params are the parameters of a throughput self-test
+type Params struct {
+	Bytes       int           // application bytes transferred (1 MiB if zero)
+	PayloadSize int           // payload bytes per data packet (see socket.Config.MSS), the default if zero
+	Latency     time.Duration // one way latency of the network (each packet delayed on its own timer, so packets may be reordered)
+	LossRate    float64       // rate at which the network loses packets, in [0, 1)
+	AckWait     time.Duration // the sockets' initial ACK wait time (see socket.Config.AckWait), the default if zero
+	Timeout     time.Duration // bounds the transfer and close (30 seconds if zero), not the handshake
+}
+
+// Result is the outcome of a throughput self-test
+type Result struct {
+	Bytes   int           // application bytes received, in full and in order
+	Elapsed time.Duration // from the first byte written to the last byte received
+
+	// Throughput is the rate (in bytes per second) at which application
+	// bytes were received, and RetransmitRate the fraction of the bytes
+	// sent by the sending socket which were retransmissions
+	Throughput     float64
+	RetransmitRate float64
+
+	// states of the sending (dialing) and receiving (accepting) sockets
+	// once all data was received, i.e. before the connection is closed
+	DialerState   socket.State
+	AcceptorState socket.State
+
+	// statistics of the sending socket once all data was received
+	DialerStats socket.Stats
+}
+
+// Transfer connects two sockets over a loopback network with the given
+// latency and loss rate, transfers data from the dialing socket to the
+// accepting one, and closes the connection. An error is returned if the
+// connection fails, the data received differs from the data sent, or the
+// test times out
+func Transfer(p Params) (*Result, error) {
+	if p.Bytes == 0 {
+		p.Bytes = defaultBytes
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultTimeout
+	}
+	mss := 0
+	if p.PayloadSize != 0 {
+		mss = p.PayloadSize + packet.HeaderByteSize
+	}
+
+	lo, err := network.NewLoopback(p.Latency, p.LossRate)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create loopback network")
+	}
+	defer lo.Close()
+
+	dialer, dialerApp, err := newSocket(lo, dialerAddr, acceptorAddr, mss, p.AckWait)
+	if err != nil {
+		return nil, err
+	}
+	acceptor, acceptorApp, err := newSocket(lo, acceptorAddr, dialerAddr, mss, p.AckWait)
+	if err != nil {
+		return nil, err
+	}
+	defer dialerApp.Close()
+	defer acceptorApp.Close()
+
+	// the acceptor's host plays the part of a listener: a SYN is accepted
+	accepted := make(chan error, 1)
+	var accept sync.Once
+	lo.Host(acceptorAddr.Host).StartReceiver(func(pck *packet.Packet) error {
+		if pck.IsSYN() && !pck.IsACK() {
+			accept.Do(func() { go func() { accepted <- acceptor.Accept() }() })
+			return nil
+		}
+		acceptor.Deliver(pck)
+		return nil
+	})
+	lo.Host(dialerAddr.Host).StartReceiver(func(pck *packet.Packet) error {
+		dialer.Deliver(pck)
+		return nil
+	})
+
+	if err = dialer.Dial(); err != nil {
+		return nil, errors.Wrap(err, "could not dial")
+	}
+	if err = <-accepted; err != nil {
+		return nil, errors.Wrap(err, "could not accept")
+	}
+
+	dialerDone, acceptorDone := make(chan error, 1), make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go func() { acceptorDone <- acceptor.Run() }()
+
+	sent := make([]byte, p.Bytes)
+	for i := range sent {
+		sent[i] = byte(i % 251) // not aligned to packets
+	}
+	deadline := time.Now().Add(p.Timeout)
+	dialerApp.SetWriteDeadline(deadline)
+	acceptorApp.SetReadDeadline(deadline)
+
+	start := time.Now()
+	go dialerApp.Write(sent)
+	received := make([]byte, p.Bytes)
+	n, err := io.ReadFull(acceptorApp, received)
+	elapsed := time.Since(start)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("transfer failed after %d of %d bytes", n, p.Bytes))
+	}
+	if !bytes.Equal(sent, received) {
+		return nil, errors.New("data received differs from data sent")
+	}
+
+	stats := dialer.Stats()
+	r := &Result{
+		Bytes:         n,
+		Elapsed:       elapsed,
+		Throughput:    float64(n) / elapsed.Seconds(),
+		DialerState:   dialer.State(),
+		AcceptorState: acceptor.State(),
+		DialerStats:   stats,
+	}
+	if stats.TxBytes > 0 {
+		r.RetransmitRate = float64(stats.TxRetransBytes) / float64(stats.TxBytes)
+	}
+
+	// closing the sending application terminates the connection at both ends
+	dialerApp.Close()
+	for _, done := range []chan error{dialerDone, acceptorDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				return nil, errors.Wrap(err, "connection failed")
+			}
+		case <-time.After(time.Until(deadline)):
+			return nil, errors.New("connection not closed before the timeout")
+		}
+	}
+
+	return r, nil
+}
+
+// newSocket returns a socket on the loopback network and the application's
+// end of its connection
+func newSocket(lo *network.Loopback, laddr, raddr *rdtp.Addr, mss int, ackWait time.Duration) (*socket.Socket, net.Conn, error) {
+	app, svc := net.Pipe()
+	s, err := socket.New(socket.Config{
+		LocalAddr:   laddr,
+		RemoteAddr:  raddr,
+		Application: svc,
+		Network:     lo.Host(laddr.Host),
+		MSS:         mss,
+		AckWait:     ackWait,
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create socket")
+	}
+	return s, app, nil
+}
@@ -0,0 +1,42 @@
+package sockettest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/socket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransfer(t *testing.T) {
+	r, err := Transfer(Params{Bytes: 20000})
+	assert.Nil(t, err)
+	assert.Equal(t, 20000, r.Bytes)
+	assert.True(t, r.Throughput > 0)
+	assert.Equal(t, socket.StateEstablished, r.DialerState)
+	assert.Equal(t, socket.StateEstablished, r.AcceptorState)
+}
+
+func TestTransferUnderLoss(t *testing.T) {
+	r, err := Transfer(Params{
+		Bytes:       2000,
+		PayloadSize: 500,
+		LossRate:    0.1,
+		AckWait:     time.Millisecond * 20,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, r.Bytes)
+	assert.Equal(t, float64(r.DialerStats.TxRetransBytes)/float64(r.DialerStats.TxBytes), r.RetransmitRate)
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	const bytes = 1 << 20
+	b.SetBytes(bytes)
+	for i := 0; i < b.N; i++ {
+		r, err := Transfer(Params{Bytes: bytes})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(r.RetransmitRate, "retransmit-rate")
+	}
+}
@@ -0,0 +1,67 @@
+package socket
+
+// State is the state of a socket's connection
+type State int
+
+// connection states, named after TCP's. A reset connection (or one whose
+// handshake failed) goes straight back to StateClosed
+const (
+	StateClosed      State = iota // not (or no longer) connected
+	StateSynSent                  // dialing, i.e. waiting for a SYN ACK
+	StateSynReceived              // accepting, i.e. waiting for an ACK
+	StateEstablished              // data can be sent and received
+	StateFinWait                  // closed locally, FIN handshake initiated
+	StateCloseWait                // closed by the remote host, FIN handshake accepted
+)
+
+var stateNames = map[State]string{
+	StateClosed:      "CLOSED",
+	StateSynSent:     "SYN_SENT",
+	StateSynReceived: "SYN_RECEIVED",
+	StateEstablished: "ESTABLISHED",
+	StateFinWait:     "FIN_WAIT",
+	StateCloseWait:   "CLOSE_WAIT",
+}
+
+func (st State) String() string {
+	if name, ok := stateNames[st]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// State returns the state of the socket's connection
+func (s *Socket) State() State {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.connState
+}
+
+// IsAlive returns true if the connection is established and neither
+// closed (locally or by the remote host) nor in an error state (see Err),
+// e.g. for a pool of pre-established connections to check a connection
+// before handing it out. It does not probe the remote host (see Ping)
+func (s *Socket) IsAlive() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.connState == StateEstablished && !s.closed && !s.aborted && s.err == nil
+}
+
+// setState transitions the connection to the given state (if not already
+// in it), calling the state change callback (see Config.OnStateChange).
+// Transitions are serialized, so the callback observes them in order
+func (s *Socket) setState(st State) {
+	s.transitions.Lock()
+	defer s.transitions.Unlock()
+
+	s.Lock()
+	old := s.connState
+	s.connState = st
+	s.Unlock()
+
+	if old != st && s.onStateChange != nil {
+		s.onStateChange(old, st)
+	}
+}
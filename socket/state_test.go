@@ -0,0 +1,123 @@
+package socket
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stateRecorder records the transitions observed by a state change callback
+type stateRecorder struct {
+	sync.Mutex
+	transitions []State // pairs of old and new states
+}
+
+func (r *stateRecorder) record(old, new State) {
+	r.Lock()
+	defer r.Unlock()
+	r.transitions = append(r.transitions, old, new)
+}
+
+func (r *stateRecorder) observed() []State {
+	r.Lock()
+	defer r.Unlock()
+	return append([]State(nil), r.transitions...)
+}
+
+func TestOnStateChange(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	assert.Equal(t, StateClosed, s.State())
+
+	var dialerStates, acceptorStates stateRecorder
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		c.OnStateChange = dialerStates.record
+	}, func(c *Config) {
+		c.OnStateChange = acceptorStates.record
+	})
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	assert.Equal(t, StateEstablished, dialer.State())
+
+	dialerDone, acceptorDone := make(chan error, 1), make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go func() { acceptorDone <- acceptor.Run() }()
+
+	_, err := dialerApp.Write([]byte("hello"))
+	assert.Nil(t, err)
+	received := make([]byte, 5)
+	acceptorApp.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(acceptorApp, received)
+	assert.Nil(t, err)
+
+	dialer.Close()
+	for _, done := range []chan error{dialerDone, acceptorDone} {
+		select {
+		case <-done:
+		case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+			t.Fatal("socket did not shut down after the connection was closed")
+		}
+	}
+
+	assert.Equal(t, []State{
+		StateClosed, StateSynSent,
+		StateSynSent, StateEstablished,
+		StateEstablished, StateFinWait,
+		StateFinWait, StateClosed,
+	}, dialerStates.observed())
+	assert.Equal(t, []State{
+		StateClosed, StateSynReceived,
+		StateSynReceived, StateEstablished,
+		StateEstablished, StateCloseWait,
+		StateCloseWait, StateClosed,
+	}, acceptorStates.observed())
+	assert.Equal(t, StateClosed, dialer.State())
+}
+
+func TestStateString(t *testing.T) {
+	assert.Equal(t, "SYN_SENT", StateSynSent.String())
+	assert.Equal(t, "FIN_WAIT", StateFinWait.String())
+	assert.Equal(t, "UNKNOWN", State(-1).String())
+}
+
+func TestIsAlive(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	assert.False(t, s.IsAlive(), "not connected yet")
+
+	dialer, acceptor, _, _, dialErr, acceptErr := mockConnPair(t, nil, nil, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+	assert.True(t, dialer.IsAlive())
+	assert.True(t, acceptor.IsAlive())
+
+	// a pooled connection closed before use (i.e. never run)
+	// is no longer alive, and closing it again is harmless
+	dialer.Close()
+	dialer.Close()
+	assert.False(t, dialer.IsAlive())
+	assert.True(t, acceptor.IsAlive(), "remote host not told yet")
+
+	// running it shuts it down, closing the remote end too
+	dialerDone, acceptorDone := make(chan error, 1), make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go func() { acceptorDone <- acceptor.Run() }()
+	for _, done := range []chan error{dialerDone, acceptorDone} {
+		select {
+		case <-done:
+		case <-time.After(maxCloseDrainTime + handshakeResponseTimeout*2):
+			t.Fatal("socket did not shut down after the connection was closed")
+		}
+	}
+	assert.False(t, acceptor.IsAlive())
+	assert.Equal(t, StateClosed, acceptor.State())
+	assert.Equal(t, ClosePeer, acceptor.CloseReason())
+
+	// a connection in an error state is not alive either
+	s, _ = mockSocket(t, &mockNetwork{})
+	s.setState(StateEstablished)
+	assert.True(t, s.IsAlive())
+	s.abort(ClosePeerReset, ErrConnectionReset)
+	assert.False(t, s.IsAlive())
+}
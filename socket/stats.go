@@ -0,0 +1,254 @@
+package socket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// throughput and goodput are measured over this window...
+	statsWindow = time.Second * 10
+
+	// ...from counter samples taken at most this often
+	statsSampleInterval = time.Second
+
+	statsSamples = int(statsWindow/statsSampleInterval) + 1
+)
+
+// Stats is a snapshot of a socket's statistics
+type Stats struct {
+	TxBytes        uint64 // bytes sent to the network, incl. headers and retransmissions
+	TxPayloadBytes uint64 // application bytes sent
+	TxRetransBytes uint64 // bytes of TxBytes which were retransmissions, incl. headers
+	RxBytes        uint64 // application bytes received
+	Dropped        uint64 // inbound packets dropped due to a full inbound channel or datagram queue
+	DuplicateSYNs  uint64 // SYNs received on the established connection, answered with a challenge ACK
+
+	// Drops breaks inbound packets dropped down by reason
+	Drops DropStats
+
+	// PacketsPerAck is the average number of in-order data packets
+	// acknowledged by each ACK sent (see Config.MaxAckCoalesce)
+	PacketsPerAck float64
+
+	// Throughput is the rate (in bytes per second) at which bytes are sent
+	// to the network, incl. headers and retransmissions, and Goodput the rate
+	// at which application bytes are sent, each counted once. Both rates are
+	// measured over a sliding window of around ten seconds
+	Throughput float64
+	Goodput    float64
+}
+
+// DropStats counts the inbound packets dropped (or, for data, not
+// delivered) by reason. Out of order data is discarded rather than
+// buffered for reassembly, and re-sent by the remote host until received
+// in order, so OutOfOrder counts what a full reassembly buffer would drop
+type DropStats struct {
+	BadChecksum       uint64 // failed the checksum
+	Misaddressed      uint64 // not addressed from the remote to the local address
+	AckNotSent        uint64 // acknowledging data never sent
+	OutOfWindow       uint64 // data with a sequence number outside of the receive window
+	Rejected          uint64 // rejected by custom validation (see Config.ValidatePacket)
+	Unauthentic       uint64 // data or FWD whose payload failed authentication (see Config.Encryption)
+	BadCompression    uint64 // data whose payload failed to decompress (see Config.Compression)
+	Untagged          uint64 // data whose payload carries no trace tag (see Config.TraceTags) or application header (see Config.AppHeaderSize)
+	StaleEpoch        uint64 // bearing another epoch, i.e. of a previous connection (see Config.EpochSource)
+	OutOfOrder        uint64 // data ahead of the next sequence number expected
+	Duplicate         uint64 // data already received (and acknowledged again)
+	InboundFull       uint64 // full inbound channel
+	DatagramQueueFull uint64 // full datagram queue (in unreliable mode)
+}
+
+// countDrop counts an inbound packet dropped as invalid (see validate)
+func (s *Socket) countDrop(err error) {
+	switch err {
+	case errBadChecksum:
+		atomic.AddUint64(&s.drops.BadChecksum, 1)
+	case errMisaddressed:
+		atomic.AddUint64(&s.drops.Misaddressed, 1)
+	case errAckNotSent:
+		atomic.AddUint64(&s.drops.AckNotSent, 1)
+	case errOutOfSeqWindow:
+		atomic.AddUint64(&s.drops.OutOfWindow, 1)
+	case errRejected:
+		atomic.AddUint64(&s.drops.Rejected, 1)
+	case errUnauthentic:
+		atomic.AddUint64(&s.drops.Unauthentic, 1)
+	case errBadCompression:
+		atomic.AddUint64(&s.drops.BadCompression, 1)
+	case errUntagged:
+		atomic.AddUint64(&s.drops.Untagged, 1)
+	case errStaleEpoch:
+		atomic.AddUint64(&s.drops.StaleEpoch, 1)
+	}
+}
+
+// dropStats returns a snapshot of the drop counters
+func (s *Socket) dropStats() DropStats {
+	return DropStats{
+		BadChecksum:       atomic.LoadUint64(&s.drops.BadChecksum),
+		Misaddressed:      atomic.LoadUint64(&s.drops.Misaddressed),
+		AckNotSent:        atomic.LoadUint64(&s.drops.AckNotSent),
+		OutOfWindow:       atomic.LoadUint64(&s.drops.OutOfWindow),
+		Rejected:          atomic.LoadUint64(&s.drops.Rejected),
+		Unauthentic:       atomic.LoadUint64(&s.drops.Unauthentic),
+		BadCompression:    atomic.LoadUint64(&s.drops.BadCompression),
+		Untagged:          atomic.LoadUint64(&s.drops.Untagged),
+		StaleEpoch:        atomic.LoadUint64(&s.drops.StaleEpoch),
+		OutOfOrder:        atomic.LoadUint64(&s.drops.OutOfOrder),
+		Duplicate:         atomic.LoadUint64(&s.drops.Duplicate),
+		InboundFull:       atomic.LoadUint64(&s.drops.InboundFull),
+		DatagramQueueFull: atomic.LoadUint64(&s.drops.DatagramQueueFull),
+	}
+}
+
+// DebugInfo is a detailed snapshot of a socket's state, for diagnostics
+// (akin to TCP_INFO). The retransmission state is consistent as of a
+// single point in time, the statistics are taken right after it
+type DebugInfo struct {
+	State string // connecting, established, closed or reset
+
+	// next sequence number to be sent
+	TxNext uint32
+
+	// sequence numbers accepted ahead of the next expected one
+	ReceiveWindow int
+
+	// retransmission state (see atc.Info)
+	AckWait         time.Duration
+	RTO             time.Duration
+	SRTT            time.Duration
+	RTTVar          time.Duration
+	PacketsInFlight int
+	BytesInFlight   int
+	WriteBuffer     int // bytes in flight at most, zero when not limited
+	PayloadSize     int
+	Retransmits     uint64
+	FastRetransmits uint64 // after duplicate ACKs rather than timing out
+
+	// application bytes not yet sent (see SendQueueDepth)
+	SendQueueDepth int
+
+	Stats Stats
+}
+
+// statsSample is a snapshot of the byte counters at a point in time
+type statsSample struct {
+	at             time.Time
+	txBytes        uint64
+	txPayloadBytes uint64
+}
+
+// rateMeter keeps a ring of counter samples from which rates are computed
+type rateMeter struct {
+	sync.Mutex
+
+	samples [statsSamples]statsSample
+	next    int // index of the next sample to be overwritten
+	n       int // number of samples in the ring
+}
+
+// Stats returns a snapshot of the socket's statistics
+func (s *Socket) Stats() Stats {
+	now := statsSample{
+		at:             time.Now(),
+		txBytes:        atomic.LoadUint64(&s.txBytes),
+		txPayloadBytes: atomic.LoadUint64(&s.txPayloadBytes),
+	}
+	throughput, goodput := s.rates.record(now)
+
+	var packetsPerAck float64
+	if acks := atomic.LoadUint64(&s.acksSent); acks > 0 {
+		packetsPerAck = float64(atomic.LoadUint64(&s.ackedPackets)) / float64(acks)
+	}
+
+	return Stats{
+		TxBytes:        now.txBytes,
+		TxPayloadBytes: now.txPayloadBytes,
+		TxRetransBytes: atomic.LoadUint64(&s.txRetransBytes),
+		RxBytes:        atomic.LoadUint64(&s.rxBytes),
+		Dropped:        atomic.LoadUint64(&s.dropped),
+		DuplicateSYNs:  atomic.LoadUint64(&s.duplicateSYNs),
+		Drops:          s.dropStats(),
+		PacketsPerAck:  packetsPerAck,
+		Throughput:     throughput,
+		Goodput:        goodput,
+	}
+}
+
+// DebugInfo returns a detailed snapshot of the socket's state
+func (s *Socket) DebugInfo() DebugInfo {
+	info := s.atc.Info()
+	return DebugInfo{
+		State:           s.state(),
+		TxNext:          s.packetizer.SeqNo(),
+		AckWait:         info.AckWait,
+		RTO:             info.RTO,
+		SRTT:            info.SRTT,
+		RTTVar:          info.RTTVar,
+		PacketsInFlight: info.PacketsInFlight,
+		BytesInFlight:   info.BytesInFlight,
+		ReceiveWindow:   int(atomic.LoadUint32(&s.receiveWindow)),
+		WriteBuffer:     info.Window,
+		PayloadSize:     s.packetizer.Size(),
+		Retransmits:     info.Retransmits,
+		FastRetransmits: info.FastRetransmits,
+		SendQueueDepth:  s.SendQueueDepth(),
+		Stats:           s.Stats(),
+	}
+}
+
+// state returns the name of the socket's connection state
+func (s *Socket) state() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	switch {
+	case s.aborted:
+		return "reset"
+	case s.closed:
+		return "closed"
+	}
+	select {
+	case <-s.handshakeDone:
+		if s.handshakeErr != nil {
+			return "closed"
+		}
+		return "established"
+	default:
+		return "connecting"
+	}
+}
+
+// record adds a sample to the ring (unless the last one is too recent)
+// and returns the rates between the oldest sample within the window
+// and the given sample
+func (m *rateMeter) record(now statsSample) (throughput, goodput float64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.n == 0 || now.at.Sub(m.samples[(m.next+statsSamples-1)%statsSamples].at) >= statsSampleInterval {
+		m.samples[m.next] = now
+		m.next = (m.next + 1) % statsSamples
+		if m.n < statsSamples {
+			m.n++
+		}
+	}
+
+	// the oldest sample within the window, or the newest if none is
+	for i := m.n; i > 0; i-- {
+		base := m.samples[(m.next+statsSamples-i)%statsSamples]
+		if now.at.Sub(base.at) > statsWindow && i > 1 {
+			continue
+		}
+		elapsed := now.at.Sub(base.at).Seconds()
+		if elapsed <= 0 {
+			return 0, 0
+		}
+		throughput = float64(now.txBytes-base.txBytes) / elapsed
+		goodput = float64(now.txPayloadBytes-base.txPayloadBytes) / elapsed
+		return throughput, goodput
+	}
+	return 0, 0
+}
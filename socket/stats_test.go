@@ -0,0 +1,289 @@
+package socket
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateMeter(t *testing.T) {
+	var m rateMeter
+	start := time.Now()
+	sample := func(secs int, txBytes, txPayloadBytes uint64) statsSample {
+		return statsSample{at: start.Add(time.Duration(secs) * time.Second), txBytes: txBytes, txPayloadBytes: txPayloadBytes}
+	}
+
+	m.record(sample(0, 0, 0))
+
+	// 1000 wire bytes and 500 application bytes per second
+	throughput, goodput := m.record(sample(2, 2000, 1000))
+	assert.Equal(t, 1000.0, throughput)
+	assert.Equal(t, 500.0, goodput)
+
+	// samples older than the window are not taken into account
+	for secs := 3; secs <= 30; secs++ {
+		m.record(sample(secs, uint64(secs)*1000, uint64(secs)*500))
+	}
+	throughput, goodput = m.record(sample(31, 31000+10000, 15500+10000))
+	assert.InDelta(t, 2000.0, throughput, 1)
+	assert.InDelta(t, 1500.0, goodput, 1)
+}
+
+func TestStatsGoodputUnderLoss(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[uint32]bool)
+	resent := make(map[uint32]uint32) // by sequence number, to the next one
+	var ackNo uint32
+
+	var s *Socket
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(sent) == 0 {
+				ackNo = p.SeqNo
+			}
+			if !sent[p.SeqNo] {
+				sent[p.SeqNo] = true
+				return nil // lost: the first transmission of every packet
+			}
+			// retransmissions may be sent out of order, and a cumulative
+			// ACK must not cover packets which were not yet re-sent
+			resent[p.SeqNo] = p.SeqNo + uint32(len(p.Payload))
+			for next, ok := resent[ackNo]; ok; next, ok = resent[ackNo] {
+				ackNo = next
+			}
+			go s.atc.Ack(ackNo)
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Millisecond * 5
+	})
+	defer s.atc.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := s.Write(make([]byte, 1000))
+		assert.Nil(t, err)
+	}
+	for deadline := time.Now().Add(time.Second); s.atc.InFlight() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("data not acknowledged")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(20*1000), stats.TxPayloadBytes)
+	assert.True(t, stats.TxRetransBytes >= 20*(packet.HeaderByteSize+1000))
+	assert.True(t, stats.TxRetransBytes < stats.TxBytes)
+	assert.True(t, stats.Goodput > 0)
+	assert.True(t, stats.Goodput < stats.Throughput*0.6,
+		"goodput %.0f B/s not much lower than throughput %.0f B/s", stats.Goodput, stats.Throughput)
+}
+
+func TestAckCoalescing(t *testing.T) {
+	acks := make(chan uint32, 100)
+
+	s, app := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsACK() && len(p.Payload) == 0 {
+				acks <- p.AckNo
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.MaxAckCoalesce = 4
+	})
+	s.rxNext = 1000
+
+	// a steady stream: every packet is queued before any is handled
+	for i := 0; i < 100; i++ {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, make([]byte, 10))
+		p.SetSeqNo(uint32(1000 + i*10))
+		p.SetSum()
+		s.Deliver(p)
+	}
+	go io.Copy(ioutil.Discard, app)
+	go s.Run()
+	defer s.Close()
+
+	for i := 1; i <= 25; i++ {
+		select {
+		case ackNo := <-acks:
+			assert.Equal(t, uint32(1000+i*4*10), ackNo, "every ACK covers 4 packets")
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 25 ACKs sent", i-1)
+		}
+	}
+	assert.Equal(t, 0, len(acks))
+	assert.Equal(t, 4.0, s.Stats().PacketsPerAck)
+}
+
+func TestDebugInfo(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[uint32]bool)
+	blackHole := false
+
+	var s *Socket
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if len(p.Payload) == 0 {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !sent[p.SeqNo] || blackHole {
+				sent[p.SeqNo] = true
+				return nil // lost
+			}
+			go s.atc.Ack(p.SeqNo + uint32(len(p.Payload)))
+			return nil
+		},
+	}, func(c *Config) {
+		c.AckWait = time.Millisecond * 5
+		c.ISNSource = func() uint32 { return 1000 }
+	})
+	defer s.atc.Close()
+	assert.Equal(t, "connecting", s.DebugInfo().State)
+	s.completeHandshake(nil)
+
+	// a single packet, lost once
+	_, err := s.Write(make([]byte, 1000))
+	assert.Nil(t, err)
+	for deadline := time.Now().Add(time.Second); s.atc.InFlight() > 0; time.Sleep(time.Millisecond * 5) {
+		if time.Now().After(deadline) {
+			t.Fatal("data not acknowledged")
+		}
+	}
+
+	info := s.DebugInfo()
+	assert.Equal(t, "established", info.State)
+	assert.Equal(t, uint32(2000), info.TxNext)
+	assert.Equal(t, time.Millisecond*5, info.AckWait)
+	assert.Equal(t, receiveWindowBytes, info.WriteBuffer)
+	assert.Equal(t, receiveWindowBytes, info.ReceiveWindow)
+	assert.Equal(t, packet.MaxPayloadBytes, info.PayloadSize)
+	assert.True(t, info.Retransmits >= 1)
+	assert.Equal(t, 0, info.BytesInFlight)
+	assert.Equal(t, uint64(1000), info.Stats.TxPayloadBytes)
+
+	// data stuck in flight
+	mu.Lock()
+	blackHole = true
+	mu.Unlock()
+	_, err = s.Write(make([]byte, 500))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 30)
+
+	info = s.DebugInfo()
+	assert.Equal(t, 1, info.PacketsInFlight)
+	assert.Equal(t, 500, info.BytesInFlight)
+	assert.True(t, info.Retransmits > 1)
+	assert.True(t, info.RTO > info.AckWait, "RTO %s not backed off", info.RTO)
+
+	s.Close()
+	assert.Equal(t, "closed", s.DebugInfo().State)
+}
+
+func TestDropStats(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.ISNSource = func() uint32 { return 0 }
+	})
+	s.rxNext = 1000
+
+	mockPacket := func(seq uint32, payload string, opts ...func(p *packet.Packet)) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(seq)
+		for _, opt := range opts {
+			opt(p)
+		}
+		p.SetSum()
+		return p
+	}
+
+	badSum := mockPacket(1010, "data")
+	badSum.Checksum++
+	s.handle(badSum)
+	s.handle(mockPacket(1010, "data", func(p *packet.Packet) { p.SrcPort++ }))
+	s.handle(mockPacket(1000, "", func(p *packet.Packet) {
+		p.SetFlagACK()
+		p.SetAckNo(100)
+	}))
+	s.handle(mockPacket(1000+1<<31, "injected"))
+	s.handle(mockPacket(1010, "ahead"))
+	s.handle(mockPacket(1010, "ahead"))
+	s.handle(mockPacket(990, "already"))
+
+	// the inbound channel fills up while the socket is not running
+	for i := 0; i < inboundPacketChannelSize+1; i++ {
+		s.Deliver(mockPacket(1010, "queued"))
+	}
+
+	assert.Equal(t, DropStats{
+		BadChecksum:  1,
+		Misaddressed: 1,
+		AckNotSent:   1,
+		OutOfWindow:  1,
+		OutOfOrder:   2,
+		Duplicate:    1,
+		InboundFull:  1,
+	}, s.Stats().Drops)
+	assert.Equal(t, uint64(1), s.Stats().Dropped)
+
+	// in unreliable mode, the datagram queue fills up while not read
+	u, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Unreliable = true
+	})
+	for i := 0; i < cap(u.datagrams)+1; i++ {
+		u.handle(mockPacket(uint32(i), "datagram"))
+	}
+	assert.Equal(t, DropStats{DatagramQueueFull: 1}, u.Stats().Drops)
+}
+
+func TestValidatePacket(t *testing.T) {
+	var validated int
+	s, app := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.ValidatePacket = func(p *packet.Packet) error {
+			validated++
+			if len(p.Payload) > 10 {
+				return errors.New("payload too large")
+			}
+			return nil
+		}
+	})
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(app)
+		received <- b
+	}()
+
+	data := func(seq int, payload string) *packet.Packet {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte(payload))
+		p.SetSeqNo(uint32(seq))
+		p.SetSum()
+		return p
+	}
+	s.handle(data(0, "hello "))
+	s.handle(data(6, "too large to accept"))
+	s.handle(data(6, "world"))
+
+	// custom validation runs after the built-in checks
+	badSum := data(11, "!")
+	badSum.Checksum++
+	s.handle(badSum)
+	assert.Equal(t, 3, validated)
+
+	assert.Equal(t, DropStats{Rejected: 1, BadChecksum: 1}, s.Stats().Drops)
+	assert.Equal(t, uint32(11), s.rxNext)
+	s.app().Close()
+	assert.Equal(t, "hello world", string(<-received))
+}
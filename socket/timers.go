@@ -0,0 +1,149 @@
+package socket
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/adrianosela/rdtp/clock"
+	"github.com/adrianosela/rdtp/packet"
+)
+
+// unanswered keepalive probes after which the remote host is presumed dead
+const maxKeepaliveProbes = 5
+
+// timers are the timers of a connection run by its receiver (see receive):
+// keepalive probes (see Config.KeepaliveInterval), the idle timeout (see
+// Config.IdleTimeout), the user timeout (see Config.UserTimeout) and the
+// maximum lifetime (see Config.MaxLifetime). The channels of timers which
+// are disabled stay nil, i.e. never fire
+type timers struct {
+	keepalive, idle, lifetime    *time.Timer
+	keepaliveC, idleC, lifetimeC <-chan time.Time
+
+	// the user timeout is measured against the socket's clock, as is the
+	// time the data in flight was sent (see Config.Clock)
+	user  clock.Timer
+	userC chan struct{}
+
+	lastHeard, lastProbe time.Time
+	unanswered           int // keepalive probes
+}
+
+// startTimers starts the timers enabled for the socket
+func (s *Socket) startTimers() *timers {
+	t := &timers{lastHeard: time.Now()}
+	if s.keepaliveInterval > 0 {
+		t.keepalive = time.NewTimer(s.keepaliveInterval)
+		t.keepaliveC = t.keepalive.C
+	}
+	if s.idleTimeout > 0 {
+		t.idle = time.NewTimer(s.idleTimeout)
+		t.idleC = t.idle.C
+	}
+	if s.userTimeout > 0 {
+		userC := make(chan struct{}, 1)
+		t.userC = userC
+		t.user = s.clock.AfterFunc(s.userTimeout, func() {
+			select {
+			case userC <- struct{}{}:
+			default:
+			}
+		})
+	}
+	if s.maxLifetime > 0 {
+		t.lifetime = time.NewTimer(s.maxLifetime)
+		t.lifetimeC = t.lifetime.C
+	}
+	return t
+}
+
+// stop stops the timers started
+func (t *timers) stop() {
+	for _, timer := range []*time.Timer{t.keepalive, t.idle, t.lifetime} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	if t.user != nil {
+		t.user.Stop()
+	}
+}
+
+// heard records that a packet was received from the remote host
+func (t *timers) heard() {
+	t.lastHeard = time.Now()
+}
+
+// keepaliveFired probes the remote host when nothing was heard from it for
+// a keepalive interval, and aborts the connection when too many probes in a
+// row go unanswered, in which case it returns true (the receiver then stops)
+func (s *Socket) keepaliveFired(t *timers) bool {
+	if t.lastHeard.After(t.lastProbe) {
+		t.unanswered = 0
+	}
+	if silence := time.Since(t.lastHeard); silence < s.keepaliveInterval {
+		t.keepalive.Reset(s.keepaliveInterval - silence)
+		return false
+	}
+	if t.unanswered >= maxKeepaliveProbes {
+		s.abort(CloseKeepaliveTimeout, ErrKeepaliveTimeout)
+		return true
+	}
+	s.probe()
+	t.lastProbe = time.Now()
+	t.unanswered++
+	t.keepalive.Reset(s.keepaliveInterval)
+	return false
+}
+
+// idleFired fails the connection when no application data was sent nor
+// received for the idle timeout, in which case it returns true
+func (s *Socket) idleFired(t *timers) bool {
+	if quiet := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastData))); quiet < s.idleTimeout {
+		t.idle.Reset(s.idleTimeout - quiet)
+		return false
+	}
+	s.fail(CloseIdleTimeout, ErrIdleTimeout)
+	return true
+}
+
+// lifetimeFired closes the connection once its maximum lifetime is reached:
+// data in flight drains (acknowledged as received by the receiver) before
+// the FIN handshake, as when closed by the application
+func (s *Socket) lifetimeFired(t *timers) {
+	log.Printf("[rdtp socket %s] Maximum lifetime of %s reached, closing connection", s.logID(), s.maxLifetime)
+	s.recordCloseReason(CloseMaxLifetime)
+	s.close()
+	t.lifetimeC = nil
+}
+
+// userTimeoutFired aborts the connection when data in flight stayed
+// unacknowledged for the user timeout, in which case it returns true
+func (s *Socket) userTimeoutFired(t *timers) bool {
+	since := s.atc.UnackedSince()
+	if since.IsZero() {
+		t.user.Reset(s.userTimeout)
+		return false
+	}
+	if unacked := s.clock.Now().Sub(since); unacked < s.userTimeout {
+		t.user.Reset(s.userTimeout - unacked)
+		return false
+	}
+	log.Printf("[rdtp socket %s] Data unacknowledged for %s, aborting connection", s.logID(), s.userTimeout)
+	s.abort(CloseUserTimeout, ErrUserTimeout)
+	s.atc.Close() // unblocks writes waiting for room in the send buffer
+	return true
+}
+
+// probe sends a keepalive probe: a FWD packet which skips no data, which the
+// remote host always answers with an ACK and never delivers to its application
+func (s *Socket) probe() {
+	p := packet.NewForwardPacket(uint16(s.lAddr.Port), uint16(s.rAddr.Port), s.packetizer.SeqNo(), 0)
+	p.SetAckNo(s.rxNext)
+	p.SetFlagACK()
+	p.SetSum()
+	if err := s.toNetwork(p); err != nil {
+		log.Printf("[rdtp socket %s] Error sending keepalive probe: %s", s.logID(), err)
+	}
+}
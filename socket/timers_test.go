@@ -0,0 +1,258 @@
+package socket
+
+import (
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/clock"
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepalive(t *testing.T) {
+	var s *Socket
+	probes := make(chan *packet.Packet, 100)
+	answer := make(chan bool, 1)
+	answer <- true
+
+	s, _ = mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsFWD() && p.ForwardBytes() == 0 {
+				probes <- p
+				select {
+				case a := <-answer:
+					answer <- a
+					if a {
+						ack, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, nil)
+						ack.SetFlagACK()
+						ack.SetAckNo(p.SeqNo)
+						ack.SetSum()
+						go s.Deliver(ack)
+					}
+				default:
+				}
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.KeepaliveInterval = time.Millisecond * 10
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	// answered probes keep the connection open indefinitely
+	for i := 0; i < maxKeepaliveProbes*2; i++ {
+		select {
+		case <-probes:
+		case err := <-result:
+			t.Fatalf("socket shut down while keepalive probes were answered: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("no keepalive probes sent")
+		}
+	}
+
+	// unanswered probes abort the connection
+	<-answer
+	answer <- false
+
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrKeepaliveTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("socket did not shut down when keepalive probes were not answered")
+	}
+	assert.Equal(t, CloseKeepaliveTimeout, s.CloseReason())
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var probes uint64
+
+	s, _ := mockSocket(t, &mockNetwork{
+		sendFunc: func(p *packet.Packet) error {
+			if p.IsFWD() {
+				atomic.AddUint64(&probes, 1)
+			}
+			return nil
+		},
+	}, func(c *Config) {
+		c.IdleTimeout = time.Millisecond * 50
+		c.AckWait = time.Hour // keep retransmissions out of the way
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	// application data keeps the connection open
+	for i := 0; i < 10; i++ {
+		_, err := s.WriteWithDeadline([]byte("data"), time.Time{})
+		assert.Nil(t, err)
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	select {
+	case err := <-result:
+		t.Fatalf("socket shut down while application data was flowing: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrIdleTimeout, err)
+	case <-time.After(time.Second * 3):
+		t.Fatal("idle socket did not shut down")
+	}
+	assert.Equal(t, CloseIdleTimeout, s.CloseReason(), "not a graceful close, despite the FIN handshake")
+
+	// no keepalive probes unless enabled
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&probes))
+}
+
+func TestMaxLifetime(t *testing.T) {
+	dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, func(c *Config) {
+		c.MaxLifetime = time.Millisecond * 200
+	}, nil)
+	assert.Nil(t, dialErr)
+	assert.Nil(t, acceptErr)
+
+	start := time.Now()
+	dialerDone, acceptorDone := make(chan error, 1), make(chan error, 1)
+	go func() { dialerDone <- dialer.Run() }()
+	go func() { acceptorDone <- acceptor.Run() }()
+
+	// the connection is closed at its deadline although data keeps flowing
+	go func() {
+		for {
+			if _, err := dialerApp.Write([]byte("data")); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go io.Copy(ioutil.Discard, acceptorApp)
+
+	select {
+	case err := <-dialerDone:
+		assert.Nil(t, err, "a graceful close")
+	case <-time.After(time.Second * 5):
+		t.Fatal("socket not closed past its maximum lifetime")
+	}
+	assert.True(t, time.Since(start) >= time.Millisecond*200, "closed after %s", time.Since(start))
+	assert.Equal(t, CloseMaxLifetime, dialer.CloseReason())
+	assert.True(t, dialer.Stats().TxPayloadBytes > 0)
+
+	select {
+	case err := <-acceptorDone:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("remote host did not shut down")
+	}
+	assert.Equal(t, ClosePeer, acceptor.CloseReason())
+	assert.Equal(t, dialer.Stats().TxPayloadBytes, acceptor.Stats().RxBytes, "data in flight drained")
+}
+
+func TestUserTimeout(t *testing.T) {
+	// an unresponsive remote host
+	s, app := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.UserTimeout = time.Millisecond * 200
+		c.AckWait = time.Millisecond * 20 // re-sent many times meanwhile
+		c.WriteBufferBytes = packet.MaxPayloadBytes
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+
+	// idle connections do not time out
+	select {
+	case err := <-result:
+		t.Fatalf("idle socket shut down: %v", err)
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	start := time.Now()
+	_, err := s.Write([]byte("never acknowledged"))
+	assert.Nil(t, err)
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, packet.MaxPayloadBytes)) // blocks on the full send buffer
+		written <- err
+	}()
+
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrUserTimeout, err)
+		elapsed := time.Since(start)
+		assert.True(t, elapsed >= time.Millisecond*200, "timed out after %s", elapsed)
+		assert.True(t, elapsed < time.Second, "timed out after %s", elapsed)
+	case <-time.After(time.Second * 3):
+		t.Fatal("socket did not shut down with data unacknowledged")
+	}
+	assert.Equal(t, CloseUserTimeout, s.CloseReason())
+	assert.Equal(t, ErrUserTimeout, s.Err())
+	assert.True(t, ErrUserTimeout.Timeout())
+
+	// blocked writes are unblocked, and reads see the end of stream
+	select {
+	case err := <-written:
+		assert.Equal(t, ErrUserTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked after the connection timed out")
+	}
+	_, err = s.Write([]byte("after timeout"))
+	assert.Equal(t, ErrUserTimeout, err)
+	_, err = app.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestUserTimeoutFakeClock(t *testing.T) {
+	start := time.Now()
+	clk := clock.NewFake(start)
+	s, _ := mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.Clock = clk
+		c.UserTimeout = time.Hour // never reached in real time
+	})
+
+	result := make(chan error)
+	go func() { result <- s.Run() }()
+	_, err := s.Write([]byte("never acknowledged"))
+	assert.Nil(t, err)
+
+	// the data stays unacknowledged for an hour of the socket's clock
+	for clk.Now().Sub(start) <= time.Hour*2 {
+		clk.Advance(time.Minute * 10)
+		select {
+		case err := <-result:
+			assert.Equal(t, ErrUserTimeout, err)
+			assert.True(t, clk.Now().Sub(start) >= time.Hour, "timed out after %s", clk.Now().Sub(start))
+			assert.Equal(t, CloseUserTimeout, s.CloseReason())
+			return
+		case <-time.After(time.Millisecond * 20):
+		}
+	}
+	t.Fatal("socket did not shut down with data unacknowledged")
+}
+
+func TestTimersDisabled(t *testing.T) {
+	// timers not enabled never fire, and stopping them is harmless
+	s, _ := mockSocket(t, &mockNetwork{})
+	timers := s.startTimers()
+	assert.Nil(t, timers.keepaliveC)
+	assert.Nil(t, timers.idleC)
+	assert.Nil(t, timers.lifetimeC)
+	assert.Nil(t, timers.userC)
+	timers.stop()
+
+	s, _ = mockSocket(t, &mockNetwork{}, func(c *Config) {
+		c.KeepaliveInterval = time.Hour
+		c.UserTimeout = time.Hour
+	})
+	timers = s.startTimers()
+	defer timers.stop()
+	assert.NotNil(t, timers.keepaliveC)
+	assert.Nil(t, timers.idleC)
+	assert.Nil(t, timers.lifetimeC)
+	assert.NotNil(t, timers.userC)
+}
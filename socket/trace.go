@@ -0,0 +1,115 @@
+package socket
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/pkg/errors"
+)
+
+// MaxTraceTagBytes is the maximum size of a trace tag (see SetTraceContext)
+const MaxTraceTagBytes = 16
+
+// SetTraceContext sets the application-defined trace tag (e.g. the ID of
+// the request being served) carried by the data packets made of the data
+// written from then on (see Config.TraceTags), up to MaxTraceTagBytes.
+// The tag is carried over when data is split or re-sent, and is not sent
+// unless the remote host agreed to trace tags at handshake (see ConnInfo).
+// A nil (or empty) tag stops tagging data
+func (s *Socket) SetTraceContext(tag []byte) error {
+	if len(tag) > MaxTraceTagBytes {
+		return fmt.Errorf("invalid trace tag of %d bytes, must be at most %d", len(tag), MaxTraceTagBytes)
+	}
+	if len(tag) == 0 {
+		tag = nil
+	}
+	s.traceContext.Store(append([]byte(nil), tag...))
+	return nil
+}
+
+// TraceContext returns the trace tag carried by the data most recently
+// received (delivered to the application or passed to Config.OnData, by
+// which it is read along with the data it came with), nil if untagged
+func (s *Socket) TraceContext() []byte {
+	tag, _ := s.tracedContext.Load().([]byte)
+	return tag
+}
+
+// tag sets the trace tag of the data written on a data packet made of it
+func (s *Socket) tag(p *packet.Packet) {
+	if tag, _ := s.traceContext.Load().([]byte); len(tag) > 0 {
+		p.TraceTag = tag
+	}
+}
+
+// frame returns the packet to send in place of the given one when carrying
+// trace tags or application headers (see Config.AppHeaderSize): a copy of a
+// data packet with its payload prefixed with the length of its trace tag (a
+// byte) and the tag itself, zero and none if untagged, then with its
+// application header, zeros if it has none. Other packets, and every packet
+// of a connection which carries neither, are sent as is
+func (s *Socket) frame(p *packet.Packet) *packet.Packet {
+	tracing := atomic.LoadUint32(&s.tracing) == 1
+	if (!tracing && s.appHeaderSize == 0) || !carriesData(p) {
+		return p
+	}
+	framed := *p
+	framed.Payload = make([]byte, 0, 1+len(p.TraceTag)+s.appHeaderSize+len(p.Payload))
+	if tracing {
+		framed.Payload = append(append(framed.Payload, uint8(len(p.TraceTag))), p.TraceTag...)
+	}
+	header := make([]byte, s.appHeaderSize)
+	copy(header, p.AppHeader)
+	framed.Payload = append(append(framed.Payload, header...), p.Payload...)
+	framed.Length = uint16(len(framed.Payload))
+	framed.SetSum()
+	return &framed
+}
+
+// unframe strips the trace tag and application header off the payload of a
+// data packet received in place, when carrying them, or returns an error if
+// either is missing
+func (s *Socket) unframe(p *packet.Packet) error {
+	tracing := atomic.LoadUint32(&s.tracing) == 1
+	if !tracing && s.appHeaderSize == 0 {
+		return nil
+	}
+	if tracing {
+		if len(p.Payload) == 0 || int(p.Payload[0]) > MaxTraceTagBytes || len(p.Payload) <= 1+int(p.Payload[0]) {
+			return errors.New("payload carries no trace tag and data")
+		}
+		size := int(p.Payload[0])
+		if size > 0 {
+			p.TraceTag = p.Payload[1 : 1+size]
+		}
+		p.Payload = p.Payload[1+size:]
+	}
+	if s.appHeaderSize > 0 {
+		if len(p.Payload) <= s.appHeaderSize {
+			return errors.New("payload carries no application header and data")
+		}
+		p.AppHeader = p.Payload[:s.appHeaderSize]
+		p.Payload = p.Payload[s.appHeaderSize:]
+	}
+	p.Length = uint16(len(p.Payload))
+	p.SetSum()
+	return nil
+}
+
+// negotiateTraceTags carries trace tags on the data packets of the
+// connection if both hosts offered to at handshake
+func (s *Socket) negotiateTraceTags(offered bool) {
+	if s.traceTags && offered {
+		atomic.StoreUint32(&s.tracing, 1)
+	}
+}
+
+// traceOverhead returns the bytes trace tags may take in the payload of
+// a data packet, if the connection carries them
+func (s *Socket) traceOverhead() int {
+	if atomic.LoadUint32(&s.tracing) == 0 {
+		return 0
+	}
+	return 1 + MaxTraceTagBytes
+}
@@ -0,0 +1,150 @@
+package socket
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianosela/rdtp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func withTraceTags(c *Config) { c.TraceTags = true }
+
+// tracedData is data received along with the trace tag it came with
+type tracedData struct {
+	tag  string
+	data []byte
+}
+
+func TestTraceTags(t *testing.T) {
+	for name, opt := range map[string]func(c *Config){
+		"trace tags": withTraceTags,
+		"trace tags, compressed and encrypted": func(c *Config) {
+			withTraceTags(c)
+			withCompression(c)
+			withEncryption(c)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var lock sync.Mutex
+			var received []tracedData
+			var acceptor *Socket
+			dialer, acceptor, dialerApp, _, dialErr, acceptErr := mockConnPair(t, nil, opt, func(c *Config) {
+				opt(c)
+				c.OnData = func(data []byte) {
+					lock.Lock()
+					defer lock.Unlock()
+					received = append(received, tracedData{
+						tag:  string(acceptor.TraceContext()),
+						data: append([]byte(nil), data...),
+					})
+				}
+			})
+			assert.Nil(t, dialErr)
+			assert.Nil(t, acceptErr)
+			go dialer.Run()
+			go acceptor.Run()
+			defer dialer.Close()
+
+			info, _ := acceptor.ConnInfo()
+			assert.True(t, info.TraceTags)
+			assert.Equal(t, dialer.packetizer.Size(), info.PayloadSize)
+			assert.True(t, info.PayloadSize <= packet.MaxPayloadBytes-1-MaxTraceTagBytes, "room for the tag")
+
+			assert.NotNil(t, dialer.SetTraceContext(make([]byte, MaxTraceTagBytes+1)))
+
+			// each write is delivered with its tag, data spanning
+			// several packets included, and untagged once cleared
+			writes := []tracedData{
+				{tag: "request-1", data: bytes.Repeat([]byte("a"), 3000)},
+				{tag: "request-2", data: []byte("b")},
+				{tag: "", data: []byte("c")},
+			}
+			var sent int
+			for _, w := range writes {
+				assert.Nil(t, dialer.SetTraceContext([]byte(w.tag)))
+				_, err := dialerApp.Write(w.data)
+				assert.Nil(t, err)
+				sent += len(w.data)
+				assert.Eventually(t, func() bool {
+					return acceptor.Stats().RxBytes == uint64(sent)
+				}, time.Second, time.Millisecond)
+			}
+
+			// sequence numbers do not count the tags
+			assert.Eventually(t, func() bool {
+				return dialer.NextSeqNo() == acceptor.NextAckNo()
+			}, time.Second, time.Millisecond)
+			assert.Equal(t, uint64(0), acceptor.Stats().Drops.Untagged)
+
+			lock.Lock()
+			defer lock.Unlock()
+			for _, w := range writes {
+				var data []byte
+				for len(received) > 0 && received[0].tag == w.tag && len(data) < len(w.data) {
+					data = append(data, received[0].data...)
+					received = received[1:]
+				}
+				assert.Equal(t, w.data, data, "tagged %q", w.tag)
+			}
+			assert.Empty(t, received)
+		})
+	}
+}
+
+func TestTraceTagsNotNegotiated(t *testing.T) {
+	for name, opts := range map[string][2]func(c *Config){
+		"remote host does not carry trace tags": {withTraceTags, func(c *Config) {}},
+		"local host does not carry trace tags":  {func(c *Config) {}, withTraceTags},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dialer, acceptor, dialerApp, acceptorApp, dialErr, acceptErr := mockConnPair(t, nil, opts[0], opts[1])
+			assert.Nil(t, dialErr)
+			assert.Nil(t, acceptErr)
+			go dialer.Run()
+			go acceptor.Run()
+			defer dialer.Close()
+
+			// the tag is not sent, the data is
+			info, _ := dialer.ConnInfo()
+			assert.False(t, info.TraceTags)
+			assert.Equal(t, packet.MaxPayloadBytes, info.PayloadSize)
+			assert.Nil(t, dialer.SetTraceContext([]byte("request-1")))
+			go dialerApp.Write([]byte("data"))
+			received := make([]byte, 4)
+			_, err := io.ReadFull(acceptorApp, received)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("data"), received)
+			assert.Nil(t, acceptor.TraceContext())
+		})
+	}
+}
+
+func TestTraceTagsUntaggedDrop(t *testing.T) {
+	s, _ := mockSocket(t, &mockNetwork{})
+	s.peerEpoch, s.rxNext = 1, 100
+	s.tracing = 1
+
+	for _, payload := range [][]byte{
+		{0x05, 'a', 'b'},            // truncated tag
+		{0x01, 'a'},                 // no data
+		{MaxTraceTagBytes + 1, 'a'}, // tag too long
+	} {
+		p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, payload)
+		p.SetSeqNo(100)
+		p.SetEpoch(1)
+		p.SetSum()
+		assert.Equal(t, errUntagged, s.validate(p))
+	}
+
+	p, _ := packet.NewPacket(testRemoteAddr.Port, testLocalAddr.Port, []byte{0x01, 'a', 'b'})
+	p.SetSeqNo(100)
+	p.SetEpoch(1)
+	p.SetSum()
+	assert.Nil(t, s.validate(p))
+	assert.Equal(t, []byte("a"), p.TraceTag)
+	assert.Equal(t, []byte("b"), p.Payload)
+}